@@ -16,6 +16,7 @@ import (
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/delay"
 	"mellium.im/xmpp/forward"
+	"mellium.im/xmpp/hints"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -124,9 +125,7 @@ func Private(r xml.TokenReader) xml.TokenReader {
 					xmlstream.Wrap(nil, xml.StartElement{
 						Name: xml.Name{Space: NS, Local: "private"},
 					}),
-					xmlstream.Wrap(nil, xml.StartElement{
-						Name: xml.Name{Space: "urn:xmpp:hints", Local: "no-copy"},
-					}),
+					hints.NoCopy.TokenReader(),
 				))
 				return err
 			}
@@ -0,0 +1,126 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h Handler"
+
+// Package chatstates implements XEP-0085: Chat State Notifications.
+package chatstates // import "mellium.im/xmpp/chatstates"
+
+import (
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "http://jabber.org/protocol/chatstates"
+
+// State is the participation of a user in a conversation.
+type State string
+
+// A list of possible chat states.
+const (
+	// Active means that the user is actively participating in the conversation.
+	Active State = "active"
+
+	// Composing means that the user is composing a message.
+	Composing State = "composing"
+
+	// Paused means that the user had been composing but has stopped.
+	Paused State = "paused"
+
+	// Inactive means that the user has not been actively participating in the
+	// conversation for a short time.
+	Inactive State = "inactive"
+
+	// Gone means that the user has effectively ended their participation in the
+	// conversation.
+	Gone State = "gone"
+)
+
+// Valid reports whether st is one of the chat states defined by XEP-0085.
+func (st State) Valid() bool {
+	switch st {
+	case Active, Composing, Paused, Inactive, Gone:
+		return true
+	}
+	return false
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (st State) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: string(st)},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (st State) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, st.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (st State) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := st.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (st *State) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	s := State(start.Name.Local)
+	if start.Name.Space != NS || !s.Valid() {
+		return d.Skip()
+	}
+	*st = s
+	return d.Skip()
+}
+
+var states = [...]State{Active, Composing, Paused, Inactive, Gone}
+
+// Handle returns an option that registers a Handler for chat state
+// notifications in chat and groupchat messages.
+func Handle(h Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		for _, st := range states {
+			name := xml.Name{Space: NS, Local: string(st)}
+			mux.Message(stanza.ChatMessage, name, h)(m)
+			mux.Message(stanza.GroupChatMessage, name, h)(m)
+		}
+	}
+}
+
+// Handler reports the chat states of our contacts.
+//
+// Receiving any chat state from a contact in a one-to-one chat means that it
+// supports chat state notifications, so the notifier for the conversation
+// can be told using SetSupport.
+type Handler struct {
+	State func(msg stanza.Message, st State) error
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h Handler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder) error {
+	// Skip the message start element.
+	_, err := t.Token()
+	if err != nil {
+		return err
+	}
+	iter := xmlstream.NewIter(t)
+	/* #nosec */
+	defer iter.Close()
+	for iter.Next() {
+		start, _ := iter.Current()
+		st := State(start.Name.Local)
+		if start.Name.Space != NS || !st.Valid() {
+			continue
+		}
+		if h.State == nil {
+			return nil
+		}
+		return h.State(msg, st)
+	}
+	return iter.Err()
+}
@@ -0,0 +1,326 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package chatstates_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/chatstates"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = chatstates.Active
+	_ xml.Unmarshaler     = (*chatstates.State)(nil)
+	_ xmlstream.Marshaler = chatstates.Active
+	_ xmlstream.WriterTo  = chatstates.Active
+	_ mux.MessageHandler  = chatstates.Handler{}
+	_ info.FeatureIter    = chatstates.Handler{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: func() *chatstates.State { s := chatstates.Composing; return &s }(),
+		XML:   `<composing xmlns="http://jabber.org/protocol/chatstates"></composing>`,
+	},
+	1: {
+		Value: func() *chatstates.State { s := chatstates.Gone; return &s }(),
+		XML:   `<gone xmlns="http://jabber.org/protocol/chatstates"></gone>`,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+func TestHandler(t *testing.T) {
+	var events []string
+	m := mux.New(stanza.NSClient, chatstates.Handle(chatstates.Handler{
+		State: func(msg stanza.Message, st chatstates.State) error {
+			events = append(events, msg.From.String()+" "+string(msg.Type)+" "+string(st))
+			return nil
+		},
+	}))
+	for _, msg := range []string{
+		`<message xmlns="jabber:client" type="chat" from="juliet@example.com/balcony"><composing xmlns="http://jabber.org/protocol/chatstates"/></message>`,
+		`<message xmlns="jabber:client" type="chat" from="juliet@example.com/balcony"><body>Hi</body><active xmlns="http://jabber.org/protocol/chatstates"/></message>`,
+		`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/thirdwitch"><paused xmlns="http://jabber.org/protocol/chatstates"/></message>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(msg))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(io.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling message: %v", err)
+		}
+	}
+	const expected = "juliet@example.com/balcony chat composing,juliet@example.com/balcony chat active,coven@chat.shakespeare.lit/thirdwitch groupchat paused"
+	if e := strings.Join(events, ","); e != expected {
+		t.Errorf("wrong events:\nwant=%s,\n got=%s", expected, e)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that can be written from timers.
+type lockedBuffer struct {
+	m   sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) Read(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Read(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return xmpptest.StripIDs(b.buf.String())
+}
+
+func notification(st chatstates.State) string {
+	return `<message xmlns="jabber:client" type="chat" to="juliet@example.com/balcony"><` + string(st) + ` xmlns="http://jabber.org/protocol/chatstates"></` + string(st) + `></message>`
+}
+
+func TestNotifier(t *testing.T) {
+	var buf lockedBuffer
+	n := &chatstates.Notifier{
+		Session:       xmpptest.NewClientSession(0, &buf),
+		To:            jid.MustParse("juliet@example.com/balcony"),
+		PauseAfter:    10 * time.Millisecond,
+		InactiveAfter: 20 * time.Millisecond,
+		GoneAfter:     30 * time.Millisecond,
+		Err: func(err error) {
+			t.Errorf("error sending notification: %v", err)
+		},
+	}
+	ctx := context.Background()
+
+	// Nothing is sent before support is known except in content messages.
+	err := n.Keystroke(ctx)
+	if err != nil {
+		t.Fatalf("error reporting keystroke: %v", err)
+	}
+	var out bytes.Buffer
+	e := xml.NewEncoder(&out)
+	_, err = xmlstream.Copy(e, n.Message(xmlstream.Wrap(xmlstream.Token(xml.CharData("Hi")), xml.StartElement{Name: xml.Name{Local: "body"}})))
+	if err != nil {
+		t.Fatalf("error encoding message payload: %v", err)
+	}
+	if err = e.Flush(); err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	const payload = `<body>Hi</body><active xmlns="http://jabber.org/protocol/chatstates"></active>`
+	if s := out.String(); s != payload {
+		t.Errorf("wrong message payload:\nwant=%s,\n got=%s", payload, s)
+	}
+	if s := buf.String(); s != "" {
+		t.Errorf("unexpected notification before support is known: %s", s)
+	}
+	if st := n.State(); st != chatstates.Active {
+		t.Errorf("wrong state after sending message: want=%s, got=%s", chatstates.Active, st)
+	}
+
+	n.SetSupport(true)
+	err = n.Keystroke(ctx)
+	if err != nil {
+		t.Fatalf("error reporting keystroke: %v", err)
+	}
+	// Further keystrokes while composing are not sent again.
+	err = n.Keystroke(ctx)
+	if err != nil {
+		t.Fatalf("error reporting keystroke: %v", err)
+	}
+
+	expected := notification(chatstates.Composing) +
+		notification(chatstates.Paused) +
+		notification(chatstates.Inactive) +
+		notification(chatstates.Gone)
+	deadline := time.Now().Add(5 * time.Second)
+	for buf.String() != expected && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := buf.String(); s != expected {
+		t.Fatalf("wrong notifications:\nwant=%s,\n got=%s", expected, s)
+	}
+	if st := n.State(); st != chatstates.Gone {
+		t.Errorf("wrong final state: want=%s, got=%s", chatstates.Gone, st)
+	}
+}
+
+func TestNotifierStop(t *testing.T) {
+	var buf lockedBuffer
+	n := &chatstates.Notifier{
+		Session:    xmpptest.NewClientSession(0, &buf),
+		To:         jid.MustParse("juliet@example.com/balcony"),
+		PauseAfter: 10 * time.Millisecond,
+		Err: func(err error) {
+			t.Errorf("error sending notification: %v", err)
+		},
+	}
+	n.SetSupport(true)
+	err := n.Keystroke(context.Background())
+	if err != nil {
+		t.Fatalf("error reporting keystroke: %v", err)
+	}
+	n.Stop()
+
+	// Timers must not fire after the notifier is stopped.
+	time.Sleep(30 * time.Millisecond)
+	if s, expected := buf.String(), notification(chatstates.Composing); s != expected {
+		t.Errorf("wrong notifications after stop:\nwant=%s,\n got=%s", expected, s)
+	}
+	if st := n.State(); st != chatstates.Composing {
+		t.Errorf("wrong state after stop: want=%s, got=%s", chatstates.Composing, st)
+	}
+
+	// Events reported by the application are still sent.
+	err = n.Active(context.Background())
+	if err != nil {
+		t.Fatalf("error reporting active: %v", err)
+	}
+	if s, expected := buf.String(), notification(chatstates.Composing)+notification(chatstates.Active); s != expected {
+		t.Errorf("wrong notifications after stop:\nwant=%s,\n got=%s", expected, s)
+	}
+}
+
+func TestNotifierGroupChat(t *testing.T) {
+	var buf lockedBuffer
+	n := &chatstates.Notifier{
+		Session:       xmpptest.NewClientSession(0, &buf),
+		To:            jid.MustParse("coven@chat.shakespeare.lit"),
+		Type:          stanza.GroupChatMessage,
+		PauseAfter:    10 * time.Millisecond,
+		InactiveAfter: 10 * time.Millisecond,
+		GoneAfter:     10 * time.Millisecond,
+		Err: func(err error) {
+			t.Errorf("error sending notification: %v", err)
+		},
+	}
+	n.SetSupport(true)
+	ctx := context.Background()
+	err := n.Active(ctx)
+	if err != nil {
+		t.Fatalf("error reporting active: %v", err)
+	}
+
+	groupNotification := func(st chatstates.State) string {
+		return `<message xmlns="jabber:client" type="groupchat" to="coven@chat.shakespeare.lit"><` + string(st) + ` xmlns="http://jabber.org/protocol/chatstates"></` + string(st) + `></message>`
+	}
+	expected := groupNotification(chatstates.Active) + groupNotification(chatstates.Inactive)
+	deadline := time.Now().Add(5 * time.Second)
+	for buf.String() != expected && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Gone must never be sent in a group chat, either by a timer or by Close.
+	time.Sleep(30 * time.Millisecond)
+	err = n.Close(ctx)
+	if err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	if s := buf.String(); s != expected {
+		t.Fatalf("wrong notifications:\nwant=%s,\n got=%s", expected, s)
+	}
+	if st := n.State(); st != chatstates.Inactive {
+		t.Errorf("wrong final state: want=%s, got=%s", chatstates.Inactive, st)
+	}
+
+	// Close stops any pending timers.
+	err = n.Keystroke(ctx)
+	if err != nil {
+		t.Fatalf("error reporting keystroke: %v", err)
+	}
+	err = n.Close(ctx)
+	if err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	expected += groupNotification(chatstates.Composing)
+	if s := buf.String(); s != expected {
+		t.Errorf("wrong notifications after close:\nwant=%s,\n got=%s", expected, s)
+	}
+}
+
+func TestNotifierUnsupported(t *testing.T) {
+	var buf lockedBuffer
+	n := &chatstates.Notifier{
+		Session: xmpptest.NewClientSession(0, &buf),
+		To:      jid.MustParse("coven@chat.shakespeare.lit"),
+		Type:    stanza.GroupChatMessage,
+	}
+	n.SetSupport(false)
+	ctx := context.Background()
+	err := n.Keystroke(ctx)
+	if err != nil {
+		t.Fatalf("error reporting keystroke: %v", err)
+	}
+	if r := n.Message(nil); r != nil {
+		t.Errorf("expected no payload when unsupported")
+	}
+	err = n.Close(ctx)
+	if err != nil {
+		t.Fatalf("error closing: %v", err)
+	}
+	if s := buf.String(); s != "" {
+		t.Errorf("unexpected notifications: %s", s)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	for _, supported := range []bool{true, false} {
+		var opts []mux.Option
+		opts = append(opts, disco.Handle())
+		if supported {
+			opts = append(opts, chatstates.Handle(chatstates.Handler{}))
+		}
+		cs := xmpptest.NewClientServer(xmpptest.ServerHandler(mux.New(stanza.NSClient, opts...)))
+		var buf lockedBuffer
+		n := &chatstates.Notifier{
+			Session: cs.Client,
+			To:      cs.Server.LocalAddr(),
+		}
+		err := n.Discover(context.Background())
+		if err != nil {
+			t.Fatalf("error discovering support: %v", err)
+		}
+		n.Session = xmpptest.NewClientSession(0, &buf)
+		err = n.Active(context.Background())
+		if err != nil {
+			t.Fatalf("error reporting activity: %v", err)
+		}
+		if sent := buf.String() != ""; sent != supported {
+			t.Errorf("wrong support discovered: want=%t, got=%t", supported, sent)
+		}
+		err = n.Close(context.Background())
+		if err != nil {
+			t.Fatalf("error closing: %v", err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package chatstates
+
+import (
+	"context"
+	"encoding/xml"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Default lengths of time used by Notifier if none are configured.
+const (
+	DefaultPauseAfter    = 30 * time.Second
+	DefaultInactiveAfter = 2 * time.Minute
+	DefaultGoneAfter     = 10 * time.Minute
+)
+
+type support int
+
+const (
+	supportUnknown support = iota
+	supportYes
+	supportNo
+)
+
+// Notifier sends chat state notifications for a single conversation.
+//
+// The application reports local events such as keystrokes and sent messages
+// and the notifier moves from composing to paused, and from active or paused
+// to inactive and then gone as time passes without further events.
+// In group chats the gone state is never sent since leaving the room is
+// already signaled by unavailable presence, so the notifier stops at inactive.
+//
+// Standalone notifications are only sent once the other side of the
+// conversation is known to support chat states, either because it was
+// discovered using Discover or because the application reported support using
+// SetSupport after receiving a chat state from the contact.
+// Until then the active state is only included in content messages built using
+// Message, and if the other side is known not to support chat states (for
+// example a group chat where they have been disabled) nothing is ever sent.
+//
+// Notifications sent when a timer fires use a context that is canceled by
+// Stop, which should be called when the notifier is no longer needed, for
+// example because the session is being closed.
+type Notifier struct {
+	// Session is used to send notifications to the JID To in messages of type
+	// Type.
+	// If Type is empty, chat messages are sent.
+	Session *xmpp.Session
+	To      jid.JID
+	Type    stanza.MessageType
+
+	// The lengths of time after which the state changes if no new events are
+	// reported.
+	// If they are zero the defaults are used.
+	PauseAfter    time.Duration
+	InactiveAfter time.Duration
+	GoneAfter     time.Duration
+
+	// Err, if set, is called with any error encountered while sending a
+	// notification in response to a timer.
+	Err func(error)
+
+	m       sync.Mutex
+	send    sync.Mutex
+	state   State
+	support support
+	timer   *time.Timer
+	gen     uint64
+	stopped bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// SetSupport records whether the other side of the conversation supports chat
+// state notifications.
+func (n *Notifier) SetSupport(ok bool) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if ok {
+		n.support = supportYes
+	} else {
+		n.support = supportNo
+	}
+}
+
+// Discover queries the other side of the conversation to see if it supports
+// chat state notifications and records the result.
+// In a one-to-one chat To should be a full JID, and in a group chat the room
+// is queried to see whether chat states are allowed.
+func (n *Notifier) Discover(ctx context.Context) error {
+	to := n.To
+	if n.Type == stanza.GroupChatMessage {
+		to = to.Bare()
+	}
+	info, err := disco.GetInfo(ctx, "", to, n.Session)
+	if err != nil {
+		return err
+	}
+	var found bool
+	for _, f := range info.Features {
+		if f.Var == NS {
+			found = true
+			break
+		}
+	}
+	n.SetSupport(found)
+	return nil
+}
+
+// State returns the last state entered by the notifier.
+func (n *Notifier) State() State {
+	n.m.Lock()
+	defer n.m.Unlock()
+	return n.state
+}
+
+// Keystroke reports that the user typed something into the message input.
+func (n *Notifier) Keystroke(ctx context.Context) error {
+	return n.transition(ctx, Composing, 0)
+}
+
+// Active reports that the user is paying attention to the conversation, for
+// example because it was focused.
+func (n *Notifier) Active(ctx context.Context) error {
+	return n.transition(ctx, Active, 0)
+}
+
+// Close reports that the user has ended the conversation, for example by
+// closing the window, and stops any timers.
+// In group chats no notification is sent and the timers are only stopped.
+func (n *Notifier) Close(ctx context.Context) error {
+	if n.Type == stanza.GroupChatMessage {
+		n.m.Lock()
+		defer n.m.Unlock()
+		n.gen++
+		if n.timer != nil {
+			n.timer.Stop()
+			n.timer = nil
+		}
+		return nil
+	}
+	return n.transition(ctx, Gone, 0)
+}
+
+// Stop stops any timers without sending a notification and cancels the context
+// of any notifications that are being sent because a timer fired.
+// After Stop is called the state no longer changes automatically, but
+// notifications are still sent for events reported by the application.
+func (n *Notifier) Stop() {
+	n.m.Lock()
+	defer n.m.Unlock()
+	n.stopped = true
+	n.gen++
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	if n.cancel != nil {
+		n.cancel()
+	}
+}
+
+// Message returns the payload of a content message sent in the conversation
+// with the active state appended, unless the other side is known not to
+// support chat states.
+// Since sending a message implies that the user is active, the notifier is
+// moved to the active state without sending a separate notification.
+func (n *Notifier) Message(payload xml.TokenReader) xml.TokenReader {
+	n.m.Lock()
+	n.enter(Active)
+	unsupported := n.support == supportNo
+	n.m.Unlock()
+	if unsupported {
+		return payload
+	}
+	if payload == nil {
+		return Active.TokenReader()
+	}
+	return xmlstream.MultiReader(payload, Active.TokenReader())
+}
+
+// transition enters the new state and sends a notification if the state
+// changed.
+// If gen is not zero, the transition was scheduled by a timer and is skipped
+// if any other transition has happened since.
+func (n *Notifier) transition(ctx context.Context, st State, gen uint64) error {
+	n.m.Lock()
+	if gen != 0 && gen != n.gen {
+		n.m.Unlock()
+		return nil
+	}
+	changed := n.state != st
+	n.enter(st)
+	if !changed || n.support != supportYes {
+		n.m.Unlock()
+		return nil
+	}
+	// Make sure notifications are sent in the order the states were entered.
+	n.send.Lock()
+	n.m.Unlock()
+	defer n.send.Unlock()
+	typ := n.Type
+	if typ == "" {
+		typ = stanza.ChatMessage
+	}
+	return n.Session.Send(ctx, stanza.Message{
+		To:   n.To,
+		Type: typ,
+	}.Wrap(st.TokenReader()))
+}
+
+// enter must be called with n.m held.
+// It changes the state and schedules the next automatic transition.
+func (n *Notifier) enter(st State) {
+	n.state = st
+	n.gen++
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+
+	var (
+		next  State
+		after time.Duration
+	)
+	switch st {
+	case Composing:
+		next, after = Paused, orDefault(n.PauseAfter, DefaultPauseAfter)
+	case Active, Paused:
+		next, after = Inactive, orDefault(n.InactiveAfter, DefaultInactiveAfter)
+	case Inactive:
+		if n.Type == stanza.GroupChatMessage {
+			return
+		}
+		next, after = Gone, orDefault(n.GoneAfter, DefaultGoneAfter)
+	default:
+		return
+	}
+	if n.stopped {
+		return
+	}
+	if n.ctx == nil {
+		n.ctx, n.cancel = context.WithCancel(context.Background())
+	}
+	ctx := n.ctx
+	gen := n.gen
+	n.timer = time.AfterFunc(after, func() {
+		err := n.transition(ctx, next, gen)
+		if err != nil && n.Err != nil {
+			n.Err(err)
+		}
+	})
+}
+
+func orDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
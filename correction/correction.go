@@ -0,0 +1,176 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h Handler"
+
+// Package correction implements XEP-0308: Last Message Correction.
+package correction // import "mellium.im/xmpp/correction"
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "urn:xmpp:message-correct:0"
+
+// Replace is a payload that marks a message as a correction of the message
+// with the given ID.
+type Replace struct {
+	XMLName xml.Name `xml:"urn:xmpp:message-correct:0 replace"`
+	ID      string   `xml:"id,attr"`
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (r Replace) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "replace"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: r.ID}},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (r Replace) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, r.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (r Replace) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := r.WriteXML(e)
+	return err
+}
+
+// Send sends a message with the provided payload that replaces the content of
+// the message with the given id.
+// The id must be the ID of the original message (for example, the ID used when
+// sending it with Session.SendMessage), not that of any earlier correction.
+// The payload will normally be the complete corrected content, for example the
+// result of calling TokenReader on a message.Content.
+func Send(ctx context.Context, s *xmpp.Session, msg stanza.Message, id string, payload xml.TokenReader) error {
+	r := Replace{ID: id}.TokenReader()
+	if payload != nil {
+		r = xmlstream.MultiReader(payload, r)
+	}
+	return s.Send(ctx, msg.Wrap(r))
+}
+
+// Correction is an incoming message that corrects an earlier message.
+type Correction struct {
+	stanza.Message
+
+	// Replace is the ID of the message being corrected.
+	Replace string
+
+	// Any IDs of the correction itself other than its id attribute.
+	OriginID  stanza.OriginID
+	StanzaIDs []stanza.ID
+
+	// Content is the corrected content that replaces that of the original
+	// message.
+	Content message.Content
+}
+
+// Read decodes a correction from a message stanza, including its start
+// element.
+// If the message is not a correction the Replace field of the result will be
+// empty.
+func Read(r xml.TokenReader) (Correction, error) {
+	v := struct {
+		stanza.Message
+		Replace   Replace         `xml:"urn:xmpp:message-correct:0 replace"`
+		OriginID  stanza.OriginID `xml:"urn:xmpp:sid:0 origin-id"`
+		StanzaIDs []stanza.ID     `xml:"urn:xmpp:sid:0 stanza-id"`
+		Subject   message.Subject `xml:"subject"`
+		Body      message.Body    `xml:"body"`
+		Thread    message.Thread  `xml:"thread"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return Correction{}, err
+	}
+	return Correction{
+		Message:   v.Message,
+		Replace:   v.Replace.ID,
+		OriginID:  v.OriginID,
+		StanzaIDs: v.StanzaIDs,
+		Content: message.Content{
+			Subject: v.Subject,
+			Body:    v.Body,
+			Thread:  v.Thread,
+		},
+	}, nil
+}
+
+// Valid reports whether c may correct a message with the header orig.
+//
+// In a group chat the correction must be sent by the same occupant JID as the
+// original message, otherwise it must be sent by the same bare JID, allowing
+// the sender to correct messages from one of their other devices.
+// Messages in a group chat can only be corrected by other group chat messages
+// and vice versa.
+func (c Correction) Valid(orig stanza.Message) bool {
+	if c.Type != orig.Type && !(isChat(c.Type) && isChat(orig.Type)) {
+		return false
+	}
+	if orig.Type == stanza.GroupChatMessage {
+		return c.From.Equal(orig.From)
+	}
+	return c.From.Bare().Equal(orig.From.Bare())
+}
+
+// isChat reports whether typ is a one-to-one chat or a normal message, which
+// has a type of "normal" or no type at all.
+func isChat(typ stanza.MessageType) bool {
+	return typ == "" || typ == stanza.NormalMessage || typ == stanza.ChatMessage
+}
+
+// Handle returns an option that registers a Handler for message corrections in
+// chat, normal, and groupchat messages.
+func Handle(h Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		name := xml.Name{Space: NS, Local: "replace"}
+		// Messages without a type attribute are normal messages.
+		mux.Message("", name, h)(m)
+		mux.Message(stanza.NormalMessage, name, h)(m)
+		mux.Message(stanza.ChatMessage, name, h)(m)
+		mux.Message(stanza.GroupChatMessage, name, h)(m)
+	}
+}
+
+// Handler reports incoming corrections.
+//
+// Corrections are only reported if the message they replace can be found in
+// Store and they are valid corrections of that message as reported by the
+// Valid method.
+// All other corrections are ignored, so a handler without a Store does
+// nothing.
+type Handler struct {
+	Store   Store
+	Correct func(Correction) error
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h Handler) HandleMessage(_ stanza.Message, t xmlstream.TokenReadEncoder) error {
+	c, err := Read(t)
+	if err != nil {
+		return err
+	}
+	if c.Replace == "" || h.Store == nil || h.Correct == nil {
+		return nil
+	}
+	orig, ok, err := h.Store.Lookup(c.Replace)
+	if err != nil {
+		return err
+	}
+	if !ok || !c.Valid(orig.Message) {
+		return nil
+	}
+	return h.Correct(c)
+}
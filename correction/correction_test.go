@@ -0,0 +1,236 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package correction_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/correction"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = correction.Replace{}
+	_ xmlstream.Marshaler = correction.Replace{}
+	_ xmlstream.WriterTo  = correction.Replace{}
+	_ mux.MessageHandler  = correction.Handler{}
+	_ info.FeatureIter    = correction.Handler{}
+	_ correction.Store    = (*correction.MemStore)(nil)
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &correction.Replace{
+			XMLName: xml.Name{Space: correction.NS, Local: "replace"},
+			ID:      "bad1",
+		},
+		XML: `<replace xmlns="urn:xmpp:message-correct:0" id="bad1"></replace>`,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+func TestSend(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	err := correction.Send(context.Background(), s, stanza.Message{
+		To:   jid.MustParse("juliet@capulet.net/balcony"),
+		Type: stanza.ChatMessage,
+	}, "bad1", message.Content{Body: message.Body{"": "But soft, what light through yonder window breaks?"}}.TokenReader())
+	if err != nil {
+		t.Fatalf("error sending correction: %v", err)
+	}
+	const expected = `<message xmlns="jabber:client" type="chat" to="juliet@capulet.net/balcony"><body>But soft, what light through yonder window breaks?</body><replace xmlns="urn:xmpp:message-correct:0" id="bad1"></replace></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+var validTests = [...]struct {
+	orig stanza.Message
+	c    stanza.Message
+	ok   bool
+}{
+	0: {
+		orig: stanza.Message{From: jid.MustParse("romeo@montague.net/orchard"), Type: stanza.ChatMessage},
+		c:    stanza.Message{From: jid.MustParse("romeo@montague.net/garden"), Type: stanza.ChatMessage},
+		ok:   true,
+	},
+	1: {
+		orig: stanza.Message{From: jid.MustParse("romeo@montague.net/orchard"), Type: stanza.ChatMessage},
+		c:    stanza.Message{From: jid.MustParse("tybalt@capulet.net/orchard"), Type: stanza.ChatMessage},
+	},
+	2: {
+		orig: stanza.Message{From: jid.MustParse("coven@chat.shakespeare.lit/thirdwitch"), Type: stanza.GroupChatMessage},
+		c:    stanza.Message{From: jid.MustParse("coven@chat.shakespeare.lit/thirdwitch"), Type: stanza.GroupChatMessage},
+		ok:   true,
+	},
+	3: {
+		orig: stanza.Message{From: jid.MustParse("coven@chat.shakespeare.lit/thirdwitch"), Type: stanza.GroupChatMessage},
+		c:    stanza.Message{From: jid.MustParse("coven@chat.shakespeare.lit/firstwitch"), Type: stanza.GroupChatMessage},
+	},
+	4: {
+		orig: stanza.Message{From: jid.MustParse("coven@chat.shakespeare.lit/thirdwitch"), Type: stanza.GroupChatMessage},
+		c:    stanza.Message{From: jid.MustParse("coven@chat.shakespeare.lit/thirdwitch"), Type: stanza.ChatMessage},
+	},
+	5: {
+		orig: stanza.Message{From: jid.MustParse("romeo@montague.net/orchard")},
+		c:    stanza.Message{From: jid.MustParse("romeo@montague.net/orchard"), Type: stanza.ChatMessage},
+		ok:   true,
+	},
+}
+
+func TestValid(t *testing.T) {
+	for i, tc := range validTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			c := correction.Correction{Message: tc.c, Replace: "bad1"}
+			if ok := c.Valid(tc.orig); ok != tc.ok {
+				t.Errorf("wrong result: want=%t, got=%t", tc.ok, ok)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	var store correction.MemStore
+	orig := correction.Message{
+		Message:   stanza.Message{ID: "bad1", From: jid.MustParse("romeo@montague.net/orchard"), Type: stanza.ChatMessage},
+		OriginID:  stanza.OriginID{ID: "origin1"},
+		StanzaIDs: []stanza.ID{{ID: "archive1", By: jid.MustParse("romeo@montague.net")}},
+		Content:   message.Content{Body: message.Body{"": "But soft, what light through yonder airlock breaks?"}},
+	}
+	store.Add(orig)
+
+	c := correction.Correction{
+		Message: stanza.Message{From: jid.MustParse("tybalt@capulet.net/orchard"), Type: stanza.ChatMessage},
+		Replace: "bad1",
+		Content: message.Content{Body: message.Body{"": "Romeo is a fool."}},
+	}
+	if err := correction.Apply(&store, c); !errors.Is(err, correction.ErrInvalid) {
+		t.Errorf("wrong error for invalid sender: want=%v, got=%v", correction.ErrInvalid, err)
+	}
+	c.Replace = "unknown"
+	if err := correction.Apply(&store, c); !errors.Is(err, correction.ErrNotFound) {
+		t.Errorf("wrong error for unknown message: want=%v, got=%v", correction.ErrNotFound, err)
+	}
+
+	c = correction.Correction{
+		Message: stanza.Message{From: jid.MustParse("romeo@montague.net/garden"), Type: stanza.ChatMessage},
+		Replace: "origin1",
+		Content: message.Content{Body: message.Body{"": "But soft, what light through yonder window breaks?"}},
+	}
+	if err := correction.Apply(&store, c); err != nil {
+		t.Fatalf("error applying correction: %v", err)
+	}
+	want := orig
+	want.Content = c.Content
+	want.Corrected = true
+	for _, id := range []string{"bad1", "origin1", "archive1"} {
+		msg, ok, err := store.Lookup(id)
+		if err != nil || !ok {
+			t.Fatalf("error looking up %s: %t, %v", id, ok, err)
+		}
+		if !reflect.DeepEqual(msg, want) {
+			t.Errorf("wrong message for %s:\nwant=%+v,\n got=%+v", id, want, msg)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var store correction.MemStore
+	store.Add(correction.Message{
+		Message: stanza.Message{ID: "bad1", From: jid.MustParse("coven@chat.shakespeare.lit/thirdwitch"), Type: stanza.GroupChatMessage},
+		Content: message.Content{Body: message.Body{"": "Harpier cries: 'tis tim, 'tis time."}},
+	})
+	var corrections []correction.Correction
+	m := mux.New(stanza.NSClient, correction.Handle(correction.Handler{
+		Store: &store,
+		Correct: func(c correction.Correction) error {
+			corrections = append(corrections, c)
+			return correction.Apply(&store, c)
+		},
+	}))
+	for _, msg := range []string{
+		`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/firstwitch" id="bad2"><body>Fillet of a fenny snake</body><replace xmlns="urn:xmpp:message-correct:0" id="bad1"/></message>`,
+		`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/thirdwitch" id="good1"><body>Harpier cries: 'tis time, 'tis time.</body><replace xmlns="urn:xmpp:message-correct:0" id="bad1"/><stanza-id xmlns="urn:xmpp:sid:0" id="archive2" by="coven@chat.shakespeare.lit"/></message>`,
+		`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/thirdwitch" id="good2"><body>Eye of newt</body><replace xmlns="urn:xmpp:message-correct:0" id="unknown"/></message>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(msg))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(io.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling message: %v", err)
+		}
+	}
+
+	if len(corrections) != 1 {
+		t.Fatalf("wrong number of corrections: want=1, got=%d", len(corrections))
+	}
+	c := corrections[0]
+	if c.ID != "good1" || c.Replace != "bad1" || len(c.StanzaIDs) != 1 || c.StanzaIDs[0].ID != "archive2" {
+		t.Errorf("wrong correction: %+v", c)
+	}
+	msg, _, _ := store.Lookup("bad1")
+	const body = "Harpier cries: 'tis time, 'tis time."
+	if b := msg.Content.Body.Text(""); b != body || !msg.Corrected {
+		t.Errorf("correction not applied: want=%q, got=%q (corrected: %t)", body, b, msg.Corrected)
+	}
+}
+
+func TestHandlerTypeless(t *testing.T) {
+	var store correction.MemStore
+	store.Add(correction.Message{
+		Message: stanza.Message{ID: "bad1", From: jid.MustParse("juliet@capulet.lit/balcony"), Type: stanza.ChatMessage},
+		Content: message.Content{Body: message.Body{"": "Wherefore art thou Romeo?"}},
+	})
+	var corrections []correction.Correction
+	m := mux.New(stanza.NSClient, correction.Handle(correction.Handler{
+		Store: &store,
+		Correct: func(c correction.Correction) error {
+			corrections = append(corrections, c)
+			return nil
+		},
+	}))
+	const msg = `<message xmlns="jabber:client" from="juliet@capulet.lit/chamber" id="good1"><body>Wherefore art thou, Romeo?</body><replace xmlns="urn:xmpp:message-correct:0" id="bad1"/></message>`
+	d := xml.NewDecoder(strings.NewReader(msg))
+	tok, _ := d.Token()
+	start := tok.(xml.StartElement)
+	err := m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     xml.NewEncoder(io.Discard),
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling message: %v", err)
+	}
+	if len(corrections) != 1 || corrections[0].ID != "good1" || corrections[0].Replace != "bad1" {
+		t.Errorf("wrong corrections for message without a type: %+v", corrections)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package correction
+
+import (
+	"errors"
+	"sync"
+
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/stanza"
+)
+
+// Errors returned by Apply.
+var (
+	ErrNotFound = errors.New("correction: corrected message not found")
+	ErrInvalid  = errors.New("correction: message cannot be corrected by this sender")
+)
+
+// Message is a message kept in a Store.
+type Message struct {
+	stanza.Message
+
+	// Any IDs of the message other than its id attribute.
+	OriginID  stanza.OriginID
+	StanzaIDs []stanza.ID
+
+	Content message.Content
+
+	// Corrected is true if the content has been replaced by a correction.
+	Corrected bool
+}
+
+// Store is a message store maintained by the application that corrections can
+// be applied to.
+//
+// A message may be referenced by its id attribute, its origin ID, or any of
+// its stanza IDs.
+type Store interface {
+	// Lookup returns the message referenced by id, or false if no such message
+	// exists.
+	Lookup(id string) (msg Message, ok bool, err error)
+
+	// Update replaces the message referenced by id.
+	Update(id string, msg Message) error
+}
+
+// Apply looks up the message corrected by c in s and replaces its content.
+// If the message cannot be found ErrNotFound is returned, and if c is not a
+// valid correction of the message ErrInvalid is returned.
+func Apply(s Store, c Correction) error {
+	msg, ok, err := s.Lookup(c.Replace)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	if !c.Valid(msg.Message) {
+		return ErrInvalid
+	}
+	msg.Content = c.Content
+	msg.Corrected = true
+	return s.Update(c.Replace, msg)
+}
+
+// MemStore is an in-memory Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m    sync.Mutex
+	msgs map[string]*Message
+}
+
+// Add adds a message to the store under its id attribute, origin ID, and stanza
+// IDs.
+// IDs that already reference another message are not replaced.
+func (s *MemStore) Add(msg Message) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.msgs == nil {
+		s.msgs = make(map[string]*Message)
+	}
+	p := &msg
+	add := func(id string) {
+		if _, ok := s.msgs[id]; id != "" && !ok {
+			s.msgs[id] = p
+		}
+	}
+	add(msg.ID)
+	add(msg.OriginID.ID)
+	for _, id := range msg.StanzaIDs {
+		add(id.ID)
+	}
+}
+
+// Lookup implements Store.
+func (s *MemStore) Lookup(id string) (Message, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	p, ok := s.msgs[id]
+	if !ok {
+		return Message{}, false, nil
+	}
+	return *p, true, nil
+}
+
+// Update implements Store.
+// The message is updated under all of the IDs that reference it.
+func (s *MemStore) Update(id string, msg Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	p, ok := s.msgs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	*p = msg
+	return nil
+}
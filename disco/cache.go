@@ -0,0 +1,281 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+type cacheKey struct {
+	jid  string
+	node string
+}
+
+type cacheEntry struct {
+	done    chan struct{}
+	expires time.Time
+	info    Info
+	items   []items.Item
+	err     error
+}
+
+// HandleCache returns an option that registers a Cache to invalidate entries
+// when an entity's entity caps change or when it goes offline.
+//
+// Unavailable presence is not handled so that registering the option does not
+// conflict with other handlers for all unavailable presence, such as
+// presence.Handle.
+// To invalidate the entries of entities that go offline, pass unavailable
+// presence to Track from the handler that receives it, or set the Cache as the
+// Next handler of a presence.Tracker.
+//
+// If the cache's Caps field is set, the CapsCache is updated with the same
+// presence and HandleCaps should not also be registered on the multiplexer.
+func HandleCache(c *Cache) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.Presence(stanza.AvailablePresence, xml.Name{Space: NSCaps, Local: "c"}, c)(m)
+		mux.Presence(stanza.AvailablePresence, xml.Name{Space: NSCaps2, Local: "c"}, c)(m)
+	}
+}
+
+// Cache is a client side cache of service discovery info and items responses
+// keyed by JID and node.
+// Concurrent requests for the same JID and node result in a single query.
+// If the context of the request that made the query is canceled, the others
+// make the query again instead of failing with its error.
+//
+// The zero value is ready to use, but does not cache anything beyond
+// coalescing concurrent requests.
+type Cache struct {
+	// TTL is the length of time for which successful responses are cached.
+	TTL time.Duration
+
+	// NegativeTTL is the length of time for which item-not-found and
+	// service-unavailable errors are cached.
+	// Other errors are never cached.
+	NegativeTTL time.Duration
+
+	// Caps is an optional entity caps cache that will be updated with any
+	// presence handled by the cache.
+	Caps *CapsCache
+
+	m     sync.Mutex
+	info  map[cacheKey]*cacheEntry
+	items map[cacheKey]*cacheEntry
+	caps  map[string]string
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (c *Cache) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	switch p.Type {
+	case stanza.AvailablePresence:
+		v := struct {
+			stanza.Presence
+			Caps  Caps  `xml:"http://jabber.org/protocol/caps c"`
+			Caps2 Caps2 `xml:"urn:xmpp:caps c"`
+		}{}
+		err := xml.NewTokenDecoder(r).Decode(&v)
+		if err != nil {
+			return err
+		}
+		if c.Caps != nil {
+			c.Caps.track(p, v.Caps)
+		}
+		key := capsKey(v.Caps, v.Caps2)
+		if key == "" {
+			return nil
+		}
+		from := p.From.String()
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.caps == nil {
+			c.caps = make(map[string]string)
+		}
+		if old, ok := c.caps[from]; ok && old != key {
+			c.invalidate(from)
+		}
+		c.caps[from] = key
+	case stanza.UnavailablePresence:
+		c.Track(p)
+	}
+	return nil
+}
+
+// Track invalidates all cached responses for an entity when it sends
+// unavailable presence and forgets its caps if the Caps field is set.
+// Other presence is ignored.
+func (c *Cache) Track(p stanza.Presence) {
+	if p.Type != stanza.UnavailablePresence {
+		return
+	}
+	if c.Caps != nil {
+		c.Caps.Track(p)
+	}
+	c.Invalidate(p.From)
+}
+
+// capsKey returns a string that changes whenever the advertised caps change.
+func capsKey(caps Caps, caps2 Caps2) string {
+	var key []string
+	if caps.Ver != "" {
+		key = append(key, caps.Hash+"."+caps.Ver)
+	}
+	for _, h := range caps2.Hashes {
+		key = append(key, h.Algo+"."+h.Value)
+	}
+	sort.Strings(key)
+	return strings.Join(key, " ")
+}
+
+// Invalidate removes all cached responses for the provided JID.
+func (c *Cache) Invalidate(j jid.JID) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.invalidate(j.String())
+	delete(c.caps, j.String())
+}
+
+func (c *Cache) invalidate(j string) {
+	for k := range c.info {
+		if k.jid == j {
+			delete(c.info, k)
+		}
+	}
+	for k := range c.items {
+		if k.jid == j {
+			delete(c.items, k)
+		}
+	}
+}
+
+func negativeErr(err error) bool {
+	return errors.Is(err, stanza.Error{Condition: stanza.ItemNotFound}) || errors.Is(err, stanza.Error{Condition: stanza.ServiceUnavailable})
+}
+
+// ctxErr reports whether err was caused by a canceled context or an expired
+// deadline.
+func ctxErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// lookup returns the cache entry for the key, querying for it using fetch if
+// no unexpired entry exists.
+//
+// If another lookup is already querying for the key, lookup waits for it
+// instead.
+// If that query fails because the context of the other lookup was canceled, the
+// query is retried using ctx.
+func (c *Cache) lookup(ctx context.Context, m *map[cacheKey]*cacheEntry, key cacheKey, fetch func(context.Context, *cacheEntry)) (*cacheEntry, error) {
+	for {
+		e, err := c.lookupOnce(ctx, m, key, fetch)
+		if err != nil || e != nil {
+			return e, err
+		}
+	}
+}
+
+// lookupOnce is like lookup except that it returns a nil entry if it waited for
+// another lookup that was canceled.
+func (c *Cache) lookupOnce(ctx context.Context, m *map[cacheKey]*cacheEntry, key cacheKey, fetch func(context.Context, *cacheEntry)) (*cacheEntry, error) {
+	c.m.Lock()
+	if *m == nil {
+		*m = make(map[cacheKey]*cacheEntry)
+	}
+	e, ok := (*m)[key]
+	if ok {
+		select {
+		case <-e.done:
+			if time.Now().Before(e.expires) {
+				c.m.Unlock()
+				return e, nil
+			}
+		default:
+			// A request is already in flight, wait for it.
+			c.m.Unlock()
+			select {
+			case <-e.done:
+				if ctxErr(e.err) && ctx.Err() == nil {
+					return nil, nil
+				}
+				return e, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	e = &cacheEntry{done: make(chan struct{})}
+	(*m)[key] = e
+	c.m.Unlock()
+
+	fetch(ctx, e)
+
+	c.m.Lock()
+	switch {
+	case e.err == nil:
+		e.expires = time.Now().Add(c.TTL)
+	case negativeErr(e.err):
+		e.expires = time.Now().Add(c.NegativeTTL)
+	}
+	if e.expires.IsZero() || !e.expires.After(time.Now()) {
+		// Only remove the entry if it has not already been replaced or
+		// invalidated.
+		if (*m)[key] == e {
+			delete(*m, key)
+		}
+	}
+	c.m.Unlock()
+	close(e.done)
+	return e, nil
+}
+
+// GetInfo is like the GetInfo function except that responses are cached.
+func (c *Cache) GetInfo(ctx context.Context, node string, to jid.JID, s *xmpp.Session) (Info, error) {
+	e, err := c.lookup(ctx, &c.info, cacheKey{jid: to.String(), node: node}, func(ctx context.Context, e *cacheEntry) {
+		e.info, e.err = GetInfo(ctx, node, to, s)
+	})
+	if err != nil {
+		return Info{}, err
+	}
+	return e.info, e.err
+}
+
+// FetchItems is like the FetchItems function except that responses are cached
+// and all items are returned at once.
+func (c *Cache) FetchItems(ctx context.Context, item items.Item, s *xmpp.Session) ([]items.Item, error) {
+	e, err := c.lookup(ctx, &c.items, cacheKey{jid: item.JID.String(), node: item.Node}, func(ctx context.Context, e *cacheEntry) {
+		e.items, e.err = fetchAllItems(ctx, item, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e.items, e.err
+}
+
+func fetchAllItems(ctx context.Context, item items.Item, s *xmpp.Session) (all []items.Item, err error) {
+	iter := FetchItems(ctx, item, s)
+	defer func() {
+		e := iter.Close()
+		if err == nil {
+			err = e
+		}
+	}()
+	for iter.Next() {
+		all = append(all, iter.Item())
+	}
+	return all, iter.Err()
+}
@@ -0,0 +1,315 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/presence"
+	"mellium.im/xmpp/stanza"
+)
+
+var cacheTree = map[string][]string{
+	"":  {"a", "b"},
+	"a": {"c"},
+	"b": {"a", "d"},
+}
+
+// cacheServer answers info and items queries, counting the number of queries
+// for each node.
+// Queries for the node "missing" result in an item-not-found error and queries
+// for the node "slow" are not answered until slow is closed.
+type cacheServer struct {
+	m       sync.Mutex
+	queries map[string]int
+	slow    chan struct{}
+}
+
+func (s *cacheServer) count(node string) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.queries[node]
+}
+
+func (s *cacheServer) HandleXMPP(e xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	iq, err := stanza.NewIQ(*start)
+	if err != nil {
+		return err
+	}
+	query := struct {
+		XMLName xml.Name
+		Node    string `xml:"node,attr"`
+	}{}
+	err = xml.NewTokenDecoder(e).Decode(&query)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	if s.queries == nil {
+		s.queries = make(map[string]int)
+	}
+	s.queries[query.Node]++
+	s.m.Unlock()
+	if query.Node == "slow" {
+		<-s.slow
+	}
+
+	iq.To, iq.From = iq.From, iq.To
+	if query.Node == "missing" {
+		_, err = xmlstream.Copy(e, iq.Error(stanza.Error{
+			Type:      stanza.Cancel,
+			Condition: stanza.ItemNotFound,
+		}))
+		return err
+	}
+	iq.Type = stanza.ResultIQ
+	if query.XMLName.Space == disco.NSInfo {
+		return e.Encode(struct {
+			stanza.IQ
+			Info disco.Info
+		}{
+			IQ: iq,
+			Info: disco.Info{
+				InfoQuery: disco.InfoQuery{Node: query.Node},
+				Features:  []info.Feature{{Var: "urn:example:" + query.Node}},
+			},
+		})
+	}
+	var children []items.Item
+	for _, node := range cacheTree[query.Node] {
+		children = append(children, items.Item{
+			XMLName: xml.Name{Space: disco.NSItems, Local: "item"},
+			JID:     jid.MustParse("example.net"),
+			Node:    node,
+		})
+	}
+	return e.Encode(struct {
+		stanza.IQ
+		Query queryItems
+	}{
+		IQ:    iq,
+		Query: queryItems{Items: children},
+	})
+}
+
+func TestCacheInfo(t *testing.T) {
+	srv := &cacheServer{}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(srv))
+	cache := &disco.Cache{TTL: time.Hour, NegativeTTL: time.Hour}
+	to := jid.MustParse("example.net")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			i, err := cache.GetInfo(context.Background(), "a", to, cs.Client)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if len(i.Features) != 1 || i.Features[0].Var != "urn:example:a" {
+				t.Errorf("wrong features: %v", i.Features)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := srv.count("a"); n != 1 {
+		t.Errorf("wrong number of queries: want=1, got=%d", n)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.GetInfo(context.Background(), "missing", to, cs.Client)
+		if !errors.Is(err, stanza.Error{Condition: stanza.ItemNotFound}) {
+			t.Errorf("wrong error: want=%v, got=%v", stanza.ItemNotFound, err)
+		}
+	}
+	if n := srv.count("missing"); n != 1 {
+		t.Errorf("error was not cached: want=1 query, got=%d", n)
+	}
+
+	cache.Invalidate(to)
+	_, err := cache.GetInfo(context.Background(), "a", to, cs.Client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := srv.count("a"); n != 2 {
+		t.Errorf("cache was not invalidated: want=2 queries, got=%d", n)
+	}
+}
+
+func TestCacheCanceled(t *testing.T) {
+	srv := &cacheServer{slow: make(chan struct{})}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(srv))
+	cache := &disco.Cache{TTL: time.Hour}
+	to := jid.MustParse("example.net")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := cache.GetInfo(ctx, "slow", to, cs.Client)
+		leaderErr <- err
+	}()
+	for srv.count("slow") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	type result struct {
+		info disco.Info
+		err  error
+	}
+	waiter := make(chan result, 1)
+	go func() {
+		i, err := cache.GetInfo(context.Background(), "slow", to, cs.Client)
+		waiter <- result{info: i, err: err}
+	}()
+	// Give the second request time to start waiting on the first.
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error for canceled request: want=%v, got=%v", context.Canceled, err)
+	}
+	close(srv.slow)
+
+	// Canceling the first request must not cause the second one to fail.
+	res := <-waiter
+	if res.err != nil {
+		t.Fatalf("unexpected error: %v", res.err)
+	}
+	if len(res.info.Features) != 1 || res.info.Features[0].Var != "urn:example:slow" {
+		t.Errorf("wrong features: %v", res.info.Features)
+	}
+	if n := srv.count("slow"); n != 2 {
+		t.Errorf("wrong number of queries: want=2, got=%d", n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	srv := &cacheServer{}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(srv))
+	cache := &disco.Cache{}
+	to := jid.MustParse("example.net")
+	for i := 0; i < 2; i++ {
+		_, err := cache.GetInfo(context.Background(), "a", to, cs.Client)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_, err = cache.GetInfo(context.Background(), "missing", to, cs.Client)
+		if err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+	if n := srv.count("a"); n != 2 {
+		t.Errorf("response should not be cached without a TTL: want=2 queries, got=%d", n)
+	}
+	if n := srv.count("missing"); n != 2 {
+		t.Errorf("error should not be cached without a TTL: want=2 queries, got=%d", n)
+	}
+}
+
+func TestCachePresence(t *testing.T) {
+	srv := &cacheServer{}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(srv))
+	cache := &disco.Cache{TTL: time.Hour, Caps: disco.NewCapsCache(nil)}
+	// Unavailable presence reaches the cache through the tracker, registering
+	// both must not panic.
+	m := mux.New(stanza.NSClient,
+		presence.Handle(&presence.Tracker{Next: cache}),
+		disco.HandleCache(cache),
+	)
+	to := jid.MustParse("me@example.net/mellium")
+
+	handle := func(p string) {
+		t.Helper()
+		d := xml.NewDecoder(strings.NewReader(p))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(nopEncoder{TokenReader: d}, &start)
+		if err != nil {
+			t.Fatalf("unexpected error handling presence: %v", err)
+		}
+	}
+	query := func() {
+		t.Helper()
+		_, err := cache.GetInfo(context.Background(), "a", to, cs.Client)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	const capsPresence = `<presence xmlns="jabber:client" from="me@example.net/mellium"><c xmlns="urn:xmpp:caps"><hash xmlns="urn:xmpp:hashes:2" algo="sha-256">`
+	handle(capsPresence + `one</hash></c></presence>`)
+	query()
+	handle(capsPresence + `one</hash></c></presence>`)
+	query()
+	if n := srv.count("a"); n != 1 {
+		t.Errorf("unchanged caps should not invalidate cache: want=1 query, got=%d", n)
+	}
+	handle(capsPresence + `two</hash></c></presence>`)
+	query()
+	if n := srv.count("a"); n != 2 {
+		t.Errorf("changed caps should invalidate cache: want=2 queries, got=%d", n)
+	}
+
+	handle(`<presence xmlns="jabber:client" from="me@example.net/mellium"><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://mellium.im" ver="ver"/></presence>`)
+	if _, ok := cache.Caps.Caps(to); !ok {
+		t.Errorf("caps cache was not updated")
+	}
+	query()
+	handle(`<presence xmlns="jabber:client" type="unavailable" from="me@example.net/mellium"/>`)
+	if _, ok := cache.Caps.Caps(to); ok {
+		t.Errorf("caps cache was not updated on unavailable presence")
+	}
+	query()
+	if n := srv.count("a"); n != 4 {
+		t.Errorf("unavailable presence should invalidate cache: want=4 queries, got=%d", n)
+	}
+}
+
+func TestWalkItemCache(t *testing.T) {
+	for _, concurrency := range []int{0, 4} {
+		srv := &cacheServer{}
+		cs := xmpptest.NewClientServer(xmpptest.ServerHandler(srv))
+		cache := &disco.Cache{TTL: time.Hour}
+
+		for i := 0; i < 2; i++ {
+			var visited []string
+			err := disco.WalkItem(context.Background(), items.Item{JID: jid.MustParse("example.net")}, cs.Client, func(level int, item items.Item, err error) error {
+				if err != nil {
+					return err
+				}
+				visited = append(visited, item.Node)
+				return nil
+			}, disco.WalkCache(cache), disco.WalkConcurrency(concurrency))
+			if err != nil {
+				t.Fatalf("unexpected error walking items: %v", err)
+			}
+			sort.Strings(visited)
+			// "a" is visited twice because it is the child of both the root and "b",
+			// but it is only queried once.
+			const expected = ",a,a,b,c,d"
+			if s := strings.Join(visited, ","); s != expected {
+				t.Errorf("wrong items visited with concurrency %d: want=%s, got=%s", concurrency, expected, s)
+			}
+		}
+		for _, node := range []string{"", "a", "b", "c", "d"} {
+			if n := srv.count(node); n != 1 {
+				t.Errorf("wrong number of queries for node %q with concurrency %d: want=1, got=%d", node, concurrency, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"crypto"
+	// Register the SHA family of hashes that may be used by entity caps.
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"sort"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+const formType = "FORM_TYPE"
+
+// capsHashes is the list of hashes that may be used to generate or verify
+// entity caps along with their names from the IANA Hash Function Textual Names
+// registry.
+var capsHashes = []struct {
+	Name string
+	Hash crypto.Hash
+}{
+	{Name: "sha-1", Hash: crypto.SHA1},
+	{Name: "sha-224", Hash: crypto.SHA224},
+	{Name: "sha-256", Hash: crypto.SHA256},
+	{Name: "sha-384", Hash: crypto.SHA384},
+	{Name: "sha-512", Hash: crypto.SHA512},
+}
+
+func capsHashName(h crypto.Hash) (string, bool) {
+	for _, c := range capsHashes {
+		if c.Hash == h {
+			return c.Name, true
+		}
+	}
+	return "", false
+}
+
+// Caps can be included in a presence stanza or in stream features to advertise
+// entity capabilities.
+// Node is a string that uniquely identifies your client (eg.
+// https://example.com/myclient) and ver is the hash of an Info value.
+type Caps struct {
+	XMLName xml.Name `xml:"http://jabber.org/protocol/caps c"`
+	Hash    string   `xml:"hash,attr"`
+	Node    string   `xml:"node,attr"`
+	Ver     string   `xml:"ver,attr"`
+}
+
+// NewCaps returns the entity caps for the provided node calculated from the
+// features, identities, and forms of the root node.
+// The hash function h must be one of the SHA family of hashes.
+//
+// A ServeMux may be passed as the final three arguments to calculate the caps
+// of all of its handlers.
+func NewCaps(node string, h crypto.Hash, features info.FeatureIter, identities info.IdentityIter, forms form.Iter) (Caps, error) {
+	name, ok := capsHashName(h)
+	if !ok || !h.Available() {
+		return Caps{}, errors.New("disco: unsupported entity caps hash")
+	}
+	ver, err := Hash(h.New(), features, identities, forms)
+	if err != nil {
+		return Caps{}, err
+	}
+	return Caps{
+		Hash: name,
+		Node: node,
+		Ver:  ver,
+	}, nil
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (c Caps) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NSCaps, Local: "c"},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "hash"}, Value: c.Hash},
+			{Name: xml.Name{Local: "node"}, Value: c.Node},
+			{Name: xml.Name{Local: "ver"}, Value: c.Ver},
+		},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (c Caps) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, c.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (c Caps) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := c.WriteXML(e)
+	return err
+}
+
+// InsertCaps returns a transformer that adds the entity caps calculated from
+// the handlers registered on m to all available presence stanzas read through
+// it.
+// For more information see NewCaps.
+func InsertCaps(m *mux.ServeMux, node string, h crypto.Hash) xmlstream.Transformer {
+	caps, capsErr := NewCaps(node, h, m, m, m)
+	return xmlstream.InsertFunc(func(start xml.StartElement, level uint64, w xmlstream.TokenWriter) error {
+		if level != 1 ||
+			start.Name.Local != "presence" ||
+			(start.Name.Space != stanza.NSClient && start.Name.Space != stanza.NSServer) {
+			return nil
+		}
+		if _, typ := attr.Get(start.Attr, "type"); typ != string(stanza.AvailablePresence) {
+			return nil
+		}
+		if capsErr != nil {
+			return capsErr
+		}
+		_, err := caps.WriteXML(w)
+		return err
+	})
+}
+
+// Hash generates the entity capabilities verification string.
+// Its output is suitable for use as a cache key.
+func Hash(h hash.Hash, features info.FeatureIter, identities info.IdentityIter, forms form.Iter) (string, error) {
+	b, err := AppendHash(nil, h, features, identities, forms)
+	return string(b), err
+}
+
+// AppendHash is like Hash except that it appends the output to the provided
+// byte slice.
+func AppendHash(dst []byte, h hash.Hash, features info.FeatureIter, identities info.IdentityIter, forms form.Iter) ([]byte, error) {
+	i, err := collectInfo("", features, identities, forms)
+	if err != nil {
+		return dst, err
+	}
+	return i.AppendHash(dst, h), nil
+}
+
+// collectInfo builds an Info from the features, identities, and forms returned
+// for the given node.
+// Duplicate features, identities, and forms (for example, from handlers
+// registered more than once on a multiplexer) are only included once and forms
+// without a FORM_TYPE are skipped, matching the response sent by the disco
+// handler.
+// Any of the iterators may be nil.
+func collectInfo(node string, features info.FeatureIter, identities info.IdentityIter, forms form.Iter) (Info, error) {
+	i := Info{InfoQuery: InfoQuery{Node: node}}
+	if features != nil {
+		seen := make(map[string]struct{})
+		err := features.ForFeatures(node, func(f info.Feature) error {
+			if _, ok := seen[f.Var]; ok {
+				return nil
+			}
+			seen[f.Var] = struct{}{}
+			i.Features = append(i.Features, f)
+			return nil
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	if identities != nil {
+		seen := make(map[string]struct{})
+		err := identities.ForIdentities(node, func(ident info.Identity) error {
+			key := ident.Category + ":" + ident.Type + ":" + ident.Name + ":" + ident.Lang
+			if _, ok := seen[key]; ok {
+				return nil
+			}
+			seen[key] = struct{}{}
+			i.Identity = append(i.Identity, ident)
+			return nil
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	if forms != nil {
+		seen := make(map[string]struct{})
+		err := forms.ForForms(node, func(f *form.Data) error {
+			typ, ok := formTypeOf(f)
+			if !ok {
+				return nil
+			}
+			if _, ok := seen[typ]; ok {
+				return nil
+			}
+			seen[typ] = struct{}{}
+			i.Form = append(i.Form, *f)
+			return nil
+		})
+		if err != nil {
+			return i, err
+		}
+	}
+	return i, nil
+}
+
+// Hash generates the entity capabilities verification string.
+// Its output is suitable for use as a cache key.
+func (i Info) Hash(h hash.Hash) string {
+	return string(i.AppendHash(nil, h))
+}
+
+// AppendHash is like Hash except that it appends the output string to the
+// provided byte slice.
+func (i Info) AppendHash(dst []byte, h hash.Hash) []byte {
+	h.Reset()
+	writeVerString(h, i)
+	sum := h.Sum(nil)
+
+	n := len(dst)
+	encLen := base64.StdEncoding.EncodedLen(len(sum))
+	if cap(dst)-n < encLen {
+		newDst := make([]byte, n, n+encLen)
+		copy(newDst, dst)
+		dst = newDst
+	}
+	dst = dst[:n+encLen]
+	base64.StdEncoding.Encode(dst[n:], sum)
+	return dst
+}
+
+// writeVerString writes the verification string defined in XEP-0115 §5.1 to w.
+// Duplicate identities, features, and forms are only written once.
+func writeVerString(w io.Writer, i Info) {
+	idents := make([]info.Identity, len(i.Identity))
+	copy(idents, i.Identity)
+	sort.Slice(idents, func(a, b int) bool {
+		ia, ib := idents[a], idents[b]
+		if ia.Category != ib.Category {
+			return ia.Category < ib.Category
+		}
+		if ia.Type != ib.Type {
+			return ia.Type < ib.Type
+		}
+		if ia.Lang != ib.Lang {
+			return ia.Lang < ib.Lang
+		}
+		return ia.Name < ib.Name
+	})
+	var prev string
+	for n, ident := range idents {
+		s := ident.Category + "/" + ident.Type + "/" + ident.Lang + "/" + ident.Name + "<"
+		if n > 0 && s == prev {
+			continue
+		}
+		prev = s
+		/* #nosec */
+		io.WriteString(w, s)
+	}
+
+	features := make([]string, 0, len(i.Features))
+	for _, f := range i.Features {
+		features = append(features, f.Var)
+	}
+	sort.Strings(features)
+	for n, f := range features {
+		if n > 0 && f == features[n-1] {
+			continue
+		}
+		/* #nosec */
+		io.WriteString(w, f+"<")
+	}
+
+	type capsField struct {
+		Var    string
+		Values []string
+	}
+	type capsForm struct {
+		Type   string
+		Fields []capsField
+	}
+	forms := make([]capsForm, 0, len(i.Form))
+	for n := range i.Form {
+		var f capsForm
+		var hidden bool
+		i.Form[n].ForFields(func(field form.FieldData) {
+			switch {
+			case field.Var == "":
+				return
+			case field.Var == formType:
+				hidden = field.Type == form.TypeHidden
+				if len(field.Raw) > 0 {
+					f.Type = field.Raw[0]
+				}
+				return
+			}
+			values := make([]string, len(field.Raw))
+			copy(values, field.Raw)
+			sort.Strings(values)
+			f.Fields = append(f.Fields, capsField{Var: field.Var, Values: values})
+		})
+		// Forms without a hidden FORM_TYPE field are ignored.
+		if !hidden || f.Type == "" {
+			continue
+		}
+		sort.Slice(f.Fields, func(a, b int) bool {
+			return f.Fields[a].Var < f.Fields[b].Var
+		})
+		forms = append(forms, f)
+	}
+	sort.Slice(forms, func(a, b int) bool {
+		return forms[a].Type < forms[b].Type
+	})
+	for n, f := range forms {
+		if n > 0 && f.Type == forms[n-1].Type {
+			continue
+		}
+		/* #nosec */
+		io.WriteString(w, f.Type+"<")
+		for _, field := range f.Fields {
+			/* #nosec */
+			io.WriteString(w, field.Var+"<")
+			for _, v := range field.Values {
+				/* #nosec */
+				io.WriteString(w, v+"<")
+			}
+		}
+	}
+}
+
+// capsVers adds the verification strings that could be generated for the
+// provided Info using each of the supported hashes to vers.
+func capsVers(i Info, vers map[string]struct{}) {
+	for _, c := range capsHashes {
+		if !c.Hash.Available() {
+			continue
+		}
+		vers[i.Hash(c.Hash.New())] = struct{}{}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"hash"
+	"io"
+	"sort"
+
+	// Register the SHA-3 and BLAKE2b hashes that may be used by ECaps2.
+	_ "golang.org/x/crypto/blake2b"
+	_ "golang.org/x/crypto/sha3"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by ECaps2.
+const (
+	NSCaps2 = `urn:xmpp:caps`
+
+	nsHashes = `urn:xmpp:hashes:2`
+)
+
+// caps2Hashes is the list of hashes that may be used to generate or verify
+// ECaps2 along with their names from the XEP-0300: Use of Cryptographic Hash
+// Functions in XMPP registry.
+var caps2Hashes = []struct {
+	Name string
+	Hash crypto.Hash
+}{
+	{Name: "sha-256", Hash: crypto.SHA256},
+	{Name: "sha-512", Hash: crypto.SHA512},
+	{Name: "sha3-256", Hash: crypto.SHA3_256},
+	{Name: "sha3-512", Hash: crypto.SHA3_512},
+	{Name: "blake2b-256", Hash: crypto.BLAKE2b_256},
+	{Name: "blake2b-512", Hash: crypto.BLAKE2b_512},
+}
+
+func caps2HashName(h crypto.Hash) (string, bool) {
+	for _, c := range caps2Hashes {
+		if c.Hash == h {
+			return c.Name, true
+		}
+	}
+	return "", false
+}
+
+func caps2HashByName(name string) (crypto.Hash, bool) {
+	for _, c := range caps2Hashes {
+		if c.Name == name {
+			return c.Hash, true
+		}
+	}
+	return 0, false
+}
+
+// Caps2Hash is a single hash advertised as part of an ECaps2 element.
+type Caps2Hash struct {
+	Algo  string `xml:"algo,attr"`
+	Value string `xml:",chardata"`
+}
+
+// Node returns the service discovery node that may be queried to request the
+// info represented by the hash.
+func (h Caps2Hash) Node() string {
+	return NSCaps2 + "#" + h.Algo + "." + h.Value
+}
+
+// Caps2 can be included in a presence stanza or in stream features to
+// advertise entity capabilities using XEP-0390: Entity Capabilities 2.0.
+// Unlike legacy entity caps, multiple hashes may be advertised at once.
+type Caps2 struct {
+	XMLName xml.Name    `xml:"urn:xmpp:caps c"`
+	Hashes  []Caps2Hash `xml:"urn:xmpp:hashes:2 hash"`
+}
+
+// NewCaps2 returns the ECaps2 calculated from the features, identities, and
+// forms of the root node using each of the provided hash functions.
+// The supported hashes are SHA-256, SHA-512, SHA3-256, SHA3-512, BLAKE2b-256,
+// and BLAKE2b-512.
+//
+// A ServeMux may be passed as the first three arguments to calculate the caps
+// of all of its handlers.
+func NewCaps2(features info.FeatureIter, identities info.IdentityIter, forms form.Iter, h ...crypto.Hash) (Caps2, error) {
+	var c Caps2
+	if len(h) == 0 {
+		return c, errors.New("disco: no ECaps2 hash provided")
+	}
+	i, err := collectInfo("", features, identities, forms)
+	if err != nil {
+		return c, err
+	}
+	for _, hh := range h {
+		name, ok := caps2HashName(hh)
+		if !ok || !hh.Available() {
+			return Caps2{}, errors.New("disco: unsupported ECaps2 hash")
+		}
+		c.Hashes = append(c.Hashes, Caps2Hash{
+			Algo:  name,
+			Value: i.Hash2(hh.New()),
+		})
+	}
+	return c, nil
+}
+
+// Verify reports whether the info is well formed and matches the caps.
+// Hashes using unsupported algorithms are ignored, but at least one hash must
+// be supported and every supported hash must match for verification to
+// succeed.
+func (c Caps2) Verify(i Info) bool {
+	if !capsWellFormed(i) {
+		return false
+	}
+	var verified bool
+	for _, ch := range c.Hashes {
+		h, ok := caps2HashByName(ch.Algo)
+		if !ok || !h.Available() {
+			continue
+		}
+		if i.Hash2(h.New()) != ch.Value {
+			return false
+		}
+		verified = true
+	}
+	return verified
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (c Caps2) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, h := range c.Hashes {
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(h.Value)),
+			xml.StartElement{
+				Name: xml.Name{Space: nsHashes, Local: "hash"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "algo"}, Value: h.Algo}},
+			},
+		))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Space: NSCaps2, Local: "c"}},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (c Caps2) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, c.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (c Caps2) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := c.WriteXML(e)
+	return err
+}
+
+// InsertCaps2 returns a transformer that adds the ECaps2 calculated from the
+// handlers registered on m to all available presence stanzas read through it.
+// For more information see NewCaps2.
+func InsertCaps2(m *mux.ServeMux, h ...crypto.Hash) xmlstream.Transformer {
+	caps, capsErr := NewCaps2(m, m, m, h...)
+	return xmlstream.InsertFunc(func(start xml.StartElement, level uint64, w xmlstream.TokenWriter) error {
+		if level != 1 ||
+			start.Name.Local != "presence" ||
+			(start.Name.Space != stanza.NSClient && start.Name.Space != stanza.NSServer) {
+			return nil
+		}
+		if _, typ := attr.Get(start.Attr, "type"); typ != string(stanza.AvailablePresence) {
+			return nil
+		}
+		if capsErr != nil {
+			return capsErr
+		}
+		_, err := caps.WriteXML(w)
+		return err
+	})
+}
+
+// Caps2Feature returns a stream feature that advertises the provided ECaps2.
+// When the feature is parsed the resulting Caps2 is available from the
+// session's Feature method using the NSCaps2 namespace.
+//
+// Actually attempting to negotiate the feature does nothing as it is meant to
+// be informational only.
+func Caps2Feature(c Caps2) xmpp.StreamFeature {
+	return xmpp.StreamFeature{
+		Name:      xml.Name{Space: NSCaps2, Local: "c"},
+		Necessary: xmpp.Secure,
+		List: func(_ context.Context, e xmlstream.TokenWriter, _ xml.StartElement) (bool, error) {
+			_, err := c.WriteXML(e)
+			return false, err
+		},
+		Parse: func(_ context.Context, d *xml.Decoder, start *xml.StartElement) (bool, interface{}, error) {
+			var parsed Caps2
+			err := d.DecodeElement(&parsed, start)
+			return false, parsed, err
+		},
+		Negotiate: func(context.Context, *xmpp.Session, interface{}) (xmpp.SessionState, io.ReadWriter, error) {
+			return 0, nil, nil
+		},
+	}
+}
+
+// Hash2 generates the ECaps2 hash of the info using the provided hash
+// function and returns it base64 encoded.
+// Its output is suitable for use as a cache key.
+func (i Info) Hash2(h hash.Hash) string {
+	return string(i.AppendHash2(nil, h))
+}
+
+// AppendHash2 is like Hash2 except that it appends the output string to the
+// provided byte slice.
+func (i Info) AppendHash2(dst []byte, h hash.Hash) []byte {
+	h.Reset()
+	writeHashInput2(h, i)
+	sum := h.Sum(nil)
+
+	n := len(dst)
+	encLen := base64.StdEncoding.EncodedLen(len(sum))
+	if cap(dst)-n < encLen {
+		newDst := make([]byte, n, n+encLen)
+		copy(newDst, dst)
+		dst = newDst
+	}
+	dst = dst[:n+encLen]
+	base64.StdEncoding.Encode(dst[n:], sum)
+	return dst
+}
+
+// sortedJoin sorts the byte strings, writes them to w, and then writes the
+// terminator.
+func sortedJoin(w io.Writer, s [][]byte, term byte) {
+	sort.Slice(s, func(a, b int) bool {
+		return bytes.Compare(s[a], s[b]) < 0
+	})
+	for _, b := range s {
+		/* #nosec */
+		w.Write(b)
+	}
+	/* #nosec */
+	w.Write([]byte{term})
+}
+
+// writeHashInput2 writes the hash function input defined in XEP-0390 §4.1 to
+// w.
+func writeHashInput2(w io.Writer, i Info) {
+	const (
+		fs = 0x1c
+		gs = 0x1d
+		rs = 0x1e
+		us = 0x1f
+	)
+
+	features := make([][]byte, 0, len(i.Features))
+	for _, f := range i.Features {
+		features = append(features, append([]byte(f.Var), us))
+	}
+	sortedJoin(w, features, fs)
+
+	idents := make([][]byte, 0, len(i.Identity))
+	for _, ident := range i.Identity {
+		var b []byte
+		for _, s := range [...]string{ident.Category, ident.Type, ident.Lang, ident.Name} {
+			b = append(b, s...)
+			b = append(b, us)
+		}
+		idents = append(idents, append(b, rs))
+	}
+	sortedJoin(w, idents, fs)
+
+	forms := make([][]byte, 0, len(i.Form))
+	for n := range i.Form {
+		var fields [][]byte
+		i.Form[n].ForFields(func(field form.FieldData) {
+			values := make([][]byte, 0, len(field.Raw))
+			for _, v := range field.Raw {
+				values = append(values, append([]byte(v), us))
+			}
+			var b bytes.Buffer
+			b.WriteString(field.Var)
+			b.WriteByte(us)
+			sortedJoin(&b, values, rs)
+			fields = append(fields, b.Bytes())
+		})
+		var b bytes.Buffer
+		sortedJoin(&b, fields, gs)
+		forms = append(forms, b.Bytes())
+	}
+	sortedJoin(w, forms, fs)
+}
+
+// caps2Nodes adds the nodes of the form "urn:xmpp:caps#algo.value", where
+// value is the ECaps2 hash of the provided Info using algo, for each of the
+// supported hashes to nodes.
+func caps2Nodes(i Info, nodes map[string]struct{}) {
+	for _, c := range caps2Hashes {
+		if !c.Hash.Available() {
+			continue
+		}
+		nodes[NSCaps2+"#"+c.Name+"."+i.Hash2(c.Hash.New())] = struct{}{}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = disco.Caps2{}
+	_ xmlstream.Marshaler = disco.Caps2{}
+	_ xmlstream.WriterTo  = disco.Caps2{}
+)
+
+var hash2TestCases = [...]struct {
+	info    string
+	sha256  string
+	sha3256 string
+}{
+	0: {
+		// XEP-0390 §4.3 Simple Example
+		info: `<query xmlns="http://jabber.org/protocol/disco#info">
+  <identity category="client" name="BombusMod" type="mobile"/>
+  <feature var="http://jabber.org/protocol/si"/>
+  <feature var="http://jabber.org/protocol/bytestreams"/>
+  <feature var="http://jabber.org/protocol/chatstates"/>
+  <feature var="http://jabber.org/protocol/disco#info"/>
+  <feature var="http://jabber.org/protocol/disco#items"/>
+  <feature var="urn:xmpp:ping"/>
+  <feature var="jabber:iq:time"/>
+  <feature var="jabber:iq:privacy"/>
+  <feature var="jabber:iq:version"/>
+  <feature var="http://jabber.org/protocol/rosterx"/>
+  <feature var="urn:xmpp:time"/>
+  <feature var="jabber:x:oob"/>
+  <feature var="http://jabber.org/protocol/ibb"/>
+  <feature var="http://jabber.org/protocol/si/profile/file-transfer"/>
+  <feature var="urn:xmpp:receipts"/>
+  <feature var="jabber:iq:roster"/>
+  <feature var="jabber:iq:last"/>
+</query>`,
+		sha256:  "kzBZbkqJ3ADrj7v08reD1qcWUwNGHaidNUgD7nHpiw8=",
+		sha3256: "79mdYAfU9rEdTOcWDO7UEAt6E56SUzk/g6TnqUeuD9Q=",
+	},
+	1: {
+		// XEP-0390 §4.3 Complex Example
+		info: `<query xmlns="http://jabber.org/protocol/disco#info">
+  <identity category="client" name="Tkabber" type="pc" xml:lang="en"/>
+  <identity category="client" name="Ткаббер" type="pc" xml:lang="ru"/>
+  <feature var="games:board"/>
+  <feature var="http://jabber.org/protocol/activity"/>
+  <feature var="http://jabber.org/protocol/activity+notify"/>
+  <feature var="http://jabber.org/protocol/bytestreams"/>
+  <feature var="http://jabber.org/protocol/chatstates"/>
+  <feature var="http://jabber.org/protocol/commands"/>
+  <feature var="http://jabber.org/protocol/disco#info"/>
+  <feature var="http://jabber.org/protocol/disco#items"/>
+  <feature var="http://jabber.org/protocol/evil"/>
+  <feature var="http://jabber.org/protocol/feature-neg"/>
+  <feature var="http://jabber.org/protocol/geoloc"/>
+  <feature var="http://jabber.org/protocol/geoloc+notify"/>
+  <feature var="http://jabber.org/protocol/ibb"/>
+  <feature var="http://jabber.org/protocol/iqibb"/>
+  <feature var="http://jabber.org/protocol/mood"/>
+  <feature var="http://jabber.org/protocol/mood+notify"/>
+  <feature var="http://jabber.org/protocol/rosterx"/>
+  <feature var="http://jabber.org/protocol/si"/>
+  <feature var="http://jabber.org/protocol/si/profile/file-transfer"/>
+  <feature var="http://jabber.org/protocol/tune"/>
+  <feature var="http://www.facebook.com/xmpp/messages"/>
+  <feature var="http://www.xmpp.org/extensions/xep-0084.html#ns-metadata+notify"/>
+  <feature var="jabber:iq:avatar"/>
+  <feature var="jabber:iq:browse"/>
+  <feature var="jabber:iq:dtcp"/>
+  <feature var="jabber:iq:filexfer"/>
+  <feature var="jabber:iq:ibb"/>
+  <feature var="jabber:iq:inband"/>
+  <feature var="jabber:iq:jidlink"/>
+  <feature var="jabber:iq:last"/>
+  <feature var="jabber:iq:oob"/>
+  <feature var="jabber:iq:privacy"/>
+  <feature var="jabber:iq:roster"/>
+  <feature var="jabber:iq:time"/>
+  <feature var="jabber:iq:version"/>
+  <feature var="jabber:x:data"/>
+  <feature var="jabber:x:event"/>
+  <feature var="jabber:x:oob"/>
+  <feature var="urn:xmpp:avatar:metadata+notify"/>
+  <feature var="urn:xmpp:ping"/>
+  <feature var="urn:xmpp:receipts"/>
+  <feature var="urn:xmpp:time"/>
+  <x xmlns="jabber:x:data" type="result">
+    <field type="hidden" var="FORM_TYPE">
+      <value>urn:xmpp:dataforms:softwareinfo</value>
+    </field>
+    <field var="software">
+      <value>Tkabber</value>
+    </field>
+    <field var="software_version">
+      <value>0.11.1-svn-20111216-mod (Tcl/Tk 8.6b2)</value>
+    </field>
+    <field var="os">
+      <value>Windows</value>
+    </field>
+    <field var="os_version">
+      <value>XP</value>
+    </field>
+  </x>
+</query>`,
+		sha256:  "u79ZroNJbdSWhdSp311mddz44oHHPsEBntQ5b1jqBSY=",
+		sha3256: "XpUJzLAc93258sMECZ3FJpebkzuyNXDzRNwQog8eycg=",
+	},
+}
+
+func TestHash2(t *testing.T) {
+	for i, tc := range hash2TestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var discoInfo disco.Info
+			err := xml.NewDecoder(strings.NewReader(tc.info)).Decode(&discoInfo)
+			if err != nil {
+				t.Fatalf("error decoding info: %v", err)
+			}
+			if h := discoInfo.Hash2(sha256.New()); h != tc.sha256 {
+				t.Errorf("wrong sha-256 hash: want=%s, got=%s", tc.sha256, h)
+			}
+			if h := discoInfo.Hash2(sha3.New256()); h != tc.sha3256 {
+				t.Errorf("wrong sha3-256 hash: want=%s, got=%s", tc.sha3256, h)
+			}
+			b := discoInfo.AppendHash2([]byte("prefix"), sha256.New())
+			if s := string(b); s != "prefix"+tc.sha256 {
+				t.Errorf("wrong appended hash: want=%s, got=%s", "prefix"+tc.sha256, s)
+			}
+
+			caps := disco.Caps2{Hashes: []disco.Caps2Hash{
+				{Algo: "sha-256", Value: tc.sha256},
+				{Algo: "sha3-256", Value: tc.sha3256},
+				{Algo: "unknown", Value: "ignored"},
+			}}
+			if !caps.Verify(discoInfo) {
+				t.Errorf("expected info to verify")
+			}
+			caps.Hashes[1].Value = tc.sha256
+			if caps.Verify(discoInfo) {
+				t.Errorf("info should not verify if any supported hash does not match")
+			}
+			if (disco.Caps2{Hashes: []disco.Caps2Hash{{Algo: "unknown", Value: tc.sha256}}}).Verify(discoInfo) {
+				t.Errorf("info should not verify if no hash is supported")
+			}
+		})
+	}
+}
+
+func TestCaps2Blake2b(t *testing.T) {
+	var discoInfo disco.Info
+	err := xml.NewDecoder(strings.NewReader(hash2TestCases[0].info)).Decode(&discoInfo)
+	if err != nil {
+		t.Fatalf("error decoding info: %v", err)
+	}
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		t.Fatalf("error creating hash: %v", err)
+	}
+	const expected = "2KmRi7KnEZXxIhhASXGRFad6XmCSjHaCYZiopMSYIoI="
+	if v := discoInfo.Hash2(h); v != expected {
+		t.Errorf("wrong blake2b-256 hash: want=%s, got=%s", expected, v)
+	}
+	caps := disco.Caps2{Hashes: []disco.Caps2Hash{{Algo: "blake2b-256", Value: expected}}}
+	if !caps.Verify(discoInfo) {
+		t.Errorf("expected info to verify")
+	}
+}
+
+func TestCaps2Encode(t *testing.T) {
+	caps := disco.Caps2{Hashes: []disco.Caps2Hash{
+		{Algo: "sha-256", Value: "a"},
+		{Algo: "sha3-256", Value: "b"},
+	}}
+	xmpptest.RunEncodingTests(t, []xmpptest.EncodingTestCase{{
+		Value:       &caps,
+		XML:         `<c xmlns="urn:xmpp:caps"><hash xmlns="urn:xmpp:hashes:2" algo="sha-256">a</hash><hash xmlns="urn:xmpp:hashes:2" algo="sha3-256">b</hash></c>`,
+		NoUnmarshal: true,
+	}})
+
+	var decoded disco.Caps2
+	err := xml.Unmarshal([]byte(`<c xmlns="urn:xmpp:caps"><hash xmlns="urn:xmpp:hashes:2" algo="sha-256">a</hash><hash xmlns="urn:xmpp:hashes:2" algo="sha3-256">b</hash></c>`), &decoded)
+	if err != nil {
+		t.Fatalf("error decoding caps: %v", err)
+	}
+	if len(decoded.Hashes) != 2 || decoded.Hashes[0] != caps.Hashes[0] || decoded.Hashes[1] != caps.Hashes[1] {
+		t.Errorf("wrong hashes decoded: want=%v, got=%v", caps.Hashes, decoded.Hashes)
+	}
+}
+
+func TestNewCaps2BadHash(t *testing.T) {
+	m := mux.New(stanza.NSClient)
+	_, err := disco.NewCaps2(m, m, m, crypto.SHA1)
+	if err == nil {
+		t.Errorf("expected error when using an unsupported hash")
+	}
+	_, err = disco.NewCaps2(m, m, m)
+	if err == nil {
+		t.Errorf("expected error when using no hashes")
+	}
+}
+
+func TestInsertCaps2(t *testing.T) {
+	m := mux.New(stanza.NSClient, mux.Handle(xml.Name{Local: "caps"}, capsHandler{}))
+	caps, err := disco.NewCaps2(m, m, m, crypto.SHA256, crypto.BLAKE2b_256)
+	if err != nil {
+		t.Fatalf("unexpected error creating caps: %v", err)
+	}
+
+	const in = `<presence xmlns="jabber:client"></presence><presence xmlns="jabber:client" type="unavailable"></presence>`
+	r := disco.InsertCaps2(m, crypto.SHA256, crypto.BLAKE2b_256)(xml.NewDecoder(strings.NewReader(in)))
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err = xmlstream.Copy(e, r)
+	if err != nil {
+		t.Fatalf("unexpected error transforming stream: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	expected := `<presence xmlns="jabber:client" xmlns="jabber:client"><c xmlns="urn:xmpp:caps"><hash xmlns="urn:xmpp:hashes:2" algo="sha-256">` + caps.Hashes[0].Value + `</hash><hash xmlns="urn:xmpp:hashes:2" algo="blake2b-256">` + caps.Hashes[1].Value + `</hash></c></presence><presence xmlns="jabber:client" xmlns="jabber:client" type="unavailable"></presence>`
+	if out := b.String(); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+func TestCaps2NodeRoundTrip(t *testing.T) {
+	m := mux.New(
+		stanza.NSClient,
+		disco.Handle(),
+		mux.Handle(xml.Name{Local: "caps"}, capsHandler{}),
+	)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(m),
+	)
+	caps, err := disco.NewCaps2(m, m, m, crypto.SHA256, crypto.SHA3_256)
+	if err != nil {
+		t.Fatalf("unexpected error creating caps: %v", err)
+	}
+
+	for _, h := range caps.Hashes {
+		info, err := disco.GetInfoIQ(context.Background(), h.Node(), stanza.IQ{ID: "123"}, cs.Client)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if info.Node != h.Node() {
+			t.Errorf("wrong node: want=%s, got=%s", h.Node(), info.Node)
+		}
+		if !caps.Verify(info) {
+			t.Errorf("response to %s query did not verify: %+v", h.Node(), info)
+		}
+	}
+}
+
+func TestCaps2Feature(t *testing.T) {
+	caps := disco.Caps2{Hashes: []disco.Caps2Hash{{Algo: "sha-256", Value: "a"}}}
+	feature := disco.Caps2Feature(caps)
+
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	req, err := feature.List(context.Background(), e, xml.StartElement{Name: feature.Name})
+	if err != nil {
+		t.Fatalf("error listing feature: %v", err)
+	}
+	if req {
+		t.Errorf("informational feature should not be required")
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+
+	d := xml.NewDecoder(&buf)
+	tok, err := d.Token()
+	if err != nil {
+		t.Fatalf("error popping start token: %v", err)
+	}
+	start := tok.(xml.StartElement)
+	_, data, err := feature.Parse(context.Background(), d, &start)
+	if err != nil {
+		t.Fatalf("error parsing feature: %v", err)
+	}
+	parsed, ok := data.(disco.Caps2)
+	if !ok {
+		t.Fatalf("wrong type of parsed data: %T", data)
+	}
+	if len(parsed.Hashes) != 1 || parsed.Hashes[0] != caps.Hashes[0] {
+		t.Errorf("wrong parsed caps: want=%v, got=%v", caps.Hashes, parsed.Hashes)
+	}
+}
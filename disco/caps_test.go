@@ -0,0 +1,268 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha1"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = disco.Caps{}
+	_ xmlstream.Marshaler = disco.Caps{}
+	_ xmlstream.WriterTo  = disco.Caps{}
+)
+
+var hashTestCases = [...]struct {
+	info string
+	ver  string
+}{
+	0: {
+		// XEP-0115 §5.2 Simple Generation Example
+		info: `<query xmlns='http://jabber.org/protocol/disco#info'>
+  <identity category='client' name='Exodus 0.9.1' type='pc'/>
+  <feature var='http://jabber.org/protocol/caps'/>
+  <feature var='http://jabber.org/protocol/disco#info'/>
+  <feature var='http://jabber.org/protocol/disco#items'/>
+  <feature var='http://jabber.org/protocol/muc'/>
+</query>`,
+		ver: "QgayPKawpkPSDYmwT/WM94uAlu0=",
+	},
+	1: {
+		// XEP-0115 §5.3 Complex Generation Example
+		info: `<query xmlns='http://jabber.org/protocol/disco#info'>
+  <identity xml:lang='en' category='client' name='Psi 0.11' type='pc'/>
+  <identity xml:lang='el' category='client' name='Ψ 0.11' type='pc'/>
+  <feature var='http://jabber.org/protocol/caps'/>
+  <feature var='http://jabber.org/protocol/disco#info'/>
+  <feature var='http://jabber.org/protocol/disco#items'/>
+  <feature var='http://jabber.org/protocol/muc'/>
+  <x xmlns='jabber:x:data' type='result'>
+    <field var='FORM_TYPE' type='hidden'>
+      <value>urn:xmpp:dataforms:softwareinfo</value>
+    </field>
+    <field var='ip_version'>
+      <value>ipv4</value>
+      <value>ipv6</value>
+    </field>
+    <field var='os'>
+      <value>Mac</value>
+    </field>
+    <field var='os_version'>
+      <value>10.5.1</value>
+    </field>
+    <field var='software'>
+      <value>Psi</value>
+    </field>
+    <field var='software_version'>
+      <value>0.11</value>
+    </field>
+  </x>
+</query>`,
+		ver: "q07IKJEyjvHSyhy//CH0CxmKi8w=",
+	},
+	2: {
+		// Order and duplicates do not matter, forms without a FORM_TYPE are
+		// ignored.
+		info: `<query xmlns='http://jabber.org/protocol/disco#info'>
+  <feature var='http://jabber.org/protocol/muc'/>
+  <feature var='http://jabber.org/protocol/disco#items'/>
+  <feature var='http://jabber.org/protocol/disco#info'/>
+  <feature var='http://jabber.org/protocol/caps'/>
+  <feature var='http://jabber.org/protocol/muc'/>
+  <identity category='client' name='Exodus 0.9.1' type='pc'/>
+  <x xmlns='jabber:x:data' type='result'>
+    <field var='os'>
+      <value>Mac</value>
+    </field>
+  </x>
+</query>`,
+		ver: "QgayPKawpkPSDYmwT/WM94uAlu0=",
+	},
+}
+
+func TestHash(t *testing.T) {
+	for i, tc := range hashTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var discoInfo disco.Info
+			err := xml.NewDecoder(strings.NewReader(tc.info)).Decode(&discoInfo)
+			if err != nil {
+				t.Fatalf("error decoding info: %v", err)
+			}
+			if ver := discoInfo.Hash(sha1.New()); ver != tc.ver {
+				t.Errorf("wrong hash: want=%s, got=%s", tc.ver, ver)
+			}
+			prefix := []byte("prefix")
+			b := discoInfo.AppendHash(prefix, sha1.New())
+			if s := string(b); s != "prefix"+tc.ver {
+				t.Errorf("wrong appended hash: want=%s, got=%s", "prefix"+tc.ver, s)
+			}
+		})
+	}
+}
+
+type capsHandler struct{}
+
+func (capsHandler) HandleXMPP(xmlstream.TokenReadEncoder, *xml.StartElement) error {
+	panic("should not be called")
+}
+
+func (capsHandler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(info.Feature{Var: "urn:example"})
+}
+
+func (capsHandler) ForIdentities(node string, f func(info.Identity) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(disco.ClientBot)
+}
+
+func (capsHandler) ForForms(node string, f func(*form.Data) error) error {
+	if node != "" {
+		return nil
+	}
+	return f(form.New(
+		form.Result,
+		form.Hidden("FORM_TYPE", form.Value("urn:example:form")),
+		form.Text("field", form.Value("value")),
+	))
+}
+
+func TestMuxHash(t *testing.T) {
+	m := mux.New(stanza.NSClient, mux.Handle(xml.Name{Local: "caps"}, capsHandler{}))
+	ver, err := disco.Hash(sha1.New(), m, m, m)
+	if err != nil {
+		t.Fatalf("unexpected error hashing mux: %v", err)
+	}
+	// client/bot//<urn:example<urn:example:form<field<value<
+	const expected = "i7CDZ5dYQJ+slw+UV+wjZAIiLcc="
+	if ver != expected {
+		t.Errorf("wrong hash: want=%s, got=%s", expected, ver)
+	}
+}
+
+func TestInsertCaps(t *testing.T) {
+	m := mux.New(stanza.NSClient, mux.Handle(xml.Name{Local: "caps"}, capsHandler{}))
+	caps, err := disco.NewCaps("https://mellium.im", crypto.SHA1, m, m, m)
+	if err != nil {
+		t.Fatalf("unexpected error creating caps: %v", err)
+	}
+
+	const in = `<presence xmlns="jabber:client"></presence><presence xmlns="jabber:client" type="unavailable"></presence><message xmlns="jabber:client"></message>`
+	r := disco.InsertCaps(m, "https://mellium.im", crypto.SHA1)(xml.NewDecoder(strings.NewReader(in)))
+	var b strings.Builder
+	e := xml.NewEncoder(&b)
+	_, err = xmlstream.Copy(e, r)
+	if err != nil {
+		t.Fatalf("unexpected error transforming stream: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	expected := `<presence xmlns="jabber:client" xmlns="jabber:client"><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://mellium.im" ver="` + caps.Ver + `"></c></presence><presence xmlns="jabber:client" xmlns="jabber:client" type="unavailable"></presence><message xmlns="jabber:client" xmlns="jabber:client"></message>`
+	if out := b.String(); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+func TestInsertCapsBadHash(t *testing.T) {
+	m := mux.New(stanza.NSClient)
+	r := disco.InsertCaps(m, "https://mellium.im", crypto.MD5)(xml.NewDecoder(strings.NewReader(`<presence xmlns="jabber:client"/>`)))
+	_, err := xmlstream.Copy(xmlstream.Discard(), r)
+	if err == nil {
+		t.Errorf("expected error when using an unsupported hash")
+	}
+}
+
+// countingCapsHandler is a capsHandler that counts how many times the
+// features of the root node are iterated over.
+type countingCapsHandler struct {
+	capsHandler
+	root *int32
+}
+
+func (h countingCapsHandler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node == "" {
+		atomic.AddInt32(h.root, 1)
+	}
+	return h.capsHandler.ForFeatures(node, f)
+}
+
+func TestCapsNodeHashedOnce(t *testing.T) {
+	var root int32
+	m := mux.New(
+		stanza.NSClient,
+		disco.Handle(),
+		mux.Handle(xml.Name{Local: "caps"}, countingCapsHandler{root: &root}),
+	)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(m),
+	)
+	for i := 0; i < 3; i++ {
+		_, err := disco.GetInfo(context.Background(), "https://mellium.im#"+strconv.Itoa(i), cs.Server.LocalAddr(), cs.Client)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&root); n != 1 {
+		t.Errorf("root node should only be hashed once: want=1, got=%d", n)
+	}
+}
+
+func TestCapsNodeRoundTrip(t *testing.T) {
+	m := mux.New(
+		stanza.NSClient,
+		disco.Handle(),
+		mux.Handle(xml.Name{Local: "caps"}, capsHandler{}),
+	)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(m),
+	)
+	caps, err := disco.NewCaps("https://mellium.im", crypto.SHA1, m, m, m)
+	if err != nil {
+		t.Fatalf("unexpected error creating caps: %v", err)
+	}
+
+	info, err := disco.GetInfoIQ(context.Background(), caps.Node+"#"+caps.Ver, stanza.IQ{ID: "123"}, cs.Client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info.Node != caps.Node+"#"+caps.Ver {
+		t.Errorf("wrong node: want=%s, got=%s", caps.Node+"#"+caps.Ver, info.Node)
+	}
+	if len(info.Features) != 2 {
+		t.Errorf("wrong number of features: want=2, got=%d", len(info.Features))
+	}
+	if ver := info.Hash(sha1.New()); ver != caps.Ver {
+		t.Errorf("response to node#ver query hashed to wrong value: want=%s, got=%s", caps.Ver, ver)
+	}
+
+	info, err = disco.GetInfoIQ(context.Background(), caps.Node+"#badver", stanza.IQ{ID: "123"}, cs.Client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(info.Features) != 0 {
+		t.Errorf("got unexpected features for unknown caps node: %v", info.Features)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// ErrCapsVerify is returned when the info returned by an entity does not match
+// the entity caps it advertised.
+var ErrCapsVerify = errors.New("disco: entity caps verification failed")
+
+// ErrCapsHash is returned when entity caps use a hash function that is not
+// supported so the info they represent cannot be verified.
+var ErrCapsHash = errors.New("disco: entity caps use an unsupported hash")
+
+func capsHashByName(name string) (crypto.Hash, bool) {
+	for _, c := range capsHashes {
+		if c.Name == name {
+			return c.Hash, true
+		}
+	}
+	return 0, false
+}
+
+// Verify reports whether the info is well formed and hashes to the
+// verification string advertised in the caps.
+// If the caps use a hash that is not supported, Verify returns false.
+func (c Caps) Verify(i Info) bool {
+	h, ok := capsHashByName(c.Hash)
+	if !ok || !h.Available() || !capsWellFormed(i) {
+		return false
+	}
+	return i.Hash(h.New()) == c.Ver
+}
+
+// capsWellFormed reports whether the info is free from the problems that
+// XEP-0115 §5.4 requires us to reject, namely duplicate identities, features,
+// or forms and forms with an invalid FORM_TYPE.
+func capsWellFormed(i Info) bool {
+	seen := make(map[string]struct{})
+	for _, ident := range i.Identity {
+		key := ident.Category + "/" + ident.Type + "/" + ident.Lang + "/" + ident.Name
+		if _, ok := seen[key]; ok {
+			return false
+		}
+		seen[key] = struct{}{}
+	}
+	for k := range seen {
+		delete(seen, k)
+	}
+	for _, f := range i.Features {
+		if _, ok := seen[f.Var]; ok {
+			return false
+		}
+		seen[f.Var] = struct{}{}
+	}
+	for k := range seen {
+		delete(seen, k)
+	}
+	for n := range i.Form {
+		typ, ok := i.Form[n].Raw(formType)
+		if !ok {
+			continue
+		}
+		if len(typ) != 1 {
+			return false
+		}
+		if _, ok := seen[typ[0]]; ok {
+			return false
+		}
+		seen[typ[0]] = struct{}{}
+	}
+	return true
+}
+
+// CapsStore is the interface implemented by types that can persist the info
+// associated with entity caps.
+// Implementations must be safe for concurrent use by multiple goroutines.
+type CapsStore interface {
+	// GetCaps returns the info previously stored for the hash and verification
+	// string.
+	// If no info is stored, ok will be false.
+	GetCaps(hash, ver string) (i Info, ok bool, err error)
+
+	// PutCaps stores the info for the hash and verification string.
+	PutCaps(hash, ver string, i Info) error
+}
+
+// MemCapsStore is a CapsStore that keeps info in memory.
+// The zero value is ready to use.
+type MemCapsStore struct {
+	m    sync.RWMutex
+	info map[string]Info
+}
+
+// GetCaps implements CapsStore.
+func (s *MemCapsStore) GetCaps(hash, ver string) (Info, bool, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	i, ok := s.info[hash+" "+ver]
+	return i, ok, nil
+}
+
+// PutCaps implements CapsStore.
+func (s *MemCapsStore) PutCaps(hash, ver string, i Info) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.info == nil {
+		s.info = make(map[string]Info)
+	}
+	s.info[hash+" "+ver] = i
+	return nil
+}
+
+// FileCapsStore is a CapsStore that persists each info as an XML file in Dir.
+// The directory must already exist.
+type FileCapsStore struct {
+	Dir string
+}
+
+func (s FileCapsStore) path(hash, ver string) string {
+	return filepath.Join(s.Dir, base64.RawURLEncoding.EncodeToString([]byte(hash+" "+ver))+".xml")
+}
+
+// GetCaps implements CapsStore.
+func (s FileCapsStore) GetCaps(hash, ver string) (Info, bool, error) {
+	var i Info
+	f, err := os.Open(s.path(hash, ver))
+	if errors.Is(err, os.ErrNotExist) {
+		return i, false, nil
+	}
+	if err != nil {
+		return i, false, err
+	}
+	/* #nosec */
+	defer f.Close()
+	err = xml.NewDecoder(f).Decode(&i)
+	if err != nil {
+		return i, false, err
+	}
+	return i, true, nil
+}
+
+// PutCaps implements CapsStore.
+// The info is written to a temporary file first and then renamed so that
+// partially written files are never read.
+func (s FileCapsStore) PutCaps(hash, ver string, i Info) error {
+	f, err := os.CreateTemp(s.Dir, "caps")
+	if err != nil {
+		return err
+	}
+	e := xml.NewEncoder(f)
+	err = e.Encode(i)
+	if err == nil {
+		err = e.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		/* #nosec */
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path(hash, ver))
+}
+
+type capsCall struct {
+	done chan struct{}
+	info Info
+	err  error
+}
+
+// HandleCaps returns an option that registers a CapsCache to track the entity
+// caps advertised in incoming presence.
+//
+// Unavailable presence is not handled so that registering the option does not
+// conflict with other handlers for all unavailable presence, such as
+// presence.Handle.
+// To forget the caps of entities that go offline, pass unavailable presence to
+// Track from the handler that receives it, or set the CapsCache as the Next
+// handler of a presence.Tracker.
+//
+// If a Cache with its Caps field set to c is registered using HandleCache, the
+// CapsCache is updated with the same presence and HandleCaps should not also be
+// registered on the multiplexer.
+func HandleCaps(c *CapsCache) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.Presence(stanza.AvailablePresence, xml.Name{Space: NSCaps, Local: "c"}, c)(m)
+	}
+}
+
+// CapsCache maps entity caps to the service discovery info that they
+// represent, fetching and verifying unknown caps as necessary.
+// It can also keep track of the caps advertised by each entity in incoming
+// presence stanzas if registered with a multiplexer using HandleCaps.
+//
+// A single CapsCache may be shared between multiple sessions.
+type CapsCache struct {
+	store CapsStore
+
+	m        sync.Mutex
+	inflight map[string]*capsCall
+	presence map[string]Caps
+}
+
+// NewCapsCache returns a new cache that persists info to the provided store.
+// If store is nil, a MemCapsStore is used.
+func NewCapsCache(store CapsStore) *CapsCache {
+	if store == nil {
+		store = &MemCapsStore{}
+	}
+	return &CapsCache{
+		store:    store,
+		inflight: make(map[string]*capsCall),
+		presence: make(map[string]Caps),
+	}
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (c *CapsCache) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	switch p.Type {
+	case stanza.AvailablePresence:
+		v := struct {
+			stanza.Presence
+			Caps Caps `xml:"http://jabber.org/protocol/caps c"`
+		}{}
+		err := xml.NewTokenDecoder(r).Decode(&v)
+		if err != nil {
+			return err
+		}
+		c.track(p, v.Caps)
+	case stanza.UnavailablePresence:
+		c.track(p, Caps{})
+	}
+	return nil
+}
+
+// Track forgets the caps of an entity when it sends unavailable presence.
+// Other presence is ignored, available presence containing caps must be passed
+// to HandlePresence instead.
+func (c *CapsCache) Track(p stanza.Presence) {
+	if p.Type == stanza.UnavailablePresence {
+		c.track(p, Caps{})
+	}
+}
+
+// track records the caps sent in an available presence or forgets the caps of
+// an entity that has gone unavailable.
+func (c *CapsCache) track(p stanza.Presence, caps Caps) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	switch {
+	case p.Type == stanza.UnavailablePresence:
+		delete(c.presence, p.From.String())
+	case p.Type == stanza.AvailablePresence && caps.Ver != "":
+		c.presence[p.From.String()] = caps
+	}
+}
+
+// Caps returns the last entity caps advertised by the provided JID in an
+// available presence.
+// If the JID is not available or did not advertise caps, ok will be false.
+func (c *CapsCache) Caps(j jid.JID) (caps Caps, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	caps, ok = c.presence[j.String()]
+	return caps, ok
+}
+
+// Lookup returns the info associated with the provided caps.
+// If the info is not in the store, it is requested from the JID that
+// advertised the caps and verified before being stored.
+// If verification fails, ErrCapsVerify is returned.
+// If the caps use a hash that is not supported the info cannot be verified and
+// ErrCapsHash is returned without making a request.
+//
+// Concurrent lookups of the same caps result in a single request.
+// If the context of the lookup that made the request is canceled, the others
+// make the request again instead of failing with its error.
+func (c *CapsCache) Lookup(ctx context.Context, caps Caps, from jid.JID, s *xmpp.Session) (Info, error) {
+	if h, ok := capsHashByName(caps.Hash); !ok || !h.Available() {
+		return Info{}, ErrCapsHash
+	}
+
+	i, ok, err := c.store.GetCaps(caps.Hash, caps.Ver)
+	if err != nil || ok {
+		return i, err
+	}
+
+	for {
+		call, leader := c.call(caps)
+		if leader {
+			call.info, call.err = c.fetch(ctx, caps, from, s)
+			c.m.Lock()
+			delete(c.inflight, caps.Hash+" "+caps.Ver)
+			c.m.Unlock()
+			close(call.done)
+			return call.info, call.err
+		}
+		select {
+		case <-call.done:
+			if ctxErr(call.err) && ctx.Err() == nil {
+				continue
+			}
+			return call.info, call.err
+		case <-ctx.Done():
+			return Info{}, ctx.Err()
+		}
+	}
+}
+
+// call returns the in flight request for the caps or, if there is none, starts
+// a new one in which case leader is true and the caller must make the request.
+func (c *CapsCache) call(caps Caps) (call *capsCall, leader bool) {
+	key := caps.Hash + " " + caps.Ver
+	c.m.Lock()
+	defer c.m.Unlock()
+	call, ok := c.inflight[key]
+	if ok {
+		return call, false
+	}
+	call = &capsCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	return call, true
+}
+
+func (c *CapsCache) fetch(ctx context.Context, caps Caps, from jid.JID, s *xmpp.Session) (Info, error) {
+	i, err := GetInfo(ctx, caps.Node+"#"+caps.Ver, from, s)
+	if err != nil {
+		return i, err
+	}
+	if !caps.Verify(i) {
+		return Info{}, ErrCapsVerify
+	}
+	return i, c.store.PutCaps(caps.Hash, caps.Ver, i)
+}
+
+// Supports reports whether the provided JID advertised support for a feature
+// in its entity caps.
+// The JID should normally be a full JID.
+// If the JID has not sent an available presence containing entity caps, false
+// is returned.
+func (c *CapsCache) Supports(ctx context.Context, j jid.JID, feature string, s *xmpp.Session) (bool, error) {
+	caps, ok := c.Caps(j)
+	if !ok {
+		return false, nil
+	}
+	i, err := c.Lookup(ctx, caps, j, s)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range i.Features {
+		if f.Var == feature {
+			return true, nil
+		}
+	}
+	return false, nil
+}
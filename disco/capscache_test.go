@@ -0,0 +1,221 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"context"
+	"crypto"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/presence"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ disco.CapsStore = (*disco.MemCapsStore)(nil)
+	_ disco.CapsStore = disco.FileCapsStore{}
+)
+
+type nopEncoder struct {
+	xml.TokenReader
+}
+
+func (nopEncoder) Encode(interface{}) error                          { return nil }
+func (nopEncoder) EncodeElement(interface{}, xml.StartElement) error { return nil }
+func (nopEncoder) EncodeToken(xml.Token) error                       { return nil }
+
+type countingStore struct {
+	disco.MemCapsStore
+	m    sync.Mutex
+	puts int
+}
+
+func (s *countingStore) PutCaps(hash, ver string, i disco.Info) error {
+	s.m.Lock()
+	s.puts++
+	s.m.Unlock()
+	return s.MemCapsStore.PutCaps(hash, ver, i)
+}
+
+func testCapsStore(t *testing.T, store disco.CapsStore) {
+	_, ok, err := store.GetCaps("sha-1", "QgayPKawpkPSDYmwT/WM94uAlu0=")
+	if err != nil {
+		t.Fatalf("unexpected error getting missing caps: %v", err)
+	}
+	if ok {
+		t.Fatalf("got caps from empty store")
+	}
+
+	var discoInfo disco.Info
+	err = xml.NewDecoder(strings.NewReader(hashTestCases[1].info)).Decode(&discoInfo)
+	if err != nil {
+		t.Fatalf("error decoding info: %v", err)
+	}
+	err = store.PutCaps("sha-1", hashTestCases[1].ver, discoInfo)
+	if err != nil {
+		t.Fatalf("unexpected error storing caps: %v", err)
+	}
+	stored, ok, err := store.GetCaps("sha-1", hashTestCases[1].ver)
+	if err != nil {
+		t.Fatalf("unexpected error getting caps: %v", err)
+	}
+	if !ok {
+		t.Fatalf("stored caps not found")
+	}
+	caps := disco.Caps{Hash: "sha-1", Ver: hashTestCases[1].ver}
+	if !caps.Verify(stored) {
+		t.Errorf("stored info does not match caps, got features=%v, identities=%v, forms=%d", stored.Features, stored.Identity, len(stored.Form))
+	}
+}
+
+func TestMemCapsStore(t *testing.T) {
+	testCapsStore(t, &disco.MemCapsStore{})
+}
+
+func TestFileCapsStore(t *testing.T) {
+	testCapsStore(t, disco.FileCapsStore{Dir: t.TempDir()})
+}
+
+func TestVerify(t *testing.T) {
+	var discoInfo disco.Info
+	err := xml.NewDecoder(strings.NewReader(hashTestCases[0].info)).Decode(&discoInfo)
+	if err != nil {
+		t.Fatalf("error decoding info: %v", err)
+	}
+	caps := disco.Caps{Hash: "sha-1", Ver: hashTestCases[0].ver}
+	if !caps.Verify(discoInfo) {
+		t.Errorf("expected info to verify")
+	}
+	if (disco.Caps{Hash: "md5", Ver: hashTestCases[0].ver}).Verify(discoInfo) {
+		t.Errorf("info with unsupported hash should not verify")
+	}
+	if (disco.Caps{Hash: "sha-1", Ver: "badver"}).Verify(discoInfo) {
+		t.Errorf("info with wrong ver should not verify")
+	}
+
+	// Duplicate features hash to the same value but must be rejected.
+	discoInfo.Features = append(discoInfo.Features, discoInfo.Features[0])
+	if caps.Verify(discoInfo) {
+		t.Errorf("info with duplicate features should not verify")
+	}
+}
+
+func TestCapsCache(t *testing.T) {
+	m := mux.New(
+		stanza.NSClient,
+		disco.Handle(),
+		mux.Handle(xml.Name{Local: "caps"}, capsHandler{}),
+	)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(m),
+	)
+	caps, err := disco.NewCaps("https://mellium.im", crypto.SHA1, m, m, m)
+	if err != nil {
+		t.Fatalf("unexpected error creating caps: %v", err)
+	}
+
+	store := &countingStore{}
+	cache := disco.NewCapsCache(store)
+	clientMux := mux.New(stanza.NSClient, disco.HandleCaps(cache))
+
+	from := jid.MustParse("me@example.net/mellium")
+	presence := `<presence xmlns="jabber:client" from="` + from.String() + `"><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://mellium.im" ver="` + caps.Ver + `"/></presence>`
+	d := xml.NewDecoder(strings.NewReader(presence))
+	tok, _ := d.Token()
+	start := tok.(xml.StartElement)
+	err = clientMux.HandleXMPP(nopEncoder{TokenReader: d}, &start)
+	if err != nil {
+		t.Fatalf("unexpected error handling presence: %v", err)
+	}
+	if tracked, ok := cache.Caps(from); !ok || tracked.Ver != caps.Ver || tracked.Hash != caps.Hash || tracked.Node != caps.Node {
+		t.Fatalf("wrong caps tracked: want=%v, got=%v (%t)", caps, tracked, ok)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := cache.Supports(context.Background(), from, "urn:example", cs.Client)
+			if err != nil {
+				t.Errorf("unexpected error checking feature support: %v", err)
+			}
+			if !ok {
+				t.Errorf("expected feature to be supported")
+			}
+		}()
+	}
+	wg.Wait()
+	if store.puts != 1 {
+		t.Errorf("wrong number of stored caps: want=1, got=%d", store.puts)
+	}
+
+	ok, err := cache.Supports(context.Background(), from, "urn:missing", cs.Client)
+	if err != nil {
+		t.Fatalf("unexpected error checking feature support: %v", err)
+	}
+	if ok {
+		t.Errorf("did not expect unadvertised feature to be supported")
+	}
+
+	_, err = cache.Lookup(context.Background(), disco.Caps{Hash: "sha-1", Node: "https://mellium.im", Ver: "badver"}, from, cs.Client)
+	if !errors.Is(err, disco.ErrCapsVerify) {
+		t.Errorf("wrong error for unverifiable caps: want=%v, got=%v", disco.ErrCapsVerify, err)
+	}
+
+	// Info for caps using an unknown hash can't be verified, so it must not be
+	// trusted.
+	_, err = cache.Lookup(context.Background(), disco.Caps{Hash: "md4", Node: "https://mellium.im", Ver: caps.Ver}, from, cs.Client)
+	if !errors.Is(err, disco.ErrCapsHash) {
+		t.Errorf("wrong error for unsupported hash: want=%v, got=%v", disco.ErrCapsHash, err)
+	}
+
+	cache.Track(stanza.Presence{From: from, Type: stanza.UnavailablePresence})
+	if _, ok := cache.Caps(from); ok {
+		t.Errorf("expected caps to be forgotten after unavailable presence")
+	}
+	ok, err = cache.Supports(context.Background(), from, "urn:example", cs.Client)
+	if err != nil || ok {
+		t.Errorf("expected unavailable entity not to support features, got %t, %v", ok, err)
+	}
+}
+
+func TestHandleCapsWithTracker(t *testing.T) {
+	cache := disco.NewCapsCache(nil)
+	tracker := &presence.Tracker{Next: cache}
+
+	// Registering both must not panic even though the caps are tracked through
+	// the tracker.
+	mux.New(stanza.NSClient, presence.Handle(tracker), disco.HandleCaps(cache))
+
+	m := mux.New(stanza.NSClient, presence.Handle(tracker))
+	from := jid.MustParse("me@example.net/mellium")
+	handle := func(p string) {
+		t.Helper()
+		d := xml.NewDecoder(strings.NewReader(p))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(nopEncoder{TokenReader: d}, &start)
+		if err != nil {
+			t.Fatalf("unexpected error handling presence: %v", err)
+		}
+	}
+	handle(`<presence xmlns="jabber:client" from="` + from.String() + `"><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://mellium.im" ver="ver"/></presence>`)
+	if _, ok := cache.Caps(from); !ok {
+		t.Errorf("caps were not tracked")
+	}
+	handle(`<presence xmlns="jabber:client" type="unavailable" from="` + from.String() + `"/>`)
+	if _, ok := cache.Caps(from); ok {
+		t.Errorf("expected caps to be forgotten after unavailable presence")
+	}
+}
@@ -5,11 +5,12 @@
 //go:generate go run gen.go
 //go:generate go run ../internal/genfeature -filename features.go -receiver "h *discoHandler" -vars Feature:NSInfo
 
-// Package disco implements service discovery.
+// Package disco implements service discovery and entity capabilities.
 package disco // import "mellium.im/xmpp/disco"
 
 // Namespaces used by this package.
 const (
 	NSInfo  = `http://jabber.org/protocol/disco#info`
 	NSItems = `http://jabber.org/protocol/disco#items`
+	NSCaps  = `http://jabber.org/protocol/caps`
 )
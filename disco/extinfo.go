@@ -0,0 +1,151 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco
+
+import (
+	"mellium.im/xmpp/form"
+)
+
+// Form types of common service discovery extensions.
+const (
+	// NSContactAddresses is the FORM_TYPE used by XEP-0157: Contact Addresses
+	// for XMPP Services.
+	NSContactAddresses = `http://jabber.org/network/serverinfo`
+
+	// NSSoftwareInfo is the FORM_TYPE used by XEP-0232: Software Information.
+	NSSoftwareInfo = `urn:xmpp:dataforms:softwareinfo`
+)
+
+// formTypeOf returns the value of the FORM_TYPE field of a form.
+// Forms without a FORM_TYPE, or with more than one value for the field, are
+// reported as not having a type.
+func formTypeOf(f *form.Data) (string, bool) {
+	typ, ok := f.Raw(formType)
+	if !ok || len(typ) != 1 || typ[0] == "" {
+		return "", false
+	}
+	return typ[0], true
+}
+
+// ContactAddresses is the service discovery extension used to advertise the
+// addresses that can be used to contact the operators of a service.
+// Each address should be a URI such as "mailto:abuse@example.net" or
+// "xmpp:admin@example.net".
+type ContactAddresses struct {
+	Abuse    []string
+	Admin    []string
+	Feedback []string
+	Sales    []string
+	Security []string
+	Status   []string
+	Support  []string
+}
+
+func (c *ContactAddresses) fields() []struct {
+	Var  string
+	Addr *[]string
+} {
+	return []struct {
+		Var  string
+		Addr *[]string
+	}{
+		{Var: "abuse-addresses", Addr: &c.Abuse},
+		{Var: "admin-addresses", Addr: &c.Admin},
+		{Var: "feedback-addresses", Addr: &c.Feedback},
+		{Var: "sales-addresses", Addr: &c.Sales},
+		{Var: "security-addresses", Addr: &c.Security},
+		{Var: "status-addresses", Addr: &c.Status},
+		{Var: "support-addresses", Addr: &c.Support},
+	}
+}
+
+// Form returns the contact addresses as a result form suitable for including
+// in a disco#info response.
+// Empty fields are omitted.
+func (c ContactAddresses) Form() *form.Data {
+	fields := []form.Field{
+		form.Result,
+		form.Hidden(formType, form.Value(NSContactAddresses)),
+	}
+	for _, f := range c.fields() {
+		if len(*f.Addr) == 0 {
+			continue
+		}
+		var opts []form.Option
+		for _, addr := range *f.Addr {
+			opts = append(opts, form.Value(addr))
+		}
+		fields = append(fields, form.ListMulti(f.Var, opts...))
+	}
+	return form.New(fields...)
+}
+
+// ParseContactAddresses extracts the contact addresses from a form.
+// If the form's FORM_TYPE is not NSContactAddresses, ok will be false.
+func ParseContactAddresses(f *form.Data) (c ContactAddresses, ok bool) {
+	if typ, ok := formTypeOf(f); !ok || typ != NSContactAddresses {
+		return c, false
+	}
+	for _, field := range c.fields() {
+		*field.Addr, _ = f.Raw(field.Var)
+	}
+	return c, true
+}
+
+// SoftwareInfo is the service discovery extension used to advertise
+// information about the software and operating system that an entity is
+// running.
+type SoftwareInfo struct {
+	OS              string
+	OSVersion       string
+	Software        string
+	SoftwareVersion string
+}
+
+func (s *SoftwareInfo) fields() []struct {
+	Var   string
+	Value *string
+} {
+	return []struct {
+		Var   string
+		Value *string
+	}{
+		{Var: "os", Value: &s.OS},
+		{Var: "os_version", Value: &s.OSVersion},
+		{Var: "software", Value: &s.Software},
+		{Var: "software_version", Value: &s.SoftwareVersion},
+	}
+}
+
+// Form returns the software information as a result form suitable for
+// including in a disco#info response.
+// Empty fields are omitted.
+func (s SoftwareInfo) Form() *form.Data {
+	fields := []form.Field{
+		form.Result,
+		form.Hidden(formType, form.Value(NSSoftwareInfo)),
+	}
+	for _, f := range s.fields() {
+		if *f.Value == "" {
+			continue
+		}
+		fields = append(fields, form.Text(f.Var, form.Value(*f.Value)))
+	}
+	return form.New(fields...)
+}
+
+// ParseSoftwareInfo extracts the software information from a form.
+// If the form's FORM_TYPE is not NSSoftwareInfo, ok will be false.
+func ParseSoftwareInfo(f *form.Data) (s SoftwareInfo, ok bool) {
+	if typ, ok := formTypeOf(f); !ok || typ != NSSoftwareInfo {
+		return s, false
+	}
+	for _, field := range s.fields() {
+		if v, ok := f.Raw(field.Var); ok && len(v) > 0 {
+			*field.Value = v[0]
+		}
+	}
+	return s, true
+}
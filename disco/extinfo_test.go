@@ -0,0 +1,99 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package disco_test
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/form"
+)
+
+func TestInfoMarshalForms(t *testing.T) {
+	i := disco.Info{
+		Form: []form.Data{*disco.SoftwareInfo{OS: "Plan 9"}.Form()},
+	}
+	b, err := xml.Marshal(i)
+	if err != nil {
+		t.Fatalf("error marshaling info: %v", err)
+	}
+	const expected = `<query xmlns="http://jabber.org/protocol/disco#info"><x xmlns="jabber:x:data" type="result"><field type="hidden" var="FORM_TYPE"><value>urn:xmpp:dataforms:softwareinfo</value></field><field type="text-single" var="os"><value>Plan 9</value></field></x></query>`
+	if out := string(b); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+func TestContactAddresses(t *testing.T) {
+	addrs := disco.ContactAddresses{
+		Abuse:   []string{"mailto:abuse@example.net", "xmpp:abuse@example.net"},
+		Support: []string{"https://example.net/support"},
+	}
+	b, err := xml.Marshal(addrs.Form())
+	if err != nil {
+		t.Fatalf("error marshaling form: %v", err)
+	}
+
+	var f form.Data
+	err = xml.Unmarshal(b, &f)
+	if err != nil {
+		t.Fatalf("error unmarshaling form: %v", err)
+	}
+	parsed, ok := disco.ParseContactAddresses(&f)
+	if !ok {
+		t.Fatalf("failed to parse contact addresses from %s", b)
+	}
+	if !reflect.DeepEqual(parsed, addrs) {
+		t.Errorf("wrong addresses: want=%+v, got=%+v", addrs, parsed)
+	}
+
+	if _, ok := disco.ParseSoftwareInfo(&f); ok {
+		t.Errorf("parsed software info from contact addresses form")
+	}
+}
+
+func TestParseSoftwareInfo(t *testing.T) {
+	// XEP-0232 §3 example form.
+	const formXML = `<x xmlns='jabber:x:data' type='result'>
+  <field var='FORM_TYPE' type='hidden'>
+    <value>urn:xmpp:dataforms:softwareinfo</value>
+  </field>
+  <field var='os'>
+    <value>Windows</value>
+  </field>
+  <field var='os_version'>
+    <value>XP</value>
+  </field>
+  <field var='software'>
+    <value>Exodus</value>
+  </field>
+  <field var='software_version'>
+    <value>0.9.1</value>
+  </field>
+</x>`
+	var f form.Data
+	err := xml.NewDecoder(strings.NewReader(formXML)).Decode(&f)
+	if err != nil {
+		t.Fatalf("error unmarshaling form: %v", err)
+	}
+	sw, ok := disco.ParseSoftwareInfo(&f)
+	if !ok {
+		t.Fatalf("failed to parse software info")
+	}
+	expected := disco.SoftwareInfo{
+		OS:              "Windows",
+		OSVersion:       "XP",
+		Software:        "Exodus",
+		SoftwareVersion: "0.9.1",
+	}
+	if sw != expected {
+		t.Errorf("wrong software info: want=%+v, got=%+v", expected, sw)
+	}
+	if _, ok := disco.ParseContactAddresses(&f); ok {
+		t.Errorf("parsed contact addresses from software info form")
+	}
+}
@@ -6,6 +6,8 @@ package disco
 
 import (
 	"encoding/xml"
+	"strings"
+	"sync"
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp/disco/info"
@@ -18,6 +20,15 @@ import (
 // Handle returns an option that configures a multiplexer to handle service
 // discovery requests by iterating over its own handlers and checking if they
 // implement info.FeatureIter, info.IdentityIter, form.Iter, or items.Iter.
+// Info requests for an entity caps node (of the form "node#ver") or an ECaps2
+// node (of the form "urn:xmpp:caps#algo.hash") where the hash matches the caps
+// calculated from the multiplexer are answered with the info of the root node.
+//
+// Forms returned by handlers that implement form.Iter are included in info
+// responses as extended information (XEP-0128).
+// They should be result forms (see form.Result) with a hidden FORM_TYPE field.
+// Forms without a FORM_TYPE are not sent and only the first form with any given
+// FORM_TYPE is sent.
 func Handle() mux.Option {
 	return func(m *mux.ServeMux) {
 		h := &discoHandler{ServeMux: m}
@@ -28,6 +39,43 @@ func Handle() mux.Option {
 
 type discoHandler struct {
 	ServeMux *mux.ServeMux
+
+	// The hashes of the root node are calculated the first time they are needed
+	// because the multiplexer is not done being built when Handle is called.
+	// Handlers can't be added to a multiplexer after it is built, so they never
+	// change after that.
+	hashOnce sync.Once
+	hashErr  error
+	vers     map[string]struct{}
+	nodes    map[string]struct{}
+}
+
+// rootNode reports whether node is an entity caps node ("node#ver") or an ECaps2
+// node ("urn:xmpp:caps#algo.hash") with one of our own hashes.
+func (h *discoHandler) rootNode(node string) (bool, error) {
+	h.hashOnce.Do(func() {
+		root, err := collectInfo("", h.ServeMux, h.ServeMux, h.ServeMux)
+		if err != nil {
+			h.hashErr = err
+			return
+		}
+		h.vers = make(map[string]struct{})
+		h.nodes = make(map[string]struct{})
+		capsVers(root, h.vers)
+		caps2Nodes(root, h.nodes)
+	})
+	if h.hashErr != nil {
+		return false, h.hashErr
+	}
+	if _, ok := h.nodes[node]; ok {
+		return true, nil
+	}
+	idx := strings.LastIndexByte(node, '#')
+	if idx == -1 {
+		return false, nil
+	}
+	_, ok := h.vers[node[idx+1:]]
+	return ok, nil
 }
 
 func (h *discoHandler) HandleXMPP(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
@@ -36,17 +84,31 @@ func (h *discoHandler) HandleXMPP(t xmlstream.TokenReadEncoder, start *xml.Start
 
 func (h *discoHandler) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
 	seen := make(map[string]struct{})
+	var node string
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "node" {
+			node = attr.Value
+			break
+		}
+	}
+	space := start.Name.Space
 	pr, pw := xmlstream.Pipe()
 	go func() {
-		var node string
-		for _, attr := range start.Attr {
-			if attr.Name.Local == "node" {
-				node = attr.Value
-				break
-			}
-		}
-		switch start.Name.Space {
+		switch space {
 		case NSInfo:
+			// Queries for "node#ver" or "urn:xmpp:caps#algo.hash" where the hash is
+			// one of our own entity caps hashes are answered with the info of the
+			// root node.
+			if node != "" {
+				ok, err := h.rootNode(node)
+				if err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				if ok {
+					node = ""
+				}
+			}
 			err := h.ServeMux.ForFeatures(node, func(f info.Feature) error {
 				_, ok := seen[f.Var]
 				if ok {
@@ -77,9 +139,19 @@ func (h *discoHandler) HandleIQ(iq stanza.IQ, r xmlstream.TokenReadEncoder, star
 				pw.CloseWithError(err)
 				return
 			}
+			for k := range seen {
+				delete(seen, k)
+			}
 			pw.CloseWithError(h.ServeMux.ForForms(node, func(f *form.Data) error {
-				result, _ := f.Submit()
-				_, err := xmlstream.Copy(pw, result)
+				typ, ok := formTypeOf(f)
+				if !ok {
+					return nil
+				}
+				if _, ok := seen[typ]; ok {
+					return nil
+				}
+				seen[typ] = struct{}{}
+				_, err := xmlstream.Copy(pw, f.TokenReader())
 				return err
 			}))
 		case NSItems:
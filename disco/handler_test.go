@@ -12,6 +12,7 @@ import (
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp/disco"
 	"mellium.im/xmpp/disco/items"
+	"mellium.im/xmpp/form"
 	"mellium.im/xmpp/internal/xmpptest"
 	"mellium.im/xmpp/mux"
 	"mellium.im/xmpp/stanza"
@@ -40,6 +41,58 @@ func TestFeaturesRoundTrip(t *testing.T) {
 	}
 }
 
+type formHandler struct{}
+
+func (formHandler) HandleXMPP(xmlstream.TokenReadEncoder, *xml.StartElement) error {
+	panic("should not be called")
+}
+
+func (formHandler) ForForms(node string, f func(*form.Data) error) error {
+	if node != "" {
+		return nil
+	}
+	err := f(disco.SoftwareInfo{Software: "Mellium", SoftwareVersion: "1.0"}.Form())
+	if err != nil {
+		return err
+	}
+	// Forms without a FORM_TYPE and duplicate forms must not be sent.
+	err = f(form.New(form.Result, form.Text("foo", form.Value("bar"))))
+	if err != nil {
+		return err
+	}
+	return f(disco.SoftwareInfo{Software: "Duplicate"}.Form())
+}
+
+func TestFormsRoundTrip(t *testing.T) {
+	m := mux.New(
+		stanza.NSClient,
+		disco.Handle(),
+		mux.Handle(xml.Name{}, formHandler{}),
+	)
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandler(m),
+	)
+
+	info, err := disco.GetInfoIQ(context.Background(), "", stanza.IQ{ID: "123"}, cs.Client)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(info.Form) != 1 {
+		t.Fatalf("wrong number of forms: want=1, got=%d", len(info.Form))
+	}
+	f, ok := info.FormByType(disco.NSSoftwareInfo)
+	if !ok {
+		t.Fatalf("software info form not found")
+	}
+	sw, ok := disco.ParseSoftwareInfo(f)
+	if !ok {
+		t.Fatalf("failed to parse software info")
+	}
+	if sw.Software != "Mellium" || sw.SoftwareVersion != "1.0" {
+		t.Errorf("wrong software info: %+v", sw)
+	}
+}
+
 type itemHandler struct{}
 
 func (itemHandler) HandleXMPP(xmlstream.TokenReadEncoder, *xml.StartElement) error {
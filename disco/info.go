@@ -57,6 +57,9 @@ func (i Info) TokenReader() xml.TokenReader {
 	for _, ident := range i.Identity {
 		payloads = append(payloads, ident.TokenReader())
 	}
+	for n := range i.Form {
+		payloads = append(payloads, i.Form[n].TokenReader())
+	}
 	return i.InfoQuery.wrap(xmlstream.MultiReader(payloads...))
 }
 
@@ -65,6 +68,23 @@ func (i Info) WriteXML(w xmlstream.TokenWriter) (int, error) {
 	return xmlstream.Copy(w, i.TokenReader())
 }
 
+// MarshalXML implements xml.Marshaler.
+func (i Info) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := i.WriteXML(e)
+	return err
+}
+
+// FormByType returns the first extended info form with a FORM_TYPE field
+// matching typ.
+func (i Info) FormByType(typ string) (*form.Data, bool) {
+	for n := range i.Form {
+		if t, ok := formTypeOf(&i.Form[n]); ok && t == typ {
+			return &i.Form[n], true
+		}
+	}
+	return nil, false
+}
+
 // GetInfo discovers a set of features and identities associated with a JID and
 // optional node.
 // An empty Node means to query the root items for the JID.
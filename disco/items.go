@@ -8,6 +8,7 @@ import (
 	"context"
 	"encoding/xml"
 	"errors"
+	"sync"
 
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
@@ -170,6 +171,29 @@ var ErrSkipItem = errors.New("skip this item")
 // with the same item to report the error.
 type WalkItemFunc func(level int, item items.Item, err error) error
 
+// WalkOption configures the behavior of WalkItem.
+type WalkOption func(*walker)
+
+// WalkCache returns an option that causes WalkItem to fetch items through the
+// provided cache.
+func WalkCache(c *Cache) WalkOption {
+	return func(w *walker) {
+		w.cache = c
+	}
+}
+
+// WalkConcurrency returns an option that allows WalkItem to crawl up to n
+// sibling items at once.
+// The WalkItemFunc is never called concurrently, but calls for items in
+// different branches of the tree may be interleaved.
+func WalkConcurrency(n int) WalkOption {
+	return func(w *walker) {
+		if n > 1 {
+			w.sem = make(chan struct{}, n-1)
+		}
+	}
+}
+
 // WalkItem walks the tree rooted at the JID, calling fn for each item in the
 // tree, including root.
 // To query the root, leave item.Node empty.
@@ -180,18 +204,47 @@ type WalkItemFunc func(level int, item items.Item, err error) error
 //
 // The items are walked in wire order which may make the output
 // non-deterministic.
-func WalkItem(ctx context.Context, item items.Item, s *xmpp.Session, fn WalkItemFunc) error {
-	return walkItem(ctx, 0, 0, []items.Item{item}, s, fn)
+// Items that have already been visited are passed to fn but not queried again.
+func WalkItem(ctx context.Context, item items.Item, s *xmpp.Session, fn WalkItemFunc, opts ...WalkOption) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	w := &walker{
+		session: s,
+		fn:      fn,
+		cancel:  cancel,
+		seen:    make(map[cacheKey]struct{}),
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	if w.sem != nil {
+		w.fn = func(level int, item items.Item, err error) error {
+			w.fnM.Lock()
+			defer w.fnM.Unlock()
+			return fn(level, item, err)
+		}
+	}
+	return w.walk(ctx, 0, item)
 }
 
 func ignoredErr(err error) bool {
 	return errors.Is(err, stanza.Error{Condition: stanza.FeatureNotImplemented}) || errors.Is(err, stanza.Error{Condition: stanza.ServiceUnavailable})
 }
 
-func walkItem(ctx context.Context, level, itemIdx int, items []items.Item, s *xmpp.Session, fn WalkItemFunc) error {
-	last := len(items) - 1
-	item := items[itemIdx]
-	err := fn(level, item, nil)
+type walker struct {
+	session *xmpp.Session
+	fn      WalkItemFunc
+	fnM     sync.Mutex
+	cache   *Cache
+	sem     chan struct{}
+	cancel  context.CancelFunc
+
+	m    sync.Mutex
+	seen map[cacheKey]struct{}
+}
+
+func (w *walker) walk(ctx context.Context, level int, item items.Item) error {
+	err := w.fn(level, item, nil)
 	if err != nil {
 		if err == ErrSkipItem {
 			err = nil
@@ -200,49 +253,76 @@ func walkItem(ctx context.Context, level, itemIdx int, items []items.Item, s *xm
 	}
 
 	// Look for loops and duplicates.
-	for n, oldItem := range items {
-		if n == itemIdx {
-			continue
-		}
-		if oldItem.Node == item.Node && oldItem.JID.Equal(item.JID) {
-			return nil
-		}
+	key := cacheKey{jid: item.JID.String(), node: item.Node}
+	w.m.Lock()
+	_, ok := w.seen[key]
+	w.seen[key] = struct{}{}
+	w.m.Unlock()
+	if ok {
+		return nil
 	}
 
-	items, err = appendItems(ctx, s, itemIdx, items)
+	var children []items.Item
+	if w.cache != nil {
+		children, err = w.cache.FetchItems(ctx, item, w.session)
+	} else {
+		children, err = fetchAllItems(ctx, item, w.session)
+	}
 	if ignoredErr(err) {
 		err = nil
 	}
 	if err != nil {
 		// Report the error with a second call to fn.
-		err = fn(level, item, err)
+		err = w.fn(level, item, err)
 		if err != nil {
 			return err
 		}
 	}
 
-	for n := range items[last+1:] {
-		err = walkItem(ctx, level+1, n+last+1, items, s, fn)
-		if err != nil {
-			if err == ErrSkipItem {
-				continue
+	if w.sem == nil {
+		for _, child := range children {
+			err = w.walk(ctx, level+1, child)
+			if err != nil && err != ErrSkipItem {
+				return err
 			}
-			return err
 		}
+		return nil
 	}
-	return nil
-}
 
-func appendItems(ctx context.Context, s *xmpp.Session, itemIdx int, items []items.Item) (i []items.Item, err error) {
-	iter := FetchItems(ctx, items[itemIdx], s)
-	defer func() {
-		e := iter.Close()
-		if err == nil {
-			err = e
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	setErr := func(err error) {
+		if err == nil || err == ErrSkipItem {
+			return
+		}
+		errOnce.Do(func() {
+			firstErr = err
+			w.cancel()
+		})
+	}
+	for _, child := range children {
+		if ctx.Err() != nil {
+			break
+		}
+		// Only start a new goroutine if one is available, otherwise crawl the
+		// child on this goroutine so that nested walks can never deadlock.
+		select {
+		case w.sem <- struct{}{}:
+			wg.Add(1)
+			go func(child items.Item) {
+				defer func() {
+					<-w.sem
+					wg.Done()
+				}()
+				setErr(w.walk(ctx, level+1, child))
+			}(child)
+		default:
+			setErr(w.walk(ctx, level+1, child))
 		}
-	}()
-	for iter.Next() {
-		items = append(items, iter.Item())
 	}
-	return items, iter.Err()
+	wg.Wait()
+	return firstErr
 }
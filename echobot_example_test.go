@@ -8,13 +8,13 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/xml"
-	"io"
 	"log"
 
 	"mellium.im/sasl"
 	"mellium.im/xmlstream"
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/message"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -23,13 +23,6 @@ const (
 	pass  = "just an example don't hardcode passwords"
 )
 
-// MessageBody is a message stanza that contains a body. It is normally used for
-// chat messages.
-type MessageBody struct {
-	stanza.Message
-	Body string `xml:"body"`
-}
-
 func Example_echobot() {
 	j := jid.MustParse(login)
 	s, err := xmpp.DialClientSession(
@@ -63,17 +56,19 @@ func Example_echobot() {
 	}
 
 	s.Serve(xmpp.HandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
-		d := xml.NewTokenDecoder(t)
-
 		// Ignore anything that's not a message. In a real system we'd want to at
 		// least respond to IQs.
 		if start.Name.Local != "message" {
 			return nil
 		}
 
-		msg := MessageBody{}
-		err = d.DecodeElement(&msg, start)
-		if err != nil && err != io.EOF {
+		msg, err := stanza.NewMessage(*start)
+		if err != nil {
+			log.Printf("Error decoding message: %q", err)
+			return nil
+		}
+		content, err := message.Read(xmlstream.MultiReader(xmlstream.Token(*start), t))
+		if err != nil {
 			log.Printf("Error decoding message: %q", err)
 			return nil
 		}
@@ -81,18 +76,17 @@ func Example_echobot() {
 		// Don't reflect messages unless they are chat messages and actually have a
 		// body.
 		// In a real world situation we'd probably want to respond to IQs, at least.
-		if msg.Body == "" || msg.Type != stanza.ChatMessage {
+		body := content.Body.Text(message.Lang(s, msg))
+		if body == "" || msg.Type != stanza.ChatMessage {
 			return nil
 		}
 
-		reply := MessageBody{
-			Message: stanza.Message{
-				To: msg.From.Bare(),
-			},
-			Body: msg.Body,
+		reply := stanza.Message{
+			To:   msg.From.Bare(),
+			Type: stanza.ChatMessage,
 		}
-		log.Printf("Replying to message %q from %s with body %q", msg.ID, reply.To, reply.Body)
-		err = t.Encode(reply)
+		log.Printf("Replying to message %q from %s with body %q", msg.ID, reply.To, body)
+		_, err = xmlstream.Copy(t, reply.Wrap(message.Body{"": body}.TokenReader()))
 		if err != nil {
 			log.Printf("Error responding to message %q: %q", msg.ID, err)
 		}
@@ -0,0 +1,191 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature
+
+// Package fallback implements XEP-0428: Fallback Indication.
+//
+// Extensions that include text in the body of a message for the benefit of
+// clients that do not support them use fallback indications to mark that text
+// so that clients that do support the extension can remove it.
+package fallback // import "mellium.im/xmpp/fallback"
+
+import (
+	"encoding/xml"
+	"strconv"
+	"unicode/utf8"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/message"
+)
+
+// NS is the namespace used by this package, provided as a convenience.
+const NS = "urn:xmpp:fallback:0"
+
+// Range is a range of characters in the body or subject of a message.
+// Offsets are counted in Unicode code points, not bytes, and End is exclusive.
+type Range struct {
+	Start int
+	End   int
+}
+
+// RangeOf returns a range covering all of s if it were to appear at the start
+// of the body.
+func RangeOf(s string) Range {
+	return Range{End: utf8.RuneCountInString(s)}
+}
+
+// Fallback indicates that text in a message is a fallback for the extension
+// with the namespace For.
+// If Body and Subject are both empty the entire body is a fallback.
+type Fallback struct {
+	For     string
+	Body    []Range
+	Subject []Range
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (f Fallback) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, r := range f.Body {
+		inner = append(inner, r.tokenReader("body"))
+	}
+	for _, r := range f.Subject {
+		inner = append(inner, r.tokenReader("subject"))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{
+			Name: xml.Name{Space: NS, Local: "fallback"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "for"}, Value: f.For}},
+		},
+	)
+}
+
+func (r Range) tokenReader(local string) xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Local: local},
+		Attr: []xml.Attr{
+			{Name: xml.Name{Local: "start"}, Value: strconv.Itoa(r.Start)},
+			{Name: xml.Name{Local: "end"}, Value: strconv.Itoa(r.End)},
+		},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (f Fallback) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, f.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (f Fallback) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := f.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (f *Fallback) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type rangeEl struct {
+		Start int `xml:"start,attr"`
+		End   int `xml:"end,attr"`
+	}
+	v := struct {
+		For     string    `xml:"for,attr"`
+		Body    []rangeEl `xml:"body"`
+		Subject []rangeEl `xml:"subject"`
+	}{}
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	f.For = v.For
+	f.Body = nil
+	f.Subject = nil
+	for _, r := range v.Body {
+		f.Body = append(f.Body, Range(r))
+	}
+	for _, r := range v.Subject {
+		f.Subject = append(f.Subject, Range(r))
+	}
+	return nil
+}
+
+// Read decodes all fallback indications from a message stanza, including its
+// start element.
+// Payloads other than fallback indications are ignored.
+func Read(r xml.TokenReader) ([]Fallback, error) {
+	v := struct {
+		Fallback []Fallback `xml:"urn:xmpp:fallback:0 fallback"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	return v.Fallback, err
+}
+
+// Strip returns the body with the fallback text for any of the namespaces in
+// ns removed.
+// If ns is empty, fallback text for all extensions is removed.
+//
+// Ranges refer to the body without an explicit language, so they are only
+// applied to that text and the text in other languages is returned unchanged.
+// Any ranges that are out of bounds are ignored.
+func Strip(body message.Body, fallbacks []Fallback, ns ...string) message.Body {
+	var ranges []Range
+	for _, f := range fallbacks {
+		if !match(f.For, ns) {
+			continue
+		}
+		if len(f.Body) == 0 && len(f.Subject) == 0 {
+			return nil
+		}
+		ranges = append(ranges, f.Body...)
+	}
+	if len(ranges) == 0 {
+		return body
+	}
+	stripped := make(message.Body, len(body))
+	for lang, text := range body {
+		stripped[lang] = text
+	}
+	if text, ok := body[""]; ok {
+		stripped[""] = StripText(text, ranges...)
+	}
+	return stripped
+}
+
+// StripText returns text with the given ranges removed.
+// Overlapping ranges are allowed and ranges that are out of bounds are ignored.
+func StripText(text string, ranges ...Range) string {
+	if len(ranges) == 0 {
+		return text
+	}
+	runes := []rune(text)
+	remove := make([]bool, len(runes))
+	for _, r := range ranges {
+		if r.Start < 0 || r.End > len(runes) || r.Start > r.End {
+			continue
+		}
+		for i := r.Start; i < r.End; i++ {
+			remove[i] = true
+		}
+	}
+	out := runes[:0]
+	for i, r := range runes {
+		if !remove[i] {
+			out = append(out, r)
+		}
+	}
+	return string(out)
+}
+
+func match(v string, ns []string) bool {
+	if len(ns) == 0 {
+		return true
+	}
+	for _, n := range ns {
+		if n == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package fallback_test
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/fallback"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/message"
+)
+
+var (
+	_ xml.Marshaler       = fallback.Fallback{}
+	_ xml.Unmarshaler     = (*fallback.Fallback)(nil)
+	_ xmlstream.Marshaler = fallback.Fallback{}
+	_ xmlstream.WriterTo  = fallback.Fallback{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &fallback.Fallback{For: "urn:xmpp:reply:0", Body: []fallback.Range{{Start: 0, End: 36}}},
+		XML:   `<fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:reply:0"><body start="0" end="36"></body></fallback>`,
+	},
+	1: {
+		Value: &fallback.Fallback{For: "urn:xmpp:message-retract:1"},
+		XML:   `<fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:message-retract:1"></fallback>`,
+	},
+	2: {
+		Value: &fallback.Fallback{
+			For:     "urn:example",
+			Body:    []fallback.Range{{Start: 1, End: 2}, {Start: 4, End: 8}},
+			Subject: []fallback.Range{{Start: 0, End: 3}},
+		},
+		XML: `<fallback xmlns="urn:xmpp:fallback:0" for="urn:example"><body start="1" end="2"></body><body start="4" end="8"></body><subject start="0" end="3"></subject></fallback>`,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+func TestRangeOf(t *testing.T) {
+	if r := fallback.RangeOf("> 🐢\n"); r != (fallback.Range{End: 4}) {
+		t.Errorf("wrong range: want=%+v, got=%+v", fallback.Range{End: 4}, r)
+	}
+}
+
+var stripTests = [...]struct {
+	body      message.Body
+	fallbacks []fallback.Fallback
+	ns        []string
+	out       message.Body
+}{
+	0: {
+		body: message.Body{"": "> 🐢\nhi"},
+		out:  message.Body{"": "> 🐢\nhi"},
+	},
+	1: {
+		body:      message.Body{"": "> 🐢\nhi"},
+		fallbacks: []fallback.Fallback{{For: "urn:a", Body: []fallback.Range{{End: 4}}}},
+		out:       message.Body{"": "hi"},
+	},
+	2: {
+		body:      message.Body{"": "> 🐢\nhi"},
+		fallbacks: []fallback.Fallback{{For: "urn:a", Body: []fallback.Range{{End: 4}}}},
+		ns:        []string{"urn:b"},
+		out:       message.Body{"": "> 🐢\nhi"},
+	},
+	3: {
+		body:      message.Body{"": "fallback"},
+		fallbacks: []fallback.Fallback{{For: "urn:a"}},
+		ns:        []string{"urn:b", "urn:a"},
+	},
+	4: {
+		body: message.Body{"": "abcdef"},
+		fallbacks: []fallback.Fallback{
+			{For: "urn:a", Body: []fallback.Range{{Start: 0, End: 2}, {Start: 1, End: 3}}},
+			{For: "urn:b", Body: []fallback.Range{{Start: 5, End: 6}, {Start: 4, End: 10}}},
+		},
+		out: message.Body{"": "de"},
+	},
+	5: {
+		body:      message.Body{"": "> hi\nhello", "de": "> hallo\nguten Tag"},
+		fallbacks: []fallback.Fallback{{For: "urn:a", Body: []fallback.Range{{End: 5}}}},
+		out:       message.Body{"": "hello", "de": "> hallo\nguten Tag"},
+	},
+}
+
+func TestStrip(t *testing.T) {
+	for i, tc := range stripTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out := fallback.Strip(tc.body, tc.fallbacks, tc.ns...)
+			if !reflect.DeepEqual(out, tc.out) {
+				t.Errorf("wrong body: want=%q, got=%q", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	const msg = `<message xmlns="jabber:client"><body>test</body><fallback xmlns="urn:xmpp:fallback:0" for="urn:a"><body start="0" end="2"/></fallback><fallback xmlns="urn:xmpp:fallback:0" for="urn:b"/></message>`
+	fallbacks, err := fallback.Read(xml.NewDecoder(strings.NewReader(msg)))
+	if err != nil {
+		t.Fatalf("error reading fallbacks: %v", err)
+	}
+	expected := []fallback.Fallback{
+		{For: "urn:a", Body: []fallback.Range{{End: 2}}},
+		{For: "urn:b"},
+	}
+	if !reflect.DeepEqual(fallbacks, expected) {
+		t.Errorf("wrong fallbacks: want=%+v, got=%+v", expected, fallbacks)
+	}
+}
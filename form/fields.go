@@ -87,6 +87,10 @@ type field struct {
 	value    []string
 	option   []fieldOpt
 	required bool
+	// untyped is set on fields that were unmarshaled without a type attribute.
+	// They are written back without one and with all of their values so that
+	// they round trip.
+	untyped bool
 }
 
 func (f *field) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
@@ -102,6 +106,7 @@ func (f *field) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 
 	err := d.DecodeElement(&s, &start)
 	f.typ = s.Type
+	f.untyped = s.Type == ""
 	f.label = s.Label
 	f.varName = s.Var
 	f.desc = s.Desc
@@ -112,10 +117,13 @@ func (f *field) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 }
 
 func (f *field) TokenReader() xml.TokenReader {
-	attr := []xml.Attr{{
-		Name:  xml.Name{Local: "type"},
-		Value: string(f.typ),
-	}}
+	var attr []xml.Attr
+	if !f.untyped {
+		attr = append(attr, xml.Attr{
+			Name:  xml.Name{Local: "type"},
+			Value: string(f.typ),
+		})
+	}
 	if f.varName != "" {
 		attr = append(attr, xml.Attr{
 			Name:  xml.Name{Local: "var"},
@@ -147,7 +155,7 @@ func (f *field) TokenReader() xml.TokenReader {
 			continue
 		}
 		// Some list types are only allowed to have a single value.
-		if firstVal && f.typ != "list-multi" && f.typ != "jid-multi" && f.typ != "text-multi" {
+		if firstVal && !f.untyped && f.typ != "list-multi" && f.typ != "jid-multi" && f.typ != "text-multi" {
 			break
 		}
 		switch f.typ {
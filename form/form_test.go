@@ -510,6 +510,23 @@ func TestUnmarshalChardata(t *testing.T) {
 	}
 }
 
+func TestUntypedRoundTrip(t *testing.T) {
+	const formData = `<x xmlns="jabber:x:data" type="result"><field var="ip_version"><value>ipv4</value><value>ipv6</value></field></x>`
+	data := &form.Data{}
+	err := xml.Unmarshal([]byte(formData), data)
+	if err != nil {
+		t.Fatalf("error unmarshaling: %v", err)
+	}
+	var b bytes.Buffer
+	err = xml.NewEncoder(&b).Encode(data)
+	if err != nil {
+		t.Fatalf("error marshaling: %v", err)
+	}
+	if out := b.String(); out != formData {
+		t.Errorf("untyped field did not round trip:\nwant=%s,\n got=%s", formData, out)
+	}
+}
+
 func TestUnmarshalInvalidToken(t *testing.T) {
 	const formData = `<x xmlns="jabber:x:data"><!-- Not allowed --></x>`
 	data := &form.Data{}
@@ -0,0 +1,210 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package hints implements XEP-0334: Message Processing Hints.
+//
+// Hints are added to messages by the sender to indicate how servers and other
+// intermediaries should handle them, for example whether they should be stored
+// in an archive or carbon copied to the recipient's other clients.
+// Code that archives or copies messages can use Read to find out which hints
+// are present on a message and respect them.
+package hints // import "mellium.im/xmpp/hints"
+
+import (
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "urn:xmpp:hints"
+
+// Hint is a message processing hint.
+type Hint string
+
+// A list of possible hints.
+const (
+	// NoPermanentStore asks entities not to store the message in a permanent
+	// archive, such as a message archive.
+	// The message may still be stored temporarily, for example for delivery to
+	// offline clients.
+	NoPermanentStore Hint = "no-permanent-store"
+
+	// NoStore asks entities not to store the message at all, either
+	// permanently or temporarily.
+	NoStore Hint = "no-store"
+
+	// NoCopy asks entities not to copy the message to other clients, for
+	// example using message carbons.
+	NoCopy Hint = "no-copy"
+
+	// Store asks entities to store the message in any archives even if it would
+	// not normally be stored, for example because it does not have a body.
+	Store Hint = "store"
+)
+
+// Valid reports whether h is one of the hints defined by XEP-0334.
+func (h Hint) Valid() bool {
+	switch h {
+	case NoPermanentStore, NoStore, NoCopy, Store:
+		return true
+	}
+	return false
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (h Hint) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: string(h)},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (h Hint) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, h.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (h Hint) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := h.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// Elements that are not valid hints are skipped.
+func (h *Hint) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	hint := Hint(start.Name.Local)
+	if start.Name.Space == NS && hint.Valid() {
+		*h = hint
+	}
+	return d.Skip()
+}
+
+// Insert returns an xmlstream.Transformer that adds the hints to all top level
+// message elements.
+func Insert(h ...Hint) xmlstream.Transformer {
+	return func(r xml.TokenReader) xml.TokenReader {
+		return xmlstream.InsertFunc(
+			func(start xml.StartElement, level uint64, w xmlstream.TokenWriter) error {
+				if level != 1 ||
+					start.Name.Local != "message" ||
+					(start.Name.Space != stanza.NSClient && start.Name.Space != stanza.NSServer) {
+					return nil
+				}
+				for _, hint := range h {
+					_, err := hint.WriteXML(w)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		)(r)
+	}
+}
+
+// Set is the set of hints present on a message.
+type Set struct {
+	NoPermanentStore bool
+	NoStore          bool
+	NoCopy           bool
+	Store            bool
+}
+
+// Has reports whether the hint h is in the set.
+func (s Set) Has(h Hint) bool {
+	switch h {
+	case NoPermanentStore:
+		return s.NoPermanentStore
+	case NoStore:
+		return s.NoStore
+	case NoCopy:
+		return s.NoCopy
+	case Store:
+		return s.Store
+	}
+	return false
+}
+
+// Add adds the hint h to the set.
+// Invalid hints are ignored.
+func (s *Set) Add(h Hint) {
+	switch h {
+	case NoPermanentStore:
+		s.NoPermanentStore = true
+	case NoStore:
+		s.NoStore = true
+	case NoCopy:
+		s.NoCopy = true
+	case Store:
+		s.Store = true
+	}
+}
+
+// Archive reports whether a message with the hints should be stored in a
+// permanent archive.
+// If no hint applies, def is returned.
+//
+// Hints that forbid storing the message take precedence over the store hint.
+func (s Set) Archive(def bool) bool {
+	if s.NoStore || s.NoPermanentStore {
+		return false
+	}
+	return def || s.Store
+}
+
+// Offline reports whether a message with the hints may be stored temporarily,
+// for example for delivery to clients that are offline.
+// If no hint applies, def is returned.
+func (s Set) Offline(def bool) bool {
+	if s.NoStore {
+		return false
+	}
+	return def || s.Store
+}
+
+// Copy reports whether a message with the hints may be copied to other
+// clients, for example using message carbons.
+// If no hint applies, def is returned.
+func (s Set) Copy(def bool) bool {
+	if s.NoCopy {
+		return false
+	}
+	return def
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (s Set) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, h := range [...]Hint{NoPermanentStore, NoStore, NoCopy, Store} {
+		if s.Has(h) {
+			inner = append(inner, h.TokenReader())
+		}
+	}
+	return xmlstream.MultiReader(inner...)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (s Set) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, s.TokenReader())
+}
+
+// Read decodes a message stanza, including its start element, and returns the
+// hints that it contains.
+// Payloads other than hints are ignored.
+func Read(r xml.TokenReader) (Set, error) {
+	var v struct {
+		Hints []Hint `xml:",any"`
+	}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return Set{}, err
+	}
+	var s Set
+	for _, h := range v.Hints {
+		s.Add(h)
+	}
+	return s, nil
+}
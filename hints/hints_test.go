@@ -0,0 +1,182 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package hints_test
+
+import (
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/hints"
+	"mellium.im/xmpp/internal/xmpptest"
+)
+
+var (
+	_ xml.Marshaler       = hints.Hint("")
+	_ xml.Unmarshaler     = (*hints.Hint)(nil)
+	_ xmlstream.Marshaler = hints.Hint("")
+	_ xmlstream.WriterTo  = hints.Hint("")
+	_ xmlstream.Marshaler = hints.Set{}
+	_ xmlstream.WriterTo  = hints.Set{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: func() *hints.Hint { h := hints.NoPermanentStore; return &h }(),
+		XML:   `<no-permanent-store xmlns="urn:xmpp:hints"></no-permanent-store>`,
+	},
+	1: {
+		Value: func() *hints.Hint { h := hints.NoStore; return &h }(),
+		XML:   `<no-store xmlns="urn:xmpp:hints"></no-store>`,
+	},
+	2: {
+		Value: func() *hints.Hint { h := hints.NoCopy; return &h }(),
+		XML:   `<no-copy xmlns="urn:xmpp:hints"></no-copy>`,
+	},
+	3: {
+		Value: func() *hints.Hint { h := hints.Store; return &h }(),
+		XML:   `<store xmlns="urn:xmpp:hints"></store>`,
+	},
+	4: {
+		Value:     func() *hints.Hint { h := hints.Hint(""); return &h }(),
+		XML:       `<store xmlns="urn:example"></store>`,
+		NoMarshal: true,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+var insertTestCases = [...]struct {
+	hints []hints.Hint
+	in    string
+	out   string
+}{
+	0: {},
+	1: {
+		hints: []hints.Hint{hints.NoStore, hints.NoCopy},
+		in:    `<message xmlns="jabber:client"><body>test</body></message>`,
+		out:   `<message xmlns="jabber:client"><no-store xmlns="urn:xmpp:hints"></no-store><no-copy xmlns="urn:xmpp:hints"></no-copy><body xmlns="jabber:client">test</body></message>`,
+	},
+	2: {
+		hints: []hints.Hint{hints.Store},
+		in:    `<iq xmlns="jabber:client"/><message xmlns="jabber:server"><message xmlns="jabber:server"/></message>`,
+		out:   `<iq xmlns="jabber:client"></iq><message xmlns="jabber:server"><store xmlns="urn:xmpp:hints"></store><message xmlns="jabber:server"></message></message>`,
+	},
+	3: {
+		hints: []hints.Hint{hints.Store},
+		in:    `<message xmlns="jabber:badns"/>`,
+		out:   `<message xmlns="jabber:badns"></message>`,
+	},
+}
+
+func TestInsert(t *testing.T) {
+	for i, tc := range insertTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r := hints.Insert(tc.hints...)(xml.NewDecoder(strings.NewReader(tc.in)))
+			// Prevent duplicate xmlns attributes. See https://mellium.im/issue/75
+			r = xmlstream.RemoveAttr(func(start xml.StartElement, attr xml.Attr) bool {
+				return (start.Name.Local == "message" || start.Name.Local == "iq") && attr.Name.Local == "xmlns"
+			})(r)
+			var buf strings.Builder
+			e := xml.NewEncoder(&buf)
+			_, err := xmlstream.Copy(e, r)
+			if err != nil {
+				t.Fatalf("error encoding: %v", err)
+			}
+			if err = e.Flush(); err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			if out := buf.String(); out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+		})
+	}
+}
+
+var readTestCases = [...]struct {
+	in      string
+	set     hints.Set
+	archive bool
+	offline bool
+	copy    bool
+}{
+	0: {
+		in:      `<message xmlns="jabber:client"><body>test</body></message>`,
+		archive: true,
+		offline: true,
+		copy:    true,
+	},
+	1: {
+		in:      `<message xmlns="jabber:client"><no-permanent-store xmlns="urn:xmpp:hints"/><no-copy xmlns="urn:xmpp:hints"/></message>`,
+		set:     hints.Set{NoPermanentStore: true, NoCopy: true},
+		offline: true,
+	},
+	2: {
+		in:   `<message xmlns="jabber:client"><no-store xmlns="urn:xmpp:hints"/><store xmlns="urn:xmpp:hints"/></message>`,
+		set:  hints.Set{NoStore: true, Store: true},
+		copy: true,
+	},
+	3: {
+		in:      `<message xmlns="jabber:client"><store xmlns="urn:xmpp:hints"/><no-copy xmlns="urn:example"/></message>`,
+		set:     hints.Set{Store: true},
+		archive: true,
+		offline: true,
+		copy:    true,
+	},
+}
+
+func TestRead(t *testing.T) {
+	for i, tc := range readTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			set, err := hints.Read(xml.NewDecoder(strings.NewReader(tc.in)))
+			if err != nil {
+				t.Fatalf("error reading hints: %v", err)
+			}
+			if set != tc.set {
+				t.Fatalf("wrong hints: want=%+v, got=%+v", tc.set, set)
+			}
+			// Messages with a body are normally archived, stored, and copied.
+			if archive := set.Archive(true); archive != tc.archive {
+				t.Errorf("wrong archive value: want=%t, got=%t", tc.archive, archive)
+			}
+			if offline := set.Offline(true); offline != tc.offline {
+				t.Errorf("wrong offline value: want=%t, got=%t", tc.offline, offline)
+			}
+			if copy := set.Copy(true); copy != tc.copy {
+				t.Errorf("wrong copy value: want=%t, got=%t", tc.copy, copy)
+			}
+			// Messages without a body are only archived with the store hint.
+			if archive := set.Archive(false); archive != (tc.archive && set.Store) {
+				t.Errorf("wrong archive value for message without body: want=%t, got=%t", tc.archive && set.Store, archive)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	var set hints.Set
+	set.Add(hints.NoCopy)
+	set.Add(hints.Store)
+	set.Add("invalid")
+	if !set.Has(hints.NoCopy) || !set.Has(hints.Store) || set.Has(hints.NoStore) || set.Has("invalid") {
+		t.Errorf("wrong set contents: %+v", set)
+	}
+	var buf strings.Builder
+	e := xml.NewEncoder(&buf)
+	if _, err := set.WriteXML(e); err != nil {
+		t.Fatalf("error encoding: %v", err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	const expected = `<no-copy xmlns="urn:xmpp:hints"></no-copy><store xmlns="urn:xmpp:hints"></store>`
+	if out := buf.String(); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
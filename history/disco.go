@@ -0,0 +1,30 @@
+// Code generated by "genfeature -receiver h serverHandler -vars Feature:NS,FeatureExt:NSExt"; DO NOT EDIT.
+
+package history
+
+import (
+	"mellium.im/xmpp/disco/info"
+)
+
+// A list of service discovery features that are supported by this package.
+var (
+	Feature    = info.Feature{Var: NS}
+	FeatureExt = info.Feature{Var: NSExt}
+)
+
+// ForFeatures implements info.FeatureIter.
+func (h serverHandler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	var err error
+	err = f(Feature)
+	if err != nil {
+		return err
+	}
+	err = f(FeatureExt)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -33,7 +33,7 @@ func Handle(h *Handler) mux.Option {
 func NewHandler(inner mux.MessageHandler) *Handler {
 	return &Handler{
 		inner:   inner,
-		tracked: make(map[string]*Iter),
+		tracked: make(map[string]*query),
 	}
 }
 
@@ -42,15 +42,39 @@ func NewHandler(inner mux.MessageHandler) *Handler {
 // passed to the correct iterator for syncronous processing if they are.
 type Handler struct {
 	inner    mux.MessageHandler
-	tracked  map[string]*Iter
+	tracked  map[string]*query
 	trackedM sync.Mutex
 }
 
+// query is a tracked query.
+// Results are sent over msgC until done is closed.
+type query struct {
+	msgC chan []byte
+	done chan struct{}
+}
+
+func (h *Handler) track(id string) (*query, error) {
+	h.trackedM.Lock()
+	defer h.trackedM.Unlock()
+	if _, ok := h.tracked[id]; ok {
+		return nil, fmt.Errorf("history query %s is already being tracked", id)
+	}
+	if h.tracked == nil {
+		h.tracked = make(map[string]*query)
+	}
+	q := &query{
+		msgC: make(chan []byte),
+		done: make(chan struct{}),
+	}
+	h.tracked[id] = q
+	return q, nil
+}
+
 func (h *Handler) remove(id string) {
 	h.trackedM.Lock()
 	defer h.trackedM.Unlock()
-	if iter, ok := h.tracked[id]; ok {
-		close(iter.msgC)
+	if q, ok := h.tracked[id]; ok {
+		close(q.done)
 		delete(h.tracked, id)
 	}
 }
@@ -75,8 +99,8 @@ func (h *Handler) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder
 		}
 	}
 	h.trackedM.Lock()
-	defer h.trackedM.Unlock()
-	iter, ok := h.tracked[queryID]
+	q, ok := h.tracked[queryID]
+	h.trackedM.Unlock()
 	if !ok {
 		if h.inner != nil {
 			return h.inner.HandleMessage(msg, struct {
@@ -90,7 +114,21 @@ func (h *Handler) HandleMessage(msg stanza.Message, r xmlstream.TokenReadEncoder
 		return nil
 	}
 
-	iter.msgC <- xmlstream.MultiReader(xmlstream.Token(msgTok), xmlstream.Token(tok), r)
+	// The reader is only valid until we return, so buffer the result before
+	// passing it on.
+	raw, err := encode(xmlstream.MultiReader(
+		xmlstream.Token(msgTok),
+		xmlstream.Token(tok),
+		xmlstream.InnerElement(r),
+		xmlstream.Token(msgTok.(xml.StartElement).End()),
+	))
+	if err != nil {
+		return err
+	}
+	select {
+	case q.msgC <- raw:
+	case <-q.done:
+	}
 	return nil
 }
 
@@ -106,22 +144,19 @@ func (h *Handler) Fetch(ctx context.Context, filter Query, to jid.JID, s *xmpp.S
 // FetchIQ is like Fetch but it allows modifying the underlying IQ.
 // Changing the type of the IQ has no effect.
 func (h *Handler) FetchIQ(ctx context.Context, filter Query, iq stanza.IQ, s *xmpp.Session) *Iter {
-	h.trackedM.Lock()
-	defer h.trackedM.Unlock()
 	if filter.ID == "" {
 		filter.ID = attr.RandomID()
 	}
-	if _, ok := h.tracked[filter.ID]; ok {
-		return &Iter{
-			err: fmt.Errorf("history query %s is already being tracked", filter.ID),
-		}
+	q, err := h.track(filter.ID)
+	if err != nil {
+		return &Iter{err: err}
 	}
 	iq.Type = stanza.SetIQ
-	msgC := make(chan xml.TokenReader)
 	iter := &Iter{
-		msgC: msgC,
-		h:    h,
-		id:   filter.ID,
+		q:        q,
+		h:        h,
+		id:       filter.ID,
+		finished: make(chan struct{}),
 	}
 
 	go func() {
@@ -131,16 +166,12 @@ func (h *Handler) FetchIQ(ctx context.Context, filter Query, iq stanza.IQ, s *xm
 			iq.Wrap(filter.TokenReader()),
 			&result,
 		)
-		if err != nil && iter.err != nil {
-			// Technically this is racey. I'm not sure that we care though as long as
-			// an error is set?
-			iter.err = err
-		}
+		iter.err = err
 		iter.res = result
+		close(iter.finished)
 		h.remove(filter.ID)
 	}()
 
-	h.tracked[filter.ID] = iter
 	return iter
 }
 
@@ -75,8 +75,22 @@ func TestRoundTrip(t *testing.T) {
 	foundMessages = 0
 	iter := h.Fetch(context.Background(), history.Query{ID: "123", AfterID: "123"}, to, cs.Client)
 	for iter.Next() {
-		if cur := iter.Current(); cur == nil {
-			t.Errorf("found nil current message")
+		cur := iter.Current()
+		if cur == nil {
+			t.Fatalf("found nil current message")
+		}
+		// The message must still be readable after the handler has returned.
+		var msg struct {
+			Result struct {
+				QueryID string `xml:"queryid,attr"`
+			} `xml:"urn:xmpp:mam:2 result"`
+		}
+		err := xml.NewTokenDecoder(cur).Decode(&msg)
+		if err != nil {
+			t.Errorf("error decoding current message: %v", err)
+		}
+		if msg.Result.QueryID != "123" {
+			t.Errorf("wrong query ID: want=123, got=%q", msg.Result.QueryID)
 		}
 		foundMessages++
 	}
@@ -101,3 +115,26 @@ func TestRoundTrip(t *testing.T) {
 		t.Fatalf("noop close returned error somehow: %v", err)
 	}
 }
+
+func TestIterClose(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}}
+	h := history.NewHandler(nil)
+	cs := newHistoryServer(srv, h)
+	fillStore(t, srv.Store, cs.Client.LocalAddr().Bare(), 5)
+
+	iter := h.Fetch(context.Background(), history.Query{}, jid.JID{}, cs.Client)
+	err := iter.Close()
+	if err != nil {
+		t.Fatalf("error closing iterator: %v", err)
+	}
+	if iter.Next() {
+		t.Errorf("did not expect more messages after close")
+	}
+	// The result is still set once the response to the query is received.
+	if err := iter.Err(); err != nil {
+		t.Errorf("unexpected error after close: %v", err)
+	}
+	if !iter.Result().Complete {
+		t.Errorf("expected the result to be set after close")
+	}
+}
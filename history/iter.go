@@ -5,46 +5,74 @@
 package history
 
 import (
+	"bytes"
 	"encoding/xml"
 )
 
 // Iter is an iterator over message history.
 type Iter struct {
-	err  error
-	msgC chan xml.TokenReader
-	cur  xml.TokenReader
-	h    *Handler
-	id   string
-	res  Result
+	err error
+	q   *query
+	cur []byte
+	h   *Handler
+	id  string
+	res Result
+
+	// finished is closed once err and res have been set.
+	finished chan struct{}
 }
 
 // Next advances the iterator
 func (i *Iter) Next() bool {
-	var ok bool
-	i.cur, ok = <-i.msgC
-	return ok
+	if i.q == nil {
+		return false
+	}
+	select {
+	case i.cur = <-i.q.msgC:
+		return true
+	case <-i.q.done:
+		i.cur = nil
+		return false
+	}
 }
 
 // Current returns the current message stream read from the iterator.
 func (i *Iter) Current() xml.TokenReader {
-	return i.cur
+	if i.cur == nil {
+		return nil
+	}
+	return xml.NewDecoder(bytes.NewReader(i.cur))
 }
 
 // Err returns any error encountered by the iterator.
+// If the iterator was closed before iteration completed, Err blocks until the
+// response to the query is received.
 func (i *Iter) Err() error {
+	i.wait()
 	return i.err
 }
 
 // Result contains the results of the query after iteration has completed if no
 // error was encountered.
+// Like Err, it blocks until the response to the query is received.
 func (i *Iter) Result() Result {
+	i.wait()
 	return i.res
 }
 
+func (i *Iter) wait() {
+	if i.finished != nil {
+		<-i.finished
+	}
+}
+
 // Close stops iterating over this query.
 // Future messages will still be received but will be handled by the fallback
 // handler instead.
 func (i *Iter) Close() error {
+	if i.h == nil {
+		return nil
+	}
 	i.h.remove(i.id)
 	return nil
 }
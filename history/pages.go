@@ -0,0 +1,287 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// MessageIter is an iterator over messages from an archive that fetches
+// further pages as needed.
+type MessageIter struct {
+	pages  chan page
+	cancel context.CancelFunc
+	cur    []Message
+	msg    Message
+	res    Result
+	err    error
+	runErr error
+	closed bool
+}
+
+type page struct {
+	msgs []Message
+	res  Result
+	err  error
+}
+
+// FetchAll requests messages from the archive and returns an iterator over all
+// of the results.
+// Unlike Fetch, once the messages in a page have been received the iterator
+// uses the paging information in the result to request the next page until the
+// archive reports that the query is complete or max messages have been
+// returned.
+// If max is zero, there is no limit.
+//
+// If filter.Last is set, pages are requested starting at the end of the archive
+// and messages are returned newest first, otherwise they are returned oldest
+// first.
+// Filter.Limit sets the size of each page and filter.Reverse is ignored.
+// Messages that appear in more than one page are only returned once.
+//
+// The next page is requested while the current one is being iterated over, but
+// no more than one page is fetched ahead of time.
+// If ctx is canceled, iteration stops and the iterator returns the context's
+// error.
+// Close must be called if iteration is stopped before all messages have been
+// read.
+func (h *Handler) FetchAll(ctx context.Context, filter Query, to jid.JID, max uint64, s *xmpp.Session) *MessageIter {
+	return h.FetchAllIQ(ctx, filter, stanza.IQ{
+		To: to,
+	}, max, s)
+}
+
+// FetchAllIQ is like FetchAll but it allows modifying the underlying IQ.
+// Changing the type of the IQ has no effect.
+func (h *Handler) FetchAllIQ(ctx context.Context, filter Query, iq stanza.IQ, max uint64, s *xmpp.Session) *MessageIter {
+	ctx, cancel := context.WithCancel(ctx)
+	iter := &MessageIter{
+		pages:  make(chan page),
+		cancel: cancel,
+	}
+	go iter.run(ctx, h, filter, iq, max, s)
+	return iter
+}
+
+func (i *MessageIter) run(ctx context.Context, h *Handler, filter Query, iq stanza.IQ, max uint64, s *xmpp.Session) {
+	defer i.cancel()
+	defer close(i.pages)
+
+	filter.Reverse = false
+	var (
+		returned uint64
+		prev     map[string]struct{}
+	)
+	for {
+		q := filter
+		q.ID = attr.RandomID()
+		if max > 0 && (q.Limit == 0 || q.Limit > max-returned) {
+			q.Limit = max - returned
+		}
+		msgs, res, err := h.fetchPage(ctx, q, iq, s)
+		if err != nil {
+			if ctx.Err() != nil {
+				i.runErr = ctx.Err()
+				return
+			}
+			select {
+			case i.pages <- page{err: err}:
+			case <-ctx.Done():
+				i.runErr = ctx.Err()
+			}
+			return
+		}
+
+		// Servers may include the message that we paged from in the next page, so
+		// skip any that we've already returned.
+		seen := make(map[string]struct{}, len(msgs))
+		var out []Message
+		for _, msg := range msgs {
+			seen[msg.ID] = struct{}{}
+			if _, ok := prev[msg.ID]; ok {
+				continue
+			}
+			out = append(out, msg)
+		}
+		prev = seen
+		if filter.Last {
+			for l, r := 0, len(out)-1; l < r; l, r = l+1, r-1 {
+				out[l], out[r] = out[r], out[l]
+			}
+		}
+		if max > 0 && uint64(len(out)) > max-returned {
+			out = out[:max-returned]
+		}
+		returned += uint64(len(out))
+
+		done := res.Complete || (max > 0 && returned >= max)
+		if !done {
+			next := nextPage(filter.Last, msgs, res)
+			// If we don't know where the next page starts or the server keeps
+			// returning the same page, stop instead of looping forever.
+			done = next == "" || next == filter.PageID
+			filter.PageID = next
+		}
+
+		select {
+		case i.pages <- page{msgs: out, res: res}:
+		case <-ctx.Done():
+			i.runErr = ctx.Err()
+			return
+		}
+		if done {
+			return
+		}
+	}
+}
+
+// nextPage returns the ID to page from to get the page after msgs.
+func nextPage(last bool, msgs []Message, res Result) string {
+	if last {
+		if res.Set.First.ID != "" {
+			return res.Set.First.ID
+		}
+		if len(msgs) > 0 {
+			return msgs[0].ID
+		}
+		return ""
+	}
+	if res.Set.Last != "" {
+		return res.Set.Last
+	}
+	if len(msgs) > 0 {
+		return msgs[len(msgs)-1].ID
+	}
+	return ""
+}
+
+// fetchPage sends the query and collects the results.
+func (h *Handler) fetchPage(ctx context.Context, filter Query, iq stanza.IQ, s *xmpp.Session) ([]Message, Result, error) {
+	q, err := h.track(filter.ID)
+	if err != nil {
+		return nil, Result{}, err
+	}
+	defer h.remove(filter.ID)
+
+	iq.Type = stanza.SetIQ
+	var res Result
+	errC := make(chan error, 1)
+	go func() {
+		errC <- s.UnmarshalIQ(ctx, iq.Wrap(filter.TokenReader()), &res)
+	}()
+
+	var msgs []Message
+	for {
+		select {
+		case raw := <-q.msgC:
+			msg, err := decodeResult(raw)
+			if err != nil {
+				return nil, Result{}, err
+			}
+			msgs = append(msgs, msg)
+		case err := <-errC:
+			// All results are received before the response to the query.
+			if err != nil {
+				return nil, Result{}, err
+			}
+			return msgs, res, nil
+		}
+	}
+}
+
+// rawElement is the XML encoding of an element.
+type rawElement []byte
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (r *rawElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	raw, err := encode(xmlstream.MultiReader(
+		xmlstream.Token(start),
+		xmlstream.InnerElement(d),
+	))
+	*r = raw
+	return err
+}
+
+// decodeResult decodes a message containing a query result.
+func decodeResult(raw []byte) (Message, error) {
+	var v struct {
+		Result struct {
+			ID        string `xml:"id,attr"`
+			Forwarded struct {
+				Delay   delay.Delay `xml:"urn:xmpp:delay delay"`
+				Message rawElement  `xml:"message"`
+			} `xml:"urn:xmpp:forward:0 forwarded"`
+		} `xml:"urn:xmpp:mam:2 result"`
+	}
+	err := xml.NewDecoder(bytes.NewReader(raw)).Decode(&v)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		ID:     v.Result.ID,
+		Time:   v.Result.Forwarded.Delay.Time,
+		Stanza: v.Result.Forwarded.Message,
+	}, nil
+}
+
+// Next advances the iterator, fetching the next page if necessary.
+func (i *MessageIter) Next() bool {
+	if i.closed {
+		return false
+	}
+	for len(i.cur) == 0 {
+		p, ok := <-i.pages
+		if !ok {
+			i.err = i.runErr
+			return false
+		}
+		if p.err != nil {
+			i.err = p.err
+			return false
+		}
+		i.res = p.res
+		i.cur = p.msgs
+	}
+	i.msg = i.cur[0]
+	i.cur = i.cur[1:]
+	return true
+}
+
+// Message returns the current message.
+// The ID of the message is its ID in the archive, Time is the time the message
+// was archived, and Stanza is the forwarded message.
+// With is not set.
+func (i *MessageIter) Message() Message {
+	return i.msg
+}
+
+// Err returns any error encountered by the iterator.
+func (i *MessageIter) Err() error {
+	return i.err
+}
+
+// Result returns the result of the last page that was fetched.
+// After iteration has completed without error, Result().Complete reports
+// whether all messages matching the query were returned or iteration stopped
+// because the limit was reached.
+func (i *MessageIter) Result() Result {
+	return i.res
+}
+
+// Close stops iterating and cancels any pending requests.
+func (i *MessageIter) Close() error {
+	i.closed = true
+	i.cancel()
+	return nil
+}
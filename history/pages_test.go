@@ -0,0 +1,203 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/jid"
+)
+
+// overlapStore is a store that includes the message being paged from in the
+// next page, like some servers do.
+type overlapStore struct {
+	history.MemStore
+}
+
+func (s *overlapStore) Query(archive jid.JID, q history.Query, max uint64) (history.Page, error) {
+	page, err := s.MemStore.Query(archive, q, max)
+	if err != nil || q.PageID == "" {
+		return page, err
+	}
+	ids, err := s.MemStore.Query(archive, history.Query{IDs: []string{q.PageID}}, 0)
+	if err != nil {
+		return page, err
+	}
+	if q.Last {
+		page.Messages = append(page.Messages, ids.Messages...)
+	} else {
+		page.Messages = append(ids.Messages, page.Messages...)
+	}
+	return page, nil
+}
+
+func fillStore(t *testing.T, store history.Store, archive jid.JID, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		err := store.Add(archive, history.Message{
+			ID:     strconv.Itoa(i),
+			Time:   time.Date(2021, 1, 1, 0, i, 0, 0, time.UTC),
+			With:   jid.MustParse("romeo@example.net"),
+			Stanza: []byte(fmt.Sprintf(`<message xmlns="jabber:client" type="chat"><body>%d</body></message>`, i)),
+		})
+		if err != nil {
+			t.Fatalf("error adding message: %v", err)
+		}
+	}
+}
+
+func collectAll(t *testing.T, iter *history.MessageIter) []string {
+	t.Helper()
+	var bodies []string
+	for iter.Next() {
+		msg := iter.Message()
+		var v struct {
+			Body string `xml:"body"`
+		}
+		err := xml.Unmarshal(msg.Stanza, &v)
+		if err != nil {
+			t.Fatalf("error decoding stanza %s: %v", msg.Stanza, err)
+		}
+		if v.Body != msg.ID {
+			t.Errorf("body %q does not match ID %q", v.Body, msg.ID)
+		}
+		if msg.Time.IsZero() {
+			t.Errorf("expected message %s to have a time", msg.ID)
+		}
+		bodies = append(bodies, v.Body)
+	}
+	return bodies
+}
+
+var fetchAllTestCases = [...]struct {
+	overlap  bool
+	q        history.Query
+	max      uint64
+	expected []string
+	complete bool
+}{
+	0: {
+		q:        history.Query{Limit: 2},
+		expected: []string{"0", "1", "2", "3", "4"},
+		complete: true,
+	},
+	1: {
+		q:        history.Query{Limit: 2, Last: true},
+		expected: []string{"4", "3", "2", "1", "0"},
+		complete: true,
+	},
+	2: {
+		q:        history.Query{Limit: 2},
+		max:      3,
+		expected: []string{"0", "1", "2"},
+	},
+	3: {
+		q:        history.Query{Last: true},
+		max:      2,
+		expected: []string{"4", "3"},
+	},
+	4: {
+		overlap:  true,
+		q:        history.Query{Limit: 2},
+		expected: []string{"0", "1", "2", "3", "4"},
+		complete: true,
+	},
+	5: {
+		overlap:  true,
+		q:        history.Query{Limit: 2, Last: true},
+		expected: []string{"4", "3", "2", "1", "0"},
+		complete: true,
+	},
+	6: {
+		q:        history.Query{Limit: 2, AfterID: "1", Reverse: true},
+		expected: []string{"2", "3", "4"},
+		complete: true,
+	},
+	7: {
+		q:        history.Query{Limit: 2, PageID: "2"},
+		expected: []string{"3", "4"},
+		complete: true,
+	},
+}
+
+func TestFetchAll(t *testing.T) {
+	for i, tc := range fetchAllTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var store history.Store = &history.MemStore{}
+			if tc.overlap {
+				store = &overlapStore{}
+			}
+			srv := &history.Server{Store: store}
+			h := history.NewHandler(nil)
+			cs := newHistoryServer(srv, h)
+			fillStore(t, store, cs.Client.LocalAddr().Bare(), 5)
+
+			iter := h.FetchAll(context.Background(), tc.q, jid.JID{}, tc.max, cs.Client)
+			bodies := collectAll(t, iter)
+			if err := iter.Err(); err != nil {
+				t.Fatalf("error iterating: %v", err)
+			}
+			if !reflect.DeepEqual(bodies, tc.expected) {
+				t.Errorf("wrong messages: want=%q, got=%q", tc.expected, bodies)
+			}
+			if complete := iter.Result().Complete; complete != tc.complete {
+				t.Errorf("wrong value for complete: want=%t, got=%t", tc.complete, complete)
+			}
+		})
+	}
+}
+
+func TestFetchAllErr(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}}
+	h := history.NewHandler(nil)
+	cs := newHistoryServer(srv, h)
+	fillStore(t, srv.Store, cs.Client.LocalAddr().Bare(), 5)
+
+	iter := h.FetchAll(context.Background(), history.Query{PageID: "nope"}, jid.JID{}, 0, cs.Client)
+	if bodies := collectAll(t, iter); len(bodies) != 0 {
+		t.Errorf("did not expect any messages, got=%q", bodies)
+	}
+	if err := iter.Err(); err == nil {
+		t.Errorf("expected an error for an unknown page")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	iter = h.FetchAll(ctx, history.Query{}, jid.JID{}, 0, cs.Client)
+	collectAll(t, iter)
+	if err := iter.Err(); !errors.Is(err, context.Canceled) {
+		t.Errorf("wrong error for canceled context: want=%v, got=%v", context.Canceled, err)
+	}
+}
+
+func TestFetchAllClose(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}}
+	h := history.NewHandler(nil)
+	cs := newHistoryServer(srv, h)
+	fillStore(t, srv.Store, cs.Client.LocalAddr().Bare(), 5)
+
+	iter := h.FetchAll(context.Background(), history.Query{Limit: 1}, jid.JID{}, 0, cs.Client)
+	if !iter.Next() {
+		t.Fatalf("expected a message, got error: %v", iter.Err())
+	}
+	err := iter.Close()
+	if err != nil {
+		t.Fatalf("error closing iterator: %v", err)
+	}
+	if iter.Next() {
+		t.Errorf("did not expect more messages after close")
+	}
+	if err := iter.Err(); err != nil {
+		t.Errorf("did not expect an error after close, got=%v", err)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Default is the default archiving behavior for JIDs that do not appear in
+// the always or never lists of the archiving preferences.
+type Default string
+
+// A list of possible default archiving behaviors.
+const (
+	// Always archive all messages.
+	Always Default = "always"
+
+	// Never archive messages.
+	Never Default = "never"
+
+	// Roster archives messages to and from contacts in the roster.
+	Roster Default = "roster"
+)
+
+// Prefs are the archiving preferences of an account.
+type Prefs struct {
+	Default Default
+
+	// Always is a list of JIDs for which messages are always archived.
+	Always []jid.JID
+
+	// Never is a list of JIDs for which messages are never archived.
+	Never []jid.JID
+}
+
+func jidList(name string, jids []jid.JID) xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, j := range jids {
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(j.String())),
+			xml.StartElement{Name: xml.Name{Local: "jid"}},
+		))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{Name: xml.Name{Local: name}},
+	)
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (p Prefs) TokenReader() xml.TokenReader {
+	start := xml.StartElement{Name: xml.Name{Space: NS, Local: "prefs"}}
+	if p.Default != "" {
+		start.Attr = append(start.Attr, xml.Attr{
+			Name:  xml.Name{Local: "default"},
+			Value: string(p.Default),
+		})
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(
+			jidList("always", p.Always),
+			jidList("never", p.Never),
+		),
+		start,
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (p Prefs) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, p.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (p Prefs) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := p.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (p *Prefs) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	v := struct {
+		Default Default `xml:"default,attr"`
+		Always  struct {
+			JID []jid.JID `xml:"jid"`
+		} `xml:"always"`
+		Never struct {
+			JID []jid.JID `xml:"jid"`
+		} `xml:"never"`
+	}{}
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	p.Default = v.Default
+	p.Always = v.Always.JID
+	p.Never = v.Never.JID
+	return nil
+}
+
+// GetPrefs returns the archiving preferences of the account.
+func GetPrefs(ctx context.Context, s *xmpp.Session) (Prefs, error) {
+	return GetPrefsIQ(ctx, stanza.IQ{}, s)
+}
+
+// GetPrefsIQ is like GetPrefs but it allows modifying the underlying IQ.
+// Changing the type of the IQ has no effect.
+func GetPrefsIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session) (Prefs, error) {
+	iq.Type = stanza.GetIQ
+	var p Prefs
+	err := s.UnmarshalIQ(ctx, iq.Wrap(xmlstream.Wrap(
+		nil,
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "prefs"}},
+	)), &p)
+	return p, err
+}
+
+// SetPrefs replaces the archiving preferences of the account and returns the
+// preferences that were applied by the server.
+// Servers may ignore preferences they do not support, so the result may not
+// match p.
+func SetPrefs(ctx context.Context, s *xmpp.Session, p Prefs) (Prefs, error) {
+	return SetPrefsIQ(ctx, stanza.IQ{}, s, p)
+}
+
+// SetPrefsIQ is like SetPrefs but it allows modifying the underlying IQ.
+// Changing the type of the IQ has no effect.
+func SetPrefsIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session, p Prefs) (Prefs, error) {
+	iq.Type = stanza.SetIQ
+	var result Prefs
+	err := s.UnmarshalIQ(ctx, iq.Wrap(p.TokenReader()), &result)
+	return result, err
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = history.Prefs{}
+	_ xml.Unmarshaler     = (*history.Prefs)(nil)
+	_ xmlstream.Marshaler = history.Prefs{}
+	_ xmlstream.WriterTo  = history.Prefs{}
+)
+
+var prefsTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &history.Prefs{},
+		XML:   `<prefs xmlns="urn:xmpp:mam:2"><always></always><never></never></prefs>`,
+	},
+	1: {
+		Value: &history.Prefs{
+			Default: history.Roster,
+			Always:  []jid.JID{jid.MustParse("romeo@montague.lit")},
+			Never: []jid.JID{
+				jid.MustParse("montague@montague.lit"),
+				jid.MustParse("tybalt@capulet.lit"),
+			},
+		},
+		XML: `<prefs xmlns="urn:xmpp:mam:2" default="roster"><always><jid>romeo@montague.lit</jid></always><never><jid>montague@montague.lit</jid><jid>tybalt@capulet.lit</jid></never></prefs>`,
+	},
+}
+
+func TestPrefsEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, prefsTestCases)
+}
+
+func TestGetSetPrefs(t *testing.T) {
+	stored := history.Prefs{Default: history.Always}
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandlerFunc(func(e xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			iq, err := stanza.NewIQ(*start)
+			if err != nil {
+				return err
+			}
+			d := xml.NewTokenDecoder(e)
+			tok, err := d.Token()
+			if err != nil {
+				return err
+			}
+			payload := tok.(xml.StartElement)
+			if iq.Type == stanza.SetIQ {
+				var p history.Prefs
+				err = d.DecodeElement(&p, &payload)
+				if err != nil {
+					return err
+				}
+				// Pretend that the server does not support the never list.
+				p.Never = nil
+				stored = p
+			}
+			_, err = xmlstream.Copy(e, iq.Result(stored.TokenReader()))
+			return err
+		}),
+	)
+
+	p, err := history.GetPrefs(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error getting prefs: %v", err)
+	}
+	if !reflect.DeepEqual(p, history.Prefs{Default: history.Always}) {
+		t.Errorf("wrong prefs: want=%+v, got=%+v", history.Prefs{Default: history.Always}, p)
+	}
+
+	romeo := jid.MustParse("romeo@montague.lit")
+	p, err = history.SetPrefs(context.Background(), cs.Client, history.Prefs{
+		Default: history.Never,
+		Always:  []jid.JID{romeo},
+		Never:   []jid.JID{jid.MustParse("tybalt@capulet.lit")},
+	})
+	if err != nil {
+		t.Fatalf("error setting prefs: %v", err)
+	}
+	expected := history.Prefs{Default: history.Never, Always: []jid.JID{romeo}}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("wrong applied prefs: want=%+v, got=%+v", expected, p)
+	}
+	p, err = history.GetPrefs(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error getting prefs: %v", err)
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("wrong stored prefs: want=%+v, got=%+v", expected, p)
+	}
+}
@@ -5,21 +5,30 @@
 package history
 
 import (
+	"context"
 	"encoding/xml"
 	"time"
 
 	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
 	"mellium.im/xmpp/form"
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/paging"
+	"mellium.im/xmpp/stanza"
 )
 
 // Query is a request to the archive for data.
 // An empty query indicates all messages should be fetched without a filter and
 // with a random ID.
+//
+// To query the archive of a group chat, send the query to the address of the
+// channel.
+// To query the archive of a pubsub node, send the query to the pubsub service
+// and set Node.
 type Query struct {
 	// Query parameters
-	ID string
+	ID   string
+	Node string
 
 	// Filters
 	With     jid.JID
@@ -44,9 +53,34 @@ type Query struct {
 
 	// Reverse flips messages returned within a page.
 	Reverse bool
+
+	// Form contains values for any additional fields supported by the archive,
+	// such as FieldFullText or FieldIncludeGroupchat.
+	// It is normally the form returned by GetForm with the extra fields set.
+	// The filters above take precedence over fields with the same name in the
+	// form.
+	//
+	// When unmarshaling a query, Form is only set if the query contains fields
+	// other than the filters above.
+	Form *form.Data
 }
 
+// Well known fields that may be supported by an archive in addition to the
+// standard filters.
+// Support for these fields can be discovered using GetForm.
+const (
+	// FieldFullText is a text field that limits results to messages that match
+	// a full text search.
+	FieldFullText = "{urn:xmpp:fulltext:0}fulltext"
+
+	// FieldIncludeGroupchat is a boolean field that indicates whether messages
+	// from group chats should be included in the results when querying the
+	// archive of an account.
+	FieldIncludeGroupchat = "include-groupchat"
+)
+
 const (
+	fieldType   = "FORM_TYPE"
 	fieldWith   = "with"
 	fieldStart  = "start"
 	fieldEnd    = "end"
@@ -57,15 +91,36 @@ const (
 
 // TokenReader implements xmlstream.Marshaler.
 func (f *Query) TokenReader() xml.TokenReader {
-	dataForm := form.New(
-		form.Hidden("FORM_TYPE", form.Value(NS)),
+	fields := []form.Field{
+		form.Hidden(fieldType, form.Value(NS)),
 		form.JID(fieldWith),
 		form.Text(fieldStart),
 		form.Text(fieldEnd),
 		form.Text(fieldAfter),
 		form.Text(fieldBefore),
 		form.ListMulti(fieldIDs),
-	)
+	}
+	var extra []form.FieldData
+	if f.Form != nil {
+		f.Form.ForFields(func(field form.FieldData) {
+			if standardField(field.Var) || field.Type == form.TypeFixed {
+				return
+			}
+			newField, ok := fieldTypes[field.Type]
+			if !ok {
+				return
+			}
+			fields = append(fields, newField(field.Var))
+			extra = append(extra, field)
+		})
+	}
+	dataForm := form.New(fields...)
+	for _, field := range extra {
+		if v, ok := f.Form.Get(field.Var); ok {
+			/* #nosec */
+			dataForm.Set(field.Var, v)
+		}
+	}
 	if !f.With.Equal(jid.JID{}) {
 		/* #nosec */
 		dataForm.Set(fieldWith, f.With)
@@ -112,15 +167,42 @@ func (f *Query) TokenReader() xml.TokenReader {
 			xml.StartElement{Name: xml.Name{Local: "flip-page"}},
 		))
 	}
+	start := xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "query"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "queryid"}, Value: f.ID}},
+	}
+	if f.Node != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "node"}, Value: f.Node})
+	}
 	return xmlstream.Wrap(
 		xmlstream.MultiReader(inner...),
-		xml.StartElement{
-			Name: xml.Name{Space: NS, Local: "query"},
-			Attr: []xml.Attr{{Name: xml.Name{Local: "queryid"}, Value: f.ID}},
-		},
+		start,
 	)
 }
 
+// fieldTypes maps field types to the functions that create them.
+// Fixed fields are omitted because they cannot be submitted.
+var fieldTypes = map[form.FieldType]func(string, ...form.Option) form.Field{
+	form.TypeBoolean:     form.Boolean,
+	form.TypeHidden:      form.Hidden,
+	form.TypeJIDMulti:    form.JIDMulti,
+	form.TypeJID:         form.JID,
+	form.TypeListMulti:   form.ListMulti,
+	form.TypeList:        form.List,
+	form.TypeTextMulti:   form.TextMulti,
+	form.TypeTextPrivate: form.TextPrivate,
+	form.TypeText:        form.Text,
+	"":                   form.Text,
+}
+
+func standardField(v string) bool {
+	switch v {
+	case fieldType, fieldWith, fieldStart, fieldEnd, fieldAfter, fieldBefore, fieldIDs:
+		return true
+	}
+	return false
+}
+
 // WriteXML implements xmlstream.WriterTo.
 func (f *Query) WriteXML(w xmlstream.TokenWriter) (int, error) {
 	return xmlstream.Copy(w, f.TokenReader())
@@ -137,6 +219,7 @@ func (f *Query) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	s := struct {
 		XMLName xml.Name   `xml:"urn:xmpp:mam:2 query"`
 		ID      string     `xml:"queryid,attr"`
+		Node    string     `xml:"node,attr"`
 		Form    *form.Data `xml:"jabber:x:data x"`
 		Flip    struct {
 			XMLName xml.Name `xml:"flip-page"`
@@ -147,6 +230,7 @@ func (f *Query) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 			After   string   `xml:"after"`
 			Before  struct {
 				XMLName xml.Name `xml:"before"`
+				ID      string   `xml:",chardata"`
 			}
 		}
 	}{}
@@ -156,10 +240,21 @@ func (f *Query) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	}
 
 	f.ID = s.ID
+	f.Node = s.Node
+	f.Limit = s.Set.Max
+	f.Last = s.Set.Before.XMLName.Local == "before"
+	f.Reverse = s.Flip.XMLName.Local == "flip-page"
+	if f.Last {
+		f.PageID = s.Set.Before.ID
+	} else {
+		f.PageID = s.Set.After
+	}
+	if s.Form == nil {
+		return nil
+	}
 	f.With, _ = s.Form.GetJID(fieldWith)
 	startTime, ok := s.Form.GetString(fieldStart)
 	if ok {
-		//panic(startTime)
 		f.Start, err = time.Parse(time.RFC3339, startTime)
 		if err != nil {
 			return err
@@ -175,9 +270,38 @@ func (f *Query) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
 	f.BeforeID, _ = s.Form.GetString(fieldBefore)
 	f.AfterID, _ = s.Form.GetString(fieldAfter)
 	f.IDs, _ = s.Form.GetStrings(fieldIDs)
-	f.Limit = s.Set.Max
-
-	f.Last = s.Set.Before.XMLName.Local == "before"
-	f.Reverse = s.Flip.XMLName.Local == "flip-page"
+	s.Form.ForFields(func(field form.FieldData) {
+		if !standardField(field.Var) {
+			f.Form = s.Form
+		}
+	})
 	return nil
 }
+
+// GetForm requests the form describing the fields that may be used to query
+// the archive at the provided address.
+// An empty address queries the archive of the account.
+//
+// The form can be used to discover support for fields in addition to the
+// standard filters, such as FieldFullText, and to set values for them before
+// using it as the Form of a Query.
+func GetForm(ctx context.Context, to jid.JID, s *xmpp.Session) (*form.Data, error) {
+	return GetFormIQ(ctx, stanza.IQ{To: to}, s)
+}
+
+// GetFormIQ is like GetForm but it allows modifying the underlying IQ.
+// Changing the type of the IQ has no effect.
+func GetFormIQ(ctx context.Context, iq stanza.IQ, s *xmpp.Session) (*form.Data, error) {
+	iq.Type = stanza.GetIQ
+	v := struct {
+		Form form.Data `xml:"jabber:x:data x"`
+	}{}
+	err := s.UnmarshalIQ(ctx, iq.Wrap(xmlstream.Wrap(
+		nil,
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}},
+	)), &v)
+	if err != nil {
+		return nil, err
+	}
+	return &v.Form, nil
+}
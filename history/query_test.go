@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"mellium.im/xmlstream"
+	"mellium.im/xmpp/form"
 	"mellium.im/xmpp/history"
 	"mellium.im/xmpp/internal/xmpptest"
 	"mellium.im/xmpp/jid"
@@ -70,6 +71,77 @@ var queryEncodingTestCases = []xmpptest.EncodingTestCase{
 		},
 		XML: `<query xmlns="urn:xmpp:mam:2" queryid=""><x xmlns="jabber:x:data" type="submit"><field type="hidden" var="FORM_TYPE"><value>urn:xmpp:mam:2</value></field></x><set xmlns="http://jabber.org/protocol/rsm"><before></before></set><flip-page></flip-page></query>`,
 	},
+	8: {
+		Value: &history.Query{
+			ID:   "f27",
+			Node: "fdp/submitted/stan.is/coffee",
+		},
+		XML: `<query xmlns="urn:xmpp:mam:2" queryid="f27" node="fdp/submitted/stan.is/coffee"><x xmlns="jabber:x:data" type="submit"><field type="hidden" var="FORM_TYPE"><value>urn:xmpp:mam:2</value></field></x><set xmlns="http://jabber.org/protocol/rsm"></set></query>`,
+	},
+	9: {
+		Value: &history.Query{
+			Limit:  10,
+			PageID: "09af3-cc343-b409f",
+		},
+		XML: `<query xmlns="urn:xmpp:mam:2" queryid=""><x xmlns="jabber:x:data" type="submit"><field type="hidden" var="FORM_TYPE"><value>urn:xmpp:mam:2</value></field></x><set xmlns="http://jabber.org/protocol/rsm"><max>10</max><after>09af3-cc343-b409f</after></set></query>`,
+	},
+	10: {
+		Value: &history.Query{
+			Last:   true,
+			PageID: "09af3-cc343-b409f",
+		},
+		XML: `<query xmlns="urn:xmpp:mam:2" queryid=""><x xmlns="jabber:x:data" type="submit"><field type="hidden" var="FORM_TYPE"><value>urn:xmpp:mam:2</value></field></x><set xmlns="http://jabber.org/protocol/rsm"><before>09af3-cc343-b409f</before></set></query>`,
+	},
+}
+
+func TestQueryExtraFields(t *testing.T) {
+	f := form.New(
+		form.Hidden("FORM_TYPE", form.Value(history.NS)),
+		form.Text("with"),
+		form.Text(history.FieldFullText),
+		form.Boolean(history.FieldIncludeGroupchat),
+		form.Fixed(form.Value("Ignored")),
+	)
+	_, err := f.Set(history.FieldFullText, "fire")
+	if err != nil {
+		t.Fatalf("error setting full text field: %v", err)
+	}
+	_, err = f.Set(history.FieldIncludeGroupchat, true)
+	if err != nil {
+		t.Fatalf("error setting include groupchat field: %v", err)
+	}
+	_, err = f.Set("with", "romeo@example.net")
+	if err != nil {
+		t.Fatalf("error setting with field: %v", err)
+	}
+	q := &history.Query{
+		ID:   "q1",
+		With: jid.MustParse("juliet@example.com"),
+		Form: f,
+	}
+	out, err := xml.Marshal(q)
+	if err != nil {
+		t.Fatalf("error marshaling query: %v", err)
+	}
+	const expected = `<query xmlns="urn:xmpp:mam:2" queryid="q1"><x xmlns="jabber:x:data" type="submit"><field type="hidden" var="FORM_TYPE"><value>urn:xmpp:mam:2</value></field><field type="jid-single" var="with"><value>juliet@example.com</value></field><field type="text-single" var="{urn:xmpp:fulltext:0}fulltext"><value>fire</value></field><field type="boolean" var="include-groupchat"><value>true</value></field></x><set xmlns="http://jabber.org/protocol/rsm"></set></query>`
+	if string(out) != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+
+	var decoded history.Query
+	err = xml.Unmarshal(out, &decoded)
+	if err != nil {
+		t.Fatalf("error unmarshaling query: %v", err)
+	}
+	if !decoded.With.Equal(q.With) {
+		t.Errorf("wrong with: want=%v, got=%v", q.With, decoded.With)
+	}
+	if v, _ := decoded.Form.GetString(history.FieldFullText); v != "fire" {
+		t.Errorf("wrong full text field: want=fire, got=%q", v)
+	}
+	if v, _ := decoded.Form.GetBool(history.FieldIncludeGroupchat); !v {
+		t.Errorf("wrong include groupchat field: want=true, got=%t", v)
+	}
 }
 
 func TestEncodeQuery(t *testing.T) {
@@ -0,0 +1,242 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/forward"
+	"mellium.im/xmpp/hints"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// defaultMaxResults is the maximum number of messages returned in a single page
+// if the server does not set a limit.
+const defaultMaxResults = 50
+
+// Server answers history queries using a Store and archives messages.
+//
+// The zero value is not usable, Store must be set.
+type Server struct {
+	Store Store
+
+	// MaxResults is the maximum number of messages returned in a single page.
+	// Queries that ask for more messages, or do not ask for a specific number,
+	// receive at most MaxResults messages.
+	// If zero, a default of 50 is used.
+	MaxResults uint64
+
+	// Allowed reports whether the entity from may query the archive.
+	// If nil, only the owner of the archive (an entity with the same bare JID)
+	// may query it.
+	Allowed func(from, archive jid.JID) bool
+}
+
+// Handle returns an option that registers a handler for history queries and
+// requests for the query form sent over s.
+//
+// The archive being queried is the bare JID that the query is addressed to or,
+// if the query has no to address, the bare JID of the entity that sent it as
+// is the case for clients querying their own archive.
+// The entity making the query is always the remote address of s and queries
+// with a from address that belongs to a different account are rejected.
+func (srv *Server) Handle(s *xmpp.Session) mux.Option {
+	h := serverHandler{srv: srv, s: s}
+	return func(m *mux.ServeMux) {
+		mux.IQ(stanza.GetIQ, xml.Name{Space: NS, Local: "query"}, h)(m)
+		mux.IQ(stanza.SetIQ, xml.Name{Space: NS, Local: "query"}, h)(m)
+	}
+}
+
+// removeXMLNS removes xmlns attributes which are already represented by the
+// namespaces of element names to prevent them from being duplicated when the
+// tokens are encoded again.
+var removeXMLNS = xmlstream.RemoveAttr(func(_ xml.StartElement, attr xml.Attr) bool {
+	return attr.Name.Space == "" && attr.Name.Local == "xmlns"
+})
+
+// encode returns the XML encoding of the tokens read from r.
+func encode(r xml.TokenReader) ([]byte, error) {
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	_, err := xmlstream.Copy(e, removeXMLNS(r))
+	if err != nil {
+		return nil, err
+	}
+	err = e.Flush()
+	return buf.Bytes(), err
+}
+
+// Archive stores the message read from r in the archive.
+// With is the other party to the conversation, see Message for details.
+//
+// Messages are only stored if their processing hints allow it.
+// Messages with a body are stored unless they have a no-store or
+// no-permanent-store hint, other messages are only stored if they have a store
+// hint.
+// Error messages are never stored.
+// If the message was stored, its ID in the archive is returned and ok is true.
+// The ID can be used to add a stanza-id to the message before it is delivered.
+func (srv *Server) Archive(archive, with jid.JID, r xml.TokenReader) (id string, ok bool, err error) {
+	raw, err := encode(r)
+	if err != nil {
+		return "", false, err
+	}
+
+	var v struct {
+		Type stanza.MessageType `xml:"type,attr"`
+		Body []struct{}         `xml:"body"`
+	}
+	err = xml.Unmarshal(raw, &v)
+	if err != nil {
+		return "", false, err
+	}
+	if v.Type == stanza.ErrorMessage {
+		return "", false, nil
+	}
+	h, err := hints.Read(xml.NewDecoder(bytes.NewReader(raw)))
+	if err != nil {
+		return "", false, err
+	}
+	if !h.Archive(len(v.Body) > 0) {
+		return "", false, nil
+	}
+
+	id = attr.RandomID()
+	err = srv.Store.Add(archive.Bare(), Message{
+		ID:     id,
+		Time:   time.Now().UTC(),
+		With:   with,
+		Stanza: raw,
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return id, true, nil
+}
+
+type serverHandler struct {
+	srv *Server
+	s   *xmpp.Session
+}
+
+func sendErr(t xmlstream.TokenWriter, iq stanza.IQ, typ stanza.ErrorType, cond stanza.Condition) error {
+	_, err := xmlstream.Copy(t, iq.Error(stanza.Error{Type: typ, Condition: cond}))
+	return err
+}
+
+func (h serverHandler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	// The from address is set by the client, so only trust the address of the
+	// session.
+	from := h.s.RemoteAddr()
+	if !iq.From.Equal(jid.JID{}) && !iq.From.Bare().Equal(from.Bare()) {
+		return sendErr(t, iq, stanza.Cancel, stanza.Forbidden)
+	}
+	archive := iq.To.Bare()
+	if archive.Equal(jid.JID{}) {
+		archive = from.Bare()
+	}
+	allowed := h.srv.Allowed
+	if allowed == nil {
+		allowed = func(from, archive jid.JID) bool {
+			return from.Bare().Equal(archive)
+		}
+	}
+	if !allowed(from, archive) {
+		return sendErr(t, iq, stanza.Cancel, stanza.Forbidden)
+	}
+
+	if iq.Type == stanza.GetIQ {
+		_, err := xmlstream.Copy(t, iq.Result(xmlstream.Wrap(
+			form.New(
+				form.Hidden(fieldType, form.Value(NS)),
+				form.JID(fieldWith),
+				form.Text(fieldStart),
+				form.Text(fieldEnd),
+				form.Text(fieldBefore),
+				form.Text(fieldAfter),
+				form.ListMulti(fieldIDs),
+			).TokenReader(),
+			xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}},
+		)))
+		return err
+	}
+
+	var q Query
+	err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), t)).Decode(&q)
+	if err != nil {
+		return sendErr(t, iq, stanza.Modify, stanza.BadRequest)
+	}
+
+	max := h.srv.MaxResults
+	if max == 0 {
+		max = defaultMaxResults
+	}
+	if q.Limit > 0 && q.Limit < max {
+		max = q.Limit
+	}
+	page, err := h.srv.Store.Query(archive, q, max)
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return sendErr(t, iq, stanza.Cancel, stanza.ItemNotFound)
+	case err != nil:
+		return sendErr(t, iq, stanza.Wait, stanza.InternalServerError)
+	}
+
+	msgs := page.Messages
+	if q.Reverse {
+		msgs = make([]Message, 0, len(page.Messages))
+		for i := len(page.Messages) - 1; i >= 0; i-- {
+			msgs = append(msgs, page.Messages[i])
+		}
+	}
+	for _, msg := range msgs {
+		_, err = xmlstream.Copy(t, resultMessage(q.ID, archive, from, msg))
+		if err != nil {
+			return err
+		}
+	}
+
+	count := page.Count
+	res := Result{Complete: page.Complete}
+	res.Set.Count = &count
+	if len(page.Messages) > 0 {
+		res.Set.First.ID = page.Messages[0].ID
+		res.Set.Last = page.Messages[len(page.Messages)-1].ID
+	}
+	_, err = xmlstream.Copy(t, iq.Result(res.TokenReader()))
+	return err
+}
+
+// resultMessage returns a message containing msg as the result of the query
+// with the given ID.
+func resultMessage(queryID string, archive, to jid.JID, msg Message) xml.TokenReader {
+	return stanza.Message{
+		ID:   attr.RandomID(),
+		To:   to,
+		From: archive,
+	}.Wrap(xmlstream.Wrap(
+		forward.Forwarded{
+			Delay: delay.Delay{Time: msg.Time},
+		}.Wrap(removeXMLNS(xml.NewDecoder(bytes.NewReader(msg.Stanza)))),
+		xml.StartElement{
+			Name: xml.Name{Space: NS, Local: "result"},
+			Attr: []xml.Attr{
+				{Name: xml.Name{Local: "queryid"}, Value: queryID},
+				{Name: xml.Name{Local: "id"}, Value: msg.ID},
+			},
+		},
+	))
+}
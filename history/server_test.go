@@ -0,0 +1,194 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// newHistoryServer returns a client and server where the server answers
+// history queries using srv and the client handles results using h.
+func newHistoryServer(srv *history.Server, h *history.Handler) *xmpptest.ClientServer {
+	var m *mux.ServeMux
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			return m.HandleXMPP(t, start)
+		}),
+		// Results are sent by the server session which uses the server namespace.
+		xmpptest.ClientHandler(mux.New(stanza.NSServer, history.Handle(h))),
+	)
+	m = mux.New(stanza.NSClient, srv.Handle(cs.Server))
+	return cs
+}
+
+type result struct {
+	ID        string `xml:"id,attr"`
+	QueryID   string `xml:"queryid,attr"`
+	Forwarded struct {
+		Delay struct {
+			Stamp string `xml:"stamp,attr"`
+		} `xml:"urn:xmpp:delay delay"`
+		Message struct {
+			To   string `xml:"to,attr"`
+			Body string `xml:"body"`
+		} `xml:"jabber:client message"`
+	} `xml:"urn:xmpp:forward:0 forwarded"`
+}
+
+// resultCollector returns a handler that decodes query results into results.
+func resultCollector(results *[]result) *history.Handler {
+	return history.NewHandler(mux.MessageHandlerFunc(func(_ stanza.Message, t xmlstream.TokenReadEncoder) error {
+		var r result
+		err := xml.NewTokenDecoder(t).Decode(&r)
+		if err != nil {
+			return err
+		}
+		*results = append(*results, r)
+		return nil
+	}))
+}
+
+func fetchBodies(t *testing.T, results *[]result, cs *xmpptest.ClientServer, q history.Query, to jid.JID) ([]string, history.Result) {
+	t.Helper()
+	*results = nil
+	res, err := history.Fetch(context.Background(), q, to, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching history: %v", err)
+	}
+	var bodies []string
+	for _, r := range *results {
+		if r.QueryID != q.ID {
+			t.Errorf("wrong query ID: want=%q, got=%q", q.ID, r.QueryID)
+		}
+		if r.ID == "" || r.Forwarded.Delay.Stamp == "" {
+			t.Errorf("expected result to have an ID and delay: %+v", r)
+		}
+		bodies = append(bodies, r.Forwarded.Message.Body)
+	}
+	return bodies, res
+}
+
+func TestServer(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}, MaxResults: 2}
+	var results []result
+	cs := newHistoryServer(srv, resultCollector(&results))
+	account := cs.Client.LocalAddr().Bare()
+
+	var stored []string
+	for _, msg := range []string{
+		`<message xmlns="jabber:client" to="romeo@example.net" type="chat"><body>one</body></message>`,
+		`<message xmlns="jabber:client" to="romeo@example.net" type="chat"><body>private</body><no-store xmlns="urn:xmpp:hints"/></message>`,
+		`<message xmlns="jabber:client" to="romeo@example.net" type="chat"><body>temporary</body><no-permanent-store xmlns="urn:xmpp:hints"/></message>`,
+		`<message xmlns="jabber:client" to="romeo@example.net" type="chat"><composing xmlns="http://jabber.org/protocol/chatstates"/></message>`,
+		`<message xmlns="jabber:client" to="romeo@example.net" type="error"><body>error</body></message>`,
+		`<message xmlns="jabber:client" to="romeo@example.net" type="chat"><store xmlns="urn:xmpp:hints"/></message>`,
+		`<message xmlns="jabber:client" to="romeo@example.net" type="chat"><body>three</body></message>`,
+	} {
+		id, ok, err := srv.Archive(account, jid.MustParse("romeo@example.net"), xml.NewDecoder(strings.NewReader(msg)))
+		if err != nil {
+			t.Fatalf("error archiving message: %v", err)
+		}
+		if ok {
+			if id == "" {
+				t.Errorf("archived message has no ID")
+			}
+			stored = append(stored, id)
+		}
+	}
+	if len(stored) != 3 {
+		t.Fatalf("wrong number of messages archived: want=3, got=%d", len(stored))
+	}
+
+	bodies, res := fetchBodies(t, &results, cs, history.Query{ID: "q1"}, jid.JID{})
+	if want := []string{"one", ""}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("wrong first page: want=%q, got=%q", want, bodies)
+	}
+	if res.Complete || res.Set.Last != stored[1] || res.Set.First.ID != stored[0] || res.Set.Count == nil || *res.Set.Count != 3 {
+		t.Errorf("wrong first page result: %+v", res)
+	}
+
+	bodies, res = fetchBodies(t, &results, cs, history.Query{ID: "q2", PageID: res.Set.Last}, jid.JID{})
+	if want := []string{"three"}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("wrong second page: want=%q, got=%q", want, bodies)
+	}
+	if !res.Complete || res.Set.Last != stored[2] {
+		t.Errorf("wrong second page result: %+v", res)
+	}
+
+	bodies, res = fetchBodies(t, &results, cs, history.Query{ID: "q3", Last: true, Reverse: true, Limit: 5}, jid.JID{})
+	if want := []string{"three", ""}; !reflect.DeepEqual(bodies, want) {
+		t.Errorf("wrong last page: want=%q, got=%q", want, bodies)
+	}
+	if res.Complete || res.Set.First.ID != stored[1] {
+		t.Errorf("wrong last page result: %+v", res)
+	}
+
+	_, err := history.Fetch(context.Background(), history.Query{PageID: "nope"}, jid.JID{}, cs.Client)
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.ItemNotFound {
+		t.Errorf("wrong error for unknown page: want=%v, got=%v", stanza.ItemNotFound, err)
+	}
+	_, err = history.Fetch(context.Background(), history.Query{}, jid.MustParse("romeo@example.net"), cs.Client)
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.Forbidden {
+		t.Errorf("wrong error for other archive: want=%v, got=%v", stanza.Forbidden, err)
+	}
+	// The from address is set by the client and must not be trusted.
+	victim := jid.MustParse("romeo@example.net")
+	_, err = history.FetchIQ(context.Background(), history.Query{}, stanza.IQ{From: victim, To: victim}, cs.Client)
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.Forbidden {
+		t.Errorf("wrong error for spoofed from: want=%v, got=%v", stanza.Forbidden, err)
+	}
+}
+
+func TestServerFeatures(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}}
+	m := mux.New(stanza.NSClient, srv.Handle(nil))
+	// The handler is registered for multiple IQ types so features may be
+	// reported more than once.
+	features := make(map[info.Feature]struct{})
+	err := m.ForFeatures("", func(f info.Feature) error {
+		features[f] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error listing features: %v", err)
+	}
+	expected := map[info.Feature]struct{}{
+		history.Feature:    {},
+		history.FeatureExt: {},
+	}
+	if !reflect.DeepEqual(features, expected) {
+		t.Errorf("wrong features: want=%v, got=%v", expected, features)
+	}
+}
+
+func TestServerGetForm(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}}
+	cs := newHistoryServer(srv, &history.Handler{})
+	f, err := history.GetForm(context.Background(), jid.JID{}, cs.Client)
+	if err != nil {
+		t.Fatalf("error getting form: %v", err)
+	}
+	var fields []string
+	f.ForFields(func(field form.FieldData) {
+		fields = append(fields, field.Var)
+	})
+	expected := []string{"FORM_TYPE", "with", "start", "end", "before-id", "after-id", "ids"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("wrong fields: want=%v, got=%v", expected, fields)
+	}
+}
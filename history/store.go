@@ -0,0 +1,203 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp/jid"
+)
+
+// ErrNotFound is returned by a Store when a query references a message ID
+// that does not exist in the archive.
+var ErrNotFound = errors.New("history: message not found in archive")
+
+// Message is a message stored in an archive.
+type Message struct {
+	// ID is the unique and stable ID of the message within the archive.
+	ID string
+
+	// Time is the time at which the message was archived.
+	Time time.Time
+
+	// With is the JID of the other party to the conversation.
+	// In the archive of a user this is the sender of incoming messages and the
+	// recipient of outgoing messages, in the archive of a group chat it is the
+	// occupant JID of the sender.
+	With jid.JID
+
+	// Stanza is the XML encoded message stanza.
+	Stanza []byte
+}
+
+// Page is a page of messages returned by a Store.
+type Page struct {
+	// Messages in the page in the order they were archived.
+	Messages []Message
+
+	// Complete is true if the page includes the first (when paging backwards)
+	// or last (when paging forwards) message that matches the query.
+	Complete bool
+
+	// Count is the total number of messages that match the query filters
+	// across all pages.
+	Count uint64
+}
+
+// Store is used by a Server to store and query archives.
+//
+// Archives are identified by a bare JID, normally the JID of the account or
+// group chat that owns the archive.
+// Methods may be called concurrently.
+type Store interface {
+	// Add appends a message to an archive.
+	// The ID of the message must not already exist in the archive.
+	Add(archive jid.JID, msg Message) error
+
+	// Query returns a page of at most max messages from the archive that match
+	// the filters in q.
+	// If q.Last is set the page contains the last messages that match the
+	// filters (before q.PageID if it is set), otherwise it contains the first
+	// messages (after q.PageID if it is set).
+	// If max is zero, all matching messages are returned.
+	//
+	// If q.PageID, q.AfterID, q.BeforeID or any of q.IDs do not exist in the
+	// archive, ErrNotFound must be returned.
+	// Query should ignore q.Limit in favor of max, and q.ID and q.Reverse which
+	// are handled by the Server.
+	// Stores that support additional fields, such as FieldFullText, can read
+	// them from q.Form, and stores that keep archives of pubsub nodes can use
+	// q.Node.
+	Query(archive jid.JID, q Query, max uint64) (Page, error)
+}
+
+// MemStore is an in-memory Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m        sync.Mutex
+	archives map[string][]Message
+}
+
+// Add implements Store.
+func (s *MemStore) Add(archive jid.JID, msg Message) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.archives == nil {
+		s.archives = make(map[string][]Message)
+	}
+	key := archive.Bare().String()
+	for _, m := range s.archives[key] {
+		if m.ID == msg.ID {
+			return errors.New("history: message ID already exists in archive")
+		}
+	}
+	s.archives[key] = append(s.archives[key], msg)
+	return nil
+}
+
+// Query implements Store.
+func (s *MemStore) Query(archive jid.JID, q Query, max uint64) (Page, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	msgs := s.archives[archive.Bare().String()]
+
+	start, end := 0, len(msgs)
+	if q.AfterID != "" {
+		idx := index(msgs, q.AfterID)
+		if idx < 0 {
+			return Page{}, ErrNotFound
+		}
+		start = idx + 1
+	}
+	if q.BeforeID != "" {
+		idx := index(msgs, q.BeforeID)
+		if idx < 0 {
+			return Page{}, ErrNotFound
+		}
+		end = idx
+	}
+	for _, id := range q.IDs {
+		if index(msgs, id) < 0 {
+			return Page{}, ErrNotFound
+		}
+	}
+
+	var matched []Message
+	for i := start; i < end; i++ {
+		if match(msgs[i], q) {
+			matched = append(matched, msgs[i])
+		}
+	}
+
+	page := Page{Count: uint64(len(matched))}
+	first, last := 0, len(matched)
+	if q.PageID != "" {
+		idx := index(matched, q.PageID)
+		if idx < 0 {
+			return Page{}, ErrNotFound
+		}
+		if q.Last {
+			last = idx
+		} else {
+			first = idx + 1
+		}
+	}
+	if max > 0 && uint64(last-first) > max {
+		if q.Last {
+			first = last - int(max)
+		} else {
+			last = first + int(max)
+		}
+	}
+	if q.Last {
+		page.Complete = first == 0
+	} else {
+		page.Complete = last == len(matched)
+	}
+	page.Messages = append([]Message(nil), matched[first:last]...)
+	return page, nil
+}
+
+func index(msgs []Message, id string) int {
+	for i, m := range msgs {
+		if m.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func match(m Message, q Query) bool {
+	if !q.With.Equal(jid.JID{}) {
+		with := m.With
+		if q.With.Resourcepart() == "" {
+			with = with.Bare()
+		}
+		if !with.Equal(q.With) {
+			return false
+		}
+	}
+	if !q.Start.IsZero() && m.Time.Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && m.Time.After(q.End) {
+		return false
+	}
+	if len(q.IDs) > 0 {
+		var found bool
+		for _, id := range q.IDs {
+			if id == m.ID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/jid"
+)
+
+var _ history.Store = (*history.MemStore)(nil)
+
+var (
+	testArchive = jid.MustParse("juliet@example.com")
+	testRomeo   = jid.MustParse("romeo@example.net/orchard")
+	testNurse   = jid.MustParse("nurse@example.com/kitchen")
+)
+
+func newTestStore(t *testing.T) *history.MemStore {
+	t.Helper()
+	s := &history.MemStore{}
+	for i, with := range []jid.JID{testRomeo, testNurse, testRomeo, testRomeo.Bare(), testNurse, testRomeo} {
+		err := s.Add(testArchive, history.Message{
+			ID:   strconv.Itoa(i),
+			Time: time.Unix(int64(i), 0).UTC(),
+			With: with,
+		})
+		if err != nil {
+			t.Fatalf("error adding message %d: %v", i, err)
+		}
+	}
+	return s
+}
+
+var storeQueryTestCases = [...]struct {
+	q        history.Query
+	max      uint64
+	ids      []string
+	complete bool
+	count    uint64
+	err      error
+}{
+	0: {
+		ids:      []string{"0", "1", "2", "3", "4", "5"},
+		complete: true,
+		count:    6,
+	},
+	1: {
+		max:   2,
+		ids:   []string{"0", "1"},
+		count: 6,
+	},
+	2: {
+		q:        history.Query{PageID: "3"},
+		max:      2,
+		ids:      []string{"4", "5"},
+		complete: true,
+		count:    6,
+	},
+	3: {
+		q:        history.Query{Last: true},
+		max:      2,
+		ids:      []string{"4", "5"},
+		complete: false,
+		count:    6,
+	},
+	4: {
+		q:        history.Query{Last: true, PageID: "2"},
+		max:      5,
+		ids:      []string{"0", "1"},
+		complete: true,
+		count:    6,
+	},
+	5: {
+		q:        history.Query{With: testRomeo.Bare()},
+		ids:      []string{"0", "2", "3", "5"},
+		complete: true,
+		count:    4,
+	},
+	6: {
+		q:        history.Query{With: testRomeo},
+		ids:      []string{"0", "2", "5"},
+		complete: true,
+		count:    3,
+	},
+	7: {
+		q:        history.Query{Start: time.Unix(2, 0), End: time.Unix(4, 0)},
+		ids:      []string{"2", "3", "4"},
+		complete: true,
+		count:    3,
+	},
+	8: {
+		q:        history.Query{AfterID: "1", BeforeID: "4", With: testRomeo.Bare()},
+		max:      1,
+		ids:      []string{"2"},
+		count:    2,
+		complete: false,
+	},
+	9: {
+		q:        history.Query{IDs: []string{"4", "1"}},
+		ids:      []string{"1", "4"},
+		complete: true,
+		count:    2,
+	},
+	10: {
+		q:   history.Query{AfterID: "nope"},
+		err: history.ErrNotFound,
+	},
+	11: {
+		q:   history.Query{IDs: []string{"1", "nope"}},
+		err: history.ErrNotFound,
+	},
+	12: {
+		// The page ID must be part of the results of the query.
+		q:   history.Query{With: testNurse, PageID: "0"},
+		err: history.ErrNotFound,
+	},
+	13: {
+		q:        history.Query{With: jid.MustParse("tybalt@example.net")},
+		complete: true,
+	},
+}
+
+func TestMemStoreQuery(t *testing.T) {
+	s := newTestStore(t)
+	for i, tc := range storeQueryTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			page, err := s.Query(testArchive, tc.q, tc.max)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("wrong error: want=%v, got=%v", tc.err, err)
+			}
+			var ids []string
+			for _, msg := range page.Messages {
+				ids = append(ids, msg.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.ids) {
+				t.Errorf("wrong messages: want=%v, got=%v", tc.ids, ids)
+			}
+			if page.Complete != tc.complete {
+				t.Errorf("wrong value for complete: want=%t, got=%t", tc.complete, page.Complete)
+			}
+			if page.Count != tc.count {
+				t.Errorf("wrong count: want=%d, got=%d", tc.count, page.Count)
+			}
+		})
+	}
+}
+
+func TestMemStoreAdd(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.Add(testArchive, history.Message{ID: "1"}); err == nil {
+		t.Errorf("expected error adding duplicate ID")
+	}
+	if err := s.Add(testRomeo, history.Message{ID: "1"}); err != nil {
+		t.Errorf("unexpected error adding ID to another archive: %v", err)
+	}
+	page, err := s.Query(testRomeo.Bare(), history.Query{}, 0)
+	if err != nil {
+		t.Fatalf("error querying archive: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != "1" {
+		t.Errorf("wrong messages in archive: %+v", page.Messages)
+	}
+}
@@ -0,0 +1,418 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+// Positions stores the ID of the last message seen in each archive so that a
+// Syncer can continue where it left off after a reconnect.
+//
+// Archives are identified by a bare JID, the JID of the account for the
+// archive of the account or the JID of the channel for a group chat archive.
+// Methods may be called concurrently.
+type Positions interface {
+	// Last returns the ID of the last message seen in the archive or an empty
+	// string if no message has been seen.
+	Last(archive jid.JID) (string, error)
+
+	// SetLast sets the ID of the last message seen in the archive.
+	SetLast(archive jid.JID, id string) error
+}
+
+// MemPositions is an in-memory implementation of Positions.
+// The zero value is ready to use.
+type MemPositions struct {
+	m   sync.Mutex
+	ids map[string]string
+}
+
+// Last implements Positions.
+func (p *MemPositions) Last(archive jid.JID) (string, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.ids[archive.Bare().String()], nil
+}
+
+// SetLast implements Positions.
+func (p *MemPositions) SetLast(archive jid.JID, id string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.ids == nil {
+		p.ids = make(map[string]string)
+	}
+	p.ids[archive.Bare().String()] = id
+	return nil
+}
+
+// Progress reports the progress of a Syncer while it fetches messages from an
+// archive.
+type Progress struct {
+	// Fetched is the number of messages fetched from the archive so far.
+	Fetched uint64
+
+	// Total is the number of messages that will be fetched if it is known, or
+	// zero otherwise.
+	// When continuing after the last seen message it is only known if the
+	// archive reports the index of the first message in the result.
+	Total uint64
+
+	// Gap is true if the last seen message could not be found in the archive, or
+	// if no message had been seen, and the Syncer fell back to fetching the most
+	// recent messages.
+	// Messages between the last seen message and the first fetched message may
+	// have been missed.
+	Gap bool
+
+	// Done is true if the archive has been synchronized.
+	Done bool
+}
+
+// syncState is the state of an archive in a Syncer.
+type syncState int
+
+const (
+	// stateLive means that messages are delivered as they arrive and are used to
+	// update the position.
+	stateLive syncState = iota
+
+	// stateSyncing means that the archive is being fetched and live messages are
+	// buffered until it is complete.
+	stateSyncing
+
+	// stateFailed means that synchronization failed and messages are delivered
+	// as they arrive without updating the position so that the next sync does
+	// not skip messages that were missed.
+	stateFailed
+)
+
+type archiveState struct {
+	state syncState
+	// live contains messages that are waiting to be delivered.
+	live []Message
+	// delivering is true while a call to Receive or Sync is delivering the live
+	// messages.
+	delivering bool
+}
+
+// Syncer catches up on messages that were missed while offline by fetching
+// them from archives and merges them with live messages.
+//
+// Each archive is synchronized by calling Sync, normally after reconnecting.
+// Sync fetches all messages after the last seen message from the archive, then
+// delivers any live messages that arrived in the meantime.
+// Live messages are passed to the Syncer using Receive and any that were also
+// fetched from the archive are only delivered once.
+// To avoid missing messages, Sync should be called before live messages for the
+// archive are received, for example before sending initial presence or joining
+// a group chat.
+//
+// The zero value is not usable, Handler, Positions, and Deliver must be set.
+type Syncer struct {
+	// Handler is used to receive the results of queries and must be registered
+	// with the session, see Handle.
+	Handler *Handler
+
+	// Positions stores the ID of the last message delivered from each archive.
+	Positions Positions
+
+	// PageSize is the maximum number of messages to request in each page.
+	// If zero, the server picks a page size.
+	PageSize uint64
+
+	// Max is the maximum number of messages to fetch from an archive if there
+	// is no last seen message or it could not be found in the archive.
+	// The most recent messages are fetched.
+	// If zero, the entire archive is fetched.
+	Max uint64
+
+	// Deliver is called for each message in the order they were archived.
+	// The ID of the message is its ID in the archive, or for live messages the
+	// stanza ID assigned by the archive.
+	// Live messages that were not assigned a stanza ID by the archive are
+	// delivered with an empty ID.
+	// With is not set.
+	//
+	// Messages from the same archive are delivered one at a time, but Deliver
+	// may be called concurrently for different archives.
+	// No locks are held while Deliver is called so it may call Receive or Sync.
+	// If Deliver returns an error the position in the archive is not updated
+	// until the next successful call to Sync.
+	Deliver func(archive jid.JID, msg Message) error
+
+	// Progress, if set, is called after each message is fetched from an archive
+	// and once more when the archive has been synchronized.
+	Progress func(archive jid.JID, p Progress)
+
+	m        sync.Mutex
+	archives map[string]*archiveState
+}
+
+func (sy *Syncer) progress(archive jid.JID, p Progress) {
+	if sy.Progress != nil {
+		sy.Progress(archive, p)
+	}
+}
+
+// deliver passes the message to Deliver and updates the position in the archive
+// if update is true.
+func (sy *Syncer) deliver(archive jid.JID, msg Message, update bool) error {
+	err := sy.Deliver(archive, msg)
+	if err != nil || !update || msg.ID == "" {
+		return err
+	}
+	return sy.Positions.SetLast(archive, msg.ID)
+}
+
+// Receive handles a live message, including its start element, that was or
+// will be stored in archive.
+// If the archive is being synchronized the message is buffered until Sync has
+// delivered the messages from the archive.
+// Otherwise it is delivered before Receive returns, unless another message for
+// the same archive is already being delivered in which case it is delivered
+// after that message by the caller that is delivering it.
+//
+// Messages are identified by the stanza ID assigned by the archive, which must
+// have been added by an entity with the address of the archive.
+func (sy *Syncer) Receive(archive jid.JID, r xml.TokenReader) error {
+	raw, err := encode(r)
+	if err != nil {
+		return err
+	}
+	var v struct {
+		IDs []stanza.ID `xml:"urn:xmpp:sid:0 stanza-id"`
+	}
+	err = xml.Unmarshal(raw, &v)
+	if err != nil {
+		return err
+	}
+	archive = archive.Bare()
+	msg := Message{
+		Time:   time.Now().UTC(),
+		Stanza: raw,
+	}
+	for _, id := range v.IDs {
+		if id.By.Equal(archive) {
+			msg.ID = id.ID
+			break
+		}
+	}
+
+	sy.m.Lock()
+	state := sy.state(archive)
+	state.live = append(state.live, msg)
+	if state.state == stateSyncing || state.delivering {
+		sy.m.Unlock()
+		return nil
+	}
+	state.delivering = true
+	sy.m.Unlock()
+	return sy.flush(archive, state)
+}
+
+// state returns the state of the archive, creating it if it does not exist.
+// sy.m must be held.
+func (sy *Syncer) state(archive jid.JID) *archiveState {
+	key := archive.String()
+	if sy.archives == nil {
+		sy.archives = make(map[string]*archiveState)
+	}
+	state := sy.archives[key]
+	if state == nil {
+		state = &archiveState{}
+		sy.archives[key] = state
+	}
+	return state
+}
+
+// flush delivers live messages until there are none left or the archive starts
+// being synchronized.
+// The caller must have set state.delivering and flush unsets it when it
+// returns.
+// Messages are delivered without holding sy.m so that Deliver can call Receive
+// or Sync.
+func (sy *Syncer) flush(archive jid.JID, state *archiveState) error {
+	var err error
+	for {
+		sy.m.Lock()
+		if len(state.live) == 0 || state.state == stateSyncing {
+			state.delivering = false
+			sy.m.Unlock()
+			return err
+		}
+		msg := state.live[0]
+		state.live = state.live[1:]
+		update := state.state == stateLive
+		sy.m.Unlock()
+
+		deliverErr := sy.deliver(archive, msg, update)
+		if deliverErr != nil {
+			if err == nil {
+				err = deliverErr
+			}
+			sy.m.Lock()
+			if state.state == stateLive {
+				state.state = stateFailed
+			}
+			sy.m.Unlock()
+		}
+	}
+}
+
+// Sync fetches the messages that were added to archive after the last seen
+// message and delivers them, followed by any live messages received while
+// fetching them.
+// To synchronize the archive of the account use the bare JID of the account.
+//
+// If the archive reports that the last seen message does not exist, for
+// example because it has been deleted from the archive, the most recent
+// messages are fetched instead and the gap is reported to Progress.
+//
+// If an error is returned live messages are still delivered but the position
+// is not updated until the next successful call to Sync.
+func (sy *Syncer) Sync(ctx context.Context, archive jid.JID, s *xmpp.Session) (err error) {
+	archive = archive.Bare()
+
+	sy.m.Lock()
+	state := sy.state(archive)
+	if state.state == stateSyncing {
+		sy.m.Unlock()
+		return fmt.Errorf("history: archive %s is already being synchronized", archive)
+	}
+	state.state = stateSyncing
+	sy.m.Unlock()
+
+	delivered := make(map[string]struct{})
+	defer func() {
+		sy.m.Lock()
+		// Skip live messages that were also fetched from the archive.
+		live := state.live[:0]
+		for _, msg := range state.live {
+			if _, ok := delivered[msg.ID]; !ok {
+				live = append(live, msg)
+			}
+		}
+		state.live = live
+		if err == nil {
+			state.state = stateLive
+		} else {
+			state.state = stateFailed
+		}
+		if state.delivering {
+			// Whoever is delivering will pick up the buffered messages.
+			sy.m.Unlock()
+			return
+		}
+		state.delivering = true
+		sy.m.Unlock()
+		flushErr := sy.flush(archive, state)
+		if err == nil {
+			err = flushErr
+		}
+	}()
+
+	last, err := sy.Positions.Last(archive)
+	if err != nil {
+		return err
+	}
+	var p Progress
+	if last != "" {
+		err = sy.fetch(ctx, archive, s, Query{PageID: last}, 0, &p, delivered)
+		var stanzaErr stanza.Error
+		if !errors.As(err, &stanzaErr) || stanzaErr.Condition != stanza.ItemNotFound {
+			if err != nil {
+				return err
+			}
+			p.Done = true
+			sy.progress(archive, p)
+			return nil
+		}
+	}
+
+	p.Gap = true
+	if sy.Max == 0 {
+		err = sy.fetch(ctx, archive, s, Query{}, 0, &p, delivered)
+	} else {
+		err = sy.fetch(ctx, archive, s, Query{Last: true}, sy.Max, &p, delivered)
+	}
+	if err != nil {
+		return err
+	}
+	p.Done = true
+	sy.progress(archive, p)
+	return nil
+}
+
+// fetch delivers the messages matching q in the order they were archived.
+// If q.Last is set, the last max messages are collected before being delivered.
+func (sy *Syncer) fetch(ctx context.Context, archive jid.JID, s *xmpp.Session, q Query, max uint64, p *Progress, delivered map[string]struct{}) error {
+	q.Limit = sy.PageSize
+	iter := sy.Handler.FetchAll(ctx, q, archive, max, s)
+	/* #nosec */
+	defer iter.Close()
+
+	var (
+		newest []Message
+		// If we're paging from a message, the count is the size of the entire
+		// result set and we only know how many messages are left if the server
+		// tells us the index of the first message.
+		offset  uint64
+		unknown = q.PageID != ""
+		first   = true
+	)
+	for iter.Next() {
+		msg := iter.Message()
+		// If we're falling back after the last seen message disappeared part way
+		// through, don't deliver messages a second time.
+		if _, ok := delivered[msg.ID]; ok {
+			continue
+		}
+		p.Fetched++
+		set := iter.Result().Set
+		if first && unknown && set.First.Index != nil {
+			offset = *set.First.Index
+			unknown = false
+		}
+		first = false
+		if count := set.Count; count != nil && !unknown && *count >= offset {
+			p.Total = *count - offset
+			if max > 0 && p.Total > max {
+				p.Total = max
+			}
+		}
+		sy.progress(archive, *p)
+		if q.Last {
+			newest = append(newest, msg)
+			continue
+		}
+		err := sy.deliver(archive, msg, true)
+		if err != nil {
+			return err
+		}
+		delivered[msg.ID] = struct{}{}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	for i := len(newest) - 1; i >= 0; i-- {
+		err := sy.deliver(archive, newest[i], true)
+		if err != nil {
+			return err
+		}
+		delivered[newest[i].ID] = struct{}{}
+	}
+	return nil
+}
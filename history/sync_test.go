@@ -0,0 +1,211 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package history_test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mellium.im/xmpp/history"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/stanza"
+)
+
+func liveMessage(id string, by jid.JID) xml.TokenReader {
+	var sid string
+	if id != "" {
+		sid = fmt.Sprintf(`<stanza-id xmlns="urn:xmpp:sid:0" id="%s" by="%s"/>`, id, by)
+	}
+	return xml.NewDecoder(strings.NewReader(fmt.Sprintf(`<message xmlns="jabber:client" type="chat"><body>live %s</body>%s</message>`, id, sid)))
+}
+
+func TestSync(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}}
+	h := history.NewHandler(nil)
+	cs := newHistoryServer(srv, h)
+	account := cs.Client.LocalAddr().Bare()
+	fillStore(t, srv.Store, account, 5)
+
+	positions := &history.MemPositions{}
+	err := positions.SetLast(account, "1")
+	if err != nil {
+		t.Fatalf("error setting position: %v", err)
+	}
+	var (
+		delivered []string
+		progress  []history.Progress
+		syncer    *history.Syncer
+	)
+	syncer = &history.Syncer{
+		Handler:   h,
+		Positions: positions,
+		PageSize:  2,
+		Deliver: func(archive jid.JID, msg history.Message) error {
+			if !archive.Equal(account) {
+				t.Errorf("wrong archive: want=%v, got=%v", account, archive)
+			}
+			delivered = append(delivered, msg.ID)
+			switch msg.ID {
+			case "2":
+				// Messages that arrive while syncing are delivered after the archive,
+				// and only if they were not in the archive.
+				for _, r := range []xml.TokenReader{
+					liveMessage("3", account),
+					liveMessage("5", account),
+					liveMessage("", account),
+					liveMessage("6", jid.MustParse("romeo@example.net")),
+				} {
+					err := syncer.Receive(account, r)
+					if err != nil {
+						t.Errorf("error receiving live message: %v", err)
+					}
+				}
+			case "7":
+				// Deliver may receive further messages, which are delivered after it
+				// returns.
+				err := syncer.Receive(account, liveMessage("8", account))
+				if err != nil {
+					t.Errorf("error receiving live message: %v", err)
+				}
+			}
+			return nil
+		},
+		Progress: func(_ jid.JID, p history.Progress) {
+			progress = append(progress, p)
+		},
+	}
+
+	err = syncer.Sync(context.Background(), account, cs.Client)
+	if err != nil {
+		t.Fatalf("error syncing: %v", err)
+	}
+	if want := []string{"2", "3", "4", "5", "", ""}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("wrong messages delivered: want=%q, got=%q", want, delivered)
+	}
+	wantProgress := []history.Progress{
+		{Fetched: 1},
+		{Fetched: 2},
+		{Fetched: 3},
+		{Fetched: 3, Done: true},
+	}
+	if !reflect.DeepEqual(progress, wantProgress) {
+		t.Errorf("wrong progress: want=%+v, got=%+v", wantProgress, progress)
+	}
+	if last, _ := positions.Last(account); last != "5" {
+		t.Errorf("wrong position after sync: want=5, got=%q", last)
+	}
+
+	delivered = nil
+	err = syncer.Receive(account, liveMessage("7", account))
+	if err != nil {
+		t.Fatalf("error receiving live message: %v", err)
+	}
+	if want := []string{"7", "8"}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("wrong live messages delivered: want=%q, got=%q", want, delivered)
+	}
+	if last, _ := positions.Last(account); last != "8" {
+		t.Errorf("wrong position after live message: want=8, got=%q", last)
+	}
+}
+
+func TestSyncGap(t *testing.T) {
+	for _, tc := range [...]struct {
+		name     string
+		last     string
+		max      uint64
+		expected []string
+	}{
+		{name: "missing", last: "nope", max: 2, expected: []string{"3", "4"}},
+		{name: "empty", max: 0, expected: []string{"0", "1", "2", "3", "4"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &history.Server{Store: &history.MemStore{}}
+			h := history.NewHandler(nil)
+			cs := newHistoryServer(srv, h)
+			account := cs.Client.LocalAddr().Bare()
+			fillStore(t, srv.Store, account, 5)
+
+			positions := &history.MemPositions{}
+			err := positions.SetLast(account, tc.last)
+			if err != nil {
+				t.Fatalf("error setting position: %v", err)
+			}
+			var (
+				delivered []string
+				final     history.Progress
+			)
+			syncer := &history.Syncer{
+				Handler:   h,
+				Positions: positions,
+				PageSize:  2,
+				Max:       tc.max,
+				Deliver: func(_ jid.JID, msg history.Message) error {
+					delivered = append(delivered, msg.ID)
+					return nil
+				},
+				Progress: func(_ jid.JID, p history.Progress) {
+					final = p
+				},
+			}
+			err = syncer.Sync(context.Background(), account, cs.Client)
+			if err != nil {
+				t.Fatalf("error syncing: %v", err)
+			}
+			if !reflect.DeepEqual(delivered, tc.expected) {
+				t.Errorf("wrong messages delivered: want=%q, got=%q", tc.expected, delivered)
+			}
+			if !final.Gap || !final.Done || final.Fetched != uint64(len(tc.expected)) {
+				t.Errorf("wrong final progress: %+v", final)
+			}
+			if last, _ := positions.Last(account); last != "4" {
+				t.Errorf("wrong position after sync: want=4, got=%q", last)
+			}
+		})
+	}
+}
+
+func TestSyncErr(t *testing.T) {
+	srv := &history.Server{Store: &history.MemStore{}}
+	h := history.NewHandler(nil)
+	cs := newHistoryServer(srv, h)
+	// The default server only allows querying our own archive.
+	archive := jid.MustParse("room@muc.example.net")
+
+	positions := &history.MemPositions{}
+	err := positions.SetLast(archive, "1")
+	if err != nil {
+		t.Fatalf("error setting position: %v", err)
+	}
+	var delivered []string
+	syncer := &history.Syncer{
+		Handler:   h,
+		Positions: positions,
+		Deliver: func(_ jid.JID, msg history.Message) error {
+			delivered = append(delivered, msg.ID)
+			return nil
+		},
+	}
+	err = syncer.Sync(context.Background(), archive, cs.Client)
+	if stanzaErr, ok := err.(stanza.Error); !ok || stanzaErr.Condition != stanza.Forbidden {
+		t.Errorf("wrong error: want=%v, got=%v", stanza.Forbidden, err)
+	}
+
+	// Live messages are still delivered but the position must not move past the
+	// messages that we missed.
+	err = syncer.Receive(archive, liveMessage("2", archive))
+	if err != nil {
+		t.Fatalf("error receiving live message: %v", err)
+	}
+	if want := []string{"2"}; !reflect.DeepEqual(delivered, want) {
+		t.Errorf("wrong messages delivered: want=%q, got=%q", want, delivered)
+	}
+	if last, _ := positions.Last(archive); last != "1" {
+		t.Errorf("position was updated after failed sync: want=1, got=%q", last)
+	}
+}
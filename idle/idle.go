@@ -0,0 +1,106 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package idle implements XEP-0319: Last User Interaction in Presence.
+package idle // import "mellium.im/xmpp/idle"
+
+import (
+	"encoding/xml"
+	"fmt"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/xtime"
+)
+
+// NS is the namespace used by this package.
+const NS = "urn:xmpp:idle:1"
+
+// Idle indicates the time of the last interaction between the user and their
+// client.
+// It is normally sent in available presence.
+type Idle struct {
+	Since time.Time
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (i Idle) TokenReader() xml.TokenReader {
+	sinceAttr, err := xtime.Time{Time: i.Since}.MarshalXMLAttr(xml.Name{Local: "since"})
+	if err != nil {
+		panic(fmt.Errorf("idle: unreachable error reached while marshaling time: %w", err))
+	}
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "idle"},
+		Attr: []xml.Attr{sinceAttr},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (i Idle) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, i.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (i Idle) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := i.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// An invalid since attribute results in an error.
+// The presence.Tracker does not use it and treats entities with an invalid
+// idle time as not idle instead.
+func (i *Idle) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var since xtime.Time
+	for _, a := range start.Attr {
+		if a.Name.Local != "since" || (a.Name.Space != "" && a.Name.Space != NS) {
+			continue
+		}
+		err := since.UnmarshalXMLAttr(a)
+		if err != nil {
+			return err
+		}
+	}
+	i.Since = since.Time
+	return d.Skip()
+}
+
+// Read decodes the idle time from a presence stanza, including its start
+// element.
+// If the presence does not contain an idle element, the zero value is
+// returned.
+func Read(r xml.TokenReader) (Idle, error) {
+	v := struct {
+		stanza.Presence
+		Idle Idle `xml:"urn:xmpp:idle:1 idle"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	return v.Idle, err
+}
+
+// Insert returns a transformer that adds an idle element to all available
+// presence stanzas read through it while the user is idle.
+// The since function is called for each presence and should return the time at
+// which the user last interacted with the client, or the zero time if the user
+// is not currently idle.
+func Insert(since func() time.Time) xmlstream.Transformer {
+	return xmlstream.InsertFunc(func(start xml.StartElement, level uint64, w xmlstream.TokenWriter) error {
+		if level != 1 ||
+			start.Name.Local != "presence" ||
+			(start.Name.Space != "" && start.Name.Space != stanza.NSClient && start.Name.Space != stanza.NSServer) {
+			return nil
+		}
+		if _, typ := attr.Get(start.Attr, "type"); typ != string(stanza.AvailablePresence) {
+			return nil
+		}
+		t := since()
+		if t.IsZero() {
+			return nil
+		}
+		_, err := Idle{Since: t}.WriteXML(w)
+		return err
+	})
+}
@@ -0,0 +1,87 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package idle_test
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/idle"
+	"mellium.im/xmpp/internal/xmpptest"
+)
+
+var (
+	_ xml.Marshaler       = idle.Idle{}
+	_ xml.Unmarshaler     = (*idle.Idle)(nil)
+	_ xmlstream.Marshaler = idle.Idle{}
+	_ xmlstream.WriterTo  = idle.Idle{}
+)
+
+var since = time.Date(1969, time.July, 21, 2, 56, 15, 0, time.UTC)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &idle.Idle{Since: since},
+		XML:   `<idle xmlns="urn:xmpp:idle:1" since="1969-07-21T02:56:15Z"></idle>`,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+func TestRead(t *testing.T) {
+	i, err := idle.Read(xml.NewDecoder(strings.NewReader(`<presence xmlns="jabber:client"><show>away</show><idle xmlns="urn:xmpp:idle:1" since="1969-07-21T04:56:15+02:00"/></presence>`)))
+	if err != nil {
+		t.Fatalf("error reading idle time: %v", err)
+	}
+	if !i.Since.Equal(since) {
+		t.Errorf("wrong idle time: want=%v, got=%v", since, i.Since)
+	}
+
+	i, err = idle.Read(xml.NewDecoder(strings.NewReader(`<presence xmlns="jabber:client"/>`)))
+	if err != nil {
+		t.Fatalf("error reading presence without idle time: %v", err)
+	}
+	if !i.Since.IsZero() {
+		t.Errorf("expected zero idle time, got %v", i.Since)
+	}
+}
+
+func TestInsert(t *testing.T) {
+	var idleSince time.Time
+	const in = `<presence></presence><presence xmlns="jabber:client" type="unavailable"></presence><message xmlns="jabber:client"></message>`
+	transform := idle.Insert(func() time.Time {
+		return idleSince
+	})
+
+	for _, tc := range []struct {
+		since time.Time
+		out   string
+	}{{
+		out: `<presence></presence><presence xmlns="jabber:client" xmlns="jabber:client" type="unavailable"></presence><message xmlns="jabber:client" xmlns="jabber:client"></message>`,
+	}, {
+		since: since,
+		out:   `<presence><idle xmlns="urn:xmpp:idle:1" since="1969-07-21T02:56:15Z"></idle></presence><presence xmlns="jabber:client" xmlns="jabber:client" type="unavailable"></presence><message xmlns="jabber:client" xmlns="jabber:client"></message>`,
+	}} {
+		idleSince = tc.since
+		var b strings.Builder
+		e := xml.NewEncoder(&b)
+		_, err := xmlstream.Copy(e, transform(xml.NewDecoder(strings.NewReader(in))))
+		if err != nil {
+			t.Fatalf("error transforming stream: %v", err)
+		}
+		err = e.Flush()
+		if err != nil {
+			t.Fatalf("error flushing: %v", err)
+		}
+		if out := b.String(); out != tc.out {
+			t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package lang picks between, encodes, and decodes human readable text sent in
+// several languages.
+package lang // import "mellium.im/xmpp/internal/lang"
+
+import (
+	"encoding/xml"
+	"sort"
+
+	"golang.org/x/text/language"
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/ns"
+)
+
+// Match returns the language tag and text from texts that best matches the
+// preferred languages.
+// Texts is a map of language tags to text, where the empty tag is text that
+// was sent without an explicit language and is assumed to be in the language
+// def.
+//
+// If no preferred languages are given, or none of them match, the text without
+// an explicit language is returned if there is one.
+// Tags that cannot be parsed are only used as a last resort.
+func Match(texts map[string]string, def string, prefs ...string) (tag, text string) {
+	if len(texts) == 0 {
+		return "", ""
+	}
+
+	keys := make([]string, 0, len(texts))
+	for k := range texts {
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	// The text with no explicit language is the default and must be first.
+	if _, ok := texts[""]; ok {
+		keys = append([]string{""}, keys...)
+	}
+
+	var (
+		tags    []language.Tag
+		tagKeys []string
+	)
+	for _, k := range keys {
+		s := k
+		if s == "" {
+			s = def
+		}
+		t, err := language.Parse(s)
+		if err != nil {
+			if k != "" {
+				continue
+			}
+			t = language.Und
+		}
+		tags = append(tags, t)
+		tagKeys = append(tagKeys, k)
+	}
+	if len(tags) == 0 {
+		return keys[0], texts[keys[0]]
+	}
+
+	var want []language.Tag
+	for _, p := range prefs {
+		t, err := language.Parse(p)
+		if err != nil {
+			continue
+		}
+		want = append(want, t)
+	}
+	if len(want) == 0 {
+		return tagKeys[0], texts[tagKeys[0]]
+	}
+	_, idx, _ := language.NewMatcher(tags).Match(want...)
+	return tagKeys[idx], texts[tagKeys[idx]]
+}
+
+// TokenReader returns an element with the given local name for each text in
+// texts, ordered by language tag.
+// The xml:lang attribute is only added to texts with a non-empty tag.
+func TokenReader(name string, texts map[string]string) xml.TokenReader {
+	keys := make([]string, 0, len(texts))
+	for k := range texts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	readers := make([]xml.TokenReader, 0, len(keys))
+	for _, k := range keys {
+		start := xml.StartElement{Name: xml.Name{Local: name}}
+		// xml:lang attribute is optional, don't include it if it's empty.
+		if k != "" {
+			start.Attr = []xml.Attr{{
+				Name:  xml.Name{Space: ns.XML, Local: "lang"},
+				Value: k,
+			}}
+		}
+		readers = append(readers, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(texts[k])),
+			start,
+		))
+	}
+	return xmlstream.MultiReader(readers...)
+}
+
+// Unmarshal decodes the text of the element start and adds it to texts keyed
+// by its xml:lang attribute, or by the empty tag if it does not have one.
+func Unmarshal(d *xml.Decoder, start xml.StartElement, texts map[string]string) error {
+	var v string
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	var tag string
+	for _, attr := range start.Attr {
+		if attr.Name.Space == ns.XML && attr.Name.Local == "lang" {
+			tag = attr.Value
+			break
+		}
+	}
+	texts[tag] = v
+	return nil
+}
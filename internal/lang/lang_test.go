@@ -0,0 +1,113 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package lang_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/lang"
+)
+
+var matchTests = [...]struct {
+	texts map[string]string
+	def   string
+	prefs []string
+	tag   string
+	text  string
+}{
+	0: {},
+	1: {
+		texts: map[string]string{"": "Hi", "de": "Hallo"},
+		tag:   "",
+		text:  "Hi",
+	},
+	2: {
+		texts: map[string]string{"": "Hi", "de": "Hallo"},
+		def:   "en",
+		prefs: []string{"de-AT"},
+		tag:   "de",
+		text:  "Hallo",
+	},
+	3: {
+		texts: map[string]string{"": "Hallo", "en": "Hi"},
+		def:   "de",
+		prefs: []string{"de"},
+		tag:   "",
+		text:  "Hallo",
+	},
+	4: {
+		texts: map[string]string{"fr": "Salut", "en": "Hi"},
+		prefs: []string{"ja"},
+		tag:   "en",
+		text:  "Hi",
+	},
+	5: {
+		texts: map[string]string{"!!": "Bad"},
+		prefs: []string{"en"},
+		tag:   "!!",
+		text:  "Bad",
+	},
+	6: {
+		texts: map[string]string{"en": "Hi", "fr": "Salut"},
+		prefs: []string{"nope!", "fr"},
+		tag:   "fr",
+		text:  "Salut",
+	},
+}
+
+func TestMatch(t *testing.T) {
+	for i, tc := range matchTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tag, text := lang.Match(tc.texts, tc.def, tc.prefs...)
+			if tag != tc.tag {
+				t.Errorf("wrong tag: want=%q, got=%q", tc.tag, tag)
+			}
+			if text != tc.text {
+				t.Errorf("wrong text: want=%q, got=%q", tc.text, text)
+			}
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	texts := map[string]string{"": "Hi", "de": "Hallo", "fr": "Salut"}
+	var buf bytes.Buffer
+	e := xml.NewEncoder(&buf)
+	_, err := xmlstream.Copy(e, lang.TokenReader("body", texts))
+	if err != nil {
+		t.Fatalf("error encoding: %v", err)
+	}
+	err = e.Flush()
+	if err != nil {
+		t.Fatalf("error flushing: %v", err)
+	}
+	const expected = `<body>Hi</body><body xml:lang="de">Hallo</body><body xml:lang="fr">Salut</body>`
+	if out := buf.String(); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+
+	got := make(map[string]string)
+	d := xml.NewDecoder(&buf)
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			err = lang.Unmarshal(d, start, got)
+			if err != nil {
+				t.Fatalf("error decoding: %v", err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, texts) {
+		t.Errorf("wrong texts after round trip: want=%v, got=%v", texts, got)
+	}
+}
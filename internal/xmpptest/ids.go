@@ -0,0 +1,20 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpptest
+
+import (
+	"regexp"
+)
+
+// stanzaID matches the id attribute of message, presence, and iq start
+// elements.
+var stanzaID = regexp.MustCompile(`(<(?:message|presence|iq)\b[^>]*) id="[^"]*"`)
+
+// StripIDs removes the id attribute from the stanzas in the XML s.
+// It is used to compare the output of functions that send stanzas with randomly
+// generated IDs, leaving any IDs in their payloads intact.
+func StripIDs(s string) string {
+	return stanzaID.ReplaceAllString(s, "$1")
+}
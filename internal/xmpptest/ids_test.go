@@ -0,0 +1,21 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package xmpptest_test
+
+import (
+	"testing"
+
+	"mellium.im/xmpp/internal/xmpptest"
+)
+
+func TestStripIDs(t *testing.T) {
+	const (
+		in       = `<message xmlns="jabber:client" id="123" to="a@example.net"><replace xmlns="urn:xmpp:message-correct:0" id="456"/></message><presence id="789"/><iq type="get" id="abc"></iq>`
+		expected = `<message xmlns="jabber:client" to="a@example.net"><replace xmlns="urn:xmpp:message-correct:0" id="456"/></message><presence/><iq type="get"></iq>`
+	)
+	if out := xmpptest.StripIDs(in); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
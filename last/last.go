@@ -0,0 +1,165 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h Handler"
+
+// Package last implements XEP-0012: Last Activity.
+//
+// The meaning of the last activity depends on the entity being queried.
+// For the bare JID of an account it is the time since the account was last
+// online, for a full JID it is the time since the user last interacted with
+// their client, and for servers and components it is their uptime.
+package last // import "mellium.im/xmpp/last"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "jabber:iq:last"
+
+// Activity is the last activity of an entity.
+type Activity struct {
+	// Elapsed is the time since the last activity, rounded down to the nearest
+	// second.
+	Elapsed time.Duration
+
+	// Status is the status from the last unavailable presence sent by an
+	// account that is now offline.
+	// It is normally empty for other entities.
+	Status string
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (a Activity) TokenReader() xml.TokenReader {
+	seconds := int64(a.Elapsed / time.Second)
+	if seconds < 0 {
+		seconds = 0
+	}
+	var inner xml.TokenReader
+	if a.Status != "" {
+		inner = xmlstream.Token(xml.CharData(a.Status))
+	}
+	return xmlstream.Wrap(inner, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "query"},
+		Attr: []xml.Attr{{
+			Name:  xml.Name{Local: "seconds"},
+			Value: strconv.FormatInt(seconds, 10),
+		}},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (a Activity) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, a.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (a Activity) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := a.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (a *Activity) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	v := struct {
+		Seconds string `xml:"seconds,attr"`
+		Status  string `xml:",chardata"`
+	}{}
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	seconds, err := strconv.ParseUint(v.Seconds, 10, 32)
+	if err != nil {
+		return err
+	}
+	a.Elapsed = time.Duration(seconds) * time.Second
+	a.Status = v.Status
+	return nil
+}
+
+// Get requests the last activity of an entity.
+// For more information see the package documentation.
+func Get(ctx context.Context, s *xmpp.Session, to jid.JID) (Activity, error) {
+	var a Activity
+	err := s.UnmarshalIQElement(ctx, xmlstream.Wrap(
+		nil,
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}},
+	), stanza.IQ{
+		Type: stanza.GetIQ,
+		To:   to,
+	}, &a)
+	return a, err
+}
+
+// Handle returns an option that registers a Handler for last activity
+// requests.
+func Handle(h Handler) mux.Option {
+	return mux.IQ(stanza.GetIQ, xml.Name{Space: NS, Local: "query"}, h)
+}
+
+// Handler responds to last activity requests.
+//
+// If either function returns a stanza.Error it is sent as the response,
+// otherwise any error is returned from the handler and no response is sent.
+// If the required function is nil a service-unavailable error is sent.
+type Handler struct {
+	// Since returns the time of our own last activity: the last time the user
+	// interacted with a client, or the time at which a server or component was
+	// started.
+	Since func() (time.Time, error)
+
+	// Offline is used by servers to answer requests sent to the bare JID of an
+	// account on behalf of the account.
+	// It returns the time at which the account last went offline and the status
+	// from its last unavailable presence.
+	// Servers should only reveal this information to contacts with a presence
+	// subscription to the account, and should report that the account is still
+	// active (by returning the current time) if it has an available resource.
+	// If Offline is nil, requests sent to bare JIDs are handled by Since.
+	Offline func(iq stanza.IQ) (logout time.Time, status string, err error)
+}
+
+// HandleIQ implements mux.IQHandler.
+func (h Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	if iq.Type != stanza.GetIQ || start.Name.Local != "query" || start.Name.Space != NS {
+		return nil
+	}
+
+	var (
+		since time.Time
+		a     Activity
+		err   error
+	)
+	switch {
+	case h.Offline != nil && iq.To.Localpart() != "" && iq.To.Resourcepart() == "":
+		since, a.Status, err = h.Offline(iq)
+	case h.Since != nil:
+		since, err = h.Since()
+	default:
+		err = stanza.Error{Type: stanza.Cancel, Condition: stanza.ServiceUnavailable}
+	}
+	var stanzaErr stanza.Error
+	if errors.As(err, &stanzaErr) {
+		_, err = xmlstream.Copy(t, iq.Error(stanzaErr))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	a.Elapsed = time.Since(since)
+	_, err = xmlstream.Copy(t, iq.Result(a.TokenReader()))
+	return err
+}
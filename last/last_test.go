@@ -0,0 +1,116 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package last_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/last"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = last.Activity{}
+	_ xml.Unmarshaler     = (*last.Activity)(nil)
+	_ xmlstream.Marshaler = last.Activity{}
+	_ xmlstream.WriterTo  = last.Activity{}
+	_ mux.IQHandler       = last.Handler{}
+	_ info.FeatureIter    = last.Handler{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &last.Activity{},
+		XML:   `<query xmlns="jabber:iq:last" seconds="0"></query>`,
+	},
+	1: {
+		Value: &last.Activity{
+			Elapsed: 903 * time.Second,
+			Status:  "Heading Home",
+		},
+		XML: `<query xmlns="jabber:iq:last" seconds="903">Heading Home</query>`,
+	},
+	2: {
+		NoUnmarshal: true,
+		Value:       &last.Activity{Elapsed: 1500 * time.Millisecond},
+		XML:         `<query xmlns="jabber:iq:last" seconds="1"></query>`,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+func TestGet(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	logout := time.Now().Add(-90 * time.Second)
+	var offlineIQ stanza.IQ
+	m := mux.New(stanza.NSClient, last.Handle(last.Handler{
+		Since: func() (time.Time, error) {
+			return start, nil
+		},
+		Offline: func(iq stanza.IQ) (time.Time, string, error) {
+			offlineIQ = iq
+			if iq.To.Localpart() != "juliet" {
+				return time.Time{}, "", stanza.Error{Type: stanza.Auth, Condition: stanza.Forbidden}
+			}
+			return logout, "Gone to the balcony", nil
+		},
+	}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	ctx := context.Background()
+
+	a, err := last.Get(ctx, cs.Client, jid.MustParse("example.net"))
+	if err != nil {
+		t.Fatalf("error getting uptime: %v", err)
+	}
+	if a.Elapsed < time.Hour || a.Elapsed > time.Hour+time.Minute || a.Status != "" {
+		t.Errorf("wrong uptime: %+v", a)
+	}
+
+	a, err = last.Get(ctx, cs.Client, jid.MustParse("juliet@example.net"))
+	if err != nil {
+		t.Fatalf("error getting offline activity: %v", err)
+	}
+	if a.Elapsed < 90*time.Second || a.Elapsed > 2*time.Minute || a.Status != "Gone to the balcony" {
+		t.Errorf("wrong offline activity: %+v", a)
+	}
+	if offlineIQ.To.String() != "juliet@example.net" {
+		t.Errorf("wrong IQ passed to offline handler: %+v", offlineIQ)
+	}
+
+	_, err = last.Get(ctx, cs.Client, jid.MustParse("nurse@example.net"))
+	if !errors.Is(err, stanza.Error{Condition: stanza.Forbidden}) {
+		t.Errorf("wrong error: want=%v, got=%v", stanza.Forbidden, err)
+	}
+
+	// Full JIDs report idle time even if there is a handler for offline
+	// accounts.
+	a, err = last.Get(ctx, cs.Client, jid.MustParse("juliet@example.net/balcony"))
+	if err != nil {
+		t.Fatalf("error getting idle time: %v", err)
+	}
+	if a.Elapsed < time.Hour {
+		t.Errorf("wrong idle time: %+v", a)
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	m := mux.New(stanza.NSClient, last.Handle(last.Handler{}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	_, err := last.Get(context.Background(), cs.Client, jid.MustParse("example.net"))
+	if !errors.Is(err, stanza.Error{Condition: stanza.ServiceUnavailable}) {
+		t.Errorf("wrong error: want=%v, got=%v", stanza.ServiceUnavailable, err)
+	}
+}
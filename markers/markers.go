@@ -0,0 +1,280 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h Handler"
+
+// Package markers implements XEP-0333: Chat Markers.
+//
+// Unlike delivery receipts, which only indicate that a message arrived, chat
+// markers indicate that a message has been received, displayed to the user, or
+// acknowledged by the user.
+// A marker for a message implies that all earlier messages in the conversation
+// have been marked as well, see Tracker.
+package markers // import "mellium.im/xmpp/markers"
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/hints"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package.
+const NS = "urn:xmpp:chat-markers:0"
+
+// Type is the kind of a chat marker.
+type Type string
+
+// A list of possible marker types, in increasing order of strength.
+const (
+	// Received means that the message has been received by a client.
+	Received Type = "received"
+
+	// Displayed means that the message has been displayed to the user.
+	Displayed Type = "displayed"
+
+	// Acknowledged means that the user has acknowledged the message, for
+	// example by replying to it or taking some action that it requested.
+	Acknowledged Type = "acknowledged"
+)
+
+// Valid reports whether typ is one of the marker types defined by XEP-0333.
+func (typ Type) Valid() bool {
+	return typ.rank() >= 0
+}
+
+// Implies reports whether a marker of type typ implies a marker of type other.
+// For example, a message that has been displayed has also been received.
+func (typ Type) Implies(other Type) bool {
+	return typ.Valid() && other.Valid() && typ.rank() >= other.rank()
+}
+
+func (typ Type) rank() int {
+	switch typ {
+	case Received:
+		return 0
+	case Displayed:
+		return 1
+	case Acknowledged:
+		return 2
+	}
+	return -1
+}
+
+var types = [...]Type{Received, Displayed, Acknowledged}
+
+// Marker is a chat marker for a message.
+type Marker struct {
+	Type Type
+
+	// ID is the ID of the marked message.
+	// In a group chat this is the stanza ID assigned by the channel, otherwise
+	// it is the id attribute of the message.
+	ID string
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (m Marker) TokenReader() xml.TokenReader {
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: string(m.Type)},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: m.ID}},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (m Marker) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, m.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (m Marker) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := m.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// Elements that are not valid markers are skipped.
+func (m *Marker) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	typ := Type(start.Name.Local)
+	if start.Name.Space != NS || !typ.Valid() {
+		return d.Skip()
+	}
+	m.Type = typ
+	m.ID = ""
+	for _, attr := range start.Attr {
+		if attr.Name.Local == "id" {
+			m.ID = attr.Value
+			break
+		}
+	}
+	return d.Skip()
+}
+
+// Markable is an xmlstream.Transformer that marks any message with a body read
+// through r as markable.
+// Error messages and messages that are themselves markers are not marked.
+func Markable(r xml.TokenReader) xml.TokenReader {
+	var (
+		depth    int
+		inMsg    bool
+		hasBody  bool
+		noMarker bool
+		inner    xml.TokenReader
+	)
+	return xmlstream.ReaderFunc(func() (xml.Token, error) {
+	start:
+		if inner != nil {
+			tok, err := inner.Token()
+			if err == io.EOF {
+				inner = nil
+				err = nil
+			}
+			return tok, err
+		}
+
+		tok, err := r.Token()
+		switch err {
+		case io.EOF:
+			if tok == nil {
+				return nil, err
+			}
+			err = nil
+		case nil:
+		default:
+			return tok, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1 && isMessage(t.Name):
+				inMsg = true
+				hasBody = false
+				noMarker = false
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "type" {
+						noMarker = attr.Value == string(stanza.ErrorMessage)
+						break
+					}
+				}
+			case depth == 2 && inMsg:
+				switch {
+				case t.Name.Local == "body":
+					hasBody = true
+				case t.Name.Space == NS:
+					noMarker = true
+				}
+			}
+		case xml.EndElement:
+			depth--
+			if depth == 0 && inMsg {
+				inMsg = false
+				if hasBody && !noMarker {
+					inner = xmlstream.MultiReader(xmlstream.Wrap(nil, xml.StartElement{
+						Name: xml.Name{Space: NS, Local: "markable"},
+					}), xmlstream.Token(t))
+					goto start
+				}
+			}
+		}
+
+		return tok, err
+	})
+}
+
+func isMessage(name xml.Name) bool {
+	return name.Local == "message" && (name.Space == stanza.NSClient || name.Space == stanza.NSServer)
+}
+
+// Send sends a marker for a message that was marked as markable.
+// The marker asks the server to store it in any archives so that our other
+// clients also learn about it when they fetch the history.
+//
+// To mark a message in a group chat, msg.To should be the bare JID of the
+// channel and the marker ID should be the stanza ID assigned by the channel.
+func Send(ctx context.Context, s *xmpp.Session, msg stanza.Message, m Marker) error {
+	return s.Send(ctx, msg.Wrap(xmlstream.MultiReader(
+		m.TokenReader(),
+		hints.Store.TokenReader(),
+	)))
+}
+
+// Message contains the parts of a message that are relevant to chat markers.
+type Message struct {
+	stanza.Message
+
+	// Markable is true if the sender would like to receive markers for the
+	// message.
+	Markable bool
+
+	// Marker is set if the message marks an earlier message.
+	Marker *Marker
+}
+
+// Read decodes a message stanza, including its start element.
+// Payloads that are not relevant to chat markers are ignored.
+func Read(r xml.TokenReader) (Message, error) {
+	var v struct {
+		stanza.Message
+		Markable *struct{} `xml:"urn:xmpp:chat-markers:0 markable"`
+		Markers  []Marker  `xml:",any"`
+	}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return Message{}, err
+	}
+	m := Message{
+		Message:  v.Message,
+		Markable: v.Markable != nil,
+	}
+	for _, marker := range v.Markers {
+		if marker.Type != "" {
+			marker := marker
+			m.Marker = &marker
+			break
+		}
+	}
+	return m, nil
+}
+
+// Handle returns an option that registers a Handler for chat markers.
+func Handle(h Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		for _, typ := range types {
+			name := xml.Name{Space: NS, Local: string(typ)}
+			// Messages without a type attribute are normal messages.
+			mux.Message("", name, h)(m)
+			mux.Message(stanza.NormalMessage, name, h)(m)
+			mux.Message(stanza.ChatMessage, name, h)(m)
+			mux.Message(stanza.GroupChatMessage, name, h)(m)
+		}
+	}
+}
+
+// Handler reports incoming chat markers.
+//
+// The sender of the marker is the from address of the message.
+// To keep track of how far each conversation has been read, pass the markers
+// to a Tracker.
+type Handler struct {
+	Marker func(msg stanza.Message, m Marker) error
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h Handler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder) error {
+	m, err := Read(t)
+	if err != nil {
+		return err
+	}
+	if h.Marker == nil || m.Marker == nil {
+		return nil
+	}
+	return h.Marker(msg, *m.Marker)
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package markers_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/markers"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler         = markers.Marker{}
+	_ xml.Unmarshaler       = (*markers.Marker)(nil)
+	_ xmlstream.Marshaler   = markers.Marker{}
+	_ xmlstream.WriterTo    = markers.Marker{}
+	_ xmlstream.Transformer = markers.Markable
+	_ mux.MessageHandler    = markers.Handler{}
+	_ info.FeatureIter      = markers.Handler{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &markers.Marker{Type: markers.Received, ID: "message-1"},
+		XML:   `<received xmlns="urn:xmpp:chat-markers:0" id="message-1"></received>`,
+	},
+	1: {
+		Value: &markers.Marker{Type: markers.Displayed, ID: "message-1"},
+		XML:   `<displayed xmlns="urn:xmpp:chat-markers:0" id="message-1"></displayed>`,
+	},
+	2: {
+		Value: &markers.Marker{Type: markers.Acknowledged, ID: "message-1"},
+		XML:   `<acknowledged xmlns="urn:xmpp:chat-markers:0" id="message-1"></acknowledged>`,
+	},
+	3: {
+		Value:     &markers.Marker{},
+		XML:       `<markable xmlns="urn:xmpp:chat-markers:0"></markable>`,
+		NoMarshal: true,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+func TestImplies(t *testing.T) {
+	for _, tc := range [...]struct {
+		typ, other markers.Type
+		ok         bool
+	}{
+		{typ: markers.Received, other: markers.Received, ok: true},
+		{typ: markers.Displayed, other: markers.Received, ok: true},
+		{typ: markers.Acknowledged, other: markers.Displayed, ok: true},
+		{typ: markers.Received, other: markers.Displayed},
+		{typ: markers.Displayed, other: markers.Acknowledged},
+		{typ: "markable", other: markers.Received},
+		{typ: markers.Acknowledged, other: "markable"},
+	} {
+		if ok := tc.typ.Implies(tc.other); ok != tc.ok {
+			t.Errorf("%s implies %s: want=%t, got=%t", tc.typ, tc.other, tc.ok, ok)
+		}
+	}
+}
+
+var markableTestCases = [...]struct {
+	in  string
+	out string
+}{
+	0: {},
+	1: {
+		in:  `<message xmlns="jabber:client"/>`,
+		out: `<message xmlns="jabber:client"></message>`,
+	},
+	2: {
+		in:  `<message xmlns="jabber:client" type="chat"><body>test</body></message><message xmlns="jabber:server"><body>test</body></message>`,
+		out: `<message xmlns="jabber:client" type="chat"><body xmlns="jabber:client">test</body><markable xmlns="urn:xmpp:chat-markers:0"></markable></message><message xmlns="jabber:server"><body xmlns="jabber:server">test</body><markable xmlns="urn:xmpp:chat-markers:0"></markable></message>`,
+	},
+	3: {
+		in:  `<message xmlns="jabber:client" type="error"><body>test</body></message>`,
+		out: `<message xmlns="jabber:client" type="error"><body xmlns="jabber:client">test</body></message>`,
+	},
+	4: {
+		in:  `<message xmlns="jabber:client" type="chat"><body>test</body><markable xmlns="urn:xmpp:chat-markers:0"/></message>`,
+		out: `<message xmlns="jabber:client" type="chat"><body xmlns="jabber:client">test</body><markable xmlns="urn:xmpp:chat-markers:0"></markable></message>`,
+	},
+	5: {
+		in:  `<message xmlns="jabber:client" type="chat"><x xmlns="urn:example"><body>test</body></x></message>`,
+		out: `<message xmlns="jabber:client" type="chat"><x xmlns="urn:example"><body xmlns="urn:example">test</body></x></message>`,
+	},
+	6: {
+		in:  `<message xmlns="jabber:badns"><body>test</body></message>`,
+		out: `<message xmlns="jabber:badns"><body xmlns="jabber:badns">test</body></message>`,
+	},
+}
+
+func TestMarkable(t *testing.T) {
+	for i, tc := range markableTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			r := markers.Markable(xml.NewDecoder(strings.NewReader(tc.in)))
+			// Prevent duplicate xmlns attributes. See https://mellium.im/issue/75
+			r = xmlstream.RemoveAttr(func(start xml.StartElement, attr xml.Attr) bool {
+				return (start.Name.Local == "message" || start.Name.Local == "x" || start.Name.Local == "markable") && attr.Name.Local == "xmlns"
+			})(r)
+			var buf strings.Builder
+			e := xml.NewEncoder(&buf)
+			_, err := xmlstream.Copy(e, r)
+			if err != nil {
+				t.Fatalf("error encoding: %v", err)
+			}
+			if err = e.Flush(); err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			if out := buf.String(); out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	err := markers.Send(context.Background(), s, stanza.Message{
+		To:   jid.MustParse("juliet@capulet.lit"),
+		Type: stanza.ChatMessage,
+	}, markers.Marker{Type: markers.Displayed, ID: "message-1"})
+	if err != nil {
+		t.Fatalf("error sending marker: %v", err)
+	}
+	const expected = `<message xmlns="jabber:client" type="chat" to="juliet@capulet.lit"><displayed xmlns="urn:xmpp:chat-markers:0" id="message-1"></displayed><store xmlns="urn:xmpp:hints"></store></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+var readTestCases = [...]struct {
+	in  string
+	out markers.Message
+}{
+	0: {
+		in: `<message xmlns="jabber:client" type="chat" id="message-1"><body>test</body><markable xmlns="urn:xmpp:chat-markers:0"/></message>`,
+		out: markers.Message{
+			Message:  stanza.Message{ID: "message-1", Type: stanza.ChatMessage},
+			Markable: true,
+		},
+	},
+	1: {
+		in: `<message xmlns="jabber:client" type="chat"><store xmlns="urn:xmpp:hints"/><acknowledged xmlns="urn:xmpp:chat-markers:0" id="message-1"/></message>`,
+		out: markers.Message{
+			Message: stanza.Message{Type: stanza.ChatMessage},
+			Marker:  &markers.Marker{Type: markers.Acknowledged, ID: "message-1"},
+		},
+	},
+	2: {
+		in: `<message xmlns="jabber:client" type="chat"><body>test</body></message>`,
+		out: markers.Message{
+			Message: stanza.Message{Type: stanza.ChatMessage},
+		},
+	},
+}
+
+func TestRead(t *testing.T) {
+	for i, tc := range readTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			m, err := markers.Read(xml.NewDecoder(strings.NewReader(tc.in)))
+			if err != nil {
+				t.Fatalf("error reading message: %v", err)
+			}
+			if !reflect.DeepEqual(m, tc.out) {
+				t.Errorf("wrong message:\nwant=%+v,\n got=%+v", tc.out, m)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var events []string
+	m := mux.New(stanza.NSClient, markers.Handle(markers.Handler{
+		Marker: func(msg stanza.Message, m markers.Marker) error {
+			events = append(events, msg.From.String()+" "+string(m.Type)+" "+m.ID)
+			return nil
+		},
+	}))
+	for _, msg := range []string{
+		`<message xmlns="jabber:client" type="chat" from="juliet@capulet.lit/balcony"><received xmlns="urn:xmpp:chat-markers:0" id="message-1"/></message>`,
+		`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/thirdwitch"><displayed xmlns="urn:xmpp:chat-markers:0" id="stanza-id-1"/></message>`,
+		`<message xmlns="jabber:client" type="normal" from="juliet@capulet.lit/balcony"><acknowledged xmlns="urn:xmpp:chat-markers:0" id="message-2"/></message>`,
+		`<message xmlns="jabber:client" from="juliet@capulet.lit/balcony"><displayed xmlns="urn:xmpp:chat-markers:0" id="message-3"/></message>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(msg))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(io.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling message: %v", err)
+		}
+	}
+	expected := []string{
+		"juliet@capulet.lit/balcony received message-1",
+		"coven@chat.shakespeare.lit/thirdwitch displayed stanza-id-1",
+		"juliet@capulet.lit/balcony acknowledged message-2",
+		"juliet@capulet.lit/balcony displayed message-3",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("wrong events:\nwant=%q,\n got=%q", expected, events)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package markers
+
+import (
+	"sync"
+
+	"mellium.im/xmpp/jid"
+)
+
+// Tracker folds chat markers into the position up to which each conversation
+// has been received, displayed, and acknowledged.
+//
+// Since a marker for a message implies that all earlier messages in the
+// conversation are marked as well, the tracker must know the order of the
+// messages in each conversation.
+// Messages are added in the order they were sent using Add and markers that
+// reference messages the tracker does not know about are ignored.
+//
+// Messages are kept until MaxMessages newer messages have been added to the
+// same conversation, after which markers that reference them are ignored and
+// they are no longer reported by Unmarked.
+// The latest marked message of each type is always remembered.
+// Conversations are kept until they are removed using Forget or Reset.
+//
+// Conversations are identified by the bare JID of the contact or group chat.
+// The zero value is ready to use and a Tracker is safe for concurrent use by
+// multiple goroutines.
+type Tracker struct {
+	// MaxMessages is the number of messages that are kept for each
+	// conversation.
+	// If it is zero, DefaultMaxMessages is used.
+	MaxMessages int
+
+	mu    sync.Mutex
+	convs map[string]*conversation
+}
+
+// DefaultMaxMessages is the number of messages that are kept for each
+// conversation by a Tracker if MaxMessages is not set.
+const DefaultMaxMessages = 1000
+
+type conversation struct {
+	// order maps message IDs to their position in the conversation.
+	// Positions keep counting up when old messages are dropped, base is the
+	// position of ids[0].
+	order map[string]int
+	ids   []string
+	base  int
+	// last is the position of the latest marked message for each type of
+	// marker, or -1, and lastID is its ID.
+	last   [len(types)]int
+	lastID [len(types)]string
+}
+
+func (t *Tracker) conv(with jid.JID, create bool) *conversation {
+	key := with.Bare().String()
+	c, ok := t.convs[key]
+	if ok || !create {
+		return c
+	}
+	if t.convs == nil {
+		t.convs = make(map[string]*conversation)
+	}
+	c = &conversation{order: make(map[string]int)}
+	for i := range c.last {
+		c.last[i] = -1
+	}
+	t.convs[key] = c
+	return c
+}
+
+// Add records that a message with the given ID is the latest message in the
+// conversation with the provided JID.
+// Adding a message that is already known does not change its position.
+func (t *Tracker) Add(with jid.JID, id string) {
+	if id == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.conv(with, true)
+	if _, ok := c.order[id]; ok {
+		return
+	}
+	c.order[id] = c.base + len(c.ids)
+	c.ids = append(c.ids, id)
+
+	max := t.MaxMessages
+	if max <= 0 {
+		max = DefaultMaxMessages
+	}
+	if drop := len(c.ids) - max; drop > 0 {
+		for _, old := range c.ids[:drop] {
+			delete(c.order, old)
+		}
+		c.ids = append([]string(nil), c.ids[drop:]...)
+		c.base += drop
+	}
+}
+
+// Mark folds a marker received in the conversation with the provided JID into
+// the tracked positions.
+// It reports whether the marker advanced the position of any marker type.
+//
+// A marker implies all weaker markers, so a displayed marker also advances the
+// received position.
+// Markers for messages that have not been added, and markers for messages
+// before the current position, are ignored.
+func (t *Tracker) Mark(with jid.JID, m Marker) bool {
+	if !m.Type.Valid() {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.conv(with, false)
+	if c == nil {
+		return false
+	}
+	pos, ok := c.order[m.ID]
+	if !ok {
+		return false
+	}
+	var advanced bool
+	for i := 0; i <= m.Type.rank(); i++ {
+		if pos > c.last[i] {
+			c.last[i] = pos
+			c.lastID[i] = m.ID
+			advanced = true
+		}
+	}
+	return advanced
+}
+
+// Last returns the ID of the latest message in the conversation with the
+// provided JID that has been marked with typ or a stronger marker.
+// If no message has been marked, ok is false.
+func (t *Tracker) Last(with jid.JID, typ Type) (id string, ok bool) {
+	if !typ.Valid() {
+		return "", false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.conv(with, false)
+	if c == nil {
+		return "", false
+	}
+	if c.last[typ.rank()] < 0 {
+		return "", false
+	}
+	return c.lastID[typ.rank()], true
+}
+
+// Marked reports whether the message with the given ID in the conversation
+// with the provided JID has been marked with typ or a stronger marker, either
+// directly or by a marker for a later message.
+func (t *Tracker) Marked(with jid.JID, id string, typ Type) bool {
+	if !typ.Valid() {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.conv(with, false)
+	if c == nil {
+		return false
+	}
+	pos, ok := c.order[id]
+	return ok && pos <= c.last[typ.rank()]
+}
+
+// Unmarked returns the IDs of the messages in the conversation with the
+// provided JID that have not yet been marked with typ or a stronger marker, in
+// the order they were added.
+func (t *Tracker) Unmarked(with jid.JID, typ Type) []string {
+	if !typ.Valid() {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.conv(with, false)
+	if c == nil {
+		return nil
+	}
+	start := c.last[typ.rank()] + 1 - c.base
+	if start < 0 {
+		start = 0
+	}
+	return append([]string(nil), c.ids[start:]...)
+}
+
+// Forget stops tracking the conversation with the provided JID.
+func (t *Tracker) Forget(with jid.JID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.convs, with.Bare().String())
+}
+
+// Reset stops tracking all conversations.
+func (t *Tracker) Reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.convs = nil
+}
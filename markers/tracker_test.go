@@ -0,0 +1,121 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package markers_test
+
+import (
+	"reflect"
+	"testing"
+
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/markers"
+)
+
+func TestTracker(t *testing.T) {
+	juliet := jid.MustParse("juliet@capulet.lit/balcony")
+	romeo := jid.MustParse("romeo@montague.lit")
+
+	var tracker markers.Tracker
+	if tracker.Mark(juliet, markers.Marker{Type: markers.Displayed, ID: "1"}) {
+		t.Errorf("marker for unknown conversation advanced the position")
+	}
+	for _, id := range []string{"1", "2", "3", "4", "2"} {
+		tracker.Add(juliet.Bare(), id)
+	}
+	tracker.Add(romeo, "1")
+
+	if !tracker.Mark(juliet, markers.Marker{Type: markers.Displayed, ID: "3"}) {
+		t.Errorf("expected displayed marker to advance the position")
+	}
+	if tracker.Mark(juliet, markers.Marker{Type: markers.Received, ID: "2"}) {
+		t.Errorf("earlier received marker should not advance the position")
+	}
+	if tracker.Mark(juliet, markers.Marker{Type: markers.Received, ID: "5"}) {
+		t.Errorf("marker for unknown message should not advance the position")
+	}
+	if !tracker.Mark(juliet, markers.Marker{Type: markers.Received, ID: "4"}) {
+		t.Errorf("expected later received marker to advance the position")
+	}
+
+	for _, tc := range [...]struct {
+		typ markers.Type
+		id  string
+		ok  bool
+	}{
+		{typ: markers.Received, id: "4", ok: true},
+		{typ: markers.Displayed, id: "3", ok: true},
+		{typ: markers.Acknowledged},
+	} {
+		id, ok := tracker.Last(juliet, tc.typ)
+		if id != tc.id || ok != tc.ok {
+			t.Errorf("wrong last %s message: want=%q (%t), got=%q (%t)", tc.typ, tc.id, tc.ok, id, ok)
+		}
+	}
+	if !tracker.Marked(juliet, "1", markers.Displayed) {
+		t.Errorf("expected earlier message to be implicitly displayed")
+	}
+	if tracker.Marked(juliet, "4", markers.Displayed) {
+		t.Errorf("did not expect later message to be displayed")
+	}
+	if tracker.Marked(romeo, "1", markers.Received) {
+		t.Errorf("markers should not affect other conversations")
+	}
+	if ids := tracker.Unmarked(juliet, markers.Displayed); !reflect.DeepEqual(ids, []string{"4"}) {
+		t.Errorf("wrong unmarked messages: want=%q, got=%q", []string{"4"}, ids)
+	}
+	if ids := tracker.Unmarked(juliet, markers.Acknowledged); !reflect.DeepEqual(ids, []string{"1", "2", "3", "4"}) {
+		t.Errorf("wrong unacknowledged messages: got=%q", ids)
+	}
+
+	tracker.Forget(juliet)
+	if _, ok := tracker.Last(juliet, markers.Received); ok {
+		t.Errorf("expected forgotten conversation to have no position")
+	}
+}
+
+func TestTrackerMaxMessages(t *testing.T) {
+	juliet := jid.MustParse("juliet@capulet.lit")
+	romeo := jid.MustParse("romeo@montague.lit")
+
+	tracker := markers.Tracker{MaxMessages: 2}
+	tracker.Add(juliet, "1")
+	tracker.Add(juliet, "2")
+	if !tracker.Mark(juliet, markers.Marker{Type: markers.Displayed, ID: "2"}) {
+		t.Errorf("expected displayed marker to advance the position")
+	}
+	for _, id := range []string{"3", "4"} {
+		tracker.Add(juliet, id)
+	}
+
+	// Old messages are dropped, but the last marked message is remembered.
+	if tracker.Mark(juliet, markers.Marker{Type: markers.Acknowledged, ID: "1"}) {
+		t.Errorf("marker for dropped message should not advance the position")
+	}
+	if id, ok := tracker.Last(juliet, markers.Displayed); id != "2" || !ok {
+		t.Errorf("wrong last displayed message: want=2, got=%q (%t)", id, ok)
+	}
+	if ids := tracker.Unmarked(juliet, markers.Acknowledged); !reflect.DeepEqual(ids, []string{"3", "4"}) {
+		t.Errorf("wrong unacknowledged messages: got=%q", ids)
+	}
+	if ids := tracker.Unmarked(juliet, markers.Displayed); !reflect.DeepEqual(ids, []string{"3", "4"}) {
+		t.Errorf("wrong unmarked messages: got=%q", ids)
+	}
+	if !tracker.Mark(juliet, markers.Marker{Type: markers.Received, ID: "4"}) {
+		t.Errorf("expected received marker to advance the position")
+	}
+	if !tracker.Marked(juliet, "3", markers.Received) {
+		t.Errorf("expected earlier message to be implicitly received")
+	}
+
+	tracker.Add(romeo, "1")
+	tracker.Reset()
+	for _, with := range []jid.JID{juliet, romeo} {
+		if ids := tracker.Unmarked(with, markers.Received); len(ids) != 0 {
+			t.Errorf("expected no messages for %v after reset, got=%q", with, ids)
+		}
+	}
+	if _, ok := tracker.Last(juliet, markers.Displayed); ok {
+		t.Errorf("expected no position after reset")
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package message implements building and parsing the human readable content
+// of message stanzas.
+package message // import "mellium.im/xmpp/message"
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/lang"
+	"mellium.im/xmpp/stanza"
+)
+
+// Lang returns the language of any text in msg that does not have an explicit
+// xml:lang attribute.
+// This is the language of the message itself if set, or the language of the
+// session's input stream otherwise.
+func Lang(s *xmpp.Session, msg stanza.Message) string {
+	if msg.Lang != "" {
+		return msg.Lang
+	}
+	return s.In().Lang
+}
+
+// Body is a map of language tags to the human readable contents of a message.
+// Normally there will just be one with an empty language that inherits the
+// language of the message or stream.
+// The keys are not validated to make sure they comply with BCP 47.
+type Body map[string]string
+
+// Text returns the body in the language that best matches the preferred
+// languages.
+// Text without an explicit language is assumed to be in the language def,
+// normally the result of calling Lang.
+// If no preferences are given or none of them match, the body without an
+// explicit language is returned.
+func (b Body) Text(def string, prefs ...string) string {
+	_, text := lang.Match(b, def, prefs...)
+	return text
+}
+
+// TokenReader implements xmlstream.Marshaler.
+// A body element is returned for each language, ordered by language tag.
+func (b Body) TokenReader() xml.TokenReader {
+	return lang.TokenReader("body", b)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (b Body) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, b.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (b Body) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := b.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// It adds a single body element to the map and may be called once for each
+// body in a message.
+func (b *Body) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if *b == nil {
+		*b = make(Body)
+	}
+	return lang.Unmarshal(d, start, *b)
+}
+
+// Subject is a map of language tags to the topic of a message.
+// Normally there will just be one with an empty language that inherits the
+// language of the message or stream.
+// The keys are not validated to make sure they comply with BCP 47.
+type Subject map[string]string
+
+// Text returns the subject in the language that best matches the preferred
+// languages.
+// For more information see Body.Text.
+func (s Subject) Text(def string, prefs ...string) string {
+	_, text := lang.Match(s, def, prefs...)
+	return text
+}
+
+// TokenReader implements xmlstream.Marshaler.
+// A subject element is returned for each language, ordered by language tag.
+func (s Subject) TokenReader() xml.TokenReader {
+	return lang.TokenReader("subject", s)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (s Subject) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, s.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (s Subject) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := s.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// It adds a single subject element to the map and may be called once for each
+// subject in a message.
+func (s *Subject) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if *s == nil {
+		*s = make(Subject)
+	}
+	return lang.Unmarshal(d, start, *s)
+}
+
+// Thread identifies the conversation that a message belongs to.
+// Parent is optional and identifies the thread that this thread was forked
+// from.
+type Thread struct {
+	ID     string
+	Parent string
+}
+
+// TokenReader implements xmlstream.Marshaler.
+// If the thread ID is empty, no tokens are returned.
+func (t Thread) TokenReader() xml.TokenReader {
+	if t.ID == "" {
+		return xmlstream.MultiReader()
+	}
+	start := xml.StartElement{Name: xml.Name{Local: "thread"}}
+	if t.Parent != "" {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "parent"}, Value: t.Parent}}
+	}
+	return xmlstream.Wrap(xmlstream.Token(xml.CharData(t.ID)), start)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (t Thread) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, t.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (t Thread) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := t.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (t *Thread) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	v := struct {
+		ID     string `xml:",chardata"`
+		Parent string `xml:"parent,attr"`
+	}{}
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	t.ID = v.ID
+	t.Parent = v.Parent
+	return nil
+}
+
+// Content is the human readable content of a message.
+type Content struct {
+	Subject Subject
+	Body    Body
+	Thread  Thread
+}
+
+// Read decodes the subject, body, and thread from a message stanza, including
+// its start element.
+// Any other payloads in the message are ignored.
+func Read(r xml.TokenReader) (Content, error) {
+	v := struct {
+		stanza.Message
+		Subject Subject `xml:"subject"`
+		Body    Body    `xml:"body"`
+		Thread  Thread  `xml:"thread"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return Content{}, err
+	}
+	return Content{
+		Subject: v.Subject,
+		Body:    v.Body,
+		Thread:  v.Thread,
+	}, nil
+}
+
+// TokenReader returns the subject, body, and thread elements that represent
+// the content.
+// They are meant to be wrapped in a message, for example using the
+// stanza.Message.Wrap method.
+func (c Content) TokenReader() xml.TokenReader {
+	return xmlstream.MultiReader(
+		c.Subject.TokenReader(),
+		c.Body.TokenReader(),
+		c.Thread.TokenReader(),
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (c Content) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, c.TokenReader())
+}
+
+// Send sends a message with the provided content.
+func Send(ctx context.Context, s *xmpp.Session, msg stanza.Message, c Content) error {
+	return s.Send(ctx, msg.Wrap(c.TokenReader()))
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package message_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = message.Body{}
+	_ xml.Unmarshaler     = (*message.Body)(nil)
+	_ xmlstream.Marshaler = message.Body{}
+	_ xmlstream.WriterTo  = message.Body{}
+	_ xml.Marshaler       = message.Subject{}
+	_ xml.Unmarshaler     = (*message.Subject)(nil)
+	_ xmlstream.Marshaler = message.Subject{}
+	_ xmlstream.WriterTo  = message.Subject{}
+	_ xml.Marshaler       = message.Thread{}
+	_ xml.Unmarshaler     = (*message.Thread)(nil)
+	_ xmlstream.Marshaler = message.Thread{}
+	_ xmlstream.WriterTo  = message.Thread{}
+	_ xmlstream.Marshaler = message.Content{}
+	_ xmlstream.WriterTo  = message.Content{}
+)
+
+var readTests = [...]struct {
+	in      string
+	content message.Content
+}{
+	0: {in: `<message/>`},
+	1: {
+		in: `<message xmlns="jabber:client" xml:lang="en"><subject>Hi</subject><body>Wherefore art thou?</body><body xml:lang="de">Warum bist du?</body><thread parent="e0ffe42b">7edbca6d</thread><x xmlns="urn:example"/></message>`,
+		content: message.Content{
+			Subject: message.Subject{"": "Hi"},
+			Body:    message.Body{"": "Wherefore art thou?", "de": "Warum bist du?"},
+			Thread:  message.Thread{ID: "7edbca6d", Parent: "e0ffe42b"},
+		},
+	},
+	2: {
+		in: `<message xmlns="jabber:server"><thread>7edbca6d</thread></message>`,
+		content: message.Content{
+			Thread: message.Thread{ID: "7edbca6d"},
+		},
+	},
+}
+
+func TestRead(t *testing.T) {
+	for i, tc := range readTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			content, err := message.Read(xml.NewDecoder(strings.NewReader(tc.in)))
+			if err != nil {
+				t.Fatalf("error reading message: %v", err)
+			}
+			if !reflect.DeepEqual(content, tc.content) {
+				t.Errorf("wrong content:\nwant=%+v,\n got=%+v", tc.content, content)
+			}
+		})
+	}
+}
+
+var marshalTests = [...]struct {
+	content message.Content
+	out     string
+}{
+	0: {},
+	1: {
+		content: message.Content{
+			Subject: message.Subject{"en": "Hi", "de": "Hallo"},
+			Body:    message.Body{"": "Hi!"},
+			Thread:  message.Thread{ID: "7edbca6d", Parent: "e0ffe42b"},
+		},
+		out: `<subject xml:lang="de">Hallo</subject><subject xml:lang="en">Hi</subject><body>Hi!</body><thread parent="e0ffe42b">7edbca6d</thread>`,
+	},
+}
+
+func TestMarshal(t *testing.T) {
+	for i, tc := range marshalTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var buf bytes.Buffer
+			e := xml.NewEncoder(&buf)
+			_, err := tc.content.WriteXML(e)
+			if err != nil {
+				t.Fatalf("error encoding content: %v", err)
+			}
+			err = e.Flush()
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			if out := buf.String(); out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+
+			content, err := message.Read(stanza.Message{}.Wrap(tc.content.TokenReader()))
+			if err != nil {
+				t.Fatalf("error reading content: %v", err)
+			}
+			if !reflect.DeepEqual(content, tc.content) {
+				t.Errorf("round trip failed:\nwant=%+v,\n got=%+v", tc.content, content)
+			}
+		})
+	}
+}
+
+func TestText(t *testing.T) {
+	body := message.Body{"": "Colour", "en-US": "Color", "de": "Farbe"}
+	if s := body.Text("en-GB", "en-US"); s != "Color" {
+		t.Errorf("wrong body for en-US: %q", s)
+	}
+	if s := body.Text("en-GB", "en-GB", "de"); s != "Colour" {
+		t.Errorf("wrong body for en-GB: %q", s)
+	}
+	if s := body.Text("en-GB", "de-AT"); s != "Farbe" {
+		t.Errorf("wrong body for de-AT: %q", s)
+	}
+	if s := body.Text("en-GB"); s != "Colour" {
+		t.Errorf("wrong default body: %q", s)
+	}
+	subject := message.Subject{"fr": "Bonjour"}
+	if s := subject.Text("", "en"); s != "Bonjour" {
+		t.Errorf("wrong subject: %q", s)
+	}
+}
+
+func TestLang(t *testing.T) {
+	s := xmpptest.NewClientSession(0, nil)
+	if l := message.Lang(s, stanza.Message{Lang: "de"}); l != "de" {
+		t.Errorf("wrong message language: want=de, got=%q", l)
+	}
+	if l, want := message.Lang(s, stanza.Message{}), s.In().Lang; l != want {
+		t.Errorf("wrong session language: want=%q, got=%q", want, l)
+	}
+}
+
+func TestSend(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	err := message.Send(context.Background(), s, stanza.Message{
+		To:   jid.MustParse("juliet@example.com"),
+		Type: stanza.ChatMessage,
+	}, message.Content{
+		Body: message.Body{"en": "Hi", "fr": "Salut"},
+	})
+	if err != nil {
+		t.Fatalf("error sending message: %v", err)
+	}
+	const expected = `<message xmlns="jabber:client" type="chat" to="juliet@example.com"><body xml:lang="en">Hi</body><body xml:lang="fr">Salut</body></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
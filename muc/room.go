@@ -12,6 +12,7 @@ import (
 	"mellium.im/xmpp"
 	"mellium.im/xmpp/internal/attr"
 	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/retract"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -156,6 +157,36 @@ func (c *Channel) SetAffiliation(ctx context.Context, a Affiliation, j jid.JID,
 	}, nil)
 }
 
+// Moderate asks the channel to retract the message with the provided stanza
+// ID (as assigned by the channel) for all occupants.
+// It requires that the user be a moderator of the channel.
+//
+// If successful the channel sends a moderated retraction to all occupants which
+// can be parsed using the retract package.
+func (c *Channel) Moderate(ctx context.Context, id, reason string) error {
+	var reasonEl xml.TokenReader
+	if reason != "" {
+		reasonEl = xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(reason)),
+			xml.StartElement{Name: xml.Name{Local: "reason"}},
+		)
+	}
+	payload := xmlstream.Wrap(
+		xmlstream.MultiReader(
+			xmlstream.Wrap(nil, xml.StartElement{Name: xml.Name{Space: retract.NS, Local: "retract"}}),
+			reasonEl,
+		),
+		xml.StartElement{
+			Name: xml.Name{Space: retract.NSModerate, Local: "moderate"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: id}},
+		},
+	)
+	return c.session.UnmarshalIQElement(ctx, payload, stanza.IQ{
+		Type: stanza.SetIQ,
+		To:   c.addr.Bare(),
+	}, nil)
+}
+
 // Join is like the Join function except that it joins or re-synchronizes the
 // current room.
 // It is useful if somehow the room has become unsyncronized with the server or
@@ -7,6 +7,7 @@ package muc_test
 import (
 	"context"
 	"encoding/xml"
+	"fmt"
 	"strconv"
 	"strings"
 	"testing"
@@ -16,6 +17,7 @@ import (
 	"mellium.im/xmpp/jid"
 	"mellium.im/xmpp/muc"
 	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/retract"
 	"mellium.im/xmpp/stanza"
 )
 
@@ -174,6 +176,79 @@ func TestSetAffiliation(t *testing.T) {
 	}
 }
 
+var moderateTestCases = []struct {
+	ID     string
+	Reason string
+	x      string
+}{
+	0: {
+		ID: "stanza-id-1",
+		x:  `stanza-id-1 true ""`,
+	},
+	1: {
+		ID:     "stanza-id-2",
+		Reason: "Spam",
+		x:      `stanza-id-2 true "Spam"`,
+	},
+}
+
+func TestModerate(t *testing.T) {
+	j := jid.MustParse("room@example.net/me")
+	h := &muc.Client{}
+	handled := make(chan string, 1)
+	m := mux.New(stanza.NSClient, muc.HandleClient(h))
+	server := mux.New(
+		stanza.NSClient,
+		mux.PresenceFunc("", xml.Name{Local: "x"}, func(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+			// Send back a self presence, indicating that the join is complete.
+			p.To, p.From = p.From, p.To
+			_, err := xmlstream.Copy(r, p.Wrap(xmlstream.Wrap(
+				nil,
+				xml.StartElement{Name: xml.Name{Space: muc.NSUser, Local: "x"}},
+			)))
+			return err
+		}),
+		mux.IQFunc(stanza.SetIQ, xml.Name{Space: retract.NSModerate, Local: "moderate"}, func(iq stanza.IQ, r xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			var v struct {
+				ID      string `xml:"id,attr"`
+				Retract *struct {
+					XMLName xml.Name `xml:"urn:xmpp:message-retract:1 retract"`
+				}
+				Reason string `xml:"reason"`
+			}
+			err := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), r)).Decode(&v)
+			if err != nil {
+				return err
+			}
+			handled <- fmt.Sprintf("%s %t %q", v.ID, v.Retract != nil, v.Reason)
+			_, err = xmlstream.Copy(r, iq.Result(nil))
+			return err
+		}),
+	)
+	s := xmpptest.NewClientServer(
+		xmpptest.ClientHandler(m),
+		xmpptest.ServerHandler(server),
+	)
+
+	channel, err := h.Join(context.Background(), j, s.Client)
+	if err != nil {
+		t.Fatalf("error joining: %v", err)
+	}
+
+	for i, tc := range moderateTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			err = channel.Moderate(context.Background(), tc.ID, tc.Reason)
+			if err != nil {
+				t.Fatalf("error moderating message: %v", err)
+			}
+			x := <-handled
+			if x != tc.x {
+				t.Fatalf("wrong output:\nwant=%s,\n got=%s", tc.x, x)
+			}
+		})
+	}
+}
+
 func TestSetSubject(t *testing.T) {
 	j := jid.MustParse("room@example.net/me")
 	h := &muc.Client{}
@@ -466,9 +466,30 @@ func forChildren(m *ServeMux, stanzaVal interface{}, t xmlstream.TokenReadEncode
 	/* #nosec */
 	defer iterator.Close()
 
+	// Wildcard handlers are called at most once per stanza, even if multiple
+	// children do not have a more specific handler.
+	var calledWildcard bool
 	for iterator.Next() {
 		start, _ := iterator.Current()
 
+		var wildcard bool
+		switch s := stanzaVal.(type) {
+		case stanza.Presence:
+			wildcard = onlyWildcard(pattern{Stanza: presStanza, Payload: start.Name, Type: string(s.Type)}, func(p pattern) bool {
+				return m.presencePatterns[p] != nil
+			})
+		case stanza.Message:
+			wildcard = onlyWildcard(pattern{Stanza: msgStanza, Payload: start.Name, Type: string(s.Type)}, func(p pattern) bool {
+				return m.msgPatterns[p] != nil
+			})
+		}
+		if wildcard {
+			if calledWildcard {
+				continue
+			}
+			calledWildcard = true
+		}
+
 		var err error
 		switch s := stanzaVal.(type) {
 		case stanza.Presence:
@@ -532,6 +553,25 @@ func forChildren(m *ServeMux, stanzaVal interface{}, t xmlstream.TokenReadEncode
 	return nil
 }
 
+// onlyWildcard reports whether the payload of p would only be matched by a
+// wildcard pattern.
+func onlyWildcard(p pattern, registered func(pattern) bool) bool {
+	for _, name := range [...]xml.Name{
+		p.Payload,
+		{Local: p.Payload.Local},
+		{Space: p.Payload.Space},
+	} {
+		if name.Local == "" && name.Space == "" {
+			continue
+		}
+		p.Payload = name
+		if registered(p) {
+			return false
+		}
+	}
+	return true
+}
+
 func iqFallback(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
 	if iq.Type == stanza.ErrorIQ {
 		return nil
@@ -486,6 +486,24 @@ var testCases = [...]struct {
 		x:   `<iq xml:lang="en-us" type="get" xmlns="jabber:client"></iq>`,
 		err: io.EOF,
 	},
+	43: {
+		// Wildcard handlers are only called once per presence.
+		m: []mux.Option{
+			mux.Presence(stanza.SubscribePresence, xml.Name{}, passHandler{}),
+		},
+		x:   `<presence type="subscribe" xmlns="jabber:client"><example xmlns="com.example"/><test xmlns="com.example"/></presence>`,
+		err: errPassTest,
+	},
+	44: {
+		// Wildcard handlers are only called once per message, but more specific
+		// handlers are still called.
+		m: []mux.Option{
+			mux.Message(stanza.ChatMessage, xml.Name{}, passHandler{}),
+			mux.Message(stanza.ChatMessage, xml.Name{Local: "test", Space: exampleNS}, failHandler{}),
+		},
+		x:   `<message type="chat" xmlns="jabber:client"><body>test</body><example xmlns="com.example"/><test xmlns="com.example"/></message>`,
+		err: errors.New("mux_test: PASSED, mux_test: FAILED"),
+	},
 }
 
 type nopEncoder struct {
@@ -0,0 +1,70 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence
+
+import (
+	"time"
+)
+
+// AutoAway changes the show value of our own presence after the user has been
+// idle for a configurable length of time.
+// A zero threshold disables the corresponding show value.
+//
+// A typical client keeps track of the last time the user interacted with it
+// and when Next indicates that the show value will change broadcasts the
+// result of Apply using Available.
+type AutoAway struct {
+	// Away is the length of time after which the user is shown as away.
+	Away time.Duration
+
+	// XA is the length of time after which the user is shown as being away for
+	// an extended period.
+	XA time.Duration
+}
+
+func (a AutoAway) show(idle time.Duration) Show {
+	switch {
+	case a.XA > 0 && idle >= a.XA:
+		return ShowXA
+	case a.Away > 0 && idle >= a.Away:
+		return ShowAway
+	}
+	return ""
+}
+
+// Apply returns the state that should be broadcast if the user last interacted
+// with the client at the provided time.
+// If the user has passed one of the thresholds the show value is changed and
+// the idle time is set so that contacts can see when the user went idle.
+//
+// The show value is never made more available than the one chosen by the
+// user, so for example a user that has manually set their show value to
+// do-not-disturb stays that way.
+func (a AutoAway) Apply(st State, lastActive, now time.Time) State {
+	show := a.show(now.Sub(lastActive))
+	if show == "" || showRank(show) <= showRank(st.Show) {
+		return st
+	}
+	st.Show = show
+	st.Idle = lastActive
+	return st
+}
+
+// Next returns how long after now the result of Apply will next change if the
+// user remains idle, or false if it will not change again.
+func (a AutoAway) Next(lastActive, now time.Time) (time.Duration, bool) {
+	idle := now.Sub(lastActive)
+	var (
+		next  time.Duration
+		found bool
+	)
+	for _, threshold := range []time.Duration{a.Away, a.XA} {
+		if threshold > 0 && idle < threshold && (!found || threshold-idle < next) {
+			next = threshold - idle
+			found = true
+		}
+	}
+	return next, found
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence_test
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"mellium.im/xmpp/presence"
+)
+
+var lastActive = time.Date(2021, time.October, 1, 12, 0, 0, 0, time.UTC)
+
+var autoAwayTests = [...]struct {
+	auto presence.AutoAway
+	in   presence.State
+	idle time.Duration
+	out  presence.State
+	next time.Duration
+	ok   bool
+}{
+	0: {
+		auto: presence.AutoAway{Away: 5 * time.Minute, XA: 30 * time.Minute},
+		idle: time.Minute,
+		next: 4 * time.Minute,
+		ok:   true,
+	},
+	1: {
+		auto: presence.AutoAway{Away: 5 * time.Minute, XA: 30 * time.Minute},
+		in:   presence.State{Show: presence.ShowChat, Priority: 5},
+		idle: 10 * time.Minute,
+		out:  presence.State{Show: presence.ShowAway, Priority: 5, Idle: lastActive},
+		next: 20 * time.Minute,
+		ok:   true,
+	},
+	2: {
+		auto: presence.AutoAway{Away: 5 * time.Minute, XA: 30 * time.Minute},
+		idle: time.Hour,
+		out:  presence.State{Show: presence.ShowXA, Idle: lastActive},
+	},
+	3: {
+		auto: presence.AutoAway{Away: 5 * time.Minute, XA: 30 * time.Minute},
+		in:   presence.State{Show: presence.ShowDND},
+		idle: time.Hour,
+		out:  presence.State{Show: presence.ShowDND},
+	},
+	4: {
+		auto: presence.AutoAway{XA: 30 * time.Minute},
+		in:   presence.State{Show: presence.ShowAway},
+		idle: 10 * time.Minute,
+		out:  presence.State{Show: presence.ShowAway},
+		next: 20 * time.Minute,
+		ok:   true,
+	},
+	5: {
+		auto: presence.AutoAway{Away: 30 * time.Minute, XA: 10 * time.Minute},
+		idle: 5 * time.Minute,
+		next: 5 * time.Minute,
+		ok:   true,
+	},
+	6: {
+		idle: time.Hour,
+	},
+}
+
+func TestAutoAway(t *testing.T) {
+	for i, tc := range autoAwayTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			now := lastActive.Add(tc.idle)
+			out := tc.auto.Apply(tc.in, lastActive, now)
+			if !reflect.DeepEqual(out, tc.out) {
+				t.Errorf("wrong state:\nwant=%+v,\n got=%+v", tc.out, out)
+			}
+			next, ok := tc.auto.Next(lastActive, now)
+			if next != tc.next || ok != tc.ok {
+				t.Errorf("wrong next change: want=%v, %t, got=%v, %t", tc.next, tc.ok, next, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/idle"
+	"mellium.im/xmpp/internal/lang"
+	"mellium.im/xmpp/stanza"
+)
+
+// Show is the availability sub-state of an available entity.
+// The empty value means that the entity is simply available.
+type Show string
+
+// A list of possible show values.
+const (
+	// ShowChat means that the entity is actively interested in chatting.
+	ShowChat Show = "chat"
+
+	// ShowAway means that the entity is temporarily away.
+	ShowAway Show = "away"
+
+	// ShowXA means that the entity is away for an extended period.
+	ShowXA Show = "xa"
+
+	// ShowDND means that the entity is busy and does not wish to be disturbed.
+	ShowDND Show = "dnd"
+)
+
+// Valid reports whether s is one of the values allowed by RFC 6121.
+func (s Show) Valid() bool {
+	switch s {
+	case "", ShowChat, ShowAway, ShowXA, ShowDND:
+		return true
+	}
+	return false
+}
+
+// TokenReader implements xmlstream.Marshaler.
+// If s is empty, no tokens are returned.
+func (s Show) TokenReader() xml.TokenReader {
+	if s == "" {
+		return xmlstream.MultiReader()
+	}
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(s)),
+		xml.StartElement{Name: xml.Name{Local: "show"}},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (s Show) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, s.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (s Show) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := s.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// Unknown show values result in an error.
+// Tracker does not use it and ignores unknown values instead.
+func (s *Show) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v string
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	show := Show(strings.TrimSpace(v))
+	if !show.Valid() {
+		return fmt.Errorf("presence: invalid show value %q", v)
+	}
+	*s = show
+	return nil
+}
+
+// Priority is the priority of a resource in the range -128 to 127.
+// Messages sent to the bare JID are delivered to the available resources with
+// the highest non-negative priority.
+type Priority int8
+
+// TokenReader implements xmlstream.Marshaler.
+// If p is zero, the default priority, no tokens are returned.
+func (p Priority) TokenReader() xml.TokenReader {
+	if p == 0 {
+		return xmlstream.MultiReader()
+	}
+	return xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(strconv.Itoa(int(p)))),
+		xml.StartElement{Name: xml.Name{Local: "priority"}},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (p Priority) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, p.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (p Priority) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := p.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// Priorities outside of the range -128 to 127 result in an error.
+// Tracker does not use it and clamps priorities to the valid range instead.
+func (p *Priority) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var v string
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 8)
+	if err != nil {
+		return fmt.Errorf("presence: invalid priority %q", v)
+	}
+	*p = Priority(i)
+	return nil
+}
+
+// Status is a map of language tags to human readable descriptions of an
+// entity's availability.
+// Normally there will just be one with an empty language that inherits the
+// language of the presence or stream.
+// The keys are not validated to make sure they comply with BCP 47.
+type Status map[string]string
+
+// Text returns the status in the language that best matches the preferred
+// languages.
+// Status without an explicit language is assumed to be in the language def,
+// which is normally the language of the presence (if set) or the incoming
+// stream.
+func (s Status) Text(def string, prefs ...string) string {
+	_, text := lang.Match(s, def, prefs...)
+	return text
+}
+
+// TokenReader implements xmlstream.Marshaler.
+// A status element is returned for each language, ordered by language tag.
+func (s Status) TokenReader() xml.TokenReader {
+	return lang.TokenReader("status", s)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (s Status) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, s.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (s Status) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := s.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// It adds a single status element to the map and may be called once for each
+// status in a presence.
+func (s *Status) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	if *s == nil {
+		*s = make(Status)
+	}
+	return lang.Unmarshal(d, start, *s)
+}
+
+// State is the availability information contained in a presence stanza.
+type State struct {
+	Show     Show
+	Status   Status
+	Priority Priority
+
+	// Idle is the time of the user's last interaction with their client as
+	// defined by XEP-0319: Last User Interaction in Presence.
+	// If the user is not idle it is the zero time.
+	Idle time.Time
+}
+
+// Read decodes the availability information from a presence stanza, including
+// its start element.
+// Any other payloads in the presence are ignored.
+func Read(r xml.TokenReader) (State, error) {
+	v := struct {
+		stanza.Presence
+		Show     Show      `xml:"show"`
+		Status   Status    `xml:"status"`
+		Priority Priority  `xml:"priority"`
+		Idle     idle.Idle `xml:"urn:xmpp:idle:1 idle"`
+	}{}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return State{}, err
+	}
+	return State{
+		Show:     v.Show,
+		Status:   v.Status,
+		Priority: v.Priority,
+		Idle:     v.Idle.Since,
+	}, nil
+}
+
+// TokenReader returns the show, status, priority, and idle elements that
+// represent the state.
+// They are meant to be wrapped in a presence, for example using the
+// stanza.Presence.Wrap method.
+func (st State) TokenReader() xml.TokenReader {
+	readers := []xml.TokenReader{
+		st.Show.TokenReader(),
+		st.Status.TokenReader(),
+		st.Priority.TokenReader(),
+	}
+	if !st.Idle.IsZero() {
+		readers = append(readers, idle.Idle{Since: st.Idle}.TokenReader())
+	}
+	return xmlstream.MultiReader(readers...)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (st State) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, st.TokenReader())
+}
+
+// Available broadcasts available presence with the provided state to all
+// subscribed contacts.
+// It is also used to send initial presence after the session is established.
+func Available(ctx context.Context, s *xmpp.Session, st State) error {
+	return s.Send(ctx, stanza.Presence{}.Wrap(st.TokenReader()))
+}
+
+// Unavailable broadcasts unavailable presence with an optional status to all
+// subscribed contacts.
+// It should be sent before ending the session.
+func Unavailable(ctx context.Context, s *xmpp.Session, status Status) error {
+	return s.Send(ctx, stanza.Presence{
+		Type: stanza.UnavailablePresence,
+	}.Wrap(status.TokenReader()))
+}
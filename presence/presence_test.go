@@ -0,0 +1,183 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/presence"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = presence.Show("")
+	_ xml.Unmarshaler     = (*presence.Show)(nil)
+	_ xmlstream.Marshaler = presence.Show("")
+	_ xmlstream.WriterTo  = presence.Show("")
+	_ xml.Marshaler       = presence.Priority(0)
+	_ xml.Unmarshaler     = (*presence.Priority)(nil)
+	_ xmlstream.Marshaler = presence.Priority(0)
+	_ xmlstream.WriterTo  = presence.Priority(0)
+	_ xml.Marshaler       = presence.Status{}
+	_ xml.Unmarshaler     = (*presence.Status)(nil)
+	_ xmlstream.Marshaler = presence.Status{}
+	_ xmlstream.WriterTo  = presence.Status{}
+	_ xmlstream.Marshaler = presence.State{}
+	_ xmlstream.WriterTo  = presence.State{}
+)
+
+var readTests = [...]struct {
+	in    string
+	state presence.State
+	err   bool
+}{
+	0: {in: `<presence/>`},
+	1: {
+		in: `<presence xmlns="jabber:client"><show>chat</show><status>Hi</status><status xml:lang="de">Hallo</status><priority> -5 </priority><x xmlns="urn:example"/></presence>`,
+		state: presence.State{
+			Show:     presence.ShowChat,
+			Status:   presence.Status{"": "Hi", "de": "Hallo"},
+			Priority: -5,
+		},
+	},
+	2: {
+		in:    `<presence xmlns="jabber:server"><show>dnd</show><priority>127</priority></presence>`,
+		state: presence.State{Show: presence.ShowDND, Priority: 127},
+	},
+	3: {
+		in:  `<presence><show>sleeping</show></presence>`,
+		err: true,
+	},
+	4: {
+		in:  `<presence><priority>128</priority></presence>`,
+		err: true,
+	},
+	5: {
+		in:  `<presence><priority>high</priority></presence>`,
+		err: true,
+	},
+	6: {
+		in: `<presence xmlns="jabber:client"><show>xa</show><idle xmlns="urn:xmpp:idle:1" since="1969-07-21T02:56:15Z"/></presence>`,
+		state: presence.State{
+			Show: presence.ShowXA,
+			Idle: time.Date(1969, time.July, 21, 2, 56, 15, 0, time.UTC),
+		},
+	},
+}
+
+func TestRead(t *testing.T) {
+	for i, tc := range readTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			state, err := presence.Read(xml.NewDecoder(strings.NewReader(tc.in)))
+			switch {
+			case tc.err && err == nil:
+				t.Fatalf("expected error, got state %+v", state)
+			case !tc.err && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(state, tc.state) {
+				t.Errorf("wrong state:\nwant=%+v,\n got=%+v", tc.state, state)
+			}
+		})
+	}
+}
+
+var marshalTests = [...]struct {
+	state presence.State
+	out   string
+}{
+	0: {},
+	1: {
+		state: presence.State{
+			Show:     presence.ShowAway,
+			Status:   presence.Status{"de": "Im Garten", "": "In the garden"},
+			Priority: -1,
+		},
+		out: `<show>away</show><status>In the garden</status><status xml:lang="de">Im Garten</status><priority>-1</priority>`,
+	},
+	2: {
+		state: presence.State{
+			Show: presence.ShowXA,
+			Idle: time.Date(1969, time.July, 21, 2, 56, 15, 0, time.UTC),
+		},
+		out: `<show>xa</show><idle xmlns="urn:xmpp:idle:1" since="1969-07-21T02:56:15Z"></idle>`,
+	},
+}
+
+func TestMarshal(t *testing.T) {
+	for i, tc := range marshalTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var buf bytes.Buffer
+			e := xml.NewEncoder(&buf)
+			_, err := tc.state.WriteXML(e)
+			if err != nil {
+				t.Fatalf("error encoding state: %v", err)
+			}
+			err = e.Flush()
+			if err != nil {
+				t.Fatalf("error flushing: %v", err)
+			}
+			if out := buf.String(); out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+
+			// Round trip the state through a presence.
+			r := stanza.Presence{}.Wrap(tc.state.TokenReader())
+			state, err := presence.Read(r)
+			if err != nil {
+				t.Fatalf("error reading state: %v", err)
+			}
+			if !reflect.DeepEqual(state, tc.state) {
+				t.Errorf("round trip failed:\nwant=%+v,\n got=%+v", tc.state, state)
+			}
+		})
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	status := presence.Status{"": "In the garden", "de": "Im Garten"}
+	if s := status.Text("en", "de-CH"); s != "Im Garten" {
+		t.Errorf("wrong status for de-CH: %q", s)
+	}
+	if s := status.Text("en", "en-US"); s != "In the garden" {
+		t.Errorf("wrong status for en-US: %q", s)
+	}
+	if s := status.Text("en"); s != "In the garden" {
+		t.Errorf("wrong default status: %q", s)
+	}
+	if s := presence.Status(nil).Text("en", "en"); s != "" {
+		t.Errorf("expected empty status, got %q", s)
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	ctx := context.Background()
+	err := presence.Available(ctx, s, presence.State{
+		Show:   presence.ShowXA,
+		Status: presence.Status{"": "Gone fishing"},
+	})
+	if err != nil {
+		t.Fatalf("error sending available presence: %v", err)
+	}
+	err = presence.Unavailable(ctx, s, nil)
+	if err != nil {
+		t.Fatalf("error sending unavailable presence: %v", err)
+	}
+	const expected = `<presence xmlns="jabber:client"><show>xa</show><status>Gone fishing</status></presence><presence xmlns="jabber:client" type="unavailable"></presence>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+// Package presence implements broadcasting, parsing, and keeping track of
+// availability information sent in presence stanzas.
+package presence // import "mellium.im/xmpp/presence"
+
+import (
+	"encoding/xml"
+	"io"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/xtime"
+)
+
+// Resource is the last known presence of a single resource.
+type Resource struct {
+	JID   jid.JID
+	State State
+	Caps  disco.Caps
+	Caps2 disco.Caps2
+
+	// Delay is set if the presence was delivered with a delay, for instance
+	// because it was the last presence sent by the resource before we came
+	// online.
+	Delay delay.Delay
+
+	// since is the time at which the presence was sent, used to pick the most
+	// recently available resource when all else is equal.
+	since time.Time
+}
+
+// sameState reports whether two presences from the same resource would look
+// the same to a user.
+func sameState(a, b Resource) bool {
+	return reflect.DeepEqual(a.State, b.State) &&
+		a.Caps == b.Caps &&
+		reflect.DeepEqual(a.Caps2, b.Caps2)
+}
+
+// showRank orders the values of show from most to least available.
+func showRank(show Show) int {
+	switch show {
+	case ShowChat:
+		return 0
+	case "":
+		return 1
+	case ShowAway:
+		return 2
+	case ShowXA:
+		return 3
+	case ShowDND:
+		return 4
+	}
+	return 5
+}
+
+// better reports whether a should be preferred over b.
+func better(a, b Resource) bool {
+	if a.State.Priority != b.State.Priority {
+		return a.State.Priority > b.State.Priority
+	}
+	if ra, rb := showRank(a.State.Show), showRank(b.State.Show); ra != rb {
+		return ra < rb
+	}
+	if !a.since.Equal(b.since) {
+		return a.since.After(b.since)
+	}
+	return a.JID.String() < b.JID.String()
+}
+
+// Change is an update to the presence of a single resource.
+type Change struct {
+	// Resource is the new presence of the resource, or its last known presence
+	// if it is no longer available.
+	Resource Resource
+
+	// Unavailable is true if the resource went offline or returned an error.
+	Unavailable bool
+
+	// Err is the error returned by the entity if the change was caused by
+	// presence of type "error".
+	Err error
+
+	// Best is the best resource of the bare JID after the change has been
+	// applied, or the zero value if no resource can be selected.
+	Best Resource
+}
+
+// Handle returns an option that registers a Tracker for available,
+// unavailable, and error presence.
+//
+// Because the tracker handles all presence of these types, other handlers that
+// need unavailable presence, such as a disco.Cache or disco.CapsCache, should
+// be set as the tracker's Next field instead of being registered for them.
+func Handle(t *Tracker) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.Presence(stanza.AvailablePresence, xml.Name{}, t)(m)
+		mux.Presence(stanza.UnavailablePresence, xml.Name{}, t)(m)
+		mux.Presence(stanza.ErrorPresence, xml.Name{}, t)(m)
+	}
+}
+
+// Tracker remembers the available resources of each entity that we receive
+// presence from, including our own other resources.
+//
+// The zero value is ready to use.
+type Tracker struct {
+	// Changed, if set, is called every time the presence of a resource changes.
+	// Presence that does not change the show, status, priority, or caps of a
+	// resource does not result in a call to Changed.
+	Changed func(Change)
+
+	// Next, if set, is passed every presence handled by the tracker.
+	// This allows other handlers that need unavailable presence, such as a
+	// disco.Cache, to be used alongside the tracker.
+	Next mux.PresenceHandler
+
+	// Logger, if set, is used to log invalid values in presence received from
+	// other entities.
+	// Invalid values are ignored, or clamped to the nearest valid value in the
+	// case of priorities, instead of resulting in an error that would end the
+	// session.
+	Logger *log.Logger
+
+	m         sync.Mutex
+	emit      sync.Mutex
+	resources map[string]map[string]Resource
+}
+
+// HandlePresence implements mux.PresenceHandler.
+func (t *Tracker) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	rec := &recorder{}
+	// Values that are validated by Read are decoded as strings so that a contact
+	// sending invalid presence can't end our session.
+	v := struct {
+		stanza.Presence
+		Show     string `xml:"show"`
+		Status   Status `xml:"status"`
+		Priority string `xml:"priority"`
+		Idle     struct {
+			Since string `xml:"since,attr"`
+		} `xml:"urn:xmpp:idle:1 idle"`
+		Caps  disco.Caps  `xml:"http://jabber.org/protocol/caps c"`
+		Caps2 disco.Caps2 `xml:"urn:xmpp:caps c"`
+		Delay struct {
+			Stamp  string `xml:"stamp,attr"`
+			From   string `xml:"from,attr"`
+			Reason string `xml:",chardata"`
+		} `xml:"urn:xmpp:delay delay"`
+		Err stanza.Error `xml:"error"`
+	}{}
+	err := xml.NewTokenDecoder(xmlstream.TeeReader(r, rec)).Decode(&v)
+	if err != nil {
+		return err
+	}
+
+	switch p.Type {
+	case stanza.AvailablePresence:
+		del := delay.Delay{
+			Time:   t.parseTime(p.From, "delay stamp", v.Delay.Stamp),
+			Reason: v.Delay.Reason,
+		}
+		if v.Delay.From != "" {
+			del.From, err = jid.Parse(v.Delay.From)
+			if err != nil {
+				t.logf("presence: ignoring invalid delay from %q in presence from %s: %v", v.Delay.From, p.From, err)
+			}
+		}
+		res := Resource{
+			JID: p.From,
+			State: State{
+				Show:     t.parseShow(p.From, v.Show),
+				Status:   v.Status,
+				Priority: t.parsePriority(p.From, v.Priority),
+				Idle:     t.parseTime(p.From, "idle time", v.Idle.Since),
+			},
+			Caps:  v.Caps,
+			Caps2: v.Caps2,
+			Delay: del,
+			since: del.Time,
+		}
+		if res.since.IsZero() {
+			res.since = time.Now()
+		}
+		t.available(res)
+	case stanza.UnavailablePresence:
+		t.unavailable(p.From, nil)
+	case stanza.ErrorPresence:
+		t.unavailable(p.From, v.Err)
+	}
+
+	if t.Next == nil {
+		return nil
+	}
+	return t.Next.HandlePresence(p, struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: rec,
+		Encoder:     r,
+	})
+}
+
+func (t *Tracker) logf(format string, v ...interface{}) {
+	if t.Logger != nil {
+		t.Logger.Printf(format, v...)
+	}
+}
+
+// parseShow returns the show value s, or the default if it is not valid.
+func (t *Tracker) parseShow(from jid.JID, s string) Show {
+	show := Show(strings.TrimSpace(s))
+	if !show.Valid() {
+		t.logf("presence: ignoring invalid show value %q in presence from %s", s, from)
+		return ""
+	}
+	return show
+}
+
+// parsePriority returns the priority p, clamped to the range of valid
+// priorities, or the default priority if p is not a number.
+func (t *Tracker) parsePriority(from jid.JID, p string) Priority {
+	if p == "" {
+		return 0
+	}
+	// On a range error ParseInt returns the largest or smallest value, so the
+	// value only has to be clamped to the smaller range of Priority.
+	i, err := strconv.ParseInt(strings.TrimSpace(p), 10, 64)
+	switch {
+	case err != nil && i == 0:
+		t.logf("presence: ignoring invalid priority %q in presence from %s", p, from)
+		return 0
+	case i > 127:
+		i = 127
+	case i < -128:
+		i = -128
+	default:
+		return Priority(i)
+	}
+	t.logf("presence: clamping out of range priority %q in presence from %s", p, from)
+	return Priority(i)
+}
+
+// parseTime returns the timestamp s, or the zero time if it cannot be parsed.
+func (t *Tracker) parseTime(from jid.JID, name, s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	var xt xtime.Time
+	err := xt.UnmarshalXMLAttr(xml.Attr{Value: s})
+	if err != nil {
+		t.logf("presence: ignoring invalid %s %q in presence from %s: %v", name, s, from, err)
+		return time.Time{}
+	}
+	return xt.Time
+}
+
+func (t *Tracker) available(res Resource) {
+	bare := res.JID.Bare().String()
+	t.m.Lock()
+	if t.resources == nil {
+		t.resources = make(map[string]map[string]Resource)
+	}
+	resources := t.resources[bare]
+	if resources == nil {
+		resources = make(map[string]Resource)
+		t.resources[bare] = resources
+	}
+	old, ok := resources[res.JID.Resourcepart()]
+	if ok && sameState(old, res) {
+		t.m.Unlock()
+		return
+	}
+	resources[res.JID.Resourcepart()] = res
+	best, _ := bestOf(resources)
+	t.unlockAndEmit(Change{Resource: res, Best: best})
+}
+
+func (t *Tracker) unavailable(from jid.JID, stanzaErr error) {
+	bare := from.Bare().String()
+	t.m.Lock()
+	resources := t.resources[bare]
+	var removed []Resource
+	for part, res := range resources {
+		// Unavailable or error presence from the bare JID applies to all
+		// resources.
+		if from.Resourcepart() == "" || part == from.Resourcepart() {
+			removed = append(removed, res)
+			delete(resources, part)
+		}
+	}
+	if len(resources) == 0 {
+		delete(t.resources, bare)
+	}
+	if len(removed) == 0 {
+		if stanzaErr == nil {
+			t.m.Unlock()
+			return
+		}
+		removed = append(removed, Resource{JID: from})
+	}
+	best, _ := bestOf(resources)
+	sortResources(removed)
+	changes := make([]Change, 0, len(removed))
+	for _, res := range removed {
+		changes = append(changes, Change{
+			Resource:    res,
+			Unavailable: true,
+			Err:         stanzaErr,
+			Best:        best,
+		})
+	}
+	t.unlockAndEmit(changes...)
+}
+
+// unlockAndEmit must be called with t.m held and releases it before calling
+// the Changed callback while making sure that events are still delivered in
+// order.
+func (t *Tracker) unlockAndEmit(changes ...Change) {
+	if t.Changed == nil {
+		t.m.Unlock()
+		return
+	}
+	t.emit.Lock()
+	t.m.Unlock()
+	defer t.emit.Unlock()
+	for _, c := range changes {
+		t.Changed(c)
+	}
+}
+
+// bestOf picks the resource that messages sent to the bare JID would be
+// delivered to.
+func bestOf(resources map[string]Resource) (Resource, bool) {
+	var (
+		best  Resource
+		found bool
+	)
+	for _, res := range resources {
+		if res.State.Priority < 0 {
+			continue
+		}
+		if !found || better(res, best) {
+			best = res
+			found = true
+		}
+	}
+	return best, found
+}
+
+func sortResources(resources []Resource) {
+	sort.Slice(resources, func(i, j int) bool {
+		return better(resources[i], resources[j])
+	})
+}
+
+// Best returns the resource of the provided JID that should be preferred when
+// communicating with the entity.
+// If a full JID is provided only its bare JID is considered.
+//
+// Following RFC 6121 the resource with the highest priority is picked.
+// Ties are broken by picking the resource with the most available show value
+// and then the resource that most recently became available.
+// Resources with a negative priority never receive messages sent to the bare
+// JID and are therefore never returned.
+// If no such resource exists, ok will be false.
+func (t *Tracker) Best(j jid.JID) (res Resource, ok bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return bestOf(t.resources[j.Bare().String()])
+}
+
+// Resources returns all available resources of the provided JID ordered from
+// best to worst.
+// If a full JID is provided only its bare JID is considered.
+func (t *Tracker) Resources(j jid.JID) []Resource {
+	t.m.Lock()
+	defer t.m.Unlock()
+	resources := t.resources[j.Bare().String()]
+	if len(resources) == 0 {
+		return nil
+	}
+	list := make([]Resource, 0, len(resources))
+	for _, res := range resources {
+		list = append(list, res)
+	}
+	sortResources(list)
+	return list
+}
+
+// Resource returns the last known presence of a full JID.
+// If the resource is not available, ok will be false.
+func (t *Tracker) Resource(j jid.JID) (res Resource, ok bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	res, ok = t.resources[j.Bare().String()][j.Resourcepart()]
+	return res, ok
+}
+
+// Others returns the available resources of our own account other than the
+// one with the provided full JID, ordered from best to worst.
+// It is normally called with the session's local address.
+func (t *Tracker) Others(self jid.JID) []Resource {
+	var others []Resource
+	for _, res := range t.Resources(self) {
+		if res.JID.Resourcepart() != self.Resourcepart() {
+			others = append(others, res)
+		}
+	}
+	return others
+}
+
+// Reset forgets all tracked presence without emitting any changes.
+// It should be called when the session that the tracker is registered on ends
+// since no unavailable presence will be received for the remaining resources.
+func (t *Tracker) Reset() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.resources = nil
+}
+
+// recorder records the tokens of a presence so that they can be read again by
+// the next handler.
+type recorder struct {
+	toks []xml.Token
+}
+
+func (r *recorder) EncodeToken(tok xml.Token) error {
+	r.toks = append(r.toks, xml.CopyToken(tok))
+	return nil
+}
+
+func (r *recorder) Flush() error {
+	return nil
+}
+
+func (r *recorder) Token() (xml.Token, error) {
+	if len(r.toks) == 0 {
+		return nil, io.EOF
+	}
+	tok := r.toks[0]
+	r.toks = r.toks[1:]
+	return tok, nil
+}
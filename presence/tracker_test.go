@@ -0,0 +1,222 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package presence_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/presence"
+	"mellium.im/xmpp/stanza"
+)
+
+var _ mux.PresenceHandler = (*presence.Tracker)(nil)
+
+func handle(t *testing.T, m *mux.ServeMux, p string) {
+	t.Helper()
+	d := xml.NewDecoder(strings.NewReader(p))
+	tok, _ := d.Token()
+	start := tok.(xml.StartElement)
+	err := m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     xml.NewEncoder(io.Discard),
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling presence: %v", err)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	var changes []presence.Change
+	tracker := &presence.Tracker{
+		Changed: func(c presence.Change) {
+			changes = append(changes, c)
+		},
+	}
+	m := mux.New(stanza.NSClient, presence.Handle(tracker))
+	juliet := jid.MustParse("juliet@example.com")
+
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/balcony"><show>away</show><status>Stargazing</status><priority>1</priority><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://example.com" ver="QgayPKawpkPSDYmwT/WM94uAlu0="/></presence>`)
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/chamber"><priority>1</priority><delay xmlns="urn:xmpp:delay" stamp="2002-09-10T23:41:07Z"/></presence>`)
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/garden"><priority>-1</priority></presence>`)
+	// Sending the same presence again is not a change.
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/balcony"><show>away</show><status>Stargazing</status><priority>1</priority><c xmlns="http://jabber.org/protocol/caps" hash="sha-1" node="https://example.com" ver="QgayPKawpkPSDYmwT/WM94uAlu0="/></presence>`)
+
+	if len(changes) != 3 {
+		t.Fatalf("wrong number of changes: want=3, got=%d", len(changes))
+	}
+	if c := changes[0]; c.Resource.State.Show != presence.ShowAway || c.Resource.State.Status[""] != "Stargazing" || c.Resource.Caps.Node != "https://example.com" || c.Best.JID.String() != "juliet@example.com/balcony" {
+		t.Errorf("wrong first change: %+v", c)
+	}
+	if c := changes[1]; c.Resource.Delay.Time.Year() != 2002 || c.Best.JID.String() != "juliet@example.com/chamber" {
+		t.Errorf("wrong second change: %+v", c)
+	}
+	if c := changes[2]; c.Resource.State.Priority != -1 || c.Best.JID.String() != "juliet@example.com/chamber" {
+		t.Errorf("wrong third change: %+v", c)
+	}
+
+	resources := tracker.Resources(juliet)
+	var order []string
+	for _, res := range resources {
+		order = append(order, res.JID.Resourcepart())
+	}
+	if o := strings.Join(order, ","); o != "chamber,balcony,garden" {
+		t.Errorf("wrong resource order: %s", o)
+	}
+
+	// Higher priority wins over show.
+	handle(t, m, `<presence xmlns="jabber:client" from="juliet@example.com/balcony"><show>dnd</show><priority>5</priority></presence>`)
+	if best, ok := tracker.Best(juliet); !ok || best.JID.Resourcepart() != "balcony" {
+		t.Errorf("wrong best resource: %v, %+v", ok, best)
+	}
+
+	handle(t, m, `<presence xmlns="jabber:client" type="unavailable" from="juliet@example.com/balcony"/>`)
+	handle(t, m, `<presence xmlns="jabber:client" type="unavailable" from="juliet@example.com/chamber"/>`)
+	if _, ok := tracker.Resource(jid.MustParse("juliet@example.com/chamber")); ok {
+		t.Errorf("unavailable resource still tracked")
+	}
+	// Resources with a negative priority are available but never the best.
+	if best, ok := tracker.Best(juliet); ok {
+		t.Errorf("expected no best resource, got %+v", best)
+	}
+	if res := tracker.Resources(juliet); len(res) != 1 {
+		t.Errorf("wrong number of remaining resources: %d", len(res))
+	}
+	c := changes[len(changes)-1]
+	if !c.Unavailable || c.Resource.JID.Resourcepart() != "chamber" || !c.Best.JID.Equal(jid.JID{}) {
+		t.Errorf("wrong unavailable change: %+v", c)
+	}
+
+	// Errors from the bare JID make all resources unavailable.
+	changes = changes[:0]
+	handle(t, m, `<presence xmlns="jabber:client" type="error" from="juliet@example.com"><error type="cancel"><remote-server-not-found xmlns="urn:ietf:params:xml:ns:xmpp-stanzas"/></error></presence>`)
+	if len(changes) != 1 {
+		t.Fatalf("wrong number of changes after error: want=1, got=%d", len(changes))
+	}
+	if c := changes[0]; !c.Unavailable || c.Resource.JID.Resourcepart() != "garden" || !errors.Is(c.Err, stanza.Error{Condition: stanza.RemoteServerNotFound}) {
+		t.Errorf("wrong error change: %+v", c)
+	}
+	if res := tracker.Resources(juliet); len(res) != 0 {
+		t.Errorf("resources remain after error: %+v", res)
+	}
+}
+
+func TestOthers(t *testing.T) {
+	tracker := &presence.Tracker{}
+	m := mux.New(stanza.NSClient, presence.Handle(tracker))
+	handle(t, m, `<presence xmlns="jabber:client" from="romeo@example.net/orchard"/>`)
+	handle(t, m, `<presence xmlns="jabber:client" from="romeo@example.net/mobile"><show>xa</show></presence>`)
+
+	others := tracker.Others(jid.MustParse("romeo@example.net/orchard"))
+	if len(others) != 1 || others[0].JID.String() != "romeo@example.net/mobile" || others[0].State.Show != presence.ShowXA {
+		t.Errorf("wrong other resources: %+v", others)
+	}
+
+	tracker.Reset()
+	if others := tracker.Others(jid.MustParse("romeo@example.net/orchard")); len(others) != 0 {
+		t.Errorf("resources remain after reset: %+v", others)
+	}
+}
+
+func TestNext(t *testing.T) {
+	var forwarded []string
+	tracker := &presence.Tracker{
+		Next: mux.PresenceHandlerFunc(func(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+			v := struct {
+				stanza.Presence
+				Status string `xml:"status"`
+			}{}
+			err := xml.NewTokenDecoder(r).Decode(&v)
+			if err != nil {
+				return err
+			}
+			forwarded = append(forwarded, string(p.Type)+":"+v.Status)
+			return nil
+		}),
+	}
+	m := mux.New(stanza.NSClient, presence.Handle(tracker))
+	handle(t, m, `<presence xmlns="jabber:client" from="romeo@example.net/orchard"><status>Hi</status><c xmlns="urn:xmpp:caps"/></presence>`)
+	handle(t, m, `<presence xmlns="jabber:client" type="unavailable" from="romeo@example.net/orchard"/>`)
+	if f := strings.Join(forwarded, ","); f != ":Hi,unavailable:" {
+		t.Errorf("wrong forwarded presence: %q", f)
+	}
+}
+
+func TestTrackerInvalid(t *testing.T) {
+	changes := make(chan presence.Change, 4)
+	var logged strings.Builder
+	tracker := &presence.Tracker{
+		Changed: func(c presence.Change) {
+			changes <- c
+		},
+		Logger: log.New(&logged, "", 0),
+	}
+	// Presence sent by the server session uses the server namespace.
+	cs := xmpptest.NewClientServer(
+		xmpptest.ClientHandler(mux.New(stanza.NSServer, presence.Handle(tracker))),
+	)
+	for _, p := range []string{
+		`<presence from="juliet@example.com/show"><show>busy</show></presence>`,
+		`<presence from="juliet@example.com/priority"><priority>300</priority></presence>`,
+		`<presence from="juliet@example.com/idle"><idle xmlns="urn:xmpp:idle:1" since="yesterday"/></presence>`,
+		// If the session was ended by any of the invalid presences, this one
+		// would never arrive.
+		`<presence from="juliet@example.com/valid"><show>away</show></presence>`,
+	} {
+		err := cs.Server.Send(context.Background(), xml.NewDecoder(strings.NewReader(p)))
+		if err != nil {
+			t.Fatalf("error sending presence: %v", err)
+		}
+	}
+
+	var got []presence.Change
+	for i := 0; i < 4; i++ {
+		select {
+		case c := <-changes:
+			got = append(got, c)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for change %d, session may have been closed", i)
+		}
+	}
+	if s := got[0].Resource.State.Show; s != "" {
+		t.Errorf("invalid show was not ignored: %q", s)
+	}
+	if p := got[1].Resource.State.Priority; p != 127 {
+		t.Errorf("wrong priority: want=127, got=%d", p)
+	}
+	if idle := got[2].Resource.State.Idle; !idle.IsZero() {
+		t.Errorf("invalid idle time was not ignored: %v", idle)
+	}
+	if s := got[3].Resource.State.Show; s != presence.ShowAway {
+		t.Errorf("wrong show: want=%q, got=%q", presence.ShowAway, s)
+	}
+	if n := strings.Count(logged.String(), "\n"); n != 3 {
+		t.Errorf("wrong number of logged values: want=3, got=%d:\n%s", n, logged.String())
+	}
+
+	// Read is still strict.
+	for _, p := range []string{
+		`<presence><show>busy</show></presence>`,
+		`<presence><priority>300</priority></presence>`,
+	} {
+		_, err := presence.Read(xml.NewDecoder(strings.NewReader(p)))
+		if err == nil {
+			t.Errorf("expected error reading %s", p)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h Handler"
+
+// Package reactions implements XEP-0444: Message Reactions.
+package reactions // import "mellium.im/xmpp/reactions"
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"strconv"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/hints"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NS = "urn:xmpp:reactions:0"
+
+	// NSRestrictions is the FORM_TYPE of the service discovery extension used
+	// to advertise restrictions on the reactions that may be sent.
+	NSRestrictions = "urn:xmpp:reactions:0:restrictions"
+)
+
+const formType = "FORM_TYPE"
+
+// Errors returned when sending reactions that are not allowed.
+var (
+	ErrInvalid    = errors.New("reactions: reaction is not a single emoji")
+	ErrNotAllowed = errors.New("reactions: reaction is not allowed")
+	ErrTooMany    = errors.New("reactions: too many reactions")
+)
+
+// ID returns the ID that reactions to a message should reference.
+// In a group chat this is the stanza ID assigned by the channel, which is
+// expected to be found in ids, otherwise it is the id attribute of the message.
+func ID(msg stanza.Message, ids []stanza.ID) string {
+	if msg.Type != stanza.GroupChatMessage {
+		return msg.ID
+	}
+	channel := msg.From.Bare()
+	for _, id := range ids {
+		if id.By.Equal(channel) {
+			return id.ID
+		}
+	}
+	return ""
+}
+
+// Reactions is the complete set of reactions sent by a single entity to a
+// message.
+// An empty set removes all previous reactions.
+type Reactions struct {
+	// ID is the ID of the message being reacted to as returned by the ID
+	// function.
+	ID       string
+	Reaction []string
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (r Reactions) TokenReader() xml.TokenReader {
+	var inner []xml.TokenReader
+	for _, reaction := range r.Reaction {
+		inner = append(inner, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(reaction)),
+			xml.StartElement{Name: xml.Name{Local: "reaction"}},
+		))
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(inner...),
+		xml.StartElement{
+			Name: xml.Name{Space: NS, Local: "reactions"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: r.ID}},
+		},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (r Reactions) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, r.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (r Reactions) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := r.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+// Reactions that are not a single emoji and duplicate reactions are ignored.
+func (r *Reactions) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	v := struct {
+		ID       string   `xml:"id,attr"`
+		Reaction []string `xml:"reaction"`
+	}{}
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	r.ID = v.ID
+	r.Reaction = nil
+	seen := make(map[string]struct{}, len(v.Reaction))
+	for _, reaction := range v.Reaction {
+		if _, ok := seen[reaction]; ok || !Valid(reaction) {
+			continue
+		}
+		seen[reaction] = struct{}{}
+		r.Reaction = append(r.Reaction, reaction)
+	}
+	return nil
+}
+
+// Send sends the complete set of reactions to the message with the given ID,
+// replacing any reactions previously sent to that message.
+// Duplicate reactions are removed and if any reaction is not a single emoji
+// ErrInvalid is returned and nothing is sent.
+//
+// To react to a message in a group chat, msg.To should be the bare JID of the
+// channel and the ID should be the stanza ID assigned by the channel.
+// Channels may restrict the reactions that can be sent, so SendRestricted
+// should be used with the restrictions returned by GetRestrictions instead.
+func Send(ctx context.Context, s *xmpp.Session, msg stanza.Message, r Reactions) error {
+	return SendRestricted(ctx, s, msg, r, Restrictions{})
+}
+
+// SendRestricted is like Send except that if the reactions are not allowed by
+// the restrictions the error returned by restrictions.Check is returned and
+// nothing is sent.
+// Duplicate reactions are removed before the restrictions are checked.
+func SendRestricted(ctx context.Context, s *xmpp.Session, msg stanza.Message, r Reactions, restrictions Restrictions) error {
+	seen := make(map[string]struct{}, len(r.Reaction))
+	reactions := r.Reaction[:0:0]
+	for _, reaction := range r.Reaction {
+		if !Valid(reaction) {
+			return ErrInvalid
+		}
+		if _, ok := seen[reaction]; ok {
+			continue
+		}
+		seen[reaction] = struct{}{}
+		reactions = append(reactions, reaction)
+	}
+	err := restrictions.Check(reactions)
+	if err != nil {
+		return err
+	}
+	r.Reaction = reactions
+	return s.Send(ctx, msg.Wrap(xmlstream.MultiReader(
+		r.TokenReader(),
+		hints.Store.TokenReader(),
+	)))
+}
+
+// Restrictions are limits on the reactions that may be sent to an entity,
+// normally a group chat.
+type Restrictions struct {
+	// MaxPerUser is the maximum number of reactions each user may send to a
+	// single message, or 0 if there is no limit.
+	MaxPerUser int
+
+	// Allowlist is the set of reactions that may be sent, or nil if any emoji
+	// is allowed.
+	Allowlist []string
+}
+
+// Check returns an error if the reactions are not allowed by the
+// restrictions.
+func (r Restrictions) Check(reactions []string) error {
+	if r.MaxPerUser > 0 && len(reactions) > r.MaxPerUser {
+		return ErrTooMany
+	}
+	if r.Allowlist == nil {
+		return nil
+	}
+outer:
+	for _, reaction := range reactions {
+		for _, allowed := range r.Allowlist {
+			if reaction == allowed {
+				continue outer
+			}
+		}
+		return ErrNotAllowed
+	}
+	return nil
+}
+
+// Form returns the restrictions as a result form suitable for including in a
+// disco#info response.
+// Empty fields are omitted.
+func (r Restrictions) Form() *form.Data {
+	fields := []form.Field{
+		form.Result,
+		form.Hidden(formType, form.Value(NSRestrictions)),
+	}
+	if r.MaxPerUser > 0 {
+		fields = append(fields, form.Text("max_reactions_per_user", form.Value(strconv.Itoa(r.MaxPerUser))))
+	}
+	if r.Allowlist != nil {
+		var opts []form.Option
+		for _, reaction := range r.Allowlist {
+			opts = append(opts, form.Value(reaction))
+		}
+		fields = append(fields, form.ListMulti("allowlist", opts...))
+	}
+	return form.New(fields...)
+}
+
+// ParseRestrictions extracts restrictions from a form.
+// If the form's FORM_TYPE is not NSRestrictions, ok will be false.
+func ParseRestrictions(f *form.Data) (r Restrictions, ok bool) {
+	typ, ok := f.Raw(formType)
+	if !ok || len(typ) != 1 || typ[0] != NSRestrictions {
+		return r, false
+	}
+	if v, ok := f.Raw("max_reactions_per_user"); ok && len(v) > 0 {
+		// Invalid limits are treated as if no limit was set.
+		max, err := strconv.Atoi(v[0])
+		if err == nil && max > 0 {
+			r.MaxPerUser = max
+		}
+	}
+	if v, ok := f.Raw("allowlist"); ok {
+		r.Allowlist = append([]string{}, v...)
+	}
+	return r, true
+}
+
+// GetRestrictions queries the entity to, normally a group chat, for any
+// restrictions on reactions.
+// If the entity does not advertise any restrictions the zero value is
+// returned.
+func GetRestrictions(ctx context.Context, s *xmpp.Session, to jid.JID) (Restrictions, error) {
+	info, err := disco.GetInfo(ctx, "", to, s)
+	if err != nil {
+		return Restrictions{}, err
+	}
+	for i := range info.Form {
+		if r, ok := ParseRestrictions(&info.Form[i]); ok {
+			return r, nil
+		}
+	}
+	return Restrictions{}, nil
+}
+
+// Handle returns an option that registers a Handler for reactions in chat and
+// groupchat messages.
+func Handle(h Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		name := xml.Name{Space: NS, Local: "reactions"}
+		mux.Message(stanza.ChatMessage, name, h)(m)
+		mux.Message(stanza.GroupChatMessage, name, h)(m)
+	}
+}
+
+// Handler reports incoming reactions.
+//
+// The sender of the reactions is the from address of the message.
+// In a group chat this is the occupant JID of the sender and the ID of the
+// reactions is the stanza ID assigned by the channel.
+type Handler struct {
+	Reactions func(msg stanza.Message, r Reactions) error
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h Handler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder) error {
+	v := struct {
+		stanza.Message
+		Reactions Reactions `xml:"urn:xmpp:reactions:0 reactions"`
+	}{}
+	err := xml.NewTokenDecoder(t).Decode(&v)
+	if err != nil {
+		return err
+	}
+	if h.Reactions == nil {
+		return nil
+	}
+	return h.Reactions(msg, v.Reactions)
+}
@@ -0,0 +1,271 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package reactions_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/form"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/reactions"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = reactions.Reactions{}
+	_ xml.Unmarshaler     = (*reactions.Reactions)(nil)
+	_ xmlstream.Marshaler = reactions.Reactions{}
+	_ xmlstream.WriterTo  = reactions.Reactions{}
+	_ mux.MessageHandler  = reactions.Handler{}
+	_ info.FeatureIter    = reactions.Handler{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &reactions.Reactions{ID: "744f6e18", Reaction: []string{"👋", "🐢"}},
+		XML:   `<reactions xmlns="urn:xmpp:reactions:0" id="744f6e18"><reaction>👋</reaction><reaction>🐢</reaction></reactions>`,
+	},
+	1: {
+		Value: &reactions.Reactions{ID: "744f6e18"},
+		XML:   `<reactions xmlns="urn:xmpp:reactions:0" id="744f6e18"></reactions>`,
+	},
+	2: {
+		Value:     &reactions.Reactions{ID: "744f6e18", Reaction: []string{"👋"}},
+		XML:       `<reactions xmlns="urn:xmpp:reactions:0" id="744f6e18"><reaction>👋</reaction><reaction>wave</reaction><reaction>👋</reaction></reactions>`,
+		NoMarshal: true,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+var validTests = [...]struct {
+	in string
+	ok bool
+}{
+	0:  {in: "👍", ok: true},
+	1:  {in: "👍🏽", ok: true},
+	2:  {in: "❤️", ok: true},
+	3:  {in: "❤", ok: true},
+	4:  {in: "🇫🇷", ok: true},
+	5:  {in: "🏳️\u200d🌈", ok: true},
+	6:  {in: "👩\u200d👩\u200d👧\u200d👦", ok: true},
+	7:  {in: "1️⃣", ok: true},
+	8:  {in: "#⃣", ok: true},
+	9:  {in: "🏴\U000e0067\U000e0062\U000e0065\U000e006e\U000e0067\U000e007f", ok: true},
+	10: {in: ""},
+	11: {in: "a"},
+	12: {in: "1"},
+	13: {in: "👍👍"},
+	14: {in: "👍 "},
+	15: {in: "🇫"},
+	16: {in: "👍\u200d"},
+	17: {in: "+1"},
+	18: {in: "🏴\U000e0067\U000e0062"},
+}
+
+func TestValid(t *testing.T) {
+	for i, tc := range validTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if ok := reactions.Valid(tc.in); ok != tc.ok {
+				t.Errorf("wrong result for %q: want=%t, got=%t", tc.in, tc.ok, ok)
+			}
+		})
+	}
+}
+
+func TestID(t *testing.T) {
+	channel := jid.MustParse("coven@chat.shakespeare.lit")
+	ids := []stanza.ID{
+		{ID: "archive-1", By: jid.MustParse("thirdwitch@shakespeare.lit")},
+		{ID: "stanza-id-1", By: channel},
+	}
+	msg := stanza.Message{ID: "msg-1", Type: stanza.GroupChatMessage, From: jid.MustParse("coven@chat.shakespeare.lit/thirdwitch")}
+	if id := reactions.ID(msg, ids); id != "stanza-id-1" {
+		t.Errorf("wrong group chat ID: want=stanza-id-1, got=%s", id)
+	}
+	msg.Type = stanza.ChatMessage
+	if id := reactions.ID(msg, ids); id != "msg-1" {
+		t.Errorf("wrong chat ID: want=msg-1, got=%s", id)
+	}
+}
+
+func TestSend(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	msg := stanza.Message{
+		To:   jid.MustParse("romeo@montague.lit"),
+		Type: stanza.ChatMessage,
+	}
+	err := reactions.Send(context.Background(), s, msg, reactions.Reactions{
+		ID:       "744f6e18",
+		Reaction: []string{"👋", "🐢", "👋"},
+	})
+	if err != nil {
+		t.Fatalf("error sending reactions: %v", err)
+	}
+	err = reactions.Send(context.Background(), s, msg, reactions.Reactions{
+		ID:       "744f6e18",
+		Reaction: []string{"👋", ":wave:"},
+	})
+	if !errors.Is(err, reactions.ErrInvalid) {
+		t.Errorf("wrong error for invalid reaction: want=%v, got=%v", reactions.ErrInvalid, err)
+	}
+	const expected = `<message xmlns="jabber:client" type="chat" to="romeo@montague.lit"><reactions xmlns="urn:xmpp:reactions:0" id="744f6e18"><reaction>👋</reaction><reaction>🐢</reaction></reactions><store xmlns="urn:xmpp:hints"></store></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+func TestSendRestricted(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	msg := stanza.Message{
+		To:   jid.MustParse("coven@chat.shakespeare.lit"),
+		Type: stanza.GroupChatMessage,
+	}
+	restrictions := reactions.Restrictions{MaxPerUser: 1, Allowlist: []string{"👍", "🐸"}}
+	err := reactions.SendRestricted(context.Background(), s, msg, reactions.Reactions{
+		ID:       "stanza-id-1",
+		Reaction: []string{"👍", "🐸"},
+	}, restrictions)
+	if !errors.Is(err, reactions.ErrTooMany) {
+		t.Errorf("wrong error for too many reactions: want=%v, got=%v", reactions.ErrTooMany, err)
+	}
+	err = reactions.SendRestricted(context.Background(), s, msg, reactions.Reactions{
+		ID:       "stanza-id-1",
+		Reaction: []string{"🐢"},
+	}, restrictions)
+	if !errors.Is(err, reactions.ErrNotAllowed) {
+		t.Errorf("wrong error for disallowed reaction: want=%v, got=%v", reactions.ErrNotAllowed, err)
+	}
+	// Duplicates do not count towards the limit.
+	err = reactions.SendRestricted(context.Background(), s, msg, reactions.Reactions{
+		ID:       "stanza-id-1",
+		Reaction: []string{"🐸", "🐸"},
+	}, restrictions)
+	if err != nil {
+		t.Fatalf("error sending reactions: %v", err)
+	}
+	const expected = `<message xmlns="jabber:client" type="groupchat" to="coven@chat.shakespeare.lit"><reactions xmlns="urn:xmpp:reactions:0" id="stanza-id-1"><reaction>🐸</reaction></reactions><store xmlns="urn:xmpp:hints"></store></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var events []string
+	m := mux.New(stanza.NSClient, reactions.Handle(reactions.Handler{
+		Reactions: func(msg stanza.Message, r reactions.Reactions) error {
+			events = append(events, msg.From.String()+" "+r.ID+" "+strings.Join(r.Reaction, ""))
+			return nil
+		},
+	}))
+	for _, msg := range []string{
+		`<message xmlns="jabber:client" type="chat" from="juliet@capulet.lit/balcony"><reactions xmlns="urn:xmpp:reactions:0" id="744f6e18"><reaction>👋</reaction><reaction>🐢</reaction></reactions></message>`,
+		`<message xmlns="jabber:client" type="groupchat" from="coven@chat.shakespeare.lit/thirdwitch"><reactions xmlns="urn:xmpp:reactions:0" id="stanza-id-1"><reaction>🐸</reaction><reaction>newt</reaction></reactions></message>`,
+		`<message xmlns="jabber:client" type="chat" from="juliet@capulet.lit/balcony"><reactions xmlns="urn:xmpp:reactions:0" id="744f6e18"/></message>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(msg))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(io.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling message: %v", err)
+		}
+	}
+	expected := []string{
+		"juliet@capulet.lit/balcony 744f6e18 👋🐢",
+		"coven@chat.shakespeare.lit/thirdwitch stanza-id-1 🐸",
+		"juliet@capulet.lit/balcony 744f6e18 ",
+	}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("wrong events:\nwant=%q,\n got=%q", expected, events)
+	}
+}
+
+var checkTests = [...]struct {
+	r   reactions.Restrictions
+	in  []string
+	err error
+}{
+	0: {in: []string{"👋", "🐢", "🐸"}},
+	1: {
+		r:   reactions.Restrictions{MaxPerUser: 2},
+		in:  []string{"👋", "🐢", "🐸"},
+		err: reactions.ErrTooMany,
+	},
+	2: {
+		r:  reactions.Restrictions{MaxPerUser: 2, Allowlist: []string{"👋", "🐢"}},
+		in: []string{"🐢"},
+	},
+	3: {
+		r:   reactions.Restrictions{Allowlist: []string{"👋", "🐢"}},
+		in:  []string{"🐢", "🐸"},
+		err: reactions.ErrNotAllowed,
+	},
+	4: {
+		r:   reactions.Restrictions{Allowlist: []string{}},
+		in:  []string{"🐢"},
+		err: reactions.ErrNotAllowed,
+	},
+}
+
+func TestCheck(t *testing.T) {
+	for i, tc := range checkTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if err := tc.r.Check(tc.in); !errors.Is(err, tc.err) {
+				t.Errorf("wrong error: want=%v, got=%v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestGetRestrictions(t *testing.T) {
+	restrictions := reactions.Restrictions{
+		MaxPerUser: 1,
+		Allowlist:  []string{"💘", "❤️", "💜"},
+	}
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(mux.New(
+		stanza.NSClient,
+		mux.IQFunc(stanza.GetIQ, xml.Name{Space: disco.NSInfo, Local: "query"}, func(iq stanza.IQ, e xmlstream.TokenReadEncoder, _ *xml.StartElement) error {
+			_, err := xmlstream.Copy(e, iq.Result(disco.Info{
+				Features: []info.Feature{reactions.Feature},
+				Form: []form.Data{
+					*disco.SoftwareInfo{OS: "Plan 9"}.Form(),
+					*restrictions.Form(),
+				},
+			}.TokenReader()))
+			return err
+		}),
+	)))
+	r, err := reactions.GetRestrictions(context.Background(), cs.Client, jid.MustParse("coven@chat.shakespeare.lit"))
+	if err != nil {
+		t.Fatalf("error getting restrictions: %v", err)
+	}
+	if !reflect.DeepEqual(r, restrictions) {
+		t.Errorf("wrong restrictions: want=%+v, got=%+v", restrictions, r)
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature
+
+// Package reply implements XEP-0461: Message Replies.
+//
+// Replies include a quote of the original message as a fallback for clients
+// that do not support them, marked using XEP-0428: Fallback Indication so that
+// clients that do can remove it.
+package reply // import "mellium.im/xmpp/reply"
+
+import (
+	"context"
+	"encoding/xml"
+	"strings"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/fallback"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/stanza"
+)
+
+// NS is the namespace used by this package, provided as a convenience.
+const NS = "urn:xmpp:reply:0"
+
+// Reply references the message being replied to.
+type Reply struct {
+	// To is the JID of the author of the original message.
+	// In a group chat this is the occupant JID of the author.
+	To jid.JID
+
+	// ID is the ID of the original message.
+	// In a group chat this is the stanza ID assigned by the channel, otherwise
+	// it is the id attribute of the message.
+	ID string
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (r Reply) TokenReader() xml.TokenReader {
+	var attrs []xml.Attr
+	if !r.To.Equal(jid.JID{}) {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "to"}, Value: r.To.String()})
+	}
+	attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "id"}, Value: r.ID})
+	return xmlstream.Wrap(nil, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "reply"},
+		Attr: attrs,
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (r Reply) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, r.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (r Reply) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := r.WriteXML(e)
+	return err
+}
+
+// UnmarshalXML implements xml.Unmarshaler.
+func (r *Reply) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	v := struct {
+		To jid.JID `xml:"to,attr"`
+		ID string  `xml:"id,attr"`
+	}{}
+	err := d.DecodeElement(&v, &start)
+	if err != nil {
+		return err
+	}
+	r.To = v.To
+	r.ID = v.ID
+	return nil
+}
+
+// Quote returns a fallback quoting the text of the original message with each
+// line prefixed by "> ".
+// If author is not empty, the quote is preceded by a line attributing it.
+// The result always ends with a newline so that the reply text can be appended
+// directly.
+func Quote(author, text string) string {
+	var b strings.Builder
+	if author != "" {
+		b.WriteString("> ")
+		b.WriteString(author)
+		b.WriteString(" wrote:\n")
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		b.WriteString(">")
+		if line != "" {
+			b.WriteString(" ")
+			b.WriteString(line)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Payload returns the reply, a body containing the quote followed by the
+// text, and a fallback indication covering the quote.
+// If quote is empty the body only contains text and no fallback indication is
+// included.
+func Payload(r Reply, quote, text string) xml.TokenReader {
+	payload := []xml.TokenReader{
+		message.Body{"": quote + text}.TokenReader(),
+		r.TokenReader(),
+	}
+	if quote != "" {
+		payload = append(payload, fallback.Fallback{
+			For:  NS,
+			Body: []fallback.Range{fallback.RangeOf(quote)},
+		}.TokenReader())
+	}
+	return xmlstream.MultiReader(payload...)
+}
+
+// Send sends text as a reply to an earlier message.
+// The quote, normally created using Quote, is included at the start of the
+// body for clients that do not support replies.
+// For more information see Payload.
+func Send(ctx context.Context, s *xmpp.Session, msg stanza.Message, r Reply, quote, text string) error {
+	return s.Send(ctx, msg.Wrap(Payload(r, quote, text)))
+}
+
+// Message contains the parts of a message that are relevant to replies.
+type Message struct {
+	stanza.Message
+
+	// Reply is set if the message is a reply to an earlier message.
+	Reply *Reply
+
+	// Body is the body of the message with any fallback text for replies
+	// removed.
+	Body message.Body
+}
+
+// Read decodes a message stanza, including its start element.
+// Payloads that are not relevant to replies are ignored.
+func Read(r xml.TokenReader) (Message, error) {
+	var v struct {
+		stanza.Message
+		Reply    *Reply              `xml:"urn:xmpp:reply:0 reply"`
+		Fallback []fallback.Fallback `xml:"urn:xmpp:fallback:0 fallback"`
+		Body     message.Body        `xml:"body"`
+	}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return Message{}, err
+	}
+	m := Message{
+		Message: v.Message,
+		Reply:   v.Reply,
+		Body:    v.Body,
+	}
+	if m.Reply != nil {
+		m.Body = fallback.Strip(m.Body, v.Fallback, NS)
+	}
+	return m, nil
+}
@@ -0,0 +1,138 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package reply_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/reply"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = reply.Reply{}
+	_ xml.Unmarshaler     = (*reply.Reply)(nil)
+	_ xmlstream.Marshaler = reply.Reply{}
+	_ xmlstream.WriterTo  = reply.Reply{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value: &reply.Reply{To: jid.MustParse("anna@example.com/tablet"), ID: "message-id1"},
+		XML:   `<reply xmlns="urn:xmpp:reply:0" to="anna@example.com/tablet" id="message-id1"></reply>`,
+	},
+	1: {
+		Value: &reply.Reply{ID: "message-id1"},
+		XML:   `<reply xmlns="urn:xmpp:reply:0" id="message-id1"></reply>`,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+var quoteTests = [...]struct {
+	author string
+	text   string
+	out    string
+}{
+	0: {text: "We should bake a cake", out: "> We should bake a cake\n"},
+	1: {author: "Anna", text: "We should bake a cake", out: "> Anna wrote:\n> We should bake a cake\n"},
+	2: {text: "one\n\ntwo\n", out: "> one\n>\n> two\n"},
+}
+
+func TestQuote(t *testing.T) {
+	for i, tc := range quoteTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if out := reply.Quote(tc.author, tc.text); out != tc.out {
+				t.Errorf("wrong quote: want=%q, got=%q", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	msg := stanza.Message{
+		To:   jid.MustParse("anna@example.com"),
+		Type: stanza.ChatMessage,
+	}
+	r := reply.Reply{To: jid.MustParse("anna@example.com/tablet"), ID: "message-id1"}
+	err := reply.Send(context.Background(), s, msg, r, reply.Quote("Anna", "We should bake a cake 🎂"), "Great idea!")
+	if err != nil {
+		t.Fatalf("error sending reply: %v", err)
+	}
+	err = reply.Send(context.Background(), s, msg, r, "", "Great idea!")
+	if err != nil {
+		t.Fatalf("error sending reply without quote: %v", err)
+	}
+	const expected = `<message xmlns="jabber:client" type="chat" to="anna@example.com"><body>&gt; Anna wrote:
+&gt; We should bake a cake 🎂
+Great idea!</body><reply xmlns="urn:xmpp:reply:0" to="anna@example.com/tablet" id="message-id1"></reply><fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:reply:0"><body start="0" end="40"></body></fallback></message>` +
+		`<message xmlns="jabber:client" type="chat" to="anna@example.com"><body>Great idea!</body><reply xmlns="urn:xmpp:reply:0" to="anna@example.com/tablet" id="message-id1"></reply></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+var readTests = [...]struct {
+	in  string
+	out reply.Message
+}{
+	0: {
+		in: `<message xmlns="jabber:client" from="juliet@capulet.lit/balcony" type="chat"><body>&gt; Anna wrote:
+&gt; We should bake a cake
+Great idea!</body><reply xmlns="urn:xmpp:reply:0" to="anna@example.com/tablet" id="message-id1"/><fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:reply:0"><body start="0" end="38"/></fallback></message>`,
+		out: reply.Message{
+			Message: stanza.Message{From: jid.MustParse("juliet@capulet.lit/balcony"), Type: stanza.ChatMessage},
+			Reply:   &reply.Reply{To: jid.MustParse("anna@example.com/tablet"), ID: "message-id1"},
+			Body:    message.Body{"": "Great idea!"},
+		},
+	},
+	1: {
+		// Fallbacks for other extensions are left in place.
+		in: `<message xmlns="jabber:client" type="chat"><body>&gt; quote
+text</body><reply xmlns="urn:xmpp:reply:0" id="message-id1"/><fallback xmlns="urn:xmpp:fallback:0" for="urn:example"><body start="0" end="8"/></fallback></message>`,
+		out: reply.Message{
+			Message: stanza.Message{Type: stanza.ChatMessage},
+			Reply:   &reply.Reply{ID: "message-id1"},
+			Body:    message.Body{"": "> quote\ntext"},
+		},
+	},
+	2: {
+		// Fallbacks are only removed from replies.
+		in: `<message xmlns="jabber:client" type="chat"><body>&gt; quote
+text</body><fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:reply:0"><body start="0" end="8"/></fallback></message>`,
+		out: reply.Message{
+			Message: stanza.Message{Type: stanza.ChatMessage},
+			Body:    message.Body{"": "> quote\ntext"},
+		},
+	},
+}
+
+func TestRead(t *testing.T) {
+	for i, tc := range readTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			m, err := reply.Read(xml.NewDecoder(strings.NewReader(tc.in)))
+			if err != nil {
+				t.Fatalf("error reading message: %v", err)
+			}
+			if !reflect.DeepEqual(m, tc.out) {
+				t.Errorf("wrong message:\nwant=%+v,\n got=%+v", tc.out, m)
+			}
+		})
+	}
+}
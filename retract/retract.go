@@ -0,0 +1,349 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+//go:generate go run ../internal/genfeature -receiver "h Handler"
+
+// Package retract implements XEP-0424: Message Retraction and parsing of
+// XEP-0425: Moderated Message Retraction.
+//
+// To ask a channel to retract a message as a moderator see the Moderate method
+// on muc.Channel.
+package retract // import "mellium.im/xmpp/retract"
+
+import (
+	"context"
+	"encoding/xml"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/fallback"
+	"mellium.im/xmpp/hints"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+	"mellium.im/xmpp/xtime"
+)
+
+// Namespaces used by this package, provided as a convenience.
+const (
+	NS         = "urn:xmpp:message-retract:1"
+	NSModerate = "urn:xmpp:message-moderate:1"
+)
+
+const (
+	nsOccupantID = "urn:xmpp:occupant-id:0"
+)
+
+// fallbackBody is the body sent with retractions for the benefit of clients
+// that do not support them.
+const fallbackBody = "This person attempted to retract a previous message, but it's unsupported by your client."
+
+// Moderation contains information about a message that was retracted by a
+// moderator of a group chat instead of by its original sender.
+type Moderation struct {
+	// By is the occupant JID of the moderator.
+	By jid.JID
+
+	// OccupantID is the stable occupant ID of the moderator, if the channel
+	// assigns them.
+	OccupantID string
+
+	Reason string
+}
+
+func (m *Moderation) tokenReader() xml.TokenReader {
+	var inner xml.TokenReader
+	if m.OccupantID != "" {
+		inner = xmlstream.Wrap(nil, xml.StartElement{
+			Name: xml.Name{Space: nsOccupantID, Local: "occupant-id"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: m.OccupantID}},
+		})
+	}
+	r := xmlstream.Wrap(inner, xml.StartElement{
+		Name: xml.Name{Space: NSModerate, Local: "moderated"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "by"}, Value: m.By.String()}},
+	})
+	if m.Reason == "" {
+		return r
+	}
+	return xmlstream.MultiReader(r, xmlstream.Wrap(
+		xmlstream.Token(xml.CharData(m.Reason)),
+		xml.StartElement{Name: xml.Name{Local: "reason"}},
+	))
+}
+
+// Retraction is a request to retract an earlier message.
+type Retraction struct {
+	// ID is the ID of the retracted message.
+	// In a group chat this is the stanza ID assigned by the channel, otherwise
+	// it is the origin ID of the message.
+	ID string
+
+	// Moderated is set if the message is being retracted by a moderator.
+	Moderated *Moderation
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (r Retraction) TokenReader() xml.TokenReader {
+	var inner xml.TokenReader
+	if r.Moderated != nil {
+		inner = r.Moderated.tokenReader()
+	}
+	return xmlstream.Wrap(inner, xml.StartElement{
+		Name: xml.Name{Space: NS, Local: "retract"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "id"}, Value: r.ID}},
+	})
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (r Retraction) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, r.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (r Retraction) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := r.WriteXML(e)
+	return err
+}
+
+// Tombstone is left in an archive in place of the content of a message that
+// has been retracted.
+type Tombstone struct {
+	// ID is the ID of the message that retracted the original message.
+	ID    string
+	Stamp time.Time
+
+	// Moderated is set if the message was retracted by a moderator.
+	Moderated *Moderation
+}
+
+// Send retracts a message that was previously sent to msg.To.
+// The id is the ID of the retracted message as returned by StableID.
+//
+// The retraction includes a fallback body for clients that do not support
+// retractions and asks the server to store it in any archives so that clients
+// that later fetch the history also see it.
+func Send(ctx context.Context, s *xmpp.Session, msg stanza.Message, id string) error {
+	return s.Send(ctx, msg.Wrap(xmlstream.MultiReader(
+		Retraction{ID: id}.TokenReader(),
+		fallback.Fallback{For: NS}.TokenReader(),
+		message.Body{"": fallbackBody}.TokenReader(),
+		hints.Store.TokenReader(),
+	)))
+}
+
+// Message contains the parts of a message that are relevant to retractions.
+type Message struct {
+	stanza.Message
+
+	// Any IDs of the message other than its id attribute.
+	OriginID  stanza.OriginID
+	StanzaIDs []stanza.ID
+
+	// Delay is the time at which the message was originally sent, if it was
+	// delayed or read from an archive.
+	Delay delay.Delay
+
+	// Retract is set if the message retracts an earlier message.
+	Retract *Retraction
+
+	// Tombstone is set if the message was read from an archive and has itself
+	// been retracted.
+	Tombstone *Tombstone
+
+	// Body is the body of the message.
+	// It is always empty if the message is a retraction or a tombstone, even if
+	// the original message contained a fallback body.
+	Body message.Body
+}
+
+// StableID returns the ID that should be used when retracting m.
+// In a group chat this is the stanza ID assigned by the channel, otherwise it
+// is the origin ID of the message or its id attribute if it does not have an
+// origin ID.
+func (m Message) StableID() string {
+	if m.Type == stanza.GroupChatMessage {
+		channel := m.From.Bare()
+		for _, id := range m.StanzaIDs {
+			if id.By.Equal(channel) {
+				return id.ID
+			}
+		}
+		return ""
+	}
+	if m.OriginID.ID != "" {
+		return m.OriginID.ID
+	}
+	return m.ID
+}
+
+// Valid reports whether m is a retraction that is allowed to retract orig.
+//
+// In a group chat the retraction must be sent by the same occupant JID as the
+// original message or, if it was moderated, by the channel itself.
+// Otherwise it must be sent by the same bare JID.
+func (m Message) Valid(orig Message) bool {
+	if m.Retract == nil || (m.Type == stanza.GroupChatMessage) != (orig.Type == stanza.GroupChatMessage) {
+		return false
+	}
+	if orig.Type == stanza.GroupChatMessage {
+		if m.Retract.Moderated != nil {
+			return m.From.Equal(orig.From.Bare())
+		}
+		return m.From.Equal(orig.From)
+	}
+	return m.From.Bare().Equal(orig.From.Bare())
+}
+
+type moderatedEl struct {
+	By         jid.JID `xml:"by,attr"`
+	OccupantID struct {
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:occupant-id:0 occupant-id"`
+}
+
+func (m *moderatedEl) moderation(reason string) *Moderation {
+	if m == nil {
+		return nil
+	}
+	return &Moderation{
+		By:         m.By,
+		OccupantID: m.OccupantID.ID,
+		Reason:     reason,
+	}
+}
+
+type messageEl struct {
+	stanza.Message
+	OriginID  stanza.OriginID `xml:"urn:xmpp:sid:0 origin-id"`
+	StanzaIDs []stanza.ID     `xml:"urn:xmpp:sid:0 stanza-id"`
+	Delay     delay.Delay     `xml:"urn:xmpp:delay delay"`
+	Retract   *struct {
+		ID        string       `xml:"id,attr"`
+		Moderated *moderatedEl `xml:"urn:xmpp:message-moderate:1 moderated"`
+		Reason    string       `xml:"reason"`
+	} `xml:"urn:xmpp:message-retract:1 retract"`
+	Retracted *struct {
+		ID        string       `xml:"id,attr"`
+		Stamp     xtime.Time   `xml:"stamp,attr"`
+		Moderated *moderatedEl `xml:"urn:xmpp:message-moderate:1 moderated"`
+		Reason    string       `xml:"reason"`
+	} `xml:"urn:xmpp:message-retract:1 retracted"`
+	Fallback []fallback.Fallback `xml:"urn:xmpp:fallback:0 fallback"`
+	Body     message.Body        `xml:"body"`
+}
+
+func (v messageEl) message() Message {
+	m := Message{
+		Message:   v.Message,
+		OriginID:  v.OriginID,
+		StanzaIDs: v.StanzaIDs,
+		Delay:     v.Delay,
+		Body:      v.Body,
+	}
+	if v.Retract != nil {
+		m.Retract = &Retraction{
+			ID:        v.Retract.ID,
+			Moderated: v.Retract.Moderated.moderation(v.Retract.Reason),
+		}
+	}
+	if v.Retracted != nil {
+		m.Tombstone = &Tombstone{
+			ID:        v.Retracted.ID,
+			Stamp:     v.Retracted.Stamp.Time,
+			Moderated: v.Retracted.Moderated.moderation(v.Retracted.Reason),
+		}
+	}
+	if m.Retract != nil || m.Tombstone != nil {
+		m.Body = nil
+	} else {
+		m.Body = fallback.Strip(m.Body, v.Fallback, NS)
+	}
+	return m
+}
+
+// Read decodes a message stanza, including its start element.
+// Payloads that are not relevant to retractions are ignored.
+func Read(r xml.TokenReader) (Message, error) {
+	var v messageEl
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return Message{}, err
+	}
+	return v.message(), nil
+}
+
+// ReadResult decodes the forwarded message from a message containing a result
+// of a history query, such as those returned by history.Iter.
+//
+// The ID of the result in the archive is added to the stanza IDs of the message
+// (using the address of the archive that sent the result) if it is not already
+// present, and the time that the message was archived is used as its delay.
+func ReadResult(r xml.TokenReader) (Message, error) {
+	var v struct {
+		stanza.Message
+		Result struct {
+			ID        string `xml:"id,attr"`
+			Forwarded struct {
+				Delay delay.Delay `xml:"urn:xmpp:delay delay"`
+				Inner messageEl   `xml:"message"`
+			} `xml:"urn:xmpp:forward:0 forwarded"`
+		} `xml:"urn:xmpp:mam:2 result"`
+	}
+	err := xml.NewTokenDecoder(r).Decode(&v)
+	if err != nil {
+		return Message{}, err
+	}
+	m := v.Result.Forwarded.Inner.message()
+	if !v.Result.Forwarded.Delay.Time.IsZero() {
+		m.Delay = v.Result.Forwarded.Delay
+	}
+	if v.Result.ID == "" {
+		return m, nil
+	}
+	for _, id := range m.StanzaIDs {
+		if id.ID == v.Result.ID {
+			return m, nil
+		}
+	}
+	m.StanzaIDs = append(m.StanzaIDs, stanza.ID{ID: v.Result.ID, By: v.From})
+	return m, nil
+}
+
+// Handle returns an option that registers a Handler for retractions in chat
+// and groupchat messages.
+func Handle(h Handler) mux.Option {
+	return func(m *mux.ServeMux) {
+		name := xml.Name{Space: NS, Local: "retract"}
+		mux.Message(stanza.ChatMessage, name, h)(m)
+		mux.Message(stanza.GroupChatMessage, name, h)(m)
+	}
+}
+
+// Handler reports incoming retractions, including those sent by group chat
+// moderators.
+//
+// Retractions are reported without checking whether the sender is allowed to
+// retract the message, since this requires knowing who sent the original
+// message.
+// Before applying a retraction the application should find the message
+// referenced by its ID and check it using the Valid method.
+type Handler struct {
+	Retract func(Message) error
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h Handler) HandleMessage(_ stanza.Message, t xmlstream.TokenReadEncoder) error {
+	m, err := Read(t)
+	if err != nil {
+		return err
+	}
+	if h.Retract == nil || m.Retract == nil {
+		return nil
+	}
+	return h.Retract(m)
+}
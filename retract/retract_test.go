@@ -0,0 +1,270 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package retract_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/delay"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/message"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/retract"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = retract.Retraction{}
+	_ xmlstream.Marshaler = retract.Retraction{}
+	_ xmlstream.WriterTo  = retract.Retraction{}
+	_ mux.MessageHandler  = retract.Handler{}
+	_ info.FeatureIter    = retract.Handler{}
+)
+
+var encodingTestCases = []xmpptest.EncodingTestCase{
+	0: {
+		Value:       &retract.Retraction{ID: "origin-id-1"},
+		XML:         `<retract xmlns="urn:xmpp:message-retract:1" id="origin-id-1"></retract>`,
+		NoUnmarshal: true,
+	},
+	1: {
+		Value: &retract.Retraction{
+			ID: "stanza-id-1",
+			Moderated: &retract.Moderation{
+				By:         jid.MustParse("channel@muc.example/macbeth"),
+				OccupantID: "dd72603d",
+				Reason:     "Spam",
+			},
+		},
+		XML:         `<retract xmlns="urn:xmpp:message-retract:1" id="stanza-id-1"><moderated xmlns="urn:xmpp:message-moderate:1" by="channel@muc.example/macbeth"><occupant-id xmlns="urn:xmpp:occupant-id:0" id="dd72603d"></occupant-id></moderated><reason>Spam</reason></retract>`,
+		NoUnmarshal: true,
+	},
+}
+
+func TestEncode(t *testing.T) {
+	xmpptest.RunEncodingTests(t, encodingTestCases)
+}
+
+func TestSend(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	err := retract.Send(context.Background(), s, stanza.Message{
+		To:   jid.MustParse("lord@capulet.example"),
+		Type: stanza.ChatMessage,
+	}, "origin-id-1")
+	if err != nil {
+		t.Fatalf("error sending retraction: %v", err)
+	}
+	const expected = `<message xmlns="jabber:client" type="chat" to="lord@capulet.example"><retract xmlns="urn:xmpp:message-retract:1" id="origin-id-1"></retract><fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:message-retract:1"></fallback><body>This person attempted to retract a previous message, but it&#39;s unsupported by your client.</body><store xmlns="urn:xmpp:hints"></store></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+}
+
+var (
+	stamp   = time.Date(2019, time.September, 20, 23, 9, 32, 0, time.UTC)
+	channel = jid.MustParse("channel@muc.example")
+)
+
+var readTests = [...]struct {
+	in     string
+	result bool
+	msg    retract.Message
+}{
+	0: {
+		in: `<message xmlns="jabber:client" type="chat" from="juliet@capulet.example/balcony" id="msg-1"><body>Wherefore art thou</body><origin-id xmlns="urn:xmpp:sid:0" id="origin-id-1"/></message>`,
+		msg: retract.Message{
+			Message:  stanza.Message{Type: stanza.ChatMessage, From: jid.MustParse("juliet@capulet.example/balcony"), ID: "msg-1"},
+			OriginID: stanza.OriginID{XMLName: xml.Name{Space: stanza.NSSid, Local: "origin-id"}, ID: "origin-id-1"},
+			Body:     message.Body{"": "Wherefore art thou"},
+		},
+	},
+	1: {
+		in: `<message xmlns="jabber:client" type="chat" from="juliet@capulet.example/balcony" id="retract-1"><retract xmlns="urn:xmpp:message-retract:1" id="origin-id-1"/><fallback xmlns="urn:xmpp:fallback:0" for="urn:xmpp:message-retract:1"/><body>This person attempted to retract a previous message, but it's unsupported by your client.</body></message>`,
+		msg: retract.Message{
+			Message: stanza.Message{Type: stanza.ChatMessage, From: jid.MustParse("juliet@capulet.example/balcony"), ID: "retract-1"},
+			Retract: &retract.Retraction{ID: "origin-id-1"},
+		},
+	},
+	2: {
+		in: `<message xmlns="jabber:client" type="groupchat" from="channel@muc.example" id="retraction-id-1"><retract id="stanza-id-1" xmlns="urn:xmpp:message-retract:1"><moderated by="channel@muc.example/macbeth" xmlns="urn:xmpp:message-moderate:1"><occupant-id xmlns="urn:xmpp:occupant-id:0" id="dd72603d"/></moderated><reason>This message contains inappropriate content for this forum</reason></retract><body>A message was retracted by a moderator.</body></message>`,
+		msg: retract.Message{
+			Message: stanza.Message{Type: stanza.GroupChatMessage, From: channel, ID: "retraction-id-1"},
+			Retract: &retract.Retraction{
+				ID: "stanza-id-1",
+				Moderated: &retract.Moderation{
+					By:         jid.MustParse("channel@muc.example/macbeth"),
+					OccupantID: "dd72603d",
+					Reason:     "This message contains inappropriate content for this forum",
+				},
+			},
+		},
+	},
+	3: {
+		result: true,
+		in:     `<message xmlns="jabber:client" id="aeb213" to="juliet@capulet.example/chamber"><result xmlns="urn:xmpp:mam:2" queryid="f27" id="28482-98726-73623"><forwarded xmlns="urn:xmpp:forward:0"><delay xmlns="urn:xmpp:delay" stamp="2019-09-20T23:09:32Z"/><message xmlns="jabber:client" from="witch@shakespeare.lit" to="macbeth@shakespeare.lit" type="chat"><body>Hail to thee</body><fallback xmlns="urn:xmpp:fallback:0" for="urn:example:other"/></message></forwarded></result></message>`,
+		msg: retract.Message{
+			Message:   stanza.Message{Type: stanza.ChatMessage, From: jid.MustParse("witch@shakespeare.lit"), To: jid.MustParse("macbeth@shakespeare.lit")},
+			StanzaIDs: []stanza.ID{{ID: "28482-98726-73623"}},
+			Delay:     delay.Delay{Time: stamp},
+			Body:      message.Body{"": "Hail to thee"},
+		},
+	},
+	4: {
+		result: true,
+		in:     `<message xmlns="jabber:client" from="channel@muc.example" to="juliet@capulet.example/chamber"><result xmlns="urn:xmpp:mam:2" queryid="f27" id="stanza-id-1"><forwarded xmlns="urn:xmpp:forward:0"><delay xmlns="urn:xmpp:delay" stamp="2019-09-20T23:09:32Z"/><message xmlns="jabber:client" from="channel@muc.example/thirdwitch" type="groupchat"><stanza-id xmlns="urn:xmpp:sid:0" id="stanza-id-1" by="channel@muc.example"/><retracted xmlns="urn:xmpp:message-retract:1" id="retraction-id-1" stamp="2019-09-20T23:09:32Z"><moderated xmlns="urn:xmpp:message-moderate:1" by="channel@muc.example/macbeth"/><reason>Spam</reason></retracted></message></forwarded></result></message>`,
+		msg: retract.Message{
+			Message:   stanza.Message{Type: stanza.GroupChatMessage, From: jid.MustParse("channel@muc.example/thirdwitch")},
+			StanzaIDs: []stanza.ID{{XMLName: xml.Name{Space: stanza.NSSid, Local: "stanza-id"}, ID: "stanza-id-1", By: channel}},
+			Delay:     delay.Delay{Time: stamp},
+			Tombstone: &retract.Tombstone{
+				ID:    "retraction-id-1",
+				Stamp: stamp,
+				Moderated: &retract.Moderation{
+					By:     jid.MustParse("channel@muc.example/macbeth"),
+					Reason: "Spam",
+				},
+			},
+		},
+	},
+}
+
+func TestRead(t *testing.T) {
+	for i, tc := range readTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			read := retract.Read
+			if tc.result {
+				read = retract.ReadResult
+			}
+			msg, err := read(xml.NewDecoder(strings.NewReader(tc.in)))
+			if err != nil {
+				t.Fatalf("error reading message: %v", err)
+			}
+			if !reflect.DeepEqual(msg, tc.msg) {
+				t.Errorf("wrong message:\nwant=%+v,\n got=%+v", tc.msg, msg)
+			}
+		})
+	}
+}
+
+func TestStableID(t *testing.T) {
+	msg := retract.Message{
+		Message:   stanza.Message{ID: "msg-1", Type: stanza.GroupChatMessage, From: jid.MustParse("channel@muc.example/thirdwitch")},
+		OriginID:  stanza.OriginID{ID: "origin-id-1"},
+		StanzaIDs: []stanza.ID{{ID: "archive-1", By: jid.MustParse("thirdwitch@shakespeare.lit")}, {ID: "stanza-id-1", By: channel}},
+	}
+	if id := msg.StableID(); id != "stanza-id-1" {
+		t.Errorf("wrong group chat ID: want=stanza-id-1, got=%s", id)
+	}
+	msg.Type = stanza.ChatMessage
+	if id := msg.StableID(); id != "origin-id-1" {
+		t.Errorf("wrong chat ID: want=origin-id-1, got=%s", id)
+	}
+	msg.OriginID.ID = ""
+	if id := msg.StableID(); id != "msg-1" {
+		t.Errorf("wrong chat ID without origin ID: want=msg-1, got=%s", id)
+	}
+}
+
+var validTests = [...]struct {
+	orig  stanza.Message
+	m     stanza.Message
+	moder bool
+	ok    bool
+}{
+	0: {
+		orig: stanza.Message{From: jid.MustParse("juliet@capulet.example/balcony"), Type: stanza.ChatMessage},
+		m:    stanza.Message{From: jid.MustParse("juliet@capulet.example/chamber"), Type: stanza.ChatMessage},
+		ok:   true,
+	},
+	1: {
+		orig: stanza.Message{From: jid.MustParse("juliet@capulet.example/balcony"), Type: stanza.ChatMessage},
+		m:    stanza.Message{From: jid.MustParse("tybalt@capulet.example/balcony"), Type: stanza.ChatMessage},
+	},
+	2: {
+		orig: stanza.Message{From: jid.MustParse("channel@muc.example/thirdwitch"), Type: stanza.GroupChatMessage},
+		m:    stanza.Message{From: jid.MustParse("channel@muc.example/thirdwitch"), Type: stanza.GroupChatMessage},
+		ok:   true,
+	},
+	3: {
+		orig: stanza.Message{From: jid.MustParse("channel@muc.example/thirdwitch"), Type: stanza.GroupChatMessage},
+		m:    stanza.Message{From: jid.MustParse("channel@muc.example/firstwitch"), Type: stanza.GroupChatMessage},
+	},
+	4: {
+		orig:  stanza.Message{From: jid.MustParse("channel@muc.example/thirdwitch"), Type: stanza.GroupChatMessage},
+		m:     stanza.Message{From: channel, Type: stanza.GroupChatMessage},
+		moder: true,
+		ok:    true,
+	},
+	5: {
+		orig: stanza.Message{From: jid.MustParse("channel@muc.example/thirdwitch"), Type: stanza.GroupChatMessage},
+		m:    stanza.Message{From: channel, Type: stanza.GroupChatMessage},
+	},
+	6: {
+		orig:  stanza.Message{From: jid.MustParse("channel@muc.example/thirdwitch"), Type: stanza.GroupChatMessage},
+		m:     stanza.Message{From: jid.MustParse("channel@muc.example/macbeth"), Type: stanza.GroupChatMessage},
+		moder: true,
+	},
+}
+
+func TestValid(t *testing.T) {
+	for i, tc := range validTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			m := retract.Message{
+				Message: tc.m,
+				Retract: &retract.Retraction{ID: "id-1"},
+			}
+			if tc.moder {
+				m.Retract.Moderated = &retract.Moderation{By: jid.MustParse("channel@muc.example/macbeth")}
+			}
+			if ok := m.Valid(retract.Message{Message: tc.orig}); ok != tc.ok {
+				t.Errorf("wrong result: want=%t, got=%t", tc.ok, ok)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var retracted []string
+	m := mux.New(stanza.NSClient, retract.Handle(retract.Handler{
+		Retract: func(m retract.Message) error {
+			retracted = append(retracted, m.Retract.ID)
+			return nil
+		},
+	}))
+	for _, in := range []string{
+		readTests[1].in,
+		readTests[2].in,
+	} {
+		d := xml.NewDecoder(strings.NewReader(in))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(io.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling message: %v", err)
+		}
+	}
+	const expected = "origin-id-1,stanza-id-1"
+	if s := strings.Join(retracted, ","); s != expected {
+		t.Errorf("wrong retractions: want=%s, got=%s", expected, s)
+	}
+}
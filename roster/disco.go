@@ -0,0 +1,25 @@
+// Code generated by "genfeature -receiver h ExchangeHandler -vars FeatureExchange:NSExchange"; DO NOT EDIT.
+
+package roster
+
+import (
+	"mellium.im/xmpp/disco/info"
+)
+
+// A list of service discovery features that are supported by this package.
+var (
+	FeatureExchange = info.Feature{Var: NSExchange}
+)
+
+// ForFeatures implements info.FeatureIter.
+func (h ExchangeHandler) ForFeatures(node string, f func(info.Feature) error) error {
+	if node != "" {
+		return nil
+	}
+	var err error
+	err = f(FeatureExchange)
+	if err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NSExchange is the namespace used by XEP-0144: Roster Item Exchange.
+const NSExchange = "http://jabber.org/protocol/rosterx"
+
+// Action is the action that a roster item exchange suggests taking.
+type Action string
+
+// A list of possible actions.
+const (
+	// ActionAdd suggests adding the item to the roster, or adding it to the
+	// suggested groups if it already exists.
+	ActionAdd Action = "add"
+
+	// ActionDelete suggests removing the item from the suggested groups, or
+	// removing it from the roster entirely if no groups are suggested.
+	ActionDelete Action = "delete"
+
+	// ActionModify suggests changing the name and groups of an existing item.
+	ActionModify Action = "modify"
+)
+
+// Suggestion is a single item in a roster item exchange.
+type Suggestion struct {
+	Action Action   `xml:"action,attr,omitempty"`
+	JID    jid.JID  `xml:"jid,attr"`
+	Name   string   `xml:"name,attr,omitempty"`
+	Group  []string `xml:"group,omitempty"`
+}
+
+// Apply returns the roster item that results from accepting the suggestion.
+// The current roster item with the same JID (or the zero value if the item is
+// not in the roster) is used to determine the new groups.
+// The result may be passed directly to Set, including when the item should be
+// removed in which case it will have a subscription of "remove".
+//
+// If the action is empty it is treated as ActionAdd.
+func (s Suggestion) Apply(current Item) Item {
+	item := Item{
+		JID:  s.JID,
+		Name: current.Name,
+	}
+	switch s.Action {
+	case ActionDelete:
+		if len(s.Group) == 0 {
+			item.Subscription = "remove"
+			return item
+		}
+		for _, g := range current.Group {
+			if !contains(s.Group, g) {
+				item.Group = append(item.Group, g)
+			}
+		}
+		if len(item.Group) == 0 {
+			item.Subscription = "remove"
+		}
+	case ActionModify:
+		item.Name = s.Name
+		item.Group = append(item.Group, s.Group...)
+	default:
+		if item.Name == "" {
+			item.Name = s.Name
+		}
+		item.Group = append(item.Group, current.Group...)
+		for _, g := range s.Group {
+			if !contains(item.Group, g) {
+				item.Group = append(item.Group, g)
+			}
+		}
+	}
+	return item
+}
+
+func contains(s []string, v string) bool {
+	for _, ss := range s {
+		if ss == v {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (s Suggestion) TokenReader() xml.TokenReader {
+	var group []xml.TokenReader
+	for _, g := range s.Group {
+		group = append(group, xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(g)),
+			xml.StartElement{Name: xml.Name{Local: "group"}},
+		))
+	}
+	attrs := []xml.Attr{{Name: xml.Name{Local: "jid"}, Value: s.JID.String()}}
+	if s.Action != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "action"}, Value: string(s.Action)})
+	}
+	if s.Name != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "name"}, Value: s.Name})
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(group...),
+		xml.StartElement{Name: xml.Name{Local: "item"}, Attr: attrs},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (s Suggestion) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, s.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (s Suggestion) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := s.WriteXML(e)
+	return err
+}
+
+// Exchange is a roster item exchange payload that may be included in a
+// message or IQ.
+type Exchange struct {
+	XMLName xml.Name     `xml:"http://jabber.org/protocol/rosterx x"`
+	Items   []Suggestion `xml:"item"`
+}
+
+// TokenReader implements xmlstream.Marshaler.
+func (x Exchange) TokenReader() xml.TokenReader {
+	var items []xml.TokenReader
+	for _, item := range x.Items {
+		items = append(items, item.TokenReader())
+	}
+	return xmlstream.Wrap(
+		xmlstream.MultiReader(items...),
+		xml.StartElement{Name: xml.Name{Space: NSExchange, Local: "x"}},
+	)
+}
+
+// WriteXML implements xmlstream.WriterTo.
+func (x Exchange) WriteXML(w xmlstream.TokenWriter) (int, error) {
+	return xmlstream.Copy(w, x.TokenReader())
+}
+
+// MarshalXML implements xml.Marshaler.
+func (x Exchange) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	_, err := x.WriteXML(e)
+	return err
+}
+
+// Suggest sends roster item suggestions in a message.
+// Messages are the recommended way to send suggestions to bare JIDs or
+// entities that are not known to support roster item exchange.
+func Suggest(ctx context.Context, s *xmpp.Session, msg stanza.Message, items ...Suggestion) error {
+	return s.Send(ctx, msg.Wrap(Exchange{Items: items}.TokenReader()))
+}
+
+// SuggestIQ sends roster item suggestions in an IQ and waits for the
+// recipient to acknowledge them.
+// IQs should only be used to send suggestions to full JIDs that are known to
+// support roster item exchange.
+// Changing the type of the provided IQ has no effect.
+func SuggestIQ(ctx context.Context, s *xmpp.Session, iq stanza.IQ, items ...Suggestion) error {
+	iq.Type = stanza.SetIQ
+	resp, err := s.SendIQ(ctx, iq.Wrap(Exchange{Items: items}.TokenReader()))
+	if err != nil {
+		return err
+	}
+	return resp.Close()
+}
+
+// HandleExchange returns an option that registers an ExchangeHandler for
+// roster item exchanges sent in messages and IQs.
+func HandleExchange(h ExchangeHandler) mux.Option {
+	x := xml.Name{Space: NSExchange, Local: "x"}
+	return func(m *mux.ServeMux) {
+		// Messages without a type attribute are normal messages.
+		mux.Message("", x, h)(m)
+		mux.Message(stanza.NormalMessage, x, h)(m)
+		mux.Message(stanza.ChatMessage, x, h)(m)
+		mux.Message(stanza.HeadlineMessage, x, h)(m)
+		mux.IQ(stanza.SetIQ, x, h)(m)
+	}
+}
+
+// ExchangeHandler handles roster item exchanges.
+//
+// Suggestions should only be accepted from trusted entities such as the
+// user's server or contacts in the roster, so the sender is always provided.
+// If Exchange returns a stanza.Error when handling an IQ it is sent as the
+// response, otherwise it is passed through and returned from the handler.
+type ExchangeHandler struct {
+	Exchange func(from jid.JID, items []Suggestion) error
+}
+
+// HandleMessage satisfies mux.MessageHandler.
+func (h ExchangeHandler) HandleMessage(msg stanza.Message, t xmlstream.TokenReadEncoder) error {
+	v := struct {
+		stanza.Message
+		Exchange Exchange
+	}{}
+	err := xml.NewTokenDecoder(t).Decode(&v)
+	if err != nil {
+		return err
+	}
+	if h.Exchange == nil {
+		return nil
+	}
+	return h.Exchange(msg.From, v.Exchange.Items)
+}
+
+// HandleIQ satisfies mux.IQHandler.
+func (h ExchangeHandler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	var x Exchange
+	d := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), t))
+	err := d.Decode(&x)
+	if err != nil {
+		return err
+	}
+	if h.Exchange != nil {
+		err = h.Exchange(iq.From, x.Items)
+	}
+	var stanzaErr stanza.Error
+	if errors.As(err, &stanzaErr) {
+		_, err = xmlstream.Copy(t, iq.Error(stanzaErr))
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	_, err = xmlstream.Copy(t, iq.Result(nil))
+	return err
+}
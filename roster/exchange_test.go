@@ -0,0 +1,221 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/disco/info"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+var (
+	_ xml.Marshaler       = roster.Exchange{}
+	_ xmlstream.Marshaler = roster.Exchange{}
+	_ xmlstream.WriterTo  = roster.Exchange{}
+	_ xml.Marshaler       = roster.Suggestion{}
+	_ info.FeatureIter    = roster.ExchangeHandler{}
+)
+
+var applyTests = [...]struct {
+	current roster.Item
+	s       roster.Suggestion
+	out     roster.Item
+}{
+	0: {
+		s: roster.Suggestion{
+			JID:   jid.MustParse("juliet@example.com"),
+			Name:  "Juliet",
+			Group: []string{"Friends"},
+		},
+		out: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Name:  "Juliet",
+			Group: []string{"Friends"},
+		},
+	},
+	1: {
+		current: roster.Item{
+			JID:          jid.MustParse("juliet@example.com"),
+			Name:         "Jules",
+			Subscription: "both",
+			Group:        []string{"Capulet"},
+		},
+		s: roster.Suggestion{
+			Action: roster.ActionAdd,
+			JID:    jid.MustParse("juliet@example.com"),
+			Name:   "Juliet",
+			Group:  []string{"Friends", "Capulet"},
+		},
+		out: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Name:  "Jules",
+			Group: []string{"Capulet", "Friends"},
+		},
+	},
+	2: {
+		current: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Group: []string{"Capulet", "Friends"},
+		},
+		s: roster.Suggestion{
+			Action: roster.ActionDelete,
+			JID:    jid.MustParse("juliet@example.com"),
+			Group:  []string{"Friends"},
+		},
+		out: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Group: []string{"Capulet"},
+		},
+	},
+	3: {
+		current: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Group: []string{"Friends"},
+		},
+		s: roster.Suggestion{
+			Action: roster.ActionDelete,
+			JID:    jid.MustParse("juliet@example.com"),
+			Group:  []string{"Friends"},
+		},
+		out: roster.Item{
+			JID:          jid.MustParse("juliet@example.com"),
+			Subscription: "remove",
+		},
+	},
+	4: {
+		current: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Group: []string{"Friends"},
+		},
+		s: roster.Suggestion{
+			Action: roster.ActionDelete,
+			JID:    jid.MustParse("juliet@example.com"),
+		},
+		out: roster.Item{
+			JID:          jid.MustParse("juliet@example.com"),
+			Subscription: "remove",
+		},
+	},
+	5: {
+		current: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Name:  "Jules",
+			Group: []string{"Friends"},
+		},
+		s: roster.Suggestion{
+			Action: roster.ActionModify,
+			JID:    jid.MustParse("juliet@example.com"),
+			Name:   "Juliet",
+			Group:  []string{"Capulet"},
+		},
+		out: roster.Item{
+			JID:   jid.MustParse("juliet@example.com"),
+			Name:  "Juliet",
+			Group: []string{"Capulet"},
+		},
+	},
+}
+
+func TestApply(t *testing.T) {
+	for i, tc := range applyTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			out := tc.s.Apply(tc.current)
+			if !reflect.DeepEqual(out, tc.out) {
+				t.Errorf("wrong item:\nwant=%+v,\n got=%+v", tc.out, out)
+			}
+		})
+	}
+}
+
+var exchangeItems = []roster.Suggestion{{
+	Action: roster.ActionAdd,
+	JID:    jid.MustParse("juliet@example.com"),
+	Name:   "Juliet",
+	Group:  []string{"Friends"},
+}, {
+	Action: roster.ActionDelete,
+	JID:    jid.MustParse("nurse@example.com"),
+}}
+
+func TestSuggest(t *testing.T) {
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	err := roster.Suggest(context.Background(), s, stanza.Message{
+		To:   jid.MustParse("romeo@example.net"),
+		Type: stanza.NormalMessage,
+	}, exchangeItems...)
+	if err != nil {
+		t.Fatalf("error sending suggestions: %v", err)
+	}
+	const expected = `<message xmlns="jabber:client" type="normal" to="romeo@example.net"><x xmlns="http://jabber.org/protocol/rosterx"><item jid="juliet@example.com" action="add" name="Juliet"><group>Friends</group></item><item jid="nurse@example.com" action="delete"></item></x></message>`
+	if out := xmpptest.StripIDs(buf.String()); out != expected {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", expected, out)
+	}
+
+	var (
+		from     jid.JID
+		received []roster.Suggestion
+	)
+	m := mux.New(stanza.NSClient, roster.HandleExchange(roster.ExchangeHandler{
+		Exchange: func(f jid.JID, items []roster.Suggestion) error {
+			from = f
+			received = items
+			return nil
+		},
+	}))
+	const msg = `<message xmlns="jabber:client" from="example.net"><body>Suggested contacts</body><x xmlns="http://jabber.org/protocol/rosterx"><item jid="juliet@example.com" action="add" name="Juliet"><group>Friends</group></item><item jid="nurse@example.com" action="delete"></item></x></message>`
+	d := xml.NewDecoder(strings.NewReader(msg))
+	tok, _ := d.Token()
+	start := tok.(xml.StartElement)
+	err = m.HandleXMPP(struct {
+		xml.TokenReader
+		xmlstream.Encoder
+	}{
+		TokenReader: d,
+		Encoder:     xml.NewEncoder(io.Discard),
+	}, &start)
+	if err != nil {
+		t.Fatalf("error handling message: %v", err)
+	}
+	if from.String() != "example.net" {
+		t.Errorf("wrong sender: want=example.net, got=%s", from)
+	}
+	if !reflect.DeepEqual(received, exchangeItems) {
+		t.Errorf("wrong suggestions:\nwant=%+v,\n got=%+v", exchangeItems, received)
+	}
+}
+
+func TestSuggestIQ(t *testing.T) {
+	var received []roster.Suggestion
+	m := mux.New(stanza.NSClient, roster.HandleExchange(roster.ExchangeHandler{
+		Exchange: func(_ jid.JID, items []roster.Suggestion) error {
+			received = items
+			return nil
+		},
+	}))
+	cs := xmpptest.NewClientServer(xmpptest.ServerHandler(m))
+	err := roster.SuggestIQ(context.Background(), cs.Client, stanza.IQ{
+		To: jid.MustParse("romeo@example.net/orchard"),
+	}, exchangeItems...)
+	if err != nil {
+		t.Fatalf("error sending suggestions: %v", err)
+	}
+	if !reflect.DeepEqual(received, exchangeItems) {
+		t.Errorf("wrong suggestions:\nwant=%+v,\n got=%+v", exchangeItems, received)
+	}
+}
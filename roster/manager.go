@@ -0,0 +1,383 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+)
+
+// Store is used by a Manager to persist the roster and its version between
+// sessions.
+//
+// Each method is passed the roster version that results from the change.
+// Methods are never called concurrently by a single Manager, but a Store
+// shared between several managers must handle its own locking.
+type Store interface {
+	// Load returns the stored roster version and items.
+	// If nothing has been stored it should return an empty version and no
+	// items.
+	Load() (ver string, items []Item, err error)
+
+	// Replace replaces the entire stored roster.
+	Replace(ver string, items []Item) error
+
+	// Put adds a new item or replaces an existing item with the same JID.
+	Put(ver string, item Item) error
+
+	// Remove removes the item with the provided JID, if any.
+	Remove(ver string, j jid.JID) error
+}
+
+// MemStore is an in-memory Store.
+// The zero value is ready to use.
+type MemStore struct {
+	m     sync.Mutex
+	ver   string
+	items map[string]Item
+}
+
+// Load implements Store.
+func (s *MemStore) Load() (string, []Item, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.ver, sortedItems(s.items, nil), nil
+}
+
+// Replace implements Store.
+func (s *MemStore) Replace(ver string, items []Item) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ver = ver
+	s.items = make(map[string]Item, len(items))
+	for _, item := range items {
+		s.items[item.JID.String()] = item
+	}
+	return nil
+}
+
+// Put implements Store.
+func (s *MemStore) Put(ver string, item Item) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.items == nil {
+		s.items = make(map[string]Item)
+	}
+	s.ver = ver
+	s.items[item.JID.String()] = item
+	return nil
+}
+
+// Remove implements Store.
+func (s *MemStore) Remove(ver string, j jid.JID) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ver = ver
+	delete(s.items, j.String())
+	return nil
+}
+
+// Change is a change to a single roster item.
+type Change struct {
+	// Item is the new state of the roster item, or the item as it was before it
+	// was removed if Removed is true.
+	Item Item
+
+	// Removed is true if the item was removed from the roster.
+	Removed bool
+}
+
+// Manager keeps a local copy of the roster up to date by merging the result of
+// the initial roster fetch with any roster pushes that are received later.
+//
+// The zero value is a valid Manager that keeps the roster in memory only.
+// To receive roster pushes the handler returned by the Handler method must be
+// registered with the session's multiplexer.
+type Manager struct {
+	// Store is used to persist the roster and its version.
+	// If it is nil the roster is not persisted between sessions.
+	Store Store
+
+	// Changed, if set, is called for each item that is added, modified, or
+	// removed.
+	// Changes are reported in the order they were applied and Changed is never
+	// called concurrently, but it may be called from the goroutine handling
+	// incoming stanzas so it should not block.
+	Changed func(Change)
+
+	m      sync.Mutex
+	emit   sync.Mutex
+	loaded bool
+	ver    string
+	items  map[string]Item
+}
+
+// load populates the in-memory roster from the store the first time it is
+// called.
+// It must be called with m held.
+func (m *Manager) load() error {
+	if m.loaded {
+		return nil
+	}
+	m.items = make(map[string]Item)
+	if m.Store != nil {
+		ver, items, err := m.Store.Load()
+		if err != nil {
+			return err
+		}
+		m.ver = ver
+		for _, item := range items {
+			m.items[item.JID.String()] = item
+		}
+	}
+	m.loaded = true
+	return nil
+}
+
+// unlockAndEmit releases m and reports changes while preserving the order in
+// which they were applied.
+func (m *Manager) unlockAndEmit(changes []Change) {
+	if m.Changed == nil || len(changes) == 0 {
+		m.m.Unlock()
+		return
+	}
+	m.emit.Lock()
+	m.m.Unlock()
+	defer m.emit.Unlock()
+	for _, c := range changes {
+		m.Changed(c)
+	}
+}
+
+// Fetch requests the roster from the server and merges it into the local copy,
+// reporting any differences as changes.
+//
+// If a roster version has previously been stored it is sent with the request.
+// Versions are only ever stored if the server supports roster versioning (see
+// Versioning), in which case the server may respond with an empty result to
+// indicate that the stored roster is still current and that any changes will
+// be sent as roster pushes.
+// An empty result is therefore never treated as an empty roster.
+func (m *Manager) Fetch(ctx context.Context, s *xmpp.Session) error {
+	m.m.Lock()
+	err := m.load()
+	ver := m.ver
+	m.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var req IQ
+	req.Query.Ver = ver
+	iter := FetchIQ(ctx, req, s)
+	var items []Item
+	for iter.Next() {
+		items = append(items, iter.Item())
+	}
+	if err := iter.Err(); err != nil {
+		/* #nosec */
+		iter.Close()
+		return err
+	}
+
+	// Lock before closing the iterator so that any roster pushes sent after the
+	// result are not handled until the result has been applied.
+	m.m.Lock()
+	err = iter.Close()
+	if err != nil {
+		m.m.Unlock()
+		return err
+	}
+	if ver != "" && iter.Unchanged() {
+		m.m.Unlock()
+		return nil
+	}
+
+	// Only trust the version in the response, a result without one is a full
+	// roster from a server that does not support versioning (or has stopped).
+	newVer := iter.resVer
+	if ver != "" && newVer == ver && len(items) == 0 {
+		// Some servers include an empty query with the same version instead of an
+		// empty IQ.
+		m.m.Unlock()
+		return nil
+	}
+	if m.Store != nil {
+		err = m.Store.Replace(newVer, items)
+		if err != nil {
+			m.m.Unlock()
+			return err
+		}
+	}
+
+	var changes []Change
+	newItems := make(map[string]Item, len(items))
+	for _, item := range items {
+		key := item.JID.String()
+		newItems[key] = item
+		if old, ok := m.items[key]; !ok || !itemEqual(old, item) {
+			changes = append(changes, Change{Item: item})
+		}
+	}
+	for _, old := range sortedItems(m.items, nil) {
+		if _, ok := newItems[old.JID.String()]; !ok {
+			changes = append(changes, Change{Item: old, Removed: true})
+		}
+	}
+	m.ver = newVer
+	m.items = newItems
+	m.unlockAndEmit(changes)
+	return nil
+}
+
+// Handler returns a handler that applies roster pushes to the local copy of
+// the roster.
+// Pushes are applied in the order they are received and items with a
+// subscription of "remove" are removed from the roster.
+func (m *Manager) Handler() Handler {
+	return Handler{
+		Push: m.push,
+	}
+}
+
+func (m *Manager) push(ver string, item Item) error {
+	m.m.Lock()
+	err := m.load()
+	if err != nil {
+		m.m.Unlock()
+		return err
+	}
+	key := item.JID.String()
+	var change Change
+	if item.Subscription == "remove" {
+		old, ok := m.items[key]
+		if m.Store != nil {
+			err = m.Store.Remove(ver, item.JID)
+			if err != nil {
+				m.m.Unlock()
+				return err
+			}
+		}
+		m.ver = ver
+		if !ok {
+			m.m.Unlock()
+			return nil
+		}
+		delete(m.items, key)
+		change = Change{Item: old, Removed: true}
+	} else {
+		if m.Store != nil {
+			err = m.Store.Put(ver, item)
+			if err != nil {
+				m.m.Unlock()
+				return err
+			}
+		}
+		m.ver = ver
+		m.items[key] = item
+		change = Change{Item: item}
+	}
+	m.unlockAndEmit([]Change{change})
+	return nil
+}
+
+// Version returns the version of the local copy of the roster or the empty
+// string if the server does not support roster versioning.
+func (m *Manager) Version() string {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.ver
+}
+
+// Item returns the roster item with the provided JID.
+func (m *Manager) Item(j jid.JID) (Item, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	item, ok := m.items[j.Bare().String()]
+	if !ok {
+		item, ok = m.items[j.String()]
+	}
+	return item, ok
+}
+
+// Items returns all roster items sorted by JID.
+func (m *Manager) Items() []Item {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return sortedItems(m.items, nil)
+}
+
+// Group returns the roster items that are in the named group sorted by JID.
+// If name is empty, items that are not in any group are returned.
+func (m *Manager) Group(name string) []Item {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return sortedItems(m.items, func(item Item) bool {
+		if name == "" {
+			return len(item.Group) == 0
+		}
+		for _, g := range item.Group {
+			if g == name {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Groups returns the names of all groups used by the roster in sorted order.
+func (m *Manager) Groups() []string {
+	m.m.Lock()
+	defer m.m.Unlock()
+	seen := make(map[string]struct{})
+	var groups []string
+	for _, item := range m.items {
+		for _, g := range item.Group {
+			if _, ok := seen[g]; ok {
+				continue
+			}
+			seen[g] = struct{}{}
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// sortedItems returns the items for which filter returns true (or all items if
+// filter is nil) sorted by JID.
+func sortedItems(items map[string]Item, filter func(Item) bool) []Item {
+	var out []Item
+	for _, item := range items {
+		if filter == nil || filter(item) {
+			out = append(out, item)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].JID.String() < out[j].JID.String()
+	})
+	return out
+}
+
+func itemEqual(a, b Item) bool {
+	if !a.JID.Equal(b.JID) ||
+		a.Name != b.Name ||
+		a.Subscription != b.Subscription ||
+		a.Ask != b.Ask ||
+		a.Approved != b.Approved ||
+		len(a.Group) != len(b.Group) {
+		return false
+	}
+	for i := range a.Group {
+		if a.Group[i] != b.Group[i] {
+			return false
+		}
+	}
+	return true
+}
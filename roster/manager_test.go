@@ -0,0 +1,206 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster_test
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+var _ roster.Store = (*roster.MemStore)(nil)
+
+// rosterServer responds to roster requests with an empty result if the
+// requested version matches ver, or with the full roster otherwise.
+func rosterServer(ver string, items []roster.Item) xmpptest.Option {
+	return xmpptest.ServerHandlerFunc(func(e xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+		iq, err := stanza.NewIQ(*start)
+		if err != nil {
+			return err
+		}
+		query := struct {
+			Ver string `xml:"ver,attr"`
+		}{}
+		err = xml.NewTokenDecoder(e).Decode(&query)
+		if err != nil {
+			return err
+		}
+		if query.Ver == ver {
+			_, err = xmlstream.Copy(e, iq.Result(nil))
+			return err
+		}
+		iq.Type = stanza.ResultIQ
+		iq.To, iq.From = iq.From, iq.To
+		resp := roster.IQ{IQ: iq}
+		resp.Query.Ver = ver
+		resp.Query.Item = items
+		return e.Encode(resp)
+	})
+}
+
+func TestManager(t *testing.T) {
+	juliet := roster.Item{
+		JID:          jid.MustParse("juliet@example.com"),
+		Name:         "Juliet",
+		Subscription: "both",
+		Group:        []string{"Friends"},
+	}
+	nurse := roster.Item{
+		JID:          jid.MustParse("nurse@example.com"),
+		Subscription: "to",
+	}
+	benvolio := roster.Item{
+		JID:          jid.MustParse("benvolio@example.org"),
+		Subscription: "both",
+		Group:        []string{"Friends", "Montague"},
+	}
+
+	var changes []roster.Change
+	store := &roster.MemStore{}
+	mgr := &roster.Manager{
+		Store: store,
+		Changed: func(c roster.Change) {
+			changes = append(changes, c)
+		},
+	}
+
+	cs := xmpptest.NewClientServer(rosterServer("1", []roster.Item{juliet, nurse}))
+	err := mgr.Fetch(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching roster: %v", err)
+	}
+	if v := mgr.Version(); v != "1" {
+		t.Errorf("wrong version: want=1, got=%s", v)
+	}
+	if len(changes) != 2 {
+		t.Errorf("wrong number of changes after fetch: want=2, got=%d", len(changes))
+	}
+	if item, ok := mgr.Item(jid.MustParse("juliet@example.com/balcony")); !ok || item.Name != "Juliet" {
+		t.Errorf("wrong item for full JID: got=%+v, %t", item, ok)
+	}
+	if g := mgr.Group(""); len(g) != 1 || !g[0].JID.Equal(nurse.JID) {
+		t.Errorf("wrong ungrouped items: %+v", g)
+	}
+
+	// The roster is unchanged, so the server returns an empty result which must
+	// not be treated as an empty roster.
+	changes = nil
+	err = mgr.Fetch(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching unchanged roster: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("unexpected changes for unchanged roster: %+v", changes)
+	}
+	if items := mgr.Items(); len(items) != 2 {
+		t.Errorf("wrong items after unchanged fetch: %+v", items)
+	}
+
+	// Apply pushes in order.
+	m := mux.New(stanza.NSClient, roster.Handle(mgr.Handler()))
+	for _, push := range []string{
+		`<iq xmlns='jabber:client' id='1' type='set'><query xmlns='jabber:iq:roster' ver='2'><item jid='benvolio@example.org' subscription='both'><group>Friends</group><group>Montague</group></item></query></iq>`,
+		`<iq xmlns='jabber:client' id='2' type='set'><query xmlns='jabber:iq:roster' ver='3'><item jid='nurse@example.com' subscription='remove'/></query></iq>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(push))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err = m.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(io.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling push: %v", err)
+		}
+	}
+	wantChanges := []roster.Change{
+		{Item: benvolio},
+		{Item: nurse, Removed: true},
+	}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("wrong changes after push:\nwant=%+v,\n got=%+v", wantChanges, changes)
+	}
+	if g := mgr.Group("Friends"); len(g) != 2 || !g[0].JID.Equal(benvolio.JID) || !g[1].JID.Equal(juliet.JID) {
+		t.Errorf("wrong items in group: %+v", g)
+	}
+	if groups := mgr.Groups(); !reflect.DeepEqual(groups, []string{"Friends", "Montague"}) {
+		t.Errorf("wrong groups: %v", groups)
+	}
+
+	ver, items, err := store.Load()
+	if err != nil {
+		t.Fatalf("error loading store: %v", err)
+	}
+	if ver != "3" {
+		t.Errorf("wrong stored version: want=3, got=%s", ver)
+	}
+	if want := []roster.Item{benvolio, juliet}; !reflect.DeepEqual(items, want) {
+		t.Errorf("wrong stored items:\nwant=%+v,\n got=%+v", want, items)
+	}
+
+	// A new manager using the same store should send the stored version and use
+	// the stored items if the roster has not changed.
+	mgr = &roster.Manager{Store: store}
+	cs = xmpptest.NewClientServer(rosterServer("3", nil))
+	err = mgr.Fetch(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching roster with stored version: %v", err)
+	}
+	if items := mgr.Items(); !reflect.DeepEqual(items, []roster.Item{benvolio, juliet}) {
+		t.Errorf("stored items not used: %+v", items)
+	}
+
+	// If the roster has changed, the new roster replaces the stored one.
+	changes = nil
+	mgr.Changed = func(c roster.Change) {
+		changes = append(changes, c)
+	}
+	cs = xmpptest.NewClientServer(rosterServer("4", []roster.Item{juliet}))
+	err = mgr.Fetch(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching changed roster: %v", err)
+	}
+	wantChanges = []roster.Change{{Item: benvolio, Removed: true}}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("wrong changes after fetch:\nwant=%+v,\n got=%+v", wantChanges, changes)
+	}
+	ver, items, _ = store.Load()
+	if ver != "4" || !reflect.DeepEqual(items, []roster.Item{juliet}) {
+		t.Errorf("store not replaced: ver=%s, items=%+v", ver, items)
+	}
+
+	// A result without a version is a full roster, even if it is empty, and
+	// not an indication that the roster is unchanged.
+	changes = nil
+	cs = xmpptest.NewClientServer(rosterServer("", nil))
+	err = mgr.Fetch(context.Background(), cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching unversioned roster: %v", err)
+	}
+	wantChanges = []roster.Change{{Item: juliet, Removed: true}}
+	if !reflect.DeepEqual(changes, wantChanges) {
+		t.Errorf("wrong changes after unversioned fetch:\nwant=%+v,\n got=%+v", wantChanges, changes)
+	}
+	if v := mgr.Version(); v != "" {
+		t.Errorf("version should be cleared by an unversioned roster, got=%q", v)
+	}
+	ver, items, _ = store.Load()
+	if ver != "" || len(items) != 0 {
+		t.Errorf("store not replaced by unversioned roster: ver=%s, items=%+v", ver, items)
+	}
+}
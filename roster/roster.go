@@ -2,6 +2,8 @@
 // Use of this source code is governed by the BSD 2-clause
 // license that can be found in the LICENSE file.
 
+//go:generate go run ../internal/genfeature -receiver "h ExchangeHandler" -vars FeatureExchange:NSExchange
+
 // Package roster implements contact list functionality.
 package roster // import "mellium.im/xmpp/roster"
 
@@ -20,8 +22,9 @@ import (
 
 // Namespaces used by this package provided as a convenience.
 const (
-	NS         = "jabber:iq:roster"
-	NSFeatures = "urn:xmpp:features:rosterver"
+	NS            = "jabber:iq:roster"
+	NSFeatures    = "urn:xmpp:features:rosterver"
+	NSPreApproval = "urn:xmpp:features:pre-approval"
 )
 
 // Handle returns an option that registers a Handler for roster pushes.
@@ -66,10 +69,14 @@ func (h Handler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml
 
 // Iter is an iterator over roster items.
 type Iter struct {
-	iter    *xmlstream.Iter
-	current Item
-	err     error
-	ver     string
+	iter      *xmlstream.Iter
+	current   Item
+	err       error
+	ver       string
+	unchanged bool
+	// resVer is the version in the response, without falling back to the
+	// version in the request.
+	resVer string
 }
 
 // Next returns true if there are more items to decode.
@@ -100,6 +107,15 @@ func (i *Iter) Version() string {
 	return i.ver
 }
 
+// Unchanged reports whether the server responded to a versioned request with
+// an empty result, indicating that the roster has not changed since the
+// version that was sent in the request.
+// If Unchanged returns true the iterator will not return any items and the
+// locally cached copy of the roster should be used instead.
+func (i *Iter) Unchanged() bool {
+	return i.unchanged
+}
+
 // Err returns the last error encountered by the iterator (if any).
 func (i *Iter) Err() error {
 	if i.err != nil {
@@ -151,14 +167,17 @@ func FetchIQ(ctx context.Context, iq IQ, s *xmpp.Session) *Iter {
 			break
 		}
 	}
+	resVer := ver
 	if ver == "" {
 		ver = iq.Query.Ver
 	}
 
 	// Return the iterator which will parse the rest of the payload incrementally.
 	return &Iter{
-		iter: iter,
-		ver:  ver,
+		iter:      iter,
+		ver:       ver,
+		unchanged: start.Name.Local == "",
+		resVer:    resVer,
 	}
 }
 
@@ -234,10 +253,20 @@ func (iq IQ) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
 }
 
 // Item represents a contact in the roster.
+//
+// Subscription is the state of the presence subscription between the user and
+// the contact and is one of "none", "to", "from", or "both".
+// When setting items it may also be "remove" to remove the item.
+// Ask is "subscribe" if we have sent a subscription request to the contact
+// that has not yet been answered, and Approved is true if a subscription from
+// the contact has been pre-approved.
+// Ask and Approved are set by the server and are ignored when setting items.
 type Item struct {
 	JID          jid.JID  `xml:"jid,attr,omitempty"`
 	Name         string   `xml:"name,attr,omitempty"`
 	Subscription string   `xml:"subscription,attr,omitempty"`
+	Ask          string   `xml:"ask,attr,omitempty"`
+	Approved     bool     `xml:"approved,attr,omitempty"`
 	Group        []string `xml:"group,omitempty"`
 }
 
@@ -263,6 +292,12 @@ func (item Item) TokenReader() xml.TokenReader {
 	if item.Subscription != "" {
 		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "subscription"}, Value: item.Subscription})
 	}
+	if item.Ask != "" {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "ask"}, Value: item.Ask})
+	}
+	if item.Approved {
+		attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "approved"}, Value: "true"})
+	}
 
 	return xmlstream.Wrap(
 		xmlstream.MultiReader(group...),
@@ -0,0 +1,431 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"encoding/xml"
+	"strconv"
+	"sync"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/attr"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// pushTimeout is the amount of time to wait for a client to acknowledge a
+// roster push.
+const pushTimeout = 30 * time.Second
+
+// Update is a versioned change to a roster item.
+// Removed items have a subscription of "remove".
+type Update struct {
+	Ver  string
+	Item Item
+}
+
+// ServerStore is used by a Server to store the rosters of all accounts.
+//
+// Each method that modifies a roster returns the new roster version.
+// Methods may be called concurrently.
+type ServerStore interface {
+	// Roster returns the current version and items of an account's roster.
+	Roster(account jid.JID) (ver string, items []Item, err error)
+
+	// Changes returns the changes made to an account's roster since the
+	// provided version in the order they were made.
+	// If the changes since ver are not known, ok must be false and the full
+	// roster is sent to the client instead.
+	Changes(account jid.JID, since string) (changes []Update, ok bool, err error)
+
+	// Item returns the item with the provided JID from an account's roster.
+	Item(account, j jid.JID) (item Item, ok bool, err error)
+
+	// Put adds a new item or replaces an existing item with the same JID.
+	Put(account jid.JID, item Item) (ver string, err error)
+
+	// Remove removes the item with the provided JID.
+	Remove(account, j jid.JID) (ver string, err error)
+}
+
+// MemServerStore is an in-memory ServerStore that uses incrementing integers
+// as roster versions and keeps a log of every change so that it can always
+// return the changes since any version it has issued.
+// The zero value is ready to use.
+type MemServerStore struct {
+	m        sync.Mutex
+	accounts map[string]*memRoster
+}
+
+type memRoster struct {
+	items map[string]Item
+	log   []Update
+}
+
+func (r *memRoster) ver() string {
+	return strconv.Itoa(len(r.log))
+}
+
+func (s *MemServerStore) roster(account jid.JID) *memRoster {
+	if s.accounts == nil {
+		s.accounts = make(map[string]*memRoster)
+	}
+	key := account.Bare().String()
+	r, ok := s.accounts[key]
+	if !ok {
+		r = &memRoster{items: make(map[string]Item)}
+		s.accounts[key] = r
+	}
+	return r
+}
+
+// Roster implements ServerStore.
+func (s *MemServerStore) Roster(account jid.JID) (string, []Item, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(account)
+	return r.ver(), sortedItems(r.items, nil), nil
+}
+
+// Changes implements ServerStore.
+func (s *MemServerStore) Changes(account jid.JID, since string) ([]Update, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(account)
+	n, err := strconv.Atoi(since)
+	if err != nil || n < 0 || n > len(r.log) {
+		return nil, false, nil
+	}
+	// Only send the latest change to each item.
+	latest := make(map[string]int)
+	for i, u := range r.log[n:] {
+		latest[u.Item.JID.String()] = i
+	}
+	var changes []Update
+	for i, u := range r.log[n:] {
+		if latest[u.Item.JID.String()] == i {
+			changes = append(changes, u)
+		}
+	}
+	return changes, true, nil
+}
+
+// Item implements ServerStore.
+func (s *MemServerStore) Item(account, j jid.JID) (Item, bool, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	item, ok := s.roster(account).items[j.String()]
+	return item, ok, nil
+}
+
+// Put implements ServerStore.
+func (s *MemServerStore) Put(account jid.JID, item Item) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(account)
+	r.items[item.JID.String()] = item
+	r.log = append(r.log, Update{Ver: strconv.Itoa(len(r.log) + 1), Item: item})
+	return r.ver(), nil
+}
+
+// Remove implements ServerStore.
+func (s *MemServerStore) Remove(account, j jid.JID) (string, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	r := s.roster(account)
+	delete(r.items, j.String())
+	r.log = append(r.log, Update{
+		Ver:  strconv.Itoa(len(r.log) + 1),
+		Item: Item{JID: j, Subscription: "remove"},
+	})
+	return r.ver(), nil
+}
+
+// Server answers roster requests from clients using a ServerStore and pushes
+// roster changes to every session of an account that has requested the
+// roster.
+//
+// Roster versioning is always supported, so servers using Server should
+// advertise the Versioning stream feature.
+// The zero value is not usable, Store must be set.
+type Server struct {
+	Store ServerStore
+
+	m          sync.Mutex
+	interested map[string]map[*xmpp.Session]*pushQueue
+}
+
+// Handle returns an option that registers handlers for roster requests sent
+// by the client on the other end of s.
+// Once the session has ended Forget should be called to stop sending roster
+// pushes to it.
+func (srv *Server) Handle(s *xmpp.Session) mux.Option {
+	h := serverHandler{srv: srv, s: s}
+	return func(m *mux.ServeMux) {
+		mux.IQ(stanza.GetIQ, xml.Name{Space: NS, Local: "query"}, h)(m)
+		mux.IQ(stanza.SetIQ, xml.Name{Space: NS, Local: "query"}, h)(m)
+	}
+}
+
+// Forget stops sending roster pushes to the session.
+func (srv *Server) Forget(s *xmpp.Session) {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	account := s.RemoteAddr().Bare().String()
+	delete(srv.interested[account], s)
+	if len(srv.interested[account]) == 0 {
+		delete(srv.interested, account)
+	}
+}
+
+// Update stores an item in the account's roster and pushes it to all
+// interested sessions.
+// Unlike roster sets sent by clients, the subscription state of the item is
+// stored as is, making Update suitable for recording changes to the
+// subscription state that result from subscription related presence.
+// If the subscription is "remove" the item is removed from the roster instead.
+func (srv *Server) Update(account jid.JID, item Item) error {
+	var ver string
+	var err error
+	if item.Subscription == "remove" {
+		ver, err = srv.Store.Remove(account, item.JID)
+		item = Item{JID: item.JID, Subscription: "remove"}
+	} else {
+		ver, err = srv.Store.Put(account, item)
+	}
+	if err != nil {
+		return err
+	}
+	srv.push(account, Update{Ver: ver, Item: item})
+	return nil
+}
+
+// interest marks the session as interested in roster pushes.
+func (srv *Server) interest(s *xmpp.Session) *pushQueue {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	if srv.interested == nil {
+		srv.interested = make(map[string]map[*xmpp.Session]*pushQueue)
+	}
+	account := s.RemoteAddr().Bare().String()
+	sessions, ok := srv.interested[account]
+	if !ok {
+		sessions = make(map[*xmpp.Session]*pushQueue)
+		srv.interested[account] = sessions
+	}
+	q, ok := sessions[s]
+	if !ok {
+		q = &pushQueue{s: s}
+		sessions[s] = q
+	}
+	return q
+}
+
+// push queues updates to be sent to all interested sessions of the account.
+func (srv *Server) push(account jid.JID, updates ...Update) {
+	srv.m.Lock()
+	defer srv.m.Unlock()
+	for _, q := range srv.interested[account.Bare().String()] {
+		q.push(updates)
+	}
+}
+
+// pushQueue sends roster pushes to a session in order without blocking the
+// caller.
+type pushQueue struct {
+	s       *xmpp.Session
+	m       sync.Mutex
+	queue   []Update
+	running bool
+}
+
+func (q *pushQueue) push(updates []Update) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	q.queue = append(q.queue, updates...)
+	if !q.running && len(q.queue) > 0 {
+		q.running = true
+		go q.run()
+	}
+}
+
+func (q *pushQueue) run() {
+	for {
+		q.m.Lock()
+		if len(q.queue) == 0 {
+			q.running = false
+			q.m.Unlock()
+			return
+		}
+		u := q.queue[0]
+		q.queue = q.queue[1:]
+		q.m.Unlock()
+
+		iq := IQ{IQ: stanza.IQ{
+			Type: stanza.SetIQ,
+			To:   q.s.RemoteAddr(),
+		}}
+		iq.Query.Ver = u.Ver
+		iq.Query.Item = []Item{u.Item}
+		ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+		resp, err := q.s.SendIQ(ctx, iq.TokenReader())
+		if err == nil {
+			/* #nosec */
+			resp.Close()
+		}
+		cancel()
+	}
+}
+
+type serverHandler struct {
+	srv *Server
+	s   *xmpp.Session
+}
+
+func (h serverHandler) HandleIQ(iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	account := h.s.RemoteAddr().Bare()
+	if (!iq.From.Equal(jid.JID{}) && !iq.From.Bare().Equal(account)) ||
+		(!iq.To.Equal(jid.JID{}) && !iq.To.Bare().Equal(account)) {
+		return sendErr(t, iq, stanza.Cancel, stanza.Forbidden)
+	}
+
+	switch iq.Type {
+	case stanza.GetIQ:
+		return h.get(account, iq, t, start)
+	case stanza.SetIQ:
+		return h.set(account, iq, t, start)
+	}
+	return nil
+}
+
+func sendErr(t xmlstream.TokenWriter, iq stanza.IQ, typ stanza.ErrorType, cond stanza.Condition) error {
+	_, err := xmlstream.Copy(t, iq.Error(stanza.Error{Type: typ, Condition: cond}))
+	return err
+}
+
+func (h serverHandler) get(account jid.JID, iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	q := h.srv.interest(h.s)
+	verIdx, ver := attr.Get(start.Attr, "ver")
+
+	var changes []Update
+	var known bool
+	if ver != "" {
+		var err error
+		changes, known, err = h.srv.Store.Changes(account, ver)
+		if err != nil {
+			return sendErr(t, iq, stanza.Wait, stanza.InternalServerError)
+		}
+	}
+
+	if known {
+		// The client's roster is current or can be brought up to date with
+		// pushes, so send an empty result followed by the changes.
+		_, err := xmlstream.Copy(t, iq.Result(nil))
+		if err != nil {
+			return err
+		}
+		q.push(changes)
+		return nil
+	}
+
+	cur, items, err := h.srv.Store.Roster(account)
+	if err != nil {
+		return sendErr(t, iq, stanza.Wait, stanza.InternalServerError)
+	}
+	resp := IQ{IQ: iq}
+	resp.IQ.Type = stanza.ResultIQ
+	resp.IQ.From, resp.IQ.To = iq.To, iq.From
+	resp.Query.Item = items
+	if verIdx != -1 {
+		resp.Query.Ver = cur
+		_, err = resp.WriteXML(t)
+		return err
+	}
+	// Do not include the version if the client did not indicate support for
+	// roster versioning.
+	_, err = xmlstream.Copy(t, resp.IQ.Wrap(xmlstream.Wrap(
+		&itemMarshaler{items: items},
+		xml.StartElement{Name: xml.Name{Space: NS, Local: "query"}},
+	)))
+	return err
+}
+
+func (h serverHandler) set(account jid.JID, iq stanza.IQ, t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+	query := struct {
+		Item []Item `xml:"item"`
+	}{}
+	d := xml.NewTokenDecoder(xmlstream.MultiReader(xmlstream.Token(*start), t))
+	err := d.Decode(&query)
+	if err != nil {
+		return err
+	}
+	if len(query.Item) != 1 || query.Item[0].JID.Equal(jid.JID{}) {
+		return sendErr(t, iq, stanza.Modify, stanza.BadRequest)
+	}
+	item := query.Item[0]
+
+	if item.Subscription == "remove" {
+		_, ok, err := h.srv.Store.Item(account, item.JID)
+		if err != nil {
+			return sendErr(t, iq, stanza.Wait, stanza.InternalServerError)
+		}
+		if !ok {
+			return sendErr(t, iq, stanza.Cancel, stanza.ItemNotFound)
+		}
+		ver, err := h.srv.Store.Remove(account, item.JID)
+		if err != nil {
+			return sendErr(t, iq, stanza.Wait, stanza.InternalServerError)
+		}
+		_, err = xmlstream.Copy(t, iq.Result(nil))
+		if err != nil {
+			return err
+		}
+		h.srv.push(account, Update{
+			Ver:  ver,
+			Item: Item{JID: item.JID, Subscription: "remove"},
+		})
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(item.Group))
+	for _, g := range item.Group {
+		if g == "" {
+			return sendErr(t, iq, stanza.Modify, stanza.NotAcceptable)
+		}
+		if _, ok := seen[g]; ok {
+			return sendErr(t, iq, stanza.Modify, stanza.BadRequest)
+		}
+		seen[g] = struct{}{}
+	}
+
+	// Clients may not modify the subscription state, so keep the existing state
+	// (if any) and ignore whatever the client sent.
+	old, ok, err := h.srv.Store.Item(account, item.JID)
+	if err != nil {
+		return sendErr(t, iq, stanza.Wait, stanza.InternalServerError)
+	}
+	item.Subscription = "none"
+	item.Ask = ""
+	item.Approved = false
+	if ok {
+		item.Subscription = old.Subscription
+		item.Ask = old.Ask
+		item.Approved = old.Approved
+	}
+	ver, err := h.srv.Store.Put(account, item)
+	if err != nil {
+		return sendErr(t, iq, stanza.Wait, stanza.InternalServerError)
+	}
+	_, err = xmlstream.Copy(t, iq.Result(nil))
+	if err != nil {
+		return err
+	}
+	h.srv.push(account, Update{Ver: ver, Item: item})
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster_test
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+var _ roster.ServerStore = (*roster.MemServerStore)(nil)
+
+// newRosterServer returns a client and server where the server answers roster
+// requests using srv and the client applies roster pushes to mgr.
+func newRosterServer(srv *roster.Server, mgr *roster.Manager) *xmpptest.ClientServer {
+	var m *mux.ServeMux
+	cs := xmpptest.NewClientServer(
+		xmpptest.ServerHandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			return m.HandleXMPP(t, start)
+		}),
+		// Pushes are sent by the server session which uses the server namespace.
+		xmpptest.ClientHandler(mux.New(stanza.NSServer, roster.Handle(mgr.Handler()))),
+	)
+	m = mux.New(stanza.NSClient, srv.Handle(cs.Server))
+	return cs
+}
+
+func waitChange(t *testing.T, changes <-chan roster.Change) roster.Change {
+	t.Helper()
+	select {
+	case c := <-changes:
+		return c
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for roster push")
+	}
+	return roster.Change{}
+}
+
+func TestServer(t *testing.T) {
+	account := jid.MustParse("test@example.net")
+	srv := &roster.Server{Store: &roster.MemServerStore{}}
+	juliet := roster.Item{
+		JID:          jid.MustParse("juliet@example.com"),
+		Name:         "Juliet",
+		Subscription: "both",
+	}
+	err := srv.Update(account, juliet)
+	if err != nil {
+		t.Fatalf("error updating roster: %v", err)
+	}
+
+	changes := make(chan roster.Change, 10)
+	clientStore := &roster.MemStore{}
+	mgr := &roster.Manager{
+		Store: clientStore,
+		Changed: func(c roster.Change) {
+			changes <- c
+		},
+	}
+	cs := newRosterServer(srv, mgr)
+	ctx := context.Background()
+
+	err = mgr.Fetch(ctx, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching roster: %v", err)
+	}
+	if c := waitChange(t, changes); !reflect.DeepEqual(c.Item, juliet) {
+		t.Errorf("wrong item fetched: want=%+v, got=%+v", juliet, c.Item)
+	}
+	if v := mgr.Version(); v != "1" {
+		t.Errorf("wrong version: want=1, got=%q", v)
+	}
+
+	// Clients cannot set the subscription state.
+	err = roster.Set(ctx, cs.Client, roster.Item{
+		JID:          jid.MustParse("nurse@example.com"),
+		Subscription: "both",
+		Group:        []string{"Capulet"},
+	})
+	if err != nil {
+		t.Fatalf("error setting item: %v", err)
+	}
+	nurse := roster.Item{
+		JID:          jid.MustParse("nurse@example.com"),
+		Subscription: "none",
+		Group:        []string{"Capulet"},
+	}
+	if c := waitChange(t, changes); !reflect.DeepEqual(c.Item, nurse) {
+		t.Errorf("wrong item pushed: want=%+v, got=%+v", nurse, c.Item)
+	}
+
+	err = roster.Delete(ctx, cs.Client, juliet.JID)
+	if err != nil {
+		t.Fatalf("error deleting item: %v", err)
+	}
+	if c := waitChange(t, changes); !c.Removed || !c.Item.JID.Equal(juliet.JID) {
+		t.Errorf("wrong change pushed: %+v", c)
+	}
+	if v := mgr.Version(); v != "3" {
+		t.Errorf("wrong version after pushes: want=3, got=%q", v)
+	}
+
+	// Changes made while the client is offline are sent as pushes when it next
+	// requests the roster with its stored version.
+	srv.Forget(cs.Server)
+	romeo := roster.Item{
+		JID:          jid.MustParse("romeo@example.net"),
+		Subscription: "from",
+	}
+	for _, item := range []roster.Item{
+		{JID: nurse.JID, Subscription: "to", Group: nurse.Group},
+		romeo,
+		{JID: nurse.JID, Subscription: "remove"},
+	} {
+		err = srv.Update(account, item)
+		if err != nil {
+			t.Fatalf("error updating roster: %v", err)
+		}
+	}
+	select {
+	case c := <-changes:
+		t.Fatalf("unexpected push after forgetting session: %+v", c)
+	default:
+	}
+
+	mgr = &roster.Manager{
+		Store: clientStore,
+		Changed: func(c roster.Change) {
+			changes <- c
+		},
+	}
+	cs = newRosterServer(srv, mgr)
+	err = mgr.Fetch(ctx, cs.Client)
+	if err != nil {
+		t.Fatalf("error fetching roster with old version: %v", err)
+	}
+	if c := waitChange(t, changes); !reflect.DeepEqual(c.Item, romeo) {
+		t.Errorf("wrong first push: want=%+v, got=%+v", romeo, c.Item)
+	}
+	if c := waitChange(t, changes); !c.Removed || !c.Item.JID.Equal(nurse.JID) {
+		t.Errorf("wrong second push: %+v", c)
+	}
+	if items := mgr.Items(); !reflect.DeepEqual(items, []roster.Item{romeo}) {
+		t.Errorf("wrong items after pushes: %+v", items)
+	}
+	if v := mgr.Version(); v != "6" {
+		t.Errorf("wrong version after pushes: want=6, got=%q", v)
+	}
+}
+
+var serverErrTests = [...]struct {
+	items []roster.Item
+	cond  stanza.Condition
+}{
+	0: {
+		cond: stanza.BadRequest,
+	},
+	1: {
+		items: []roster.Item{
+			{JID: jid.MustParse("juliet@example.com")},
+			{JID: jid.MustParse("romeo@example.net")},
+		},
+		cond: stanza.BadRequest,
+	},
+	2: {
+		items: []roster.Item{{Name: "No JID"}},
+		cond:  stanza.BadRequest,
+	},
+	3: {
+		items: []roster.Item{{JID: jid.MustParse("juliet@example.com"), Group: []string{""}}},
+		cond:  stanza.NotAcceptable,
+	},
+	4: {
+		items: []roster.Item{{JID: jid.MustParse("juliet@example.com"), Group: []string{"a", "a"}}},
+		cond:  stanza.BadRequest,
+	},
+	5: {
+		items: []roster.Item{{JID: jid.MustParse("juliet@example.com"), Subscription: "remove"}},
+		cond:  stanza.ItemNotFound,
+	},
+}
+
+func TestServerErrors(t *testing.T) {
+	srv := &roster.Server{Store: &roster.MemServerStore{}}
+	cs := newRosterServer(srv, &roster.Manager{})
+	for i, tc := range serverErrTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			iq := roster.IQ{IQ: stanza.IQ{Type: stanza.SetIQ}}
+			iq.Query.Item = tc.items
+			_, _, err := cs.Client.IterIQ(context.Background(), iq.TokenReader())
+			if !errors.Is(err, stanza.Error{Condition: tc.cond}) {
+				t.Errorf("wrong error: want=%v, got=%v", tc.cond, err)
+			}
+		})
+	}
+
+	t.Run("forbidden", func(t *testing.T) {
+		iq := roster.IQ{IQ: stanza.IQ{
+			Type: stanza.GetIQ,
+			To:   jid.MustParse("juliet@example.com"),
+		}}
+		_, _, err := cs.Client.IterIQ(context.Background(), iq.TokenReader())
+		if !errors.Is(err, stanza.Error{Condition: stanza.Forbidden}) {
+			t.Errorf("wrong error: want=%v, got=%v", stanza.Forbidden, err)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster
+
+import (
+	"context"
+	"encoding/xml"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/stanza"
+)
+
+// NSNick is the namespace used by XEP-0172: User Nickname.
+// Nicknames may be included in subscription requests to let the contact know
+// who is requesting the subscription.
+const NSNick = "http://jabber.org/protocol/nick"
+
+// Subscribe sends a subscription request to the provided JID.
+// If nick is not empty it is included in the request as a suggested name for
+// the contact to use when adding us to their roster.
+func Subscribe(ctx context.Context, s *xmpp.Session, to jid.JID, nick string) error {
+	var payload xml.TokenReader
+	if nick != "" {
+		payload = xmlstream.Wrap(
+			xmlstream.Token(xml.CharData(nick)),
+			xml.StartElement{Name: xml.Name{Space: NSNick, Local: "nick"}},
+		)
+	}
+	return sendSubscription(ctx, s, stanza.SubscribePresence, to, payload)
+}
+
+// Approve approves a subscription request from the provided JID, allowing it
+// to receive our presence.
+func Approve(ctx context.Context, s *xmpp.Session, to jid.JID) error {
+	return sendSubscription(ctx, s, stanza.SubscribedPresence, to, nil)
+}
+
+// PreApprove approves a subscription request from the provided JID before
+// it has been received.
+// This is only supported if the server advertised support for subscription
+// pre-approvals (see PreApproval).
+func PreApprove(ctx context.Context, s *xmpp.Session, to jid.JID) error {
+	return Approve(ctx, s, to)
+}
+
+// Deny denies a subscription request from the provided JID.
+func Deny(ctx context.Context, s *xmpp.Session, to jid.JID) error {
+	return sendSubscription(ctx, s, stanza.UnsubscribedPresence, to, nil)
+}
+
+// Cancel revokes a previously approved subscription, preventing the provided
+// JID from receiving our presence.
+// If the subscription was pre-approved the pre-approval is canceled.
+func Cancel(ctx context.Context, s *xmpp.Session, to jid.JID) error {
+	return sendSubscription(ctx, s, stanza.UnsubscribedPresence, to, nil)
+}
+
+// Unsubscribe unsubscribes from the presence of the provided JID.
+func Unsubscribe(ctx context.Context, s *xmpp.Session, to jid.JID) error {
+	return sendSubscription(ctx, s, stanza.UnsubscribePresence, to, nil)
+}
+
+func sendSubscription(ctx context.Context, s *xmpp.Session, typ stanza.PresenceType, to jid.JID, payload xml.TokenReader) error {
+	return s.Send(ctx, stanza.Presence{
+		To:   to.Bare(),
+		Type: typ,
+	}.Wrap(payload))
+}
+
+// Request is a request to subscribe to our presence.
+type Request struct {
+	// From is the bare JID of the entity requesting the subscription.
+	From jid.JID
+
+	// Nick is the nickname that the entity suggested for itself, if any.
+	Nick string
+
+	// Status is an optional message included with the request.
+	Status string
+}
+
+// Approve approves the subscription request.
+// It may be called at any time after the request is received.
+func (r Request) Approve(ctx context.Context, s *xmpp.Session) error {
+	return Approve(ctx, s, r.From)
+}
+
+// Deny denies the subscription request.
+// It may be called at any time after the request is received.
+func (r Request) Deny(ctx context.Context, s *xmpp.Session) error {
+	return Deny(ctx, s, r.From)
+}
+
+// HandleSubscriptions returns an option that registers a SubscriptionHandler
+// for all subscription related presence types.
+func HandleSubscriptions(h SubscriptionHandler) mux.Option {
+	return func(m *mux.ServeMux) {
+		mux.Presence(stanza.SubscribePresence, xml.Name{}, h)(m)
+		mux.Presence(stanza.SubscribedPresence, xml.Name{}, h)(m)
+		mux.Presence(stanza.UnsubscribePresence, xml.Name{}, h)(m)
+		mux.Presence(stanza.UnsubscribedPresence, xml.Name{}, h)(m)
+	}
+}
+
+// SubscriptionHandler handles inbound subscription requests and notifications
+// of changes to existing subscriptions.
+// Any nil functions are ignored.
+//
+// Subscription requests do not need to be answered before Request returns, the
+// request may be stored and approved or denied later using its methods.
+type SubscriptionHandler struct {
+	// Request is called when an entity requests a subscription to our presence.
+	Request func(Request) error
+
+	// Subscribed is called when our request to subscribe to an entity's
+	// presence has been approved.
+	Subscribed func(from jid.JID) error
+
+	// Unsubscribe is called when an entity unsubscribes from our presence.
+	Unsubscribe func(from jid.JID) error
+
+	// Unsubscribed is called when our request to subscribe to an entity's
+	// presence has been denied or a previously approved subscription has been
+	// revoked.
+	Unsubscribed func(from jid.JID) error
+}
+
+// HandlePresence satisfies mux.PresenceHandler.
+func (h SubscriptionHandler) HandlePresence(p stanza.Presence, r xmlstream.TokenReadEncoder) error {
+	from := p.From.Bare()
+	switch p.Type {
+	case stanza.SubscribePresence:
+		if h.Request == nil {
+			return nil
+		}
+		v := struct {
+			stanza.Presence
+			Nick   string `xml:"http://jabber.org/protocol/nick nick"`
+			Status string `xml:"status"`
+		}{}
+		err := xml.NewTokenDecoder(r).Decode(&v)
+		if err != nil {
+			return err
+		}
+		return h.Request(Request{
+			From:   from,
+			Nick:   v.Nick,
+			Status: v.Status,
+		})
+	case stanza.SubscribedPresence:
+		if h.Subscribed != nil {
+			return h.Subscribed(from)
+		}
+	case stanza.UnsubscribePresence:
+		if h.Unsubscribe != nil {
+			return h.Unsubscribe(from)
+		}
+	case stanza.UnsubscribedPresence:
+		if h.Unsubscribed != nil {
+			return h.Unsubscribed(from)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+// Copyright 2021 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause
+// license that can be found in the LICENSE file.
+
+package roster_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"mellium.im/xmlstream"
+	"mellium.im/xmpp"
+	"mellium.im/xmpp/internal/xmpptest"
+	"mellium.im/xmpp/jid"
+	"mellium.im/xmpp/mux"
+	"mellium.im/xmpp/roster"
+	"mellium.im/xmpp/stanza"
+)
+
+var sendSubscriptionTests = [...]struct {
+	send func(context.Context, *xmpp.Session, jid.JID) error
+	out  string
+}{
+	0: {
+		send: func(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+			return roster.Subscribe(ctx, s, j, "Romeo")
+		},
+		out: `<presence xmlns="jabber:client" type="subscribe" to="juliet@example.com"><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick></presence>`,
+	},
+	1: {
+		send: func(ctx context.Context, s *xmpp.Session, j jid.JID) error {
+			return roster.Subscribe(ctx, s, j, "")
+		},
+		out: `<presence xmlns="jabber:client" type="subscribe" to="juliet@example.com"></presence>`,
+	},
+	2: {
+		send: roster.Approve,
+		out:  `<presence xmlns="jabber:client" type="subscribed" to="juliet@example.com"></presence>`,
+	},
+	3: {
+		send: roster.PreApprove,
+		out:  `<presence xmlns="jabber:client" type="subscribed" to="juliet@example.com"></presence>`,
+	},
+	4: {
+		send: roster.Deny,
+		out:  `<presence xmlns="jabber:client" type="unsubscribed" to="juliet@example.com"></presence>`,
+	},
+	5: {
+		send: roster.Cancel,
+		out:  `<presence xmlns="jabber:client" type="unsubscribed" to="juliet@example.com"></presence>`,
+	},
+	6: {
+		send: roster.Unsubscribe,
+		out:  `<presence xmlns="jabber:client" type="unsubscribe" to="juliet@example.com"></presence>`,
+	},
+}
+
+func TestSendSubscription(t *testing.T) {
+	for i, tc := range sendSubscriptionTests {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var buf bytes.Buffer
+			s := xmpptest.NewClientSession(0, &buf)
+			err := tc.send(context.Background(), s, jid.MustParse("juliet@example.com/balcony"))
+			if err != nil {
+				t.Fatalf("error sending presence: %v", err)
+			}
+			if out := xmpptest.StripIDs(buf.String()); out != tc.out {
+				t.Errorf("wrong output:\nwant=%s,\n got=%s", tc.out, out)
+			}
+		})
+	}
+}
+
+func TestHandleSubscriptions(t *testing.T) {
+	var (
+		requests []roster.Request
+		events   []string
+	)
+	record := func(name string) func(jid.JID) error {
+		return func(j jid.JID) error {
+			events = append(events, name+" "+j.String())
+			return nil
+		}
+	}
+	m := mux.New(stanza.NSClient, roster.HandleSubscriptions(roster.SubscriptionHandler{
+		Request: func(r roster.Request) error {
+			requests = append(requests, r)
+			return nil
+		},
+		Subscribed:   record("subscribed"),
+		Unsubscribe:  record("unsubscribe"),
+		Unsubscribed: record("unsubscribed"),
+	}))
+
+	for _, p := range []string{
+		`<presence xmlns="jabber:client" type="subscribe" from="romeo@example.net/orchard"><nick xmlns="http://jabber.org/protocol/nick">Romeo</nick><status>Hi!</status></presence>`,
+		`<presence xmlns="jabber:client" type="subscribe" from="nurse@example.com"/>`,
+		`<presence xmlns="jabber:client" type="subscribed" from="romeo@example.net"/>`,
+		`<presence xmlns="jabber:client" type="unsubscribe" from="romeo@example.net"/>`,
+		`<presence xmlns="jabber:client" type="unsubscribed" from="nurse@example.com"/>`,
+	} {
+		d := xml.NewDecoder(strings.NewReader(p))
+		tok, _ := d.Token()
+		start := tok.(xml.StartElement)
+		err := m.HandleXMPP(struct {
+			xml.TokenReader
+			xmlstream.Encoder
+		}{
+			TokenReader: d,
+			Encoder:     xml.NewEncoder(io.Discard),
+		}, &start)
+		if err != nil {
+			t.Fatalf("error handling presence: %v", err)
+		}
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("wrong number of requests: want=2, got=%d", len(requests))
+	}
+	if r := requests[0]; r.From.String() != "romeo@example.net" || r.Nick != "Romeo" || r.Status != "Hi!" {
+		t.Errorf("wrong request: %+v", r)
+	}
+	if r := requests[1]; r.From.String() != "nurse@example.com" || r.Nick != "" {
+		t.Errorf("wrong request: %+v", r)
+	}
+	const expected = "subscribed romeo@example.net,unsubscribe romeo@example.net,unsubscribed nurse@example.com"
+	if e := strings.Join(events, ","); e != expected {
+		t.Errorf("wrong events: want=%q, got=%q", expected, e)
+	}
+
+	// Requests may be answered later.
+	var buf bytes.Buffer
+	s := xmpptest.NewClientSession(0, &buf)
+	err := requests[0].Approve(context.Background(), s)
+	if err != nil {
+		t.Fatalf("error approving request: %v", err)
+	}
+	err = requests[1].Deny(context.Background(), s)
+	if err != nil {
+		t.Fatalf("error denying request: %v", err)
+	}
+	const out = `<presence xmlns="jabber:client" type="subscribed" to="romeo@example.net"></presence><presence xmlns="jabber:client" type="unsubscribed" to="nurse@example.com"></presence>`
+	if s := xmpptest.StripIDs(buf.String()); s != out {
+		t.Errorf("wrong output:\nwant=%s,\n got=%s", out, s)
+	}
+}
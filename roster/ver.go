@@ -19,8 +19,21 @@ import (
 // Actually attempting to negotiate the feature does nothing as it is meant to
 // be informational only.
 func Versioning() xmpp.StreamFeature {
+	return informational(xml.Name{Space: NSFeatures, Local: "ver"})
+}
+
+// PreApproval returns a stream feature that advertises support for
+// subscription pre-approvals.
+//
+// Actually attempting to negotiate the feature does nothing as it is meant to
+// be informational only.
+func PreApproval() xmpp.StreamFeature {
+	return informational(xml.Name{Space: NSPreApproval, Local: "sub"})
+}
+
+func informational(name xml.Name) xmpp.StreamFeature {
 	return xmpp.StreamFeature{
-		Name:      xml.Name{Space: NSFeatures, Local: "ver"},
+		Name:      name,
 		Necessary: xmpp.Secure,
 		List: func(_ context.Context, e xmlstream.TokenWriter, start xml.StartElement) (bool, error) {
 			err := e.EncodeToken(start)
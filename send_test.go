@@ -141,6 +141,70 @@ func TestSendIQ(t *testing.T) {
 	}
 }
 
+func TestSendIQCanceled(t *testing.T) {
+	// The server cancels the context of each request just before it responds so
+	// that the context is often canceled while the response is being received.
+	// After each response the server sends a message and the client waits for it
+	// before sending the next request, because late responses to canceled
+	// requests are passed to the client's handler which can't run while the next
+	// request is being written to the unbuffered pipe.
+	cancels := make(chan context.CancelFunc, 1)
+	received := make(chan struct{}, 1)
+	s := xmpptest.NewClientServer(
+		xmpptest.ServerHandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			iq, err := stanza.NewIQ(*start)
+			if err != nil {
+				return err
+			}
+			if cancel := <-cancels; cancel != nil {
+				cancel()
+			}
+			_, err = xmlstream.Copy(t, iq.Result(nil))
+			if err != nil {
+				return err
+			}
+			_, err = xmlstream.Copy(t, stanza.Message{Type: stanza.NormalMessage}.Wrap(nil))
+			return err
+		}),
+		xmpptest.ClientHandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
+			if start.Name.Local == "message" {
+				received <- struct{}{}
+			}
+			return nil
+		}),
+	)
+
+	for i := 0; i < 200; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancels <- cancel
+		resp, err := s.Client.SendIQ(ctx, stanza.IQ{Type: stanza.GetIQ}.Wrap(nil))
+		switch {
+		case err == nil:
+			err = resp.Close()
+			if err != nil {
+				t.Fatalf("error closing response: %v", err)
+			}
+		case !errors.Is(err, context.Canceled):
+			t.Fatalf("unexpected error: %v", err)
+		}
+		cancel()
+		<-received
+	}
+
+	// The session must still work after the canceled requests.
+	cancels <- nil
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := s.Client.SendIQ(ctx, stanza.IQ{Type: stanza.GetIQ}.Wrap(nil))
+	if err != nil {
+		t.Fatalf("error sending IQ after canceled requests: %v", err)
+	}
+	err = resp.Close()
+	if err != nil {
+		t.Fatalf("error closing response: %v", err)
+	}
+}
+
 func TestEncodeIQ(t *testing.T) {
 	t.Run("EncodeIQElement", func(t *testing.T) {
 		s := xmpptest.NewClientServer(xmpptest.ServerHandlerFunc(func(t xmlstream.TokenReadEncoder, start *xml.StartElement) error {
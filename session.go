@@ -533,8 +533,11 @@ func handleInputStream(s *Session, handler Handler) (err error) {
 	_, _, id, typ := getIDTyp(start.Attr)
 
 	if typ == string(stanza.ResultIQ) || typ == "error" {
+		// Remove the response channel so that SendIQ knows a response is being
+		// delivered if its context is canceled.
 		s.sentIQMutex.Lock()
 		c := s.sentIQs[id]
+		delete(s.sentIQs, id)
 		s.sentIQMutex.Unlock()
 		if c != nil {
 			inner := xmlstream.Inner(r)
@@ -955,7 +958,17 @@ func (s *Session) sendResp(ctx context.Context, id string, payload xml.TokenRead
 	case rr := <-c:
 		return rr, nil
 	case <-ctx.Done():
-		close(c)
+		s.sentIQMutex.Lock()
+		_, waiting := s.sentIQs[id]
+		delete(s.sentIQs, id)
+		s.sentIQMutex.Unlock()
+		if !waiting {
+			// The response is already being delivered, so receive and discard it to
+			// unblock the input stream.
+			rr := <-c
+			/* #nosec */
+			rr.Close()
+		}
 		return nil, ctx.Err()
 	}
 }